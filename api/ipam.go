@@ -36,8 +36,16 @@ func (client *Client) AllocateIP(ID string, checkAlive bool) (*net.IPNet, error)
 	return client.ipamOp(ID, "POST", ipamValues(checkAlive))
 }
 
+// IPv6 addresses are managed by a separate allocator, under /ip6
+func ipPath(ip net.IP) string {
+	if ip.To4() == nil {
+		return "/ip6"
+	}
+	return "/ip"
+}
+
 func (client *Client) AllocateIPInSubnet(ID string, subnet *net.IPNet, checkAlive bool) (*net.IPNet, error) {
-	ip, err := client.httpVerb("POST", fmt.Sprintf("/ip/%s/%s", ID, subnet), ipamValues(checkAlive))
+	ip, err := client.httpVerb("POST", fmt.Sprintf("%s/%s/%s", ipPath(subnet.IP), ID, subnet), ipamValues(checkAlive))
 	if err != nil {
 		return nil, err
 	}
@@ -52,7 +60,7 @@ func (client *Client) LookupIP(ID string) (*net.IPNet, error) {
 
 // Claim a specific IP on behalf of the ID
 func (client *Client) ClaimIP(ID string, cidr *net.IPNet, checkAlive bool) error {
-	_, err := client.httpVerb("PUT", fmt.Sprintf("/ip/%s/%s", ID, cidr), ipamValues(checkAlive))
+	_, err := client.httpVerb("PUT", fmt.Sprintf("%s/%s/%s", ipPath(cidr.IP), ID, cidr), ipamValues(checkAlive))
 	return err
 }
 
@@ -62,6 +70,38 @@ func (client *Client) ReleaseIPsFor(ID string) error {
 	return err
 }
 
+// returns an IPv6 address for the ID given, allocating a fresh one if
+// necessary, or nil if IPv6 allocation is not enabled
+func (client *Client) AllocateIP6(ID string, checkAlive bool) (*net.IPNet, error) {
+	ip, err := client.httpVerb("POST", fmt.Sprintf("/ip6/%s", ID), ipamValues(checkAlive))
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseIP(ip)
+}
+
+// returns an IPv6 address for the ID given, or nil if one has not
+// been allocated or IPv6 allocation is not enabled
+func (client *Client) LookupIP6(ID string) (*net.IPNet, error) {
+	ip, err := client.httpVerb("GET", fmt.Sprintf("/ip6/%s", ID), nil)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseIP(ip)
+}
+
+// release all IPv6 addresses owned by an ID
+func (client *Client) ReleaseIP6sFor(ID string) error {
+	_, err := client.httpVerb("DELETE", fmt.Sprintf("/ip6/%s", ID), nil)
+	return err
+}
+
 // release all IP space owned by a peer
 func (client *Client) RmPeer(peerName string) (string, error) {
 	result, err := client.httpVerb("DELETE", fmt.Sprintf("/peer/%s", peerName), nil)
@@ -77,6 +117,19 @@ func (client *Client) DefaultSubnet() (*net.IPNet, error) {
 	return ipnet, err
 }
 
+// The default IPv6 subnet, or nil if IPv6 allocation is not enabled
+func (client *Client) DefaultSubnet6() (*net.IPNet, error) {
+	cidr, err := client.httpVerb("GET", "/ipinfo/defaultsubnet6", nil)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	return ipnet, err
+}
+
 func parseIP(body string) (*net.IPNet, error) {
 	ip, ipnet, err := net.ParseCIDR(string(body))
 	if err != nil {
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"strconv"
+	"strings"
 )
 
 // Expose calls the router to assign the given IP addr to the weave bridge.
@@ -17,3 +19,19 @@ func (client *Client) ReplacePeers(peers []string) error {
 	_, err := client.httpVerb("POST", "/connect", url.Values{"replace": {"true"}, "peer": peers})
 	return err
 }
+
+// Segment asks the router which segment to attach a container with
+// the given addresses in.  It is 0, the default segment, unless
+// segments are enabled.
+func (client *Client) Segment(ips []net.IP) (uint16, error) {
+	values := url.Values{}
+	for _, ip := range ips {
+		values.Add("ip", ip.String())
+	}
+	result, err := client.httpVerb("GET", "/segment?"+values.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	segment, err := strconv.ParseUint(strings.TrimSpace(result), 10, 16)
+	return uint16(segment), err
+}
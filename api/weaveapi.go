@@ -1,7 +1,6 @@
 package api
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -47,7 +46,22 @@ func (client *Client) httpVerb(verb string, url string, values url.Values) (stri
 	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNoContent {
 		return string(rbody), nil
 	}
-	return "", errors.New(resp.Status + ": " + string(rbody))
+	return "", &statusError{resp.StatusCode, resp.Status + ": " + string(rbody)}
+}
+
+// An error status returned by the router
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (err *statusError) Error() string {
+	return err.msg
+}
+
+func isNotFound(err error) bool {
+	serr, ok := err.(*statusError)
+	return ok && serr.code == http.StatusNotFound
 }
 
 func NewClient(addr string, log Logger) *Client {
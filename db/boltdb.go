@@ -113,3 +113,22 @@ func (d *BoltDB) Save(ident string, data interface{}) error {
 func (d *BoltDB) Close() error {
 	return d.db.Close()
 }
+
+// PrefixedDB stores its data under idents carrying a fixed prefix, so
+// that more than one user of the same idents can share a DB.
+type PrefixedDB struct {
+	db     DB
+	prefix string
+}
+
+func NewPrefixedDB(db DB, prefix string) *PrefixedDB {
+	return &PrefixedDB{db: db, prefix: prefix}
+}
+
+func (d *PrefixedDB) Load(ident string, data interface{}) (bool, error) {
+	return d.db.Load(d.prefix+ident, data)
+}
+
+func (d *PrefixedDB) Save(ident string, data interface{}) error {
+	return d.db.Save(d.prefix+ident, data)
+}
@@ -63,3 +63,10 @@ require (
 	k8s.io/apimachinery v0.18.6
 	k8s.io/client-go v0.18.6
 )
+
+// Carries the secondary password and peer certificate changes to the
+// mesh handshake; see third_party/mesh/README.weave.md
+replace github.com/weaveworks/mesh => ./third_party/mesh
+
+// Carries ethertype flow keys; see third_party/go-odp/README.weave.md
+replace github.com/weaveworks/go-odp => ./third_party/go-odp
@@ -35,7 +35,7 @@ func (g *allocate) Try(alloc *Allocator) bool {
 	}
 
 	if !alloc.universe.Range().Overlaps(g.r.Range()) {
-		g.resultChan <- allocateResult{err: fmt.Errorf("range %s out of bounds: %s", g.r, alloc.universe)}
+		g.resultChan <- allocateResult{err: fmt.Errorf("range %s out of bounds: %s", alloc.formatCIDR(g.r), alloc.formatCIDR(alloc.universe))}
 		return true
 	}
 
@@ -45,7 +45,7 @@ func (g *allocate) Try(alloc *Allocator) bool {
 		// If caller hasn't supplied a unique ID, file it under the IP address
 		// which lets the caller then release the address using DELETE /ip/address
 		if g.ident == api.NoContainerID {
-			g.ident = addr.String()
+			g.ident = alloc.formatAddress(addr)
 		}
 		alloc.debugln("Allocated", addr, "for", g.ident, "in", g.r)
 		alloc.addOwned(g.ident, address.MakeCIDR(g.r, addr), g.isContainer)
@@ -5,6 +5,7 @@ import (
 	"encoding/gob"
 	"fmt"
 	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/weaveworks/mesh"
@@ -57,7 +58,9 @@ type Allocator struct {
 	ourName           mesh.PeerName
 	seed              []mesh.PeerName          // optional user supplied ring seed
 	universe          address.CIDR             // superset of all ranges
+	prefix6           *address.Prefix6         // fixed upper part of addresses, if allocating IPv6
 	ring              *ring.Ring               // information on ranges owned by all peers
+	owners            atomic.Value             // *ring.Owners copied from ring, for Owner to read without the actor
 	space             space.Space              // more detail on ranges owned by us
 	owned             map[string]ownedData     // who owns what addresses, indexed by container-ID
 	nicknames         map[mesh.PeerName]string // so we can map nicknames for rmpeer
@@ -90,6 +93,7 @@ type Config struct {
 	OurNickname string
 	Seed        []mesh.PeerName
 	Universe    address.CIDR
+	Prefix6     *address.Prefix6 // if set, Universe is the low 32 bits of an IPv6 range
 	IsObserver  bool
 	PreClaims   []PreClaim
 	Quorum      func() uint
@@ -122,6 +126,7 @@ func NewAllocator(config Config) *Allocator {
 		ourName:     config.OurName,
 		seed:        config.Seed,
 		universe:    config.Universe,
+		prefix6:     config.Prefix6,
 		ring:        ring.New(config.Universe.Range().Start, config.Universe.Range().End, config.OurName, onUpdate),
 		owned:       make(map[string]ownedData),
 		db:          config.Db,
@@ -134,6 +139,8 @@ func NewAllocator(config Config) *Allocator {
 		tracker:     config.Tracker,
 	}
 
+	alloc.publishOwners()
+
 	alloc.pendingClaims = make([]operation, len(config.PreClaims))
 	for i, c := range config.PreClaims {
 		alloc.pendingClaims[i] = &claim{ident: c.Ident, cidr: c.Cidr}
@@ -147,6 +154,22 @@ func ParseCIDRSubnet(cidrStr string) (cidr address.CIDR, err error) {
 	if err != nil {
 		return
 	}
+	err = checkSubnet(cidr, cidrStr)
+	return
+}
+
+// ParseCIDRSubnet6 is like ParseCIDRSubnet, for IPv6 subnets.  Of a
+// subnet shorter than /97 only the first /97 is allocated from.
+func ParseCIDRSubnet6(cidrStr string) (prefix address.Prefix6, cidr address.CIDR, err error) {
+	prefix, cidr, err = address.ParseCIDR6(cidrStr)
+	if err != nil {
+		return
+	}
+	err = checkSubnet(cidr, cidrStr)
+	return
+}
+
+func checkSubnet(cidr address.CIDR, cidrStr string) (err error) {
 	if !cidr.IsSubnet() {
 		err = fmt.Errorf("invalid subnet - bits after network prefix are not all zero: %s", cidrStr)
 	}
@@ -175,6 +198,7 @@ func (alloc *Allocator) Start() {
 	if loadedPersistedData { // do any pre-claims right away
 		alloc.tryOps(&alloc.pendingClaims)
 	}
+	alloc.publishOwners()
 	actionChan := make(chan func(), mesh.ChannelSize)
 	stopChan := make(chan struct{})
 	alloc.actionChan = actionChan
@@ -312,6 +336,15 @@ func (alloc *Allocator) Lookup(ident string, r address.Range) ([]address.CIDR, e
 	return <-resultChan, nil
 }
 
+// Owner - the peer which owns the range containing addr, as of the
+// last time the ring changed.  This does not wait for the actor, so
+// it is safe to call from the packet capture path.  If the address is
+// outside the ring, or the ring is empty, the owner is unknown.
+func (alloc *Allocator) Owner(addr address.Address) (mesh.PeerName, bool) {
+	owner := alloc.owners.Load().(*ring.Owners).Owner(addr)
+	return owner, owner != mesh.UnknownPeerName
+}
+
 // Claim an address that we think we should own (Sync)
 func (alloc *Allocator) Claim(ident string, cidr address.CIDR, isContainer, noErrorOnUnknown bool, hasBeenCancelled func() bool) error {
 	resultChan := make(chan error)
@@ -410,7 +443,7 @@ func (alloc *Allocator) Free(ident string, addrToFree address.Address) error {
 			return
 		}
 
-		errChan <- fmt.Errorf("Free: address %s not found for %s", addrToFree, ident)
+		errChan <- fmt.Errorf("Free: address %s not found for %s", alloc.formatAddress(addrToFree), ident)
 	}
 	return <-errChan
 }
@@ -699,6 +732,15 @@ func (alloc *Allocator) actorLoop(actionChan <-chan func(), stopChan <-chan stru
 
 		alloc.assertInvariants()
 		alloc.reportFreeSpace()
+		alloc.publishOwners()
+	}
+}
+
+// Copy who owns what from the ring, if it has changed, for Owner
+func (alloc *Allocator) publishOwners() {
+	prev, _ := alloc.owners.Load().(*ring.Owners)
+	if owners := alloc.ring.Owners(prev); owners != prev {
+		alloc.owners.Store(owners)
 	}
 }
 
@@ -1107,7 +1149,7 @@ func (alloc *Allocator) warnf(fmt string, args ...interface{}) {
 	alloc.logf(common.Log.Warnf, fmt, args...)
 }
 func (alloc *Allocator) errorf(fmt string, args ...interface{}) {
-	common.Log.Errorf("[allocator %s] "+fmt, append([]interface{}{alloc.ourName}, args...)...)
+	alloc.logf(common.Log.Errorf, fmt, args...)
 }
 func (alloc *Allocator) infof(fmt string, args ...interface{}) {
 	alloc.logf(common.Log.Infof, fmt, args...)
@@ -1116,8 +1158,42 @@ func (alloc *Allocator) debugf(fmt string, args ...interface{}) {
 	alloc.logf(common.Log.Debugf, fmt, args...)
 }
 func (alloc *Allocator) logf(f func(string, ...interface{}), fmt string, args ...interface{}) {
-	f("[allocator %s] "+fmt, append([]interface{}{alloc.ourName}, args...)...)
+	f("[%s %s] "+fmt, append([]interface{}{alloc.logName(), alloc.ourName}, args...)...)
 }
 func (alloc *Allocator) debugln(args ...interface{}) {
-	common.Log.Debugln(append([]interface{}{fmt.Sprintf("[allocator %s]:", alloc.ourName)}, args...)...)
+	common.Log.Debugln(append([]interface{}{fmt.Sprintf("[%s %s]:", alloc.logName(), alloc.ourName)}, args...)...)
+}
+func (alloc *Allocator) logName() string {
+	if alloc.prefix6 != nil {
+		return "allocator6"
+	}
+	return "allocator"
+}
+
+// Address formatting and parsing, which for an IPv6 allocator adds
+// and removes the fixed prefix.
+
+func (alloc *Allocator) formatAddress(addr address.Address) string {
+	if alloc.prefix6 != nil {
+		return alloc.prefix6.FormatAddress(addr)
+	}
+	return addr.String()
+}
+func (alloc *Allocator) formatCIDR(cidr address.CIDR) string {
+	if alloc.prefix6 != nil {
+		return alloc.prefix6.FormatCIDR(cidr)
+	}
+	return cidr.String()
+}
+func (alloc *Allocator) parseIP(s string) (address.Address, error) {
+	if alloc.prefix6 != nil {
+		return alloc.prefix6.ParseIP(s)
+	}
+	return address.ParseIP(s)
+}
+func (alloc *Allocator) parseCIDR(s string) (address.CIDR, error) {
+	if alloc.prefix6 != nil {
+		return alloc.prefix6.ParseCIDR(s)
+	}
+	return address.ParseCIDR(s)
 }
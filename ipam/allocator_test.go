@@ -98,6 +98,37 @@ func TestAllocFree(t *testing.T) {
 	require.Equal(t, address.Count(spaceSize+1), alloc.NumFreeAddresses(subnet.Range()))
 }
 
+func TestOwner(t *testing.T) {
+	const (
+		ourName  = "01:00:00:01:00:00"
+		universe = "10.0.3.0/26"
+	)
+
+	alloc, _ := makeAllocatorWithMockGossip(t, ourName, universe, 1)
+	defer alloc.Stop()
+	addr, _ := address.ParseIP("10.0.3.5")
+	outside, _ := address.ParseIP("10.0.4.5")
+
+	_, found := alloc.Owner(addr)
+	require.False(t, found, "owner before the ring is established")
+
+	alloc.claimRingForTesting()
+	owner, found := alloc.Owner(addr)
+	require.True(t, found)
+	require.Equal(t, ourName, owner.String())
+
+	_, found = alloc.Owner(outside)
+	require.False(t, found, "owner of address outside the ring")
+
+	// Owner answers while the actor is busy
+	busy := make(chan struct{})
+	alloc.actionChan <- func() { <-busy }
+	owner, found = alloc.Owner(addr)
+	close(busy)
+	require.True(t, found)
+	require.Equal(t, ourName, owner.String())
+}
+
 func TestBootstrap(t *testing.T) {
 	const (
 		donateSize     = 5
@@ -47,14 +47,14 @@ func (c *claim) Try(alloc *Allocator) bool {
 
 	addOwned := func() {
 		if c.ident == api.NoContainerID {
-			alloc.addOwned(c.cidr.Addr.String(), c.cidr, c.isContainer)
+			alloc.addOwned(alloc.formatAddress(c.cidr.Addr), c.cidr, c.isContainer)
 		} else {
 			alloc.addOwned(c.ident, c.cidr, c.isContainer)
 		}
 	}
 
 	if !alloc.ring.Contains(c.cidr.Addr) {
-		alloc.infof("Address %s claimed by %s - not in our range", c.cidr, c.ident)
+		alloc.infof("Address %s claimed by %s - not in our range", alloc.formatCIDR(c.cidr), c.ident)
 		previousOwner := alloc.findOwner(c.cidr.Addr)
 		switch {
 		case previousOwner == "":
@@ -66,7 +66,7 @@ func (c *claim) Try(alloc *Allocator) bool {
 			alloc.removeOwned(previousOwner, c.cidr.Addr)
 			addOwned()
 		default:
-			c.sendResult(fmt.Errorf("address %s already in use by %s", c.cidr, previousOwner))
+			c.sendResult(fmt.Errorf("address %s already in use by %s", alloc.formatCIDR(c.cidr), previousOwner))
 		}
 		c.sendResult(nil)
 		return true
@@ -83,17 +83,17 @@ func (c *claim) Try(alloc *Allocator) bool {
 	case mesh.UnknownPeerName:
 		// If our ring doesn't know, it must be empty.
 		alloc.infof("Claim %s for %s: is in the range %s, but the allocator is not initialized yet; will try later.",
-			c.cidr, c.ident, alloc.universe)
+			alloc.formatCIDR(c.cidr), c.ident, alloc.formatCIDR(alloc.universe))
 		if c.noErrorOnUnknown {
 			c.sendResult(nil)
 		}
 		return false
 	default:
-		alloc.debugf("requesting address %s from other peer %s", c.cidr, owner)
+		alloc.debugf("requesting address %s from other peer %s", alloc.formatCIDR(c.cidr), owner)
 		err := alloc.sendSpaceRequest(owner, address.NewRange(c.cidr.Addr, 1))
 		if err != nil { // can't speak to owner right now
 			if c.noErrorOnUnknown {
-				alloc.infof("Claim %s for %s: %s; will try later.", c.cidr, c.ident, err)
+				alloc.infof("Claim %s for %s: %s; will try later.", alloc.formatCIDR(c.cidr), c.ident, err)
 				c.sendResult(nil)
 			} else if c.tryCount > maxTryCount {
 				// give up, tell the user they can't do this
@@ -116,13 +116,13 @@ func (c *claim) Try(alloc *Allocator) bool {
 		} else {
 			c.sendResult(err)
 		}
-	case (existingIdent == c.ident) || (c.ident == api.NoContainerID && existingIdent == c.cidr.Addr.String()):
+	case (existingIdent == c.ident) || (c.ident == api.NoContainerID && existingIdent == alloc.formatAddress(c.cidr.Addr)):
 		// same identifier is claiming same address; that's OK
 		alloc.debugln("Re-Claimed", c.cidr, "for", c.ident)
 		c.sendResult(nil)
-	case existingIdent == c.cidr.Addr.String():
+	case existingIdent == alloc.formatAddress(c.cidr.Addr):
 		// Address already allocated via api.NoContainerID name and current ID is a real container ID:
-		c.sendResult(fmt.Errorf("address %s already in use", c.cidr))
+		c.sendResult(fmt.Errorf("address %s already in use", alloc.formatCIDR(c.cidr)))
 	case c.ident == api.NoContainerID:
 		// We do not know whether this is the same container or another one,
 		// but we also cannot prove otherwise, so we let it reclaim the address:
@@ -130,7 +130,7 @@ func (c *claim) Try(alloc *Allocator) bool {
 		c.sendResult(nil)
 	default:
 		// Addr already owned by container on this machine
-		c.sendResult(fmt.Errorf("address %s is already owned by %s", c.cidr.String(), existingIdent))
+		c.sendResult(fmt.Errorf("address %s is already owned by %s", alloc.formatCIDR(c.cidr), existingIdent))
 	}
 	return true
 }
@@ -144,7 +144,7 @@ func (c *claim) deniedBy(alloc *Allocator, owner mesh.PeerName, err error) {
 	if err != nil {
 		reason = fmt.Sprintf(" - %s", err)
 	}
-	c.sendResult(fmt.Errorf("address %s is owned by other peer %s%s%s", c.cidr.String(), owner, name, reason))
+	c.sendResult(fmt.Errorf("address %s is owned by other peer %s%s%s", alloc.formatCIDR(c.cidr), owner, name, reason))
 }
 
 func (c *claim) Cancel() {
@@ -18,13 +18,10 @@ func badRequest(w http.ResponseWriter, err error) {
 	common.Log.Warningln("[allocator]:", err.Error())
 }
 
-func parseCIDR(w http.ResponseWriter, cidrStr string, net bool) (address.CIDR, bool) {
-	var cidr address.CIDR
-	var err error
-	if net {
-		cidr, err = ParseCIDRSubnet(cidrStr)
-	} else {
-		cidr, err = address.ParseCIDR(cidrStr)
+func (alloc *Allocator) parseCIDRHTTP(w http.ResponseWriter, cidrStr string, net bool) (address.CIDR, bool) {
+	cidr, err := alloc.parseCIDR(cidrStr)
+	if err == nil && net {
+		err = checkSubnet(cidr, cidrStr)
 	}
 	if err != nil {
 		badRequest(w, err)
@@ -33,9 +30,9 @@ func parseCIDR(w http.ResponseWriter, cidrStr string, net bool) (address.CIDR, b
 	return cidr, true
 }
 
-func writeAddresses(w http.ResponseWriter, cidrs []address.CIDR) {
+func (alloc *Allocator) writeAddresses(w http.ResponseWriter, cidrs []address.CIDR) {
 	for i, cidr := range cidrs {
-		fmt.Fprint(w, cidr)
+		fmt.Fprint(w, alloc.formatCIDR(cidr))
 		if i < len(cidrs)-1 {
 			w.Write([]byte{' '})
 		}
@@ -73,7 +70,7 @@ func (alloc *Allocator) handleHTTPAllocate(ctx context.Context, dockerCli *docke
 		}
 		return
 	}
-	fmt.Fprintf(w, "%s/%d", addr, subnet.PrefixLen)
+	fmt.Fprint(w, alloc.formatCIDR(address.CIDR{Addr: addr, PrefixLen: subnet.PrefixLen}))
 }
 
 func (alloc *Allocator) handleHTTPClaim(ctx context.Context, dockerCli *docker.Client, w http.ResponseWriter, ident string, cidr address.CIDR, checkAlive, noErrorOnUnknown bool) {
@@ -88,15 +85,22 @@ func (alloc *Allocator) handleHTTPClaim(ctx context.Context, dockerCli *docker.C
 	w.WriteHeader(204)
 }
 
-// HandleHTTP wires up ipams HTTP endpoints to the provided mux.
+// HandleHTTP wires up ipams HTTP endpoints to the provided mux.  The
+// endpoints of an IPv6 allocator are suffixed with "6", e.g. /ip6/{id}
 func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CIDR, dockerCli *docker.Client) {
-	router.Methods("GET").Path("/ipinfo/defaultsubnet").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "%s", defaultSubnet)
+	suffix := ""
+	if alloc.prefix6 != nil {
+		suffix = "6"
+	}
+	ipPath := "/ip" + suffix
+
+	router.Methods("GET").Path("/ipinfo/defaultsubnet" + suffix).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, alloc.formatCIDR(defaultSubnet))
 	})
 
-	router.Methods("PUT").Path("/ip/{id}/{ip}/{prefixlen}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	router.Methods("PUT").Path(ipPath + "/{id}/{ip}/{prefixlen}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		if cidr, ok := parseCIDR(w, vars["ip"]+"/"+vars["prefixlen"], false); ok {
+		if cidr, ok := alloc.parseCIDRHTTP(w, vars["ip"]+"/"+vars["prefixlen"], false); ok {
 			ident := vars["id"]
 			checkAlive := r.FormValue("check-alive") == "true"
 			noErrorOnUnknown := r.FormValue("noErrorOnUnknown") == "true"
@@ -104,32 +108,32 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 		}
 	})
 
-	router.Methods("GET").Path("/ring").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	router.Methods("GET").Path("/ring" + suffix).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		alloc.Prime()
 	})
 
-	router.Methods("GET").Path("/ip/{id}/{ip}/{prefixlen}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	router.Methods("GET").Path(ipPath + "/{id}/{ip}/{prefixlen}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		if subnet, ok := parseCIDR(w, vars["ip"]+"/"+vars["prefixlen"], true); ok {
+		if subnet, ok := alloc.parseCIDRHTTP(w, vars["ip"]+"/"+vars["prefixlen"], true); ok {
 			cidrs, err := alloc.Lookup(vars["id"], subnet.HostRange())
 			if err != nil {
 				http.NotFound(w, r)
 				return
 			}
-			writeAddresses(w, cidrs)
+			alloc.writeAddresses(w, cidrs)
 		}
 	})
 
-	router.Methods("GET").Path("/ip/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	router.Methods("GET").Path(ipPath + "/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		addrs, err := alloc.Lookup(mux.Vars(r)["id"], defaultSubnet.HostRange())
 		if err != nil {
 			http.NotFound(w, r)
 			return
 		}
-		writeAddresses(w, addrs)
+		alloc.writeAddresses(w, addrs)
 	})
 
-	router.Methods("GET").Path("/ip").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	router.Methods("GET").Path(ipPath).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		type mapping struct {
 			ContainerID string   `json:"containerid"`
 			Addrs       []string `json:"addrs"`
@@ -148,7 +152,7 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 					Addrs:       []string{},
 				}
 				for _, addr := range d.Cidrs {
-					m.Addrs = append(m.Addrs, addr.String())
+					m.Addrs = append(m.Addrs, alloc.formatCIDR(addr))
 				}
 				ms.Owned = append(ms.Owned, m)
 			}
@@ -162,23 +166,23 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 		}
 	})
 
-	router.Methods("POST").Path("/ip/{id}/{ip}/{prefixlen}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	router.Methods("POST").Path(ipPath + "/{id}/{ip}/{prefixlen}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		if subnet, ok := parseCIDR(w, vars["ip"]+"/"+vars["prefixlen"], true); ok {
+		if subnet, ok := alloc.parseCIDRHTTP(w, vars["ip"]+"/"+vars["prefixlen"], true); ok {
 			alloc.handleHTTPAllocate(r.Context(), dockerCli, w, vars["id"], r.FormValue("check-alive") == "true", subnet)
 		}
 	})
 
-	router.Methods("POST").Path("/ip/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	router.Methods("POST").Path(ipPath + "/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		alloc.handleHTTPAllocate(r.Context(), dockerCli, w, vars["id"], r.FormValue("check-alive") == "true", defaultSubnet)
 	})
 
-	router.Methods("DELETE").Path("/ip/{id}/{ip}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	router.Methods("DELETE").Path(ipPath + "/{id}/{ip}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		ident := vars["id"]
 		ipStr := vars["ip"]
-		if ip, err := address.ParseIP(ipStr); err != nil {
+		if ip, err := alloc.parseIP(ipStr); err != nil {
 			badRequest(w, err)
 			return
 		} else if err := alloc.Free(ident, ip); err != nil {
@@ -189,7 +193,7 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 		w.WriteHeader(204)
 	})
 
-	router.Methods("DELETE").Path("/ip/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	router.Methods("DELETE").Path(ipPath + "/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ident := mux.Vars(r)["id"]
 		if err := alloc.Delete(ident); err != nil {
 			badRequest(w, err)
@@ -199,7 +203,7 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 		w.WriteHeader(204)
 	})
 
-	router.Methods("GET").Path("/ipinfo/tracker").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	router.Methods("GET").Path("/ipinfo/tracker" + suffix).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		tracker := ""
 		if alloc.tracker != nil {
 			tracker = alloc.tracker.String()
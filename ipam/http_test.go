@@ -13,6 +13,8 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+	"github.com/weaveworks/weave/api"
 	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/net/address"
 )
@@ -115,6 +117,92 @@ func TestHttp(t *testing.T) {
 	// See https://groups.google.com/forum/#!topic/golang-nuts/vLHWa5sHnCE
 }
 
+func TestHttp6(t *testing.T) {
+	var (
+		containerID = "deadbeef"
+		container2  = "baddf00d"
+		universe    = "fd00:1::/104"
+		testCIDR1   = "fd00:1::3:8/125"
+		testAddr1   = "fd00:1::3:9/125"
+		testAddr2   = "fd00:1::1/104"
+	)
+
+	prefix, cidr, err := ParseCIDRSubnet6(universe)
+	require.NoError(t, err)
+	peername, _ := mesh.PeerNameFromString("08:00:27:01:c3:9a")
+	alloc := NewAllocator(Config{
+		OurName:     peername,
+		Universe:    cidr,
+		Prefix6:     &prefix,
+		Quorum:      func() uint { return 1 },
+		Db:          new(mockDB),
+		IsKnownPeer: func(mesh.PeerName) bool { return true },
+	})
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "08:00:27:01:c3:9a"})
+	alloc.Start()
+	port := listenHTTP(alloc, cidr)
+	alloc.claimRingForTesting()
+
+	require.Equal(t, universe, HTTPGet(t, fmt.Sprintf("http://localhost:%d/ipinfo/defaultsubnet6", port)))
+	require.Equal(t, testAddr1, HTTPPost(t, fmt.Sprintf("http://localhost:%d/ip6/%s/%s", port, containerID, testCIDR1)))
+	require.Equal(t, testAddr2, HTTPPost(t, fmt.Sprintf("http://localhost:%d/ip6/%s", port, container2)))
+	require.Equal(t, testAddr2, HTTPGet(t, fmt.Sprintf("http://localhost:%d/ip6/%s", port, container2)))
+
+	// IPv4 addresses are not accepted by an IPv6 allocator
+	resp, err := doHTTP("POST", fmt.Sprintf("http://localhost:%d/ip6/%s/10.0.3.8/29", port, containerID))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "http response")
+
+	resp, err = doHTTP("DELETE", fmt.Sprintf("http://localhost:%d/ip6/%s/fd00:1::3:9", port, containerID))
+	require.NoError(t, err)
+	require.Equal(t, 204, resp.StatusCode, "http response")
+}
+
+// A /64 range is allocated from its first /97, and containers are
+// given the /64
+func TestHttp6Range64(t *testing.T) {
+	var (
+		containerID = "deadbeef"
+		universe    = "fd00:1:2:3::/64"
+	)
+
+	prefix, cidr, err := ParseCIDRSubnet6(universe)
+	require.NoError(t, err)
+	peername, _ := mesh.PeerNameFromString("08:00:27:01:c3:9a")
+	alloc := NewAllocator(Config{
+		OurName:     peername,
+		Universe:    cidr,
+		Prefix6:     &prefix,
+		Quorum:      func() uint { return 1 },
+		Db:          new(mockDB),
+		IsKnownPeer: func(mesh.PeerName) bool { return true },
+	})
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "08:00:27:01:c3:9a"})
+	alloc.Start()
+	port := listenHTTP(alloc, cidr)
+	alloc.claimRingForTesting()
+
+	require.Equal(t, universe, HTTPGet(t, fmt.Sprintf("http://localhost:%d/ipinfo/defaultsubnet6", port)))
+	require.Equal(t, "fd00:1:2:3::1/64", HTTPPost(t, fmt.Sprintf("http://localhost:%d/ip6/%s", port, containerID)))
+
+	// Addresses without a container are filed under the IPv6
+	// address, whether allocated or claimed
+	require.Equal(t, "fd00:1:2:3::2/64", HTTPPost(t, fmt.Sprintf("http://localhost:%d/ip6/%s", port, api.NoContainerID)))
+	resp, err := doHTTP("PUT", fmt.Sprintf("http://localhost:%d/ip6/%s/fd00:1:2:3::a00:5/64", port, api.NoContainerID))
+	require.NoError(t, err)
+	require.Equal(t, 204, resp.StatusCode, "http response")
+	for _, addr := range []string{"fd00:1:2:3::2", "fd00:1:2:3::a00:5"} {
+		resp, err = doHTTP("DELETE", fmt.Sprintf("http://localhost:%d/ip6/%s", port, addr))
+		require.NoError(t, err)
+		require.Equal(t, 204, resp.StatusCode, addr)
+	}
+
+	// Addresses beyond the first /97 can't be claimed
+	resp, err = doHTTP("PUT", fmt.Sprintf("http://localhost:%d/ip6/%s/fd00:1:2:3:0:1:a00:5/64", port, containerID))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "http response")
+}
+
 func TestBadHttp(t *testing.T) {
 	var (
 		containerID = "deadbeef"
@@ -644,6 +644,60 @@ func (r *Ring) Owner(token address.Address) mesh.PeerName {
 	return entry.Peer
 }
 
+// Owners is a copy of which peer owns each part of a ring, to be
+// read where the ring itself cannot be.
+type Owners struct {
+	start, end address.Address
+	tokens     []address.Address
+	peers      []mesh.PeerName
+}
+
+// Owners returns a copy of which peer owns each part of the ring, or
+// prev if that is still accurate.
+func (r *Ring) Owners(prev *Owners) *Owners {
+	if prev != nil && prev.start == r.Start && prev.end == r.End && len(prev.tokens) == len(r.Entries) {
+		same := true
+		for i, entry := range r.Entries {
+			if prev.tokens[i] != entry.Token || prev.peers[i] != entry.Peer {
+				same = false
+				break
+			}
+		}
+		if same {
+			return prev
+		}
+	}
+	owners := &Owners{
+		start:  r.Start,
+		end:    r.End,
+		tokens: make([]address.Address, len(r.Entries)),
+		peers:  make([]mesh.PeerName, len(r.Entries)),
+	}
+	for i, entry := range r.Entries {
+		owners.tokens[i] = entry.Token
+		owners.peers[i] = entry.Peer
+	}
+	return owners
+}
+
+// Owner returns the peername which owns the range containing addr, or
+// UnknownPeerName if the address is outside the ring or the ring is
+// empty
+func (o *Owners) Owner(addr address.Address) mesh.PeerName {
+	if addr < o.start || addr >= o.end || len(o.tokens) == 0 {
+		return mesh.UnknownPeerName
+	}
+	// The right-most token less than or equal to addr, wrapping round
+	// to the last when addr is below them all
+	i := sort.Search(len(o.tokens), func(j int) bool {
+		return o.tokens[j] > addr
+	})
+	if i == 0 {
+		i = len(o.tokens)
+	}
+	return o.peers[i-1]
+}
+
 // Get the set of PeerNames mentioned in the ring
 func (r *Ring) PeerNames() map[mesh.PeerName]struct{} {
 	res := make(map[mesh.PeerName]struct{})
@@ -591,6 +591,33 @@ func TestOwner(t *testing.T) {
 
 }
 
+func TestOwners(t *testing.T) {
+	ring1 := NewRing(start, end, peer1name)
+	owners := ring1.Owners(nil)
+	require.Equal(t, mesh.UnknownPeerName, owners.Owner(start))
+
+	// Tokens are not at the start, so the lowest addresses wrap round
+	// to the last owner
+	ring1.Entries = []*entry{{Token: dot10, Peer: peer1name}, {Token: dot245, Peer: peer2name}}
+	owners = ring1.Owners(owners)
+	for _, addr := range []address.Address{start, dot10, middle, dot245, end - 1} {
+		require.Equal(t, ring1.Owner(addr), owners.Owner(addr), addr.String())
+	}
+	require.Equal(t, mesh.UnknownPeerName, owners.Owner(end))
+	require.Equal(t, mesh.UnknownPeerName, owners.Owner(start-1))
+
+	// An unchanged ring gives back the same copy; a change gives a new
+	// one, leaving the old as it was
+	require.True(t, owners == ring1.Owners(owners))
+	ring1.Entries[1].Free = 10
+	require.True(t, owners == ring1.Owners(owners))
+	ring1.Entries[1].Peer = peer1name
+	updated := ring1.Owners(owners)
+	require.False(t, owners == updated)
+	require.Equal(t, peer2name, owners.Owner(dot245))
+	require.Equal(t, peer1name, updated.Owner(dot245))
+}
+
 func makePeerName(i int) mesh.PeerName {
 	if i >= 10000 {
 		panic("makePeerName: invalid value")
@@ -51,10 +51,10 @@ func NewStatus(allocator *Allocator, defaultSubnet address.CIDR) *Status {
 	allocator.actionChan <- func() {
 		resultChan <- &Status{
 			paxosStatus,
-			allocator.universe.String(),
+			allocator.formatCIDR(allocator.universe),
 			int(allocator.universe.Size()),
 			int(allocator.space.NumOwnedAddresses()),
-			defaultSubnet.String(),
+			allocator.formatCIDR(defaultSubnet),
 			newEntryStatusSlice(allocator),
 			newClaimStatusSlice(allocator),
 			newAllocateIdentSlice(allocator)}
@@ -72,7 +72,7 @@ func newEntryStatusSlice(allocator *Allocator) []EntryStatus {
 
 	for _, r := range allocator.ring.AllRangeInfo() {
 		slice = append(slice, EntryStatus{
-			Token:       r.Start.String(),
+			Token:       allocator.formatAddress(r.Start),
 			Size:        uint32(r.Size()),
 			Peer:        r.Peer.String(),
 			Nickname:    allocator.nicknames[r.Peer],
@@ -97,7 +97,7 @@ func newAllocateIdentSlice(allocator *Allocator) []string {
 	var slice []string
 	for _, op := range allocator.pendingAllocates {
 		allocate := op.(*allocate)
-		slice = append(slice, fmt.Sprintf("%s %s", allocate.ident, allocate.r.String()))
+		slice = append(slice, fmt.Sprintf("%s %s", allocate.ident, allocator.formatCIDR(allocate.r)))
 	}
 	return slice
 }
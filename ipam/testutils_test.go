@@ -154,6 +154,7 @@ func (alloc *Allocator) claimRingForTesting(allocs ...*Allocator) {
 	}
 	alloc.ring.ClaimForPeers(normalizeConsensus(peers))
 	alloc.space.AddRanges(alloc.ring.OwnedRanges())
+	alloc.publishOwners()
 }
 
 func (alloc *Allocator) NumFreeAddresses(r address.Range) address.Count {
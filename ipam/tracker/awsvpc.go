@@ -17,6 +17,9 @@ package tracker
 // one by the AWS host subnet), therefore it is suggested to avoid
 // an excessive fragmentation within the IPAM ring which might happen due to
 // the claim operations or uneven distribution of containers across the hosts.
+//
+// An IPv6 allocator has a tracker of its own, made with IPv6, which installs
+// IPv6 routes for its ranges.
 
 import (
 	"fmt"
@@ -38,6 +41,7 @@ type AWSVPCTracker struct {
 	instanceID   string // EC2 Instance ID
 	routeTableID string // VPC Route Table ID
 	linkIndex    int    // The weave bridge link index
+	prefix6      *address.Prefix6
 }
 
 // NewAWSVPCTracker creates and initialises AWS VPC based tracker.
@@ -80,6 +84,14 @@ func NewAWSVPCTracker(bridgeName string) (*AWSVPCTracker, error) {
 	return t, nil
 }
 
+// IPv6 returns a tracker for the ranges of an IPv6 allocator, which
+// are the low 32 bits of addresses with the given prefix.
+func (t *AWSVPCTracker) IPv6(prefix address.Prefix6) *AWSVPCTracker {
+	t6 := *t
+	t6.prefix6 = &prefix
+	return &t6
+}
+
 // HandleUpdate method updates the AWS VPC and the host route tables.
 func (t *AWSVPCTracker) HandleUpdate(prevRanges, currRanges []address.Range, local bool) error {
 	t.debugf("replacing %q by %q; local(%t)", prevRanges, currRanges, local)
@@ -92,7 +104,7 @@ func (t *AWSVPCTracker) HandleUpdate(prevRanges, currRanges []address.Range, loc
 
 	// Add new entries
 	for _, cidr := range curr {
-		cidrStr := cidr.String()
+		cidrStr := t.formatCIDR(cidr)
 		t.debugf("adding route %s to %s", cidrStr, t.instanceID)
 		if _, err := t.createVPCRoute(cidrStr); err != nil {
 			return fmt.Errorf("createVPCRoutes failed: %s", err)
@@ -108,7 +120,7 @@ func (t *AWSVPCTracker) HandleUpdate(prevRanges, currRanges []address.Range, loc
 
 	// Remove obsolete entries
 	for _, cidr := range prev {
-		cidrStr := cidr.String()
+		cidrStr := t.formatCIDR(cidr)
 		t.debugf("removing %s route", cidrStr)
 		if _, err := t.deleteVPCRoute(cidrStr); err != nil {
 			return fmt.Errorf("deleteVPCRoute failed: %s", err)
@@ -127,11 +139,22 @@ func (t *AWSVPCTracker) String() string {
 	return "awsvpc"
 }
 
+func (t *AWSVPCTracker) formatCIDR(cidr address.CIDR) string {
+	if t.prefix6 != nil {
+		return t.prefix6.FormatCIDR(cidr)
+	}
+	return cidr.String()
+}
+
 func (t *AWSVPCTracker) createVPCRoute(cidr string) (*ec2.CreateRouteOutput, error) {
 	route := &ec2.CreateRouteInput{
-		RouteTableId:         &t.routeTableID,
-		InstanceId:           &t.instanceID,
-		DestinationCidrBlock: &cidr,
+		RouteTableId: &t.routeTableID,
+		InstanceId:   &t.instanceID,
+	}
+	if t.prefix6 != nil {
+		route.DestinationIpv6CidrBlock = &cidr
+	} else {
+		route.DestinationCidrBlock = &cidr
 	}
 	return t.ec2.CreateRoute(route)
 }
@@ -151,8 +174,12 @@ func (t *AWSVPCTracker) createHostRoute(cidr string) error {
 
 func (t *AWSVPCTracker) deleteVPCRoute(cidr string) (*ec2.DeleteRouteOutput, error) {
 	route := &ec2.DeleteRouteInput{
-		RouteTableId:         &t.routeTableID,
-		DestinationCidrBlock: &cidr,
+		RouteTableId: &t.routeTableID,
+	}
+	if t.prefix6 != nil {
+		route.DestinationIpv6CidrBlock = &cidr
+	} else {
+		route.DestinationCidrBlock = &cidr
 	}
 	return t.ec2.DeleteRoute(route)
 }
@@ -130,6 +130,21 @@ func (n *Nameserver) ReverseLookup(ip address.Address) (string, error) {
 	return match.Hostname, nil
 }
 
+// Origin returns the peer which added an entry for the address, if
+// there is one.
+func (n *Nameserver) Origin(ip address.Address) (mesh.PeerName, bool) {
+	n.RLock()
+	defer n.RUnlock()
+
+	match, err := n.entries.first(func(e *Entry) bool {
+		return e.Tombstone == 0 && e.Addr == ip
+	})
+	if err != nil {
+		return mesh.UnknownPeerName, false
+	}
+	return match.Origin, true
+}
+
 func (n *Nameserver) ContainerStarted(ident string)   {}
 func (n *Nameserver) ContainerDestroyed(ident string) {}
 
@@ -236,6 +236,26 @@ func TestContainerAndPeerDeath(t *testing.T) {
 	require.Equal(t, []address.Address{}, nameserver.Lookup("hostname"))
 }
 
+func TestOrigin(t *testing.T) {
+	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
+	require.Nil(t, err)
+	otherPeername, err := mesh.PeerNameFromString("00:00:00:03:00:00")
+	require.Nil(t, err)
+	nameserver := makeNameserver(peername)
+
+	_, found := nameserver.Origin(address.Address(1))
+	require.False(t, found)
+
+	nameserver.AddEntry("hostname", "containerid", otherPeername, address.Address(1))
+	origin, found := nameserver.Origin(address.Address(1))
+	require.True(t, found)
+	require.Equal(t, otherPeername, origin)
+
+	nameserver.PeerGone(otherPeername)
+	_, found = nameserver.Origin(address.Address(1))
+	require.False(t, found)
+}
+
 func TestTombstoneDeletion(t *testing.T) {
 	oldNow := now
 	defer func() { now = oldNow }()
@@ -0,0 +1,143 @@
+package address
+
+import (
+	"fmt"
+	"net"
+)
+
+// IPv6 address ranges are handled by the same 32-bit machinery as
+// IPv4 ones: addresses are represented by their low 32 bits, and the
+// remaining 96 bits are the Prefix6, which is fixed for a given range.
+//
+// A range of /97 or longer is represented exactly.  A shorter range,
+// such as a /64, is allocated from its first /97, which is as many
+// addresses as the 32-bit machinery can manage; that part stands for
+// the whole range, so that containers are given its prefix length.
+
+const Prefix6Len = 96
+
+// The part of a short range which is allocated from, as a CIDR of
+// the low 32 bits
+var short6Universe = CIDR{Addr: 0, PrefixLen: 1}
+
+type Prefix6 struct {
+	fixed    [12]byte
+	rangeLen int // prefix length of the range
+}
+
+// ParseCIDR6 parses an IPv6 CIDR, returning the fixed part and the
+// CIDR within it.
+func ParseCIDR6(s string) (Prefix6, CIDR, error) {
+	ip, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return Prefix6{}, CIDR{}, err
+	}
+	if ipnet.IP.To4() != nil {
+		return Prefix6{}, CIDR{}, &net.ParseError{Type: "Non-IPv6 address not supported", Text: s}
+	}
+	prefixLen, _ := ipnet.Mask.Size()
+	prefix := Prefix6{rangeLen: prefixLen}
+	if !prefix.short() {
+		copy(prefix.fixed[:], ip.To16())
+		return prefix, CIDR{Addr: fromIP6(ip), PrefixLen: prefixLen - Prefix6Len}, nil
+	}
+	if !ip.Equal(ipnet.IP) {
+		return Prefix6{}, CIDR{}, fmt.Errorf("invalid subnet - bits after network prefix are not all zero: %s", s)
+	}
+	copy(prefix.fixed[:], ipnet.IP)
+	return prefix, short6Universe, nil
+}
+
+// Whether the range is allocated from its first /97 only
+func (prefix Prefix6) short() bool {
+	return prefix.rangeLen <= Prefix6Len
+}
+
+func (prefix Prefix6) contains(ip net.IP) bool {
+	var fixed [12]byte
+	copy(fixed[:], ip.To16())
+	return fixed == prefix.fixed
+}
+
+// ParseCIDR parses an IPv6 CIDR, which must lie within this prefix,
+// or, for a short range, be within the range with its prefix length.
+func (prefix Prefix6) ParseCIDR(s string) (CIDR, error) {
+	ip, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return CIDR{}, err
+	}
+	if ipnet.IP.To4() != nil {
+		return CIDR{}, &net.ParseError{Type: "Non-IPv6 address not supported", Text: s}
+	}
+	if !prefix.contains(ip) {
+		return CIDR{}, fmt.Errorf("%s is not within %s", s, prefix)
+	}
+	prefixLen, _ := ipnet.Mask.Size()
+	switch {
+	case prefixLen > Prefix6Len:
+		return CIDR{Addr: fromIP6(ip), PrefixLen: prefixLen - Prefix6Len}, nil
+	case prefix.short() && prefixLen == prefix.rangeLen:
+		return CIDR{Addr: fromIP6(ip), PrefixLen: short6Universe.PrefixLen}, nil
+	}
+	return CIDR{}, fmt.Errorf("%s must have a prefix length of more than %d", s, Prefix6Len)
+}
+
+// String formats the fixed part of the prefix as a /96
+func (prefix Prefix6) String() string {
+	return fmt.Sprintf("%s/%d", prefix.IP(0), Prefix6Len)
+}
+
+// ParseIP parses an IPv6 address, which must lie within this prefix.
+func (prefix Prefix6) ParseIP(s string) (Address, error) {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() != nil {
+		return 0, &net.ParseError{Type: "IPv6 Address", Text: s}
+	}
+	if !prefix.contains(ip) {
+		return 0, fmt.Errorf("%s is not within %s", s, prefix)
+	}
+	return fromIP6(ip), nil
+}
+
+// IP converts an address within this prefix to an IPv6 address
+func (prefix Prefix6) IP(addr Address) net.IP {
+	r := make(net.IP, net.IPv6len)
+	copy(r, prefix.fixed[:])
+	copy(r[len(prefix.fixed):], addr.IP4())
+	return r
+}
+
+func (prefix Prefix6) FormatAddress(addr Address) string {
+	return prefix.IP(addr).String()
+}
+
+// The IPv6 prefix length of a CIDR, which for the part of a short
+// range which is allocated from is that of the range
+func (prefix Prefix6) prefixLen(cidr CIDR) int {
+	if prefix.short() && cidr.PrefixLen == short6Universe.PrefixLen {
+		return prefix.rangeLen
+	}
+	return cidr.PrefixLen + Prefix6Len
+}
+
+func (prefix Prefix6) FormatCIDR(cidr CIDR) string {
+	return fmt.Sprintf("%s/%d", prefix.IP(cidr.Addr), prefix.prefixLen(cidr))
+}
+
+func (prefix Prefix6) FormatRange(r Range) string {
+	return fmt.Sprintf("%s-%s", prefix.IP(r.Start), prefix.IP(r.End-1))
+}
+
+func (prefix Prefix6) IPNet(cidr CIDR) *net.IPNet {
+	mask := net.CIDRMask(prefix.prefixLen(cidr), 8*net.IPv6len)
+	return &net.IPNet{IP: prefix.IP(cidr.Addr), Mask: mask}
+}
+
+// fromIP6 extracts the low 32 bits of an IPv6 address
+func fromIP6(ip net.IP) (r Address) {
+	for _, b := range ip.To16()[Prefix6Len/8:] {
+		r <<= 8
+		r |= Address(b)
+	}
+	return
+}
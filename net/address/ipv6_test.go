@@ -0,0 +1,77 @@
+package address
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCIDR6(t *testing.T) {
+	prefix, cidr, err := ParseCIDR6("fd00:1:2::a00:0/120")
+	require.NoError(t, err)
+	require.Equal(t, ip("10.0.0.0"), cidr.Addr)
+	require.Equal(t, 24, cidr.PrefixLen)
+	require.Equal(t, "fd00:1:2::a00:0/120", prefix.FormatCIDR(cidr))
+	require.Equal(t, "fd00:1:2::a00:0-fd00:1:2::a00:ff", prefix.FormatRange(cidr.Range()))
+	_, ipnet, _ := net.ParseCIDR("fd00:1:2::a00:0/120")
+	require.Equal(t, ipnet, prefix.IPNet(cidr))
+
+	addr, err := prefix.ParseIP("fd00:1:2::a00:5")
+	require.NoError(t, err)
+	require.Equal(t, ip("10.0.0.5"), addr)
+	require.Equal(t, "fd00:1:2::a00:5", prefix.FormatAddress(addr))
+
+	sub, err := prefix.ParseCIDR("fd00:1:2::a00:80/121")
+	require.NoError(t, err)
+	require.Equal(t, cidr2("10.0.0.128", "10.0.0.255"), sub)
+
+	_, err = prefix.ParseIP("fd00:1:3::a00:5")
+	require.Error(t, err, "address outside prefix")
+	_, err = prefix.ParseCIDR("fd00:1:3::/120")
+	require.Error(t, err, "cidr outside prefix")
+	_, err = prefix.ParseIP("10.0.0.5")
+	require.Error(t, err, "IPv4 address")
+
+	_, _, err = ParseCIDR6("10.0.0.0/8")
+	require.Error(t, err, "IPv4 cidr")
+}
+
+// A range shorter than /97 is allocated from its first /97, which
+// stands for the whole range
+func TestParseCIDR6Short(t *testing.T) {
+	for _, s := range []string{"fd00:1:2:3::/64", "fd00:1:2:3::/96"} {
+		prefix, cidr, err := ParseCIDR6(s)
+		require.NoError(t, err, s)
+		require.Equal(t, CIDR{Addr: 0, PrefixLen: 1}, cidr, s)
+		require.Equal(t, s, prefix.FormatCIDR(cidr))
+		require.Equal(t, "fd00:1:2:3::-fd00:1:2:3::7fff:ffff", prefix.FormatRange(cidr.Range()))
+		_, ipnet, _ := net.ParseCIDR(s)
+		require.Equal(t, ipnet, prefix.IPNet(cidr))
+	}
+
+	prefix, cidr, _ := ParseCIDR6("fd00:1:2:3::/64")
+	addr, err := prefix.ParseIP("fd00:1:2:3::a00:5")
+	require.NoError(t, err)
+	require.Equal(t, ip("10.0.0.5"), addr)
+	require.True(t, cidr.Range().Contains(addr))
+
+	// Addresses with the range's prefix length, as given to containers
+	sub, err := prefix.ParseCIDR("fd00:1:2:3::a00:5/64")
+	require.NoError(t, err)
+	require.Equal(t, CIDR{Addr: ip("10.0.0.5"), PrefixLen: 1}, sub)
+	require.Equal(t, "fd00:1:2:3::a00:5/64", prefix.FormatCIDR(sub))
+	sub, err = prefix.ParseCIDR("fd00:1:2:3::a00:0/120")
+	require.NoError(t, err)
+	require.Equal(t, "fd00:1:2:3::a00:0/120", prefix.FormatCIDR(sub))
+
+	_, err = prefix.ParseIP("fd00:1:2:3:0:1:a00:5")
+	require.Error(t, err, "address outside the part allocated from")
+	_, err = prefix.ParseCIDR("fd00:1:2:3::/96")
+	require.Error(t, err, "cidr with another prefix length")
+	_, err = prefix.ParseCIDR("fd00:1:2:4::/64")
+	require.Error(t, err, "cidr outside range")
+
+	_, _, err = ParseCIDR6("fd00:1:2:3::1/64")
+	require.Error(t, err, "host bits set")
+}
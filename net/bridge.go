@@ -19,7 +19,7 @@ import (
 	"github.com/weaveworks/weave/net/ipset"
 )
 
-/* This code implements three possible configurations to connect
+/* This code implements four possible configurations to connect
    containers to the Weave Net overlay:
 
 1. Bridge
@@ -49,6 +49,20 @@ the "datapath" device, via "router/fastdp.go:fastDatapathBridge"
 "weave" is an Open vSwitch datapath, and capture/injection are as in
 BridgedFastdp. Not used by default due to missing conntrack support in
 datapath of old kernel versions (https://github.com/weaveworks/weave/issues/1577).
+
+4. TC
+
+                 +-------+
+(container-veth)-+ weave +-(vethwe-bridge)--(vethwe-pcap)
+                 +-------+
+                            (vethwe-tc)--(vethwe-miss)     (vethwe-vxlan)
+
+As Bridge, plus "vethwe-vxlan", a VXLAN device in external mode.
+eBPF programs attached with tc to the egress of "vethwe-bridge" and
+the ingress of "vethwe-vxlan" forward the frames which match flows
+between them; the others are redirected to "vethwe-tc", and captured
+on "vethwe-miss", by router/tc_datapath.go.  Injection uses
+"vethwe-pcap".  Does not need Open vSwitch.
 */
 
 const (
@@ -57,6 +71,10 @@ const (
 	DatapathIfName   = "vethwe-datapath"
 	BridgeIfName     = "vethwe-bridge"
 	PcapIfName       = "vethwe-pcap"
+	TCIfName         = "vethwe-tc"
+	TCMissIfName     = "vethwe-miss"
+	TCVxlanIfName    = "vethwe-vxlan"
+	TCDatapathName   = "tc" // the datapath name which selects the tc bridge type
 	NoMasqLocalIpset = ipset.Name("weaver-no-masq-local")
 )
 
@@ -64,6 +82,7 @@ type Bridge interface {
 	init(procPath string, config *BridgeConfig) error // create and initialise bridge device(s)
 	attach(veth *netlink.Veth) error                  // attach veth to bridge
 	IsFastdp() bool                                   // does this bridge use fastdp?
+	IsTC() bool                                       // does this bridge use the tc datapath?
 	String() string                                   // human-readable type string
 }
 
@@ -76,16 +95,25 @@ type bridgedFastdpImpl struct {
 	bridgeImpl
 	fastdpImpl
 }
+type tcImpl struct{ bridgeImpl }
 
 // Returns a string that is consistent with the weave script
 func (bridgeImpl) String() string        { return "bridge" }
 func (fastdpImpl) String() string        { return "fastdp" }
 func (bridgedFastdpImpl) String() string { return "bridged_fastdp" }
+func (tcImpl) String() string            { return "tc" }
 
 // Used to decide whether to manage ODP tunnels
 func (bridgeImpl) IsFastdp() bool        { return false }
 func (fastdpImpl) IsFastdp() bool        { return true }
 func (bridgedFastdpImpl) IsFastdp() bool { return true }
+func (tcImpl) IsFastdp() bool            { return false }
+
+// Used to decide whether to manage tc flows
+func (bridgeImpl) IsTC() bool        { return false }
+func (fastdpImpl) IsTC() bool        { return false }
+func (bridgedFastdpImpl) IsTC() bool { return false }
+func (tcImpl) IsTC() bool            { return true }
 
 func ExistingBridgeType(weaveBridgeName, datapathName string) (Bridge, error) {
 	bridge, _ := netlink.LinkByName(weaveBridgeName)
@@ -95,6 +123,9 @@ func ExistingBridgeType(weaveBridgeName, datapathName string) (Bridge, error) {
 	case bridge == nil && datapath == nil:
 		return nil, nil
 	case isBridge(bridge) && datapath == nil:
+		if miss, _ := netlink.LinkByName(TCMissIfName); miss != nil {
+			return tcImpl{bridgeImpl{bridge: bridge}}, nil
+		}
 		return bridgeImpl{bridge: bridge}, nil
 	case isDatapath(bridge) && datapath == nil:
 		return fastdpImpl{datapathName: datapathName}, nil
@@ -214,6 +245,7 @@ type BridgeConfig struct {
 	DatapathName     string
 	NoFastdp         bool
 	NoBridgedFastdp  bool
+	TC               bool
 	AWSVPC           bool
 	NPC              bool
 	MTU              int
@@ -221,10 +253,13 @@ type BridgeConfig struct {
 	Port             int
 	ControlPort      string
 	NoMasqLocal      bool
+	Segments         []uint16 // VLANs of the segments on the bridge
 }
 
 func (config *BridgeConfig) configuredBridgeType() Bridge {
 	switch {
+	case config.TC:
+		return tcImpl{}
 	case config.NoFastdp:
 		return bridgeImpl{}
 	case config.NoBridgedFastdp:
@@ -260,6 +295,15 @@ func EnsureBridge(procPath string, config *BridgeConfig, log *logrus.Logger, ips
 		break
 	}
 
+	if _, ok := bridgeType.(fastdpImpl); ok {
+		// There is no Linux bridge to put the VLANs on
+		if len(config.Segments) > 0 {
+			return bridgeType, fmt.Errorf("segments cannot be used with bridge type %q", bridgeType)
+		}
+	} else if err := configureSegments(config.WeaveBridgeName, config.Segments); err != nil {
+		return bridgeType, errors.Wrap(err, "configuring segments")
+	}
+
 	if err := ConfigureIPTables(config, ips); err != nil {
 		return bridgeType, errors.Wrap(err, "configuring iptables")
 	}
@@ -415,6 +459,91 @@ func (bf bridgedFastdpImpl) init(procPath string, config *BridgeConfig) error {
 	return linkSetUpByName(bf.datapathName)
 }
 
+func (t tcImpl) init(procPath string, config *BridgeConfig) error {
+	if config.MTU == 0 {
+		// As for fast datapath, which the tc datapath
+		// interoperates with
+		config.MTU = 1376
+	}
+	if err := initTCVxlan(config); err != nil {
+		return err
+	}
+	if err := t.bridgeImpl.init(procPath, config); err != nil {
+		return err
+	}
+	if err := ensureClsact(BridgeIfName); err != nil {
+		return errors.Wrapf(err, "adding clsact qdisc to %q", BridgeIfName)
+	}
+
+	// The frames which miss the flows pass through this veth pair
+	// to the router.  Those received from other peers carry a
+	// header giving the VXLAN tunnel they arrived on, which would
+	// make a full-sized frame too big for the bridge MTU.
+	veth := &netlink.Veth{LinkAttrs: netlink.NewLinkAttrs(), PeerName: TCMissIfName}
+	veth.LinkAttrs.Name = TCIfName
+	veth.LinkAttrs.MTU = tcMissMTU
+	if err := LinkAddIfNotExist(veth); err != nil {
+		return errors.Wrap(err, "creating tc miss veth pair")
+	}
+	for _, name := range []string{TCIfName, TCMissIfName} {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return errors.Wrapf(err, "finding %q", name)
+		}
+		if err := netlink.LinkSetMTU(link, tcMissMTU); err != nil {
+			return errors.Wrapf(err, "setting %q mtu %d", name, tcMissMTU)
+		}
+		if err := sysctlIfExists(procPath, "net/ipv6/conf/"+name+"/disable_ipv6", "1"); err != nil {
+			return errors.Wrapf(err, "disabling ipv6 on %q", name)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return errors.Wrapf(err, "setting link up on %q", name)
+		}
+	}
+	return nil
+}
+
+const tcMissMTU = 65535
+
+// Create the VXLAN device, on the weave port plus 1 as for fast
+// datapath.  Kernels which cannot attach eBPF programs to it fall
+// back to the plain bridge.
+func initTCVxlan(config *BridgeConfig) error {
+	vxlan := &netlink.Vxlan{
+		LinkAttrs: netlink.NewLinkAttrs(),
+		FlowBased: true,
+		Port:      config.Port + 1,
+	}
+	vxlan.LinkAttrs.Name = TCVxlanIfName
+	vxlan.LinkAttrs.MTU = config.MTU
+	if err := LinkAddIfNotExist(vxlan); err != nil {
+		return errors.Wrap(errBridgeNotSupported, err.Error())
+	}
+	if err := ensureClsact(TCVxlanIfName); err != nil {
+		if link, _ := netlink.LinkByName(TCVxlanIfName); link != nil {
+			netlink.LinkDel(link)
+		}
+		return errors.Wrap(errBridgeNotSupported, err.Error())
+	}
+	return linkSetUpByName(TCVxlanIfName)
+}
+
+// Add a clsact qdisc, which eBPF programs attach to, to a link
+func ensureClsact(linkName string) error {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return err
+	}
+	return netlink.QdiscReplace(&netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	})
+}
+
 func (b bridgeImpl) attach(veth *netlink.Veth) error {
 	return netlink.LinkSetMasterByIndex(veth, b.bridge.Attrs().Index)
 }
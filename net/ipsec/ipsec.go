@@ -65,6 +65,9 @@ type IPSec struct {
 	spiInfo map[spiID]spiInfo
 	// A reference to spiInfo; spiInfo might be of an expired SPI.
 	spis map[SPI]*spiInfo
+	// Inbound SPIs which have been replaced by a rekey, but are
+	// still in use until the remote peer acknowledges the new one.
+	retiring map[spiID]SPI
 }
 
 func New(log *logrus.Logger) (*IPSec, error) {
@@ -74,10 +77,11 @@ func New(log *logrus.Logger) (*IPSec, error) {
 	}
 
 	ipsec := &IPSec{
-		ipt:     ipt,
-		log:     log,
-		spiInfo: make(map[spiID]spiInfo),
-		spis:    make(map[SPI]*spiInfo),
+		ipt:      ipt,
+		log:      log,
+		spiInfo:  make(map[spiID]spiInfo),
+		spis:     make(map[SPI]*spiInfo),
+		retiring: make(map[spiID]SPI),
 	}
 
 	return ipsec, nil
@@ -86,12 +90,132 @@ func New(log *logrus.Logger) (*IPSec, error) {
 // InitSALocal initializes inbound ipsec from remotePeer and triggers
 // the initialization on remotePeer.
 func (ipsec *IPSec) InitSALocal(localPeer, remotePeer mesh.PeerName, connUID uint64, localIP, remoteIP net.IP, udpPort int, sessionKey *[32]byte) ([]byte, error) {
-	// ID of inbound SPI
+	ipsec.Lock()
+	defer ipsec.Unlock()
+
+	return ipsec.initSALocal(localPeer, remotePeer, connUID, localIP, remoteIP, udpPort, sessionKey)
+}
+
+// RekeySALocal replaces the inbound SA from remotePeer, in the same way
+// as InitSALocal.  The old SA stays in place until RetireSALocal is
+// called, once remotePeer has switched to the new one, so that no
+// packets are lost in between.
+func (ipsec *IPSec) RekeySALocal(localPeer, remotePeer mesh.PeerName, connUID uint64, localIP, remoteIP net.IP, udpPort int, sessionKey *[32]byte) ([]byte, error) {
+	spiID := getSPIId(remotePeer, localPeer, connUID)
+
+	ipsec.Lock()
+	defer ipsec.Unlock()
+
+	old, ok := ipsec.spiInfo[spiID]
+	if !ok {
+		return nil, fmt.Errorf("no inbound SA from %s to rekey", remotePeer)
+	}
+	if _, ok := ipsec.retiring[spiID]; ok {
+		return nil, fmt.Errorf("rekey of inbound SA from %s already in progress", remotePeer)
+	}
+
+	msg, err := ipsec.initSALocal(localPeer, remotePeer, connUID, localIP, remoteIP, udpPort, sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	ipsec.retiring[spiID] = old.spi
+	return msg, nil
+}
+
+// RetireSALocal removes the inbound SA replaced by RekeySALocal, after
+// remotePeer has acknowledged the new one.
+func (ipsec *IPSec) RetireSALocal(msgRekeyAck []byte, localPeer, remotePeer mesh.PeerName, connUID uint64, localIP, remoteIP net.IP, udpPort int) error {
+	spiID := getSPIId(remotePeer, localPeer, connUID)
+
+	msg, err := deserializeMsgRekeyAck(msgRekeyAck)
+	if err != nil {
+		return errors.Wrap(err, "deserialize RekeyAck")
+	}
+
+	ipsec.Lock()
+	defer ipsec.Unlock()
+
+	oldSPI, ok := ipsec.retiring[spiID]
+	if !ok {
+		return fmt.Errorf("no rekey of inbound SA from %s in progress", remotePeer)
+	}
+	if current := ipsec.spiInfo[spiID]; current.spi != msg.spi {
+		return fmt.Errorf("rekey acknowledged for SPI 0x%x, expected 0x%x", msg.spi, current.spi)
+	}
+
+	ipsec.log.Infof("ipsec: RetireSALocal: %s -> %s :%d 0x%x", remoteIP, localIP, udpPort, oldSPI)
+	ipsec.destroyInbound(localIP, remoteIP, udpPort, oldSPI)
+	delete(ipsec.retiring, spiID)
+	return nil
+}
+
+// AbandonRekeySALocal ends a rekey which remotePeer has not
+// acknowledged.  If nothing has arrived through the new inbound SA,
+// remotePeer has not switched to it, so it is removed and the old one
+// stays in use.  Otherwise remotePeer did switch, and only the
+// acknowledgement was lost, so the old SA is retired as
+// RetireSALocal would.  Returns whether the new SA was kept.
+func (ipsec *IPSec) AbandonRekeySALocal(localPeer, remotePeer mesh.PeerName, connUID uint64, localIP, remoteIP net.IP, udpPort int) (bool, error) {
 	spiID := getSPIId(remotePeer, localPeer, connUID)
 
 	ipsec.Lock()
 	defer ipsec.Unlock()
 
+	oldSPI, ok := ipsec.retiring[spiID]
+	if !ok {
+		return false, fmt.Errorf("no rekey of inbound SA from %s in progress", remotePeer)
+	}
+	newSPI := ipsec.spiInfo[spiID].spi
+	delete(ipsec.retiring, spiID)
+
+	sa, err := netlink.XfrmStateGet(&netlink.XfrmState{
+		Src:   remoteIP,
+		Dst:   localIP,
+		Proto: netlink.XFRM_PROTO_ESP,
+		Spi:   int(newSPI),
+	})
+	if err == nil && sa.Statistics.Bytes > 0 {
+		ipsec.log.Infof("ipsec: AbandonRekeySALocal: in use, retire %s -> %s :%d 0x%x", remoteIP, localIP, udpPort, oldSPI)
+		ipsec.destroyInbound(localIP, remoteIP, udpPort, oldSPI)
+		return true, nil
+	}
+
+	ipsec.log.Infof("ipsec: AbandonRekeySALocal: %s -> %s :%d 0x%x, back to 0x%x", remoteIP, localIP, udpPort, newSPI, oldSPI)
+	ipsec.destroyInbound(localIP, remoteIP, udpPort, newSPI)
+	si := spiInfo{spi: oldSPI}
+	ipsec.spiInfo[spiID] = si
+	ipsec.spis[oldSPI] = &si
+	return false, nil
+}
+
+// InboundSABytes returns the number of bytes received through the
+// current inbound SA from remotePeer.
+func (ipsec *IPSec) InboundSABytes(localPeer, remotePeer mesh.PeerName, connUID uint64, localIP, remoteIP net.IP) (uint64, error) {
+	spiID := getSPIId(remotePeer, localPeer, connUID)
+
+	ipsec.RLock()
+	si, ok := ipsec.spiInfo[spiID]
+	ipsec.RUnlock()
+	if !ok {
+		return 0, fmt.Errorf("no inbound SA from %s", remotePeer)
+	}
+
+	sa, err := netlink.XfrmStateGet(&netlink.XfrmState{
+		Src:   remoteIP,
+		Dst:   localIP,
+		Proto: netlink.XFRM_PROTO_ESP,
+		Spi:   int(si.spi),
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("xfrm state get (in, %s, %s, 0x%x)", remoteIP, localIP, si.spi))
+	}
+	return sa.Statistics.Bytes, nil
+}
+
+func (ipsec *IPSec) initSALocal(localPeer, remotePeer mesh.PeerName, connUID uint64, localIP, remoteIP net.IP, udpPort int, sessionKey *[32]byte) ([]byte, error) {
+	// ID of inbound SPI
+	spiID := getSPIId(remotePeer, localPeer, connUID)
+
 	// Derive SA key
 	nonce, err := genNonce()
 	if err != nil {
@@ -140,18 +264,66 @@ func (ipsec *IPSec) InitSALocal(localPeer, remotePeer mesh.PeerName, connUID uin
 // InitSARemote initializes outbound ipsec to remotePeer.
 // Triggered by remotePeer.
 func (ipsec *IPSec) InitSARemote(msgInitSARemote []byte, localPeer, remotePeer mesh.PeerName, connUID uint64, localIP, remoteIP net.IP, udpPort int, sessionKey *[32]byte) error {
-	// ID of outbound SPI
+	msg, err := deserializeMsgInitSARemote(msgInitSARemote)
+	if err != nil {
+		return errors.Wrap(err, "deserialize InitSARemote")
+	}
+
+	ipsec.Lock()
+	defer ipsec.Unlock()
+
+	return ipsec.initSARemote(msg, localPeer, remotePeer, connUID, localIP, remoteIP, udpPort, sessionKey)
+}
+
+// RekeySARemote switches outbound ipsec to remotePeer over to the SA
+// which remotePeer set up with RekeySALocal, and removes the old
+// outbound SA.  It returns the message acknowledging the switch.
+func (ipsec *IPSec) RekeySARemote(msgInitSARemote []byte, localPeer, remotePeer mesh.PeerName, connUID uint64, localIP, remoteIP net.IP, udpPort int, sessionKey *[32]byte) ([]byte, error) {
 	spiID := getSPIId(localPeer, remotePeer, connUID)
 
 	msg, err := deserializeMsgInitSARemote(msgInitSARemote)
 	if err != nil {
-		return errors.Wrap(err, "deserialize InitSARemote")
+		return nil, errors.Wrap(err, "deserialize InitSARemote")
 	}
-	spi := msg.spi
 
 	ipsec.Lock()
 	defer ipsec.Unlock()
 
+	old, hadOld := ipsec.spiInfo[spiID]
+	if hadOld && old.spi == msg.spi {
+		// remotePeer sent the RekeySA again, having missed our
+		// acknowledgement
+		ack := &msgRekeyAck{msg.spi}
+		return ack.serialize(), nil
+	}
+	if err := ipsec.initSARemote(msg, localPeer, remotePeer, connUID, localIP, remoteIP, udpPort, sessionKey); err != nil {
+		return nil, err
+	}
+
+	// The policy now refers to the new SA, so the old one is unused
+	if hadOld && old.spi != msg.spi {
+		ipsec.log.Infof("ipsec: RekeySARemote: retire %s -> %s 0x%x", localIP, remoteIP, old.spi)
+		outSA := &netlink.XfrmState{
+			Src:   localIP,
+			Dst:   remoteIP,
+			Proto: netlink.XFRM_PROTO_ESP,
+			Spi:   int(old.spi),
+		}
+		if err := netlink.XfrmStateDel(outSA); err != nil {
+			ipsec.log.Warnf("ipsec: xfrm state del (out, %s, %s, 0x%x) failed: %s", outSA.Src, outSA.Dst, outSA.Spi, err)
+		}
+		delete(ipsec.spis, old.spi)
+	}
+
+	ack := &msgRekeyAck{msg.spi}
+	return ack.serialize(), nil
+}
+
+func (ipsec *IPSec) initSARemote(msg *msgInitSARemote, localPeer, remotePeer mesh.PeerName, connUID uint64, localIP, remoteIP net.IP, udpPort int, sessionKey *[32]byte) error {
+	// ID of outbound SPI
+	spiID := getSPIId(localPeer, remotePeer, connUID)
+	spi := msg.spi
+
 	ipsec.log.Infof("ipsec: InitSARemote: %s -> %s :%d 0x%x", localIP, remoteIP, udpPort, spi)
 
 	// Derive SA key by using the received nonce
@@ -194,25 +366,13 @@ func (ipsec *IPSec) Destroy(localPeer, remotePeer mesh.PeerName, connUID uint64,
 
 	if inSPIInfo, ok := ipsec.spiInfo[inSPIID]; ok {
 		ipsec.log.Infof("ipsec: destroy: in %s -> %s 0x%x", remoteIP, localIP, inSPIInfo.spi)
-
-		inSPI := inSPIInfo.spi
-
-		inSA := &netlink.XfrmState{
-			Src:   remoteIP,
-			Dst:   localIP,
-			Proto: netlink.XFRM_PROTO_ESP,
-			Spi:   int(inSPI),
-		}
-		if err := netlink.XfrmStateDel(inSA); err != nil {
-			ipsec.log.Warnf("ipsec: xfrm state del (in, %s, %s, 0x%x) failed: %s", inSA.Src, inSA.Dst, inSA.Spi, err)
-		}
-
-		if err := ipsec.removeDropNonEncrypted(localIP, remoteIP, udpPort, inSPI); err != nil {
-			ipsec.log.Warnf("ipsec: remove protecting rules (%s, %s, %d, 0x%x) failed: %s", localIP, remoteIP, udpPort, inSPI, err)
-		}
-
+		ipsec.destroyInbound(localIP, remoteIP, udpPort, inSPIInfo.spi)
 		delete(ipsec.spiInfo, inSPIID)
-		delete(ipsec.spis, inSPI)
+	}
+	if oldSPI, ok := ipsec.retiring[inSPIID]; ok {
+		ipsec.log.Infof("ipsec: destroy: in %s -> %s 0x%x", remoteIP, localIP, oldSPI)
+		ipsec.destroyInbound(localIP, remoteIP, udpPort, oldSPI)
+		delete(ipsec.retiring, inSPIID)
 	}
 
 	// Destroy outbound
@@ -251,6 +411,24 @@ func (ipsec *IPSec) Destroy(localPeer, remotePeer mesh.PeerName, connUID uint64,
 	return nil
 }
 
+func (ipsec *IPSec) destroyInbound(localIP, remoteIP net.IP, udpPort int, inSPI SPI) {
+	inSA := &netlink.XfrmState{
+		Src:   remoteIP,
+		Dst:   localIP,
+		Proto: netlink.XFRM_PROTO_ESP,
+		Spi:   int(inSPI),
+	}
+	if err := netlink.XfrmStateDel(inSA); err != nil {
+		ipsec.log.Warnf("ipsec: xfrm state del (in, %s, %s, 0x%x) failed: %s", inSA.Src, inSA.Dst, inSA.Spi, err)
+	}
+
+	if err := ipsec.removeDropNonEncrypted(localIP, remoteIP, udpPort, inSPI); err != nil {
+		ipsec.log.Warnf("ipsec: remove protecting rules (%s, %s, %d, 0x%x) failed: %s", localIP, remoteIP, udpPort, inSPI, err)
+	}
+
+	delete(ipsec.spis, inSPI)
+}
+
 // Flush removes all policies/SAs established by us. Also, it removes chains and
 // rules of iptables.
 //
@@ -555,3 +733,30 @@ func (msg *msgInitSARemote) serialize() []byte {
 
 	return b
 }
+
+type msgRekeyAck struct {
+	spi SPI
+}
+
+func deserializeMsgRekeyAck(b []byte) (*msgRekeyAck, error) {
+	msg := &msgRekeyAck{}
+	if len(b) != msg.size() {
+		return nil, fmt.Errorf("invalid payload size: %d", len(b))
+	}
+
+	msg.spi = SPI(binary.BigEndian.Uint32(b))
+
+	return msg, nil
+}
+
+func (msg *msgRekeyAck) size() int {
+	return 4 // SPI
+}
+
+func (msg *msgRekeyAck) serialize() []byte {
+	b := make([]byte, msg.size())
+
+	binary.BigEndian.PutUint32(b, uint32(msg.spi))
+
+	return b
+}
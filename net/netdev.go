@@ -13,6 +13,8 @@ type Dev struct {
 	Name  string           `json:"Name,omitempty"`
 	MAC   net.HardwareAddr `json:"MAC,omitempty"`
 	CIDRs []*net.IPNet     `json:"CIDRs,omitempty"`
+	// Global IPv6 addresses; link-local ones are left out
+	CIDRs6 []*net.IPNet `json:"CIDRs6,omitempty"`
 }
 
 func linkToNetDev(link netlink.Link) (Dev, error) {
@@ -25,6 +27,16 @@ func linkToNetDev(link netlink.Link) (Dev, error) {
 	for _, addr := range addrs {
 		netDev.CIDRs = append(netDev.CIDRs, addr.IPNet)
 	}
+
+	addrs6, err := netlink.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return Dev{}, err
+	}
+	for _, addr := range addrs6 {
+		if addr.IP.IsGlobalUnicast() {
+			netDev.CIDRs6 = append(netDev.CIDRs6, addr.IPNet)
+		}
+	}
 	return netDev, nil
 }
 
@@ -0,0 +1,154 @@
+package net
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Segments are VLANs on the weave bridge (see router/segments.go).
+// With VLAN filtering on, a container's port is an untagged member of
+// the VLAN of its segment only, and the port to the router is a tagged
+// member of the VLANs of all the segments.  The default segment is the
+// bridge's default VLAN, which every port is an untagged member of
+// unless it is put into another.
+
+const (
+	defaultVLAN    = 1
+	segmentTagSize = 4 // of the 802.1Q tag a frame in a segment has on the overlay
+)
+
+// Turn VLAN filtering on the bridge on if there are segments, and off
+// otherwise, and make the port to the router a member of exactly the
+// VLANs of the segments.
+func configureSegments(bridgeName string, segments []uint16) error {
+	filtering := "0"
+	if len(segments) > 0 {
+		filtering = "1"
+	}
+	filename := filepath.Join("/sys/class/net/", bridgeName, "/bridge/vlan_filtering")
+	current, err := ioutil.ReadFile(filename)
+	switch {
+	case err != nil && len(segments) == 0:
+		// Old kernels have no VLAN filtering to turn off
+		return nil
+	case err != nil:
+		return errors.Wrapf(err, "reading %q", filename)
+	case strings.TrimSpace(string(current)) != filtering:
+		if err := ioutil.WriteFile(filename, []byte(filtering), 0644); err != nil {
+			return errors.Wrapf(err, "writing %q", filename)
+		}
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+
+	port, err := netlink.LinkByName(BridgeIfName)
+	if err != nil {
+		return errors.Wrapf(err, "finding %q", BridgeIfName)
+	}
+	vlans, err := portVLANs(port)
+	if err != nil {
+		return err
+	}
+	wanted := make(map[uint16]bool)
+	for _, vid := range segments {
+		wanted[vid] = true
+		if _, found := vlans[vid]; found {
+			continue
+		}
+		if err := netlink.BridgeVlanAdd(port, vid, false, false, false, true); err != nil {
+			return errors.Wrapf(err, "adding VLAN %d to %q", vid, BridgeIfName)
+		}
+	}
+	// Segments from previous rules
+	for vid := range vlans {
+		if vid != defaultVLAN && !wanted[vid] {
+			if err := netlink.BridgeVlanDel(port, vid, false, false, false, true); err != nil {
+				return errors.Wrapf(err, "deleting VLAN %d from %q", vid, BridgeIfName)
+			}
+		}
+	}
+	return nil
+}
+
+// The VLANs a bridge port is a member of
+func portVLANs(port netlink.Link) (map[uint16]*nl.BridgeVlanInfo, error) {
+	all, err := netlink.BridgeVlanList()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing bridge VLANs")
+	}
+	vlans := make(map[uint16]*nl.BridgeVlanInfo)
+	for _, info := range all[int32(port.Attrs().Index)] {
+		vlans[info.Vid] = info
+	}
+	return vlans, nil
+}
+
+// The segment of a container's port, which is the VLAN it sends
+// untagged frames in
+func portSegment(port netlink.Link) (uint16, error) {
+	vlans, err := portVLANs(port)
+	if err != nil {
+		return 0, err
+	}
+	for vid, info := range vlans {
+		if info.PortVID() {
+			if vid == defaultVLAN {
+				return 0, nil
+			}
+			return vid, nil
+		}
+	}
+	return 0, nil
+}
+
+// Put a container's port into a segment, taking it out of the
+// default one
+func setPortSegment(port netlink.Link, segment uint16) error {
+	if segment == 0 {
+		return nil
+	}
+	if err := netlink.BridgeVlanAdd(port, segment, true, true, false, true); err != nil {
+		return fmt.Errorf("adding %q to VLAN %d: %s", port.Attrs().Name, segment, err)
+	}
+	if err := netlink.BridgeVlanDel(port, defaultVLAN, false, false, false, true); err != nil {
+		return fmt.Errorf("removing %q from VLAN %d: %s", port.Attrs().Name, defaultVLAN, err)
+	}
+	return nil
+}
+
+// SetVethSegment puts a container's veth, made by CreateAndAttachVeth
+// but not yet moved into the container, into a segment, as
+// AttachContainer does.
+func SetVethSegment(name, peerName string, segment uint16) error {
+	if segment == 0 {
+		return nil
+	}
+	peer, err := netlink.LinkByName(peerName)
+	if err != nil {
+		return err
+	}
+	if err := setSegmentMTU(peer); err != nil {
+		return err
+	}
+	port, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return setPortSegment(port, segment)
+}
+
+// Leave room in the container's frames for the VLAN tag they carry
+// over the overlay
+func setSegmentMTU(veth netlink.Link) error {
+	if err := netlink.LinkSetMTU(veth, veth.Attrs().MTU-segmentTagSize); err != nil {
+		return fmt.Errorf("failed to set veth mtu: %s", err)
+	}
+	return nil
+}
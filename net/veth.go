@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/coreos/go-iptables/iptables"
@@ -80,7 +81,7 @@ func CreateAndAttachVeth(procPath, name, peerName, bridgeName string, mtu int, k
 }
 
 func AddAddresses(link netlink.Link, cidrs []*net.IPNet) (newAddrs []*net.IPNet, err error) {
-	existingAddrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	existingAddrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get IP address for %q: %v", link.Attrs().Name, err)
 	}
@@ -88,7 +89,14 @@ func AddAddresses(link netlink.Link, cidrs []*net.IPNet) (newAddrs []*net.IPNet,
 		if contains(existingAddrs, ipnet) {
 			continue
 		}
-		if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: ipnet}); err != nil {
+		addr := &netlink.Addr{IPNet: ipnet}
+		if ipnet.IP.To4() == nil {
+			// IPAM has made sure the address is unique, so skip
+			// duplicate address detection, which would leave it
+			// unusable for a while
+			addr.Flags = syscall.IFA_F_NODAD
+		}
+		if err := netlink.AddrAdd(link, addr); err != nil {
 			return nil, fmt.Errorf("failed to add IP address to %q: %v", link.Attrs().Name, err)
 		}
 		newAddrs = append(newAddrs, ipnet)
@@ -118,7 +126,9 @@ func interfaceExistsInNamespace(netNSPath string, ifName string) bool {
 	return err == nil
 }
 
-func AttachContainer(netNSPath, id, ifName, bridgeName string, mtu int, withMulticastRoute bool, cidrs []*net.IPNet, keepTXOn bool, hairpinMode bool) error {
+// AttachContainer connects a container to the bridge, in the given
+// segment, and gives it the addresses.
+func AttachContainer(netNSPath, id, ifName, bridgeName string, mtu int, withMulticastRoute bool, cidrs []*net.IPNet, keepTXOn bool, hairpinMode bool, segment uint16) error {
 	// AttachContainer expects to be called in host pid namespace
 	const procPath = "/proc"
 
@@ -128,13 +138,19 @@ func AttachContainer(netNSPath, id, ifName, bridgeName string, mtu int, withMult
 	}
 	defer ns.Close()
 
+	maxIDLen := IFNAMSIZ - 1 - len(vethPrefix+"pl")
+	if len(id) > maxIDLen {
+		id = id[:maxIDLen] // trim passed ID if too long
+	}
+	name, peerName := vethPrefix+"pl"+id, vethPrefix+"pg"+id
+
 	if !interfaceExistsInNamespace(netNSPath, ifName) {
-		maxIDLen := IFNAMSIZ - 1 - len(vethPrefix+"pl")
-		if len(id) > maxIDLen {
-			id = id[:maxIDLen] // trim passed ID if too long
-		}
-		name, peerName := vethPrefix+"pl"+id, vethPrefix+"pg"+id
 		veth, err := CreateAndAttachVeth(procPath, name, peerName, bridgeName, mtu, keepTXOn, true, func(veth netlink.Link) error {
+			if segment != 0 {
+				if err := setSegmentMTU(veth); err != nil {
+					return err
+				}
+			}
 			if err := netlink.LinkSetNsFd(veth, int(ns)); err != nil {
 				return fmt.Errorf("failed to move veth to container netns: %s", err)
 			}
@@ -151,7 +167,21 @@ func AttachContainer(netNSPath, id, ifName, bridgeName string, mtu int, withMult
 		if err = netlink.LinkSetHairpin(veth, hairpinMode); err != nil {
 			return fmt.Errorf("unable to set hairpin mode to %t for bridge side of veth %s: %s", hairpinMode, name, err)
 		}
-
+		if err := setPortSegment(veth, segment); err != nil {
+			netlink.LinkDel(veth)
+			return err
+		}
+	} else if port, err := netlink.LinkByName(name); err == nil {
+		// More addresses must be in the segment the container is in
+		current, err := portSegment(port)
+		if err != nil {
+			return err
+		}
+		if current != segment {
+			return fmt.Errorf("container is in segment %d, not %d", current, segment)
+		}
+	} else if segment != 0 {
+		return fmt.Errorf("unable to find bridge side of veth %s: %s", name, err)
 	}
 
 	if err := WithNetNSLink(ns, ifName, func(veth netlink.Link) error {
@@ -177,6 +207,9 @@ func setupIfaceAddrs(veth netlink.Link, withMulticastRoute bool, cidrs []*net.IP
 
 	// Add multicast ACCEPT rules for new subnets
 	for _, ipnet := range newAddresses {
+		if ipnet.IP.To4() == nil {
+			continue
+		}
 		acceptRule := []string{"-i", ifName, "-s", subnet(ipnet), "-d", "224.0.0.0/4", "-j", "ACCEPT"}
 		exists, err := ipt.Exists("filter", "INPUT", acceptRule...)
 		if err != nil {
@@ -193,6 +226,9 @@ func setupIfaceAddrs(veth netlink.Link, withMulticastRoute bool, cidrs []*net.IP
 		return err
 	}
 	for _, ipnet := range newAddresses {
+		if ipnet.IP.To4() == nil {
+			continue
+		}
 		// If we don't wait for a bit here, we see the arp fail to reach the bridge.
 		time.Sleep(1 * time.Millisecond)
 		arping.GratuitousArpOverIfaceByName(ipnet.IP, ifName)
@@ -268,7 +304,7 @@ func DetachContainer(netNSPath, id, ifName string, cidrs []*net.IPNet) error {
 	}
 
 	return WithNetNSLink(ns, ifName, func(veth netlink.Link) error {
-		existingAddrs, err := netlink.AddrList(veth, netlink.FAMILY_V4)
+		existingAddrs, err := netlink.AddrList(veth, netlink.FAMILY_ALL)
 		if err != nil {
 			return fmt.Errorf("failed to get IP address for %q: %v", veth.Attrs().Name, err)
 		}
@@ -280,6 +316,8 @@ func DetachContainer(netNSPath, id, ifName string, cidrs []*net.IPNet) error {
 				return fmt.Errorf("failed to remove IP address from %q: %v", veth.Attrs().Name, err)
 			}
 		}
+		// IPv6 addresses do not keep the interface: it always has a
+		// link-local one
 		addrs, err := netlink.AddrList(veth, netlink.FAMILY_V4)
 		if err != nil {
 			return fmt.Errorf("failed to get IP address for %q: %v", veth.Attrs().Name, err)
@@ -0,0 +1,257 @@
+// package wireguard provides primitives for configuring the kernel
+// WireGuard device used by the wireguard overlay.
+package wireguard
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	KeySize = 32
+
+	genlName    = "wireguard"
+	genlVersion = 1
+
+	cmdSetDevice = 1
+
+	// attribute and flag values from include/uapi/linux/wireguard.h
+	deviceAttrIfname     = 2
+	deviceAttrPrivateKey = 3
+	deviceAttrFlags      = 5
+	deviceAttrListenPort = 6
+	deviceAttrPeers      = 8
+
+	peerAttrPublicKey    = 1
+	peerAttrPresharedKey = 2
+	peerAttrFlags        = 3
+	peerAttrEndpoint     = 4
+	peerAttrAllowedIPs   = 9
+
+	allowedIPAttrFamily   = 1
+	allowedIPAttrIPAddr   = 2
+	allowedIPAttrCIDRMask = 3
+
+	deviceFlagReplacePeers    = 1
+	peerFlagRemoveMe          = 1
+	peerFlagReplaceAllowedIPs = 2
+
+	pskInfo = "weave wireguard psk"
+)
+
+// Keys
+
+type Key [KeySize]byte
+
+func GeneratePrivateKey() (Key, error) {
+	var k Key
+	if _, err := io.ReadFull(rand.Reader, k[:]); err != nil {
+		return k, err
+	}
+	// clamp, as per https://cr.yp.to/ecdh.html
+	k[0] &= 248
+	k[31] = (k[31] & 127) | 64
+	return k, nil
+}
+
+func (k Key) PublicKey() Key {
+	var pub [KeySize]byte
+	priv := [KeySize]byte(k)
+	curve25519.ScalarBaseMult(&pub, &priv)
+	return Key(pub)
+}
+
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+func ParseKey(s string) (Key, error) {
+	var k Key
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return k, err
+	}
+	if len(b) != KeySize {
+		return k, fmt.Errorf("invalid key length %d", len(b))
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+// DerivePresharedKey derives the WireGuard preshared key for a
+// connection from its mesh session key.  Both ends of the connection
+// derive the same key.
+func DerivePresharedKey(sessionKey *[32]byte, connUID uint64) (Key, error) {
+	var k Key
+
+	salt := make([]byte, 8)
+	binary.BigEndian.PutUint64(salt, connUID)
+
+	n, err := io.ReadFull(hkdf.New(sha256.New, sessionKey[:], salt, []byte(pskInfo)), k[:])
+	if err != nil {
+		return k, err
+	}
+	if n != KeySize {
+		return k, fmt.Errorf("derived too short key: %d", n)
+	}
+
+	return k, nil
+}
+
+// Device
+
+type Device struct {
+	link     netlink.Link
+	familyID uint16
+}
+
+type Peer struct {
+	PublicKey    Key
+	PresharedKey Key
+	Endpoint     *net.UDPAddr // nil to have WireGuard learn it from the peer
+	AllowedIP    net.IP       // a single host address
+}
+
+// New creates the WireGuard link called name, unless it already
+// exists, and brings it up.
+func New(name string, mtu int) (*Device, error) {
+	family, err := netlink.GenlFamilyGet(genlName)
+	if err != nil {
+		return nil, errors.Wrap(err, "wireguard genetlink family (is the wireguard kernel module available?)")
+	}
+
+	link := &netlink.GenericLink{LinkAttrs: netlink.LinkAttrs{Name: name, MTU: mtu}, LinkType: "wireguard"}
+	if err := netlink.LinkAdd(link); err != nil && err != syscall.EEXIST {
+		return nil, errors.Wrapf(err, "creating link %q", name)
+	}
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "finding link %q", name)
+	}
+	if err := netlink.LinkSetUp(l); err != nil {
+		return nil, errors.Wrapf(err, "setting link %q up", name)
+	}
+
+	return &Device{link: l, familyID: family.ID}, nil
+}
+
+func (d *Device) Name() string {
+	return d.link.Attrs().Name
+}
+
+// Configure sets the private key and listen port of the device, and
+// removes any existing peers.
+func (d *Device) Configure(privateKey Key, listenPort int) error {
+	flags := make([]byte, 4)
+	nl.NativeEndian().PutUint32(flags, deviceFlagReplacePeers)
+	port := make([]byte, 2)
+	nl.NativeEndian().PutUint16(port, uint16(listenPort))
+
+	return errors.Wrap(d.setDevice(
+		nl.NewRtAttr(deviceAttrPrivateKey, privateKey[:]),
+		nl.NewRtAttr(deviceAttrListenPort, port),
+		nl.NewRtAttr(deviceAttrFlags, flags),
+	), "configure wireguard device")
+}
+
+// AddAddr assigns a link-local address to the device.
+func (d *Device) AddAddr(ip net.IP) error {
+	addr := &netlink.Addr{
+		IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(64, 8*net.IPv6len)},
+		Flags: unix.IFA_F_NODAD,
+	}
+	if err := netlink.AddrReplace(d.link, addr); err != nil {
+		return errors.Wrapf(err, "adding address %s to %q", ip, d.Name())
+	}
+	return nil
+}
+
+// SetPeer adds a peer, or replaces its configuration.
+func (d *Device) SetPeer(peer Peer) error {
+	p := nl.NewRtAttr(unix.NLA_F_NESTED, nil)
+	nl.NewRtAttrChild(p, peerAttrPublicKey, peer.PublicKey[:])
+	nl.NewRtAttrChild(p, peerAttrPresharedKey, peer.PresharedKey[:])
+	flags := make([]byte, 4)
+	nl.NativeEndian().PutUint32(flags, peerFlagReplaceAllowedIPs)
+	nl.NewRtAttrChild(p, peerAttrFlags, flags)
+	if peer.Endpoint != nil {
+		nl.NewRtAttrChild(p, peerAttrEndpoint, sockaddr(peer.Endpoint))
+	}
+	ips := nl.NewRtAttrChild(p, peerAttrAllowedIPs|unix.NLA_F_NESTED, nil)
+	ips.AddChild(allowedIP(peer.AllowedIP))
+
+	peers := nl.NewRtAttr(deviceAttrPeers|unix.NLA_F_NESTED, nil)
+	peers.AddChild(p)
+	return errors.Wrapf(d.setDevice(peers), "set wireguard peer %s", peer.PublicKey)
+}
+
+func (d *Device) RemovePeer(publicKey Key) error {
+	p := nl.NewRtAttr(unix.NLA_F_NESTED, nil)
+	nl.NewRtAttrChild(p, peerAttrPublicKey, publicKey[:])
+	flags := make([]byte, 4)
+	nl.NativeEndian().PutUint32(flags, peerFlagRemoveMe)
+	nl.NewRtAttrChild(p, peerAttrFlags, flags)
+
+	peers := nl.NewRtAttr(deviceAttrPeers|unix.NLA_F_NESTED, nil)
+	peers.AddChild(p)
+	return errors.Wrapf(d.setDevice(peers), "remove wireguard peer %s", publicKey)
+}
+
+// Destroy deletes the link.
+func (d *Device) Destroy() error {
+	return netlink.LinkDel(d.link)
+}
+
+func (d *Device) setDevice(attrs ...*nl.RtAttr) error {
+	req := nl.NewNetlinkRequest(int(d.familyID), unix.NLM_F_ACK)
+	req.AddData(&nl.Genlmsg{Command: cmdSetDevice, Version: genlVersion})
+	req.AddData(nl.NewRtAttr(deviceAttrIfname, nl.ZeroTerminated(d.Name())))
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+	_, err := req.Execute(unix.NETLINK_GENERIC, 0)
+	return err
+}
+
+func allowedIP(ip net.IP) *nl.RtAttr {
+	family, addr := uint16(unix.AF_INET6), ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		family, addr = unix.AF_INET, ip4
+	}
+	a := nl.NewRtAttr(unix.NLA_F_NESTED, nil)
+	b := make([]byte, 2)
+	nl.NativeEndian().PutUint16(b, family)
+	nl.NewRtAttrChild(a, allowedIPAttrFamily, b)
+	nl.NewRtAttrChild(a, allowedIPAttrIPAddr, addr)
+	nl.NewRtAttrChild(a, allowedIPAttrCIDRMask, []byte{uint8(8 * len(addr))})
+	return a
+}
+
+// sockaddr encodes addr as a struct sockaddr_in or sockaddr_in6
+func sockaddr(addr *net.UDPAddr) []byte {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b := make([]byte, unix.SizeofSockaddrInet4)
+		nl.NativeEndian().PutUint16(b, unix.AF_INET)
+		binary.BigEndian.PutUint16(b[2:], uint16(addr.Port))
+		copy(b[4:], ip4)
+		return b
+	}
+	b := make([]byte, unix.SizeofSockaddrInet6)
+	nl.NativeEndian().PutUint16(b, unix.AF_INET6)
+	binary.BigEndian.PutUint16(b[2:], uint16(addr.Port))
+	copy(b[8:], addr.IP.To16())
+	return b
+}
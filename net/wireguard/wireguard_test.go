@@ -0,0 +1,46 @@
+package wireguard
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDerivePresharedKey(t *testing.T) {
+	var sessionKey [32]byte
+	for i := range sessionKey {
+		sessionKey[i] = byte(i)
+	}
+
+	// Peers running different versions must derive the same key
+	key, err := DerivePresharedKey(&sessionKey, 0x0102030405060708)
+	require.NoError(t, err)
+	require.Equal(t, "nM584YyRvXzj9Cq4mXLCO156p7qb9tUrKTMcv+n7j0Y=", key.String())
+
+	// Each connection gets its own key
+	other, err := DerivePresharedKey(&sessionKey, 0x0102030405060709)
+	require.NoError(t, err)
+	require.NotEqual(t, key, other)
+
+	sessionKey[0]++
+	other, err = DerivePresharedKey(&sessionKey, 0x0102030405060708)
+	require.NoError(t, err)
+	require.NotEqual(t, key, other)
+}
+
+func TestKeys(t *testing.T) {
+	privateKey, err := GeneratePrivateKey()
+	require.NoError(t, err)
+	require.Equal(t, byte(0), privateKey[0]&7)
+	require.Equal(t, byte(64), privateKey[31]&(128|64))
+
+	publicKey := privateKey.PublicKey()
+	parsed, err := ParseKey(publicKey.String())
+	require.NoError(t, err)
+	require.Equal(t, publicKey, parsed)
+
+	_, err = ParseKey("c2hvcnQ=")
+	require.Error(t, err)
+	_, err = ParseKey("not base64")
+	require.Error(t, err)
+}
@@ -53,20 +53,50 @@ func (i *Ipam) Allocate(args *skel.CmdArgs) (types.Result, error) {
 	}
 	result := &current.Result{
 		IPs: []*current.IPConfig{{
-			Version: "4",
+			Version: ipVersion(ipnet.IP),
 			Address: *ipnet,
 			Gateway: conf.Gateway,
 		}},
 		Routes: conf.Routes,
 	}
+
+	// On the default subnet, the container also gets an IPv6
+	// address if IPv6 allocation is enabled
+	if conf.Subnet == "" {
+		ipnet6, err := i.weave.AllocateIP6(containerID, false)
+		if err != nil {
+			return nil, err
+		}
+		if ipnet6 != nil {
+			result.IPs = append(result.IPs, &current.IPConfig{Version: "6", Address: *ipnet6})
+		}
+	}
 	return result, nil
 }
 
+func ipVersion(ip net.IP) string {
+	if ip.To4() == nil {
+		return "6"
+	}
+	return "4"
+}
+
 func (i *Ipam) CmdDel(args *skel.CmdArgs) error {
 	return i.Release(args)
 }
 
 func (i *Ipam) Release(args *skel.CmdArgs) error {
+	// Containers added before IPv6 allocation was enabled have no
+	// IPv6 address
+	ipnet6, err := i.weave.LookupIP6(args.ContainerID)
+	if err != nil {
+		return err
+	}
+	if ipnet6 != nil {
+		if err := i.weave.ReleaseIP6sFor(args.ContainerID); err != nil {
+			return err
+		}
+	}
 	return i.weave.ReleaseIPsFor(args.ContainerID)
 }
 
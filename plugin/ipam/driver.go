@@ -32,9 +32,14 @@ func (i *Ipam) GetDefaultAddressSpaces() (string, string, error) {
 func (i *Ipam) RequestPool(addressSpace, pool, subPool string, options map[string]string, v6 bool) (poolname string, subnet *net.IPNet, data map[string]string, err error) {
 	i.logReq("RequestPool", addressSpace, pool, subPool, options)
 	defer func() { i.logRes("RequestPool", err, poolname, subnet, data) }()
-	if pool == "" {
+	switch {
+	case pool == "" && v6:
+		if subnet, err = i.weave.DefaultSubnet6(); err == nil && subnet == nil {
+			err = fmt.Errorf("IPv6 address allocation is not enabled; launch weave with --ipalloc-range6")
+		}
+	case pool == "":
 		subnet, err = i.weave.DefaultSubnet()
-	} else {
+	default:
 		_, subnet, err = net.ParseCIDR(pool)
 	}
 	if err != nil {
@@ -106,6 +111,8 @@ func (i *Ipam) ReleaseAddress(poolID string, address net.IP) error {
 		return err
 	} else if address.Equal(subnet.IP) { // is it the gateway address we faked earlier?
 		return nil
+	} else if address.To4() == nil {
+		return i.weave.ReleaseIP6sFor(address.String())
 	}
 	return i.weave.ReleaseIPsFor(address.String())
 }
@@ -82,8 +82,13 @@ func (c *CNIPlugin) CmdAdd(args *skel.CmdArgs) error {
 	if err != nil {
 		return fmt.Errorf("unable to allocate IP address: %s", err)
 	}
-	// Only expecting one address
+	// The first address is the one routed via the bridge; any others
+	// (i.e. an IPv6 address) are just added to the interface
 	ip := result.IPs[0]
+	cidrs := make([]*net.IPNet, len(result.IPs))
+	for i, ipc := range result.IPs {
+		cidrs[i] = &ipc.Address
+	}
 
 	// If config says nothing about routes or gateway, default one will be via the bridge
 	if len(result.Routes) == 0 && ip.Gateway == nil {
@@ -138,7 +143,16 @@ func (c *CNIPlugin) CmdAdd(args *skel.CmdArgs) error {
 		id = fmt.Sprintf("%x", data)
 	}
 
-	if err := weavenet.AttachContainer(args.Netns, id, args.IfName, conf.BrName, conf.MTU, false, []*net.IPNet{&ip.Address}, false, conf.HairpinMode); err != nil {
+	ips := make([]net.IP, len(cidrs))
+	for i, cidr := range cidrs {
+		ips[i] = cidr.IP
+	}
+	segment, err := c.weave.Segment(ips)
+	if err != nil {
+		return fmt.Errorf("unable to find segment: %s", err)
+	}
+
+	if err := weavenet.AttachContainer(args.Netns, id, args.IfName, conf.BrName, conf.MTU, false, cidrs, false, conf.HairpinMode, segment); err != nil {
 		return err
 	}
 	if err := weavenet.WithNetNSLink(ns, args.IfName, func(link netlink.Link) error {
@@ -2,6 +2,7 @@ package plugin
 
 import (
 	"fmt"
+	"net"
 	"strconv"
 	"sync"
 
@@ -40,6 +41,7 @@ type driver struct {
 	forceMulticast bool
 	networks       map[string]network
 	procPath       string
+	weave          *weaveapi.Client
 }
 
 func New(client *docker.Client, weave *weaveapi.Client, name, scope string, dns, isPluginV2, forceMulticast bool, procPath string) (skel.Driver, error) {
@@ -53,6 +55,7 @@ func New(client *docker.Client, weave *weaveapi.Client, name, scope string, dns,
 		forceMulticast: isPluginV2 && forceMulticast,
 		networks:       make(map[string]network),
 		procPath:       procPath,
+		weave:          weave,
 	}
 
 	// Do not start watcher in the case of plugin v2, which prevents us from
@@ -139,6 +142,10 @@ func (driver *driver) CreateEndpoint(create *api.CreateEndpointRequest) (*api.Cr
 	if _, err := weavenet.CreateAndAttachVeth(driver.procPath, name, peerName, weavenet.WeaveBridgeName, 0, false, true, nil); err != nil {
 		return nil, driver.error("JoinEndpoint", "%s", err)
 	}
+	if err := driver.setSegment(name, peerName, create.Interface); err != nil {
+		netlink.LinkDel(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}})
+		return nil, driver.error("CreateEndpoint", "%s", err)
+	}
 
 	// Send back the MAC address
 	link, _ := netlink.LinkByName(peerName)
@@ -148,6 +155,26 @@ func (driver *driver) CreateEndpoint(create *api.CreateEndpointRequest) (*api.Cr
 	return resp, nil
 }
 
+// Put the endpoint into the segment of its addresses
+func (driver *driver) setSegment(name, peerName string, iface *api.EndpointInterface) error {
+	var ips []net.IP
+	for _, addr := range []string{iface.Address, iface.AddressIPv6} {
+		if addr == "" {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(addr)
+		if err != nil {
+			return err
+		}
+		ips = append(ips, ip)
+	}
+	segment, err := driver.weave.Segment(ips)
+	if err != nil {
+		return fmt.Errorf("unable to find segment: %s", err)
+	}
+	return weavenet.SetVethSegment(name, peerName, segment)
+}
+
 func (driver *driver) DeleteEndpoint(deleteReq *api.DeleteEndpointRequest) error {
 	driver.logReq("DeleteEndpoint", deleteReq, deleteReq.EndpointID)
 	name, _ := vethPair(deleteReq.EndpointID)
@@ -29,7 +29,11 @@ if [ ! -f "/restart.sentinel" ]; then
 fi
 
 router_bridge_opts() {
-    echo --datapath=datapath
+    if [ -n "$WEAVE_TC_DATAPATH" ] ; then
+        echo --datapath=tc
+    else
+        echo --datapath=datapath
+    fi
     [ -z "$WEAVE_MTU" ] || echo --mtu "$WEAVE_MTU"
     [ -z "$WEAVE_NO_FASTDP" ] || echo --no-fastdp
 }
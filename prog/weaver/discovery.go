@@ -75,7 +75,7 @@ func peerDiscoveryDelete(discoveryEndpoint, token, peername string) error {
 	return do("DELETE", discoveryEndpoint, token, request, nil)
 }
 
-func HandleHTTPPeer(router *mux.Router, alloc *ipam.Allocator, discoveryEndpoint, token, peername string) {
+func HandleHTTPPeer(router *mux.Router, alloc, alloc6 *ipam.Allocator, discoveryEndpoint, token, peername string) {
 	router.Methods("DELETE").Path("/peer").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if discoveryEndpoint != "" && token != "" {
 			if err := peerDiscoveryDelete(discoveryEndpoint, token, peername); err != nil {
@@ -85,6 +85,9 @@ func HandleHTTPPeer(router *mux.Router, alloc *ipam.Allocator, discoveryEndpoint
 		if alloc != nil {
 			alloc.Shutdown()
 		}
+		if alloc6 != nil {
+			alloc6.Shutdown()
+		}
 		w.WriteHeader(204)
 	})
 
@@ -100,5 +103,9 @@ func HandleHTTPPeer(router *mux.Router, alloc *ipam.Allocator, discoveryEndpoint
 			transferred := alloc.AdminTakeoverRanges(ident)
 			fmt.Fprintf(w, "%d IPs taken over from %s\n", transferred, ident)
 		}
+		if alloc6 != nil {
+			transferred := alloc6.AdminTakeoverRanges(ident)
+			fmt.Fprintf(w, "%d IPv6 addresses taken over from %s\n", transferred, ident)
+		}
 	})
 }
@@ -98,6 +98,7 @@ var rootTemplate = template.New("root").Funcs(map[string]interface{}{
 		return "disabled"
 	},
 	"trimSuffix": strings.TrimSuffix,
+	"join":       strings.Join,
 })
 
 type ipamStats struct {
@@ -180,25 +181,12 @@ var statusTemplate = defTemplate("status", `\
 {{if .IPAM}}\
 
         Service: ipam
-{{if .IPAM.Entries}}\
-{{if allIPAMOwnersUnreachable .IPAM}}\
-         Status: all IP ranges owned by unreachable peers - use 'rmpeer' if they are dead
-{{else if len .IPAM.PendingAllocates}}\
-         Status: waiting for IP(s) to become available
-{{else}}\
-         Status: ready
-{{end}}\
-{{else if .IPAM.Paxos}}\
-{{if .IPAM.Paxos.Elector}}\
-         Status: awaiting consensus (quorum: {{.IPAM.Paxos.Quorum}}, known: {{.IPAM.Paxos.KnownNodes}})
-{{else}}\
-         Status: priming
-{{end}}\
-{{else}}\
-         Status: idle
+{{template "ipamStatus" .IPAM}}\
 {{end}}\
-          Range: {{.IPAM.Range}}
-  DefaultSubnet: {{.IPAM.DefaultSubnet}}
+{{if .IPAM6}}\
+
+        Service: ipam6
+{{template "ipamStatus" .IPAM6}}\
 {{end}}\
 {{if .DNS}}\
 
@@ -224,6 +212,28 @@ var statusTemplate = defTemplate("status", `\
 {{end}}\
 `)
 
+var ipamStatusTemplate = defTemplate("ipamStatus", `\
+{{if .Entries}}\
+{{if allIPAMOwnersUnreachable .}}\
+         Status: all IP ranges owned by unreachable peers - use 'rmpeer' if they are dead
+{{else if len .PendingAllocates}}\
+         Status: waiting for IP(s) to become available
+{{else}}\
+         Status: ready
+{{end}}\
+{{else if .Paxos}}\
+{{if .Paxos.Elector}}\
+         Status: awaiting consensus (quorum: {{.Paxos.Quorum}}, known: {{.Paxos.KnownNodes}})
+{{else}}\
+         Status: priming
+{{end}}\
+{{else}}\
+         Status: idle
+{{end}}\
+          Range: {{.Range}}
+  DefaultSubnet: {{.DefaultSubnet}}
+`)
+
 var targetsTemplate = defTemplate("targetsTemplate", `\
 {{range .Router.Targets}}{{.}}
 {{end}}\
@@ -231,7 +241,13 @@ var targetsTemplate = defTemplate("targetsTemplate", `\
 
 var connectionsTemplate = defTemplate("connectionsTemplate", `\
 {{range .Router.Connections}}\
-{{if .Outbound}}->{{else}}<-{{end}} {{printf "%-21v" .Address}} {{printf "%-11v" .State}} {{.Info}} {{range $key,$element := .Attrs}}{{if ne $key "name"}}{{$key}}={{$element}}{{end}}{{end}}
+{{if .Outbound}}->{{else}}<-{{end}} {{printf "%-21v" .Address}} {{printf "%-11v" .State}} {{.Info}} {{range $key,$element := .Attrs}}{{if ne $key "name"}}{{$key}}={{$element}} {{end}}{{end}}
+{{end}}\
+{{range .Router.DirectLinks}}\
+{{if .Outbound}}->{{else}}<-{{end}} {{printf "%-21v" .Address}} {{printf "%-11v" .State}} {{printf "%-6v" "direct"}} {{.Peer}}({{.NickName}}) via {{.Via}} {{range $key,$element := .Attrs}}{{if ne $key "name"}}{{$key}}={{$element}} {{end}}{{end}}
+{{end}}\
+{{range .Router.Refused}}\
+<- {{printf "%-21v" .Address}} {{printf "%-11v" "refused"}} {{.Peer}}({{.NickName}}) {{.Error}} at {{.Time.Format "2006/01/02 15:04:05"}}
 {{end}}\
 `)
 
@@ -246,6 +262,19 @@ var peersTemplate = defTemplate("peers", `\
 {{end}}\
 `)
 
+var linkRoutesTemplate = defTemplate("linkRoutes", `\
+{{range .Router.LinkRoutes}}\
+{{$nameNickName := printf "%v(%v)" .Destination .NickName}}{{printf "%-37v" $nameNickName}} \
+cost={{.Cost}} via {{join .Path " -> "}}{{if .Topology}} (topology: {{.Topology}}){{end}}
+{{end}}\
+`)
+
+var multicastTemplate = defTemplate("multicast", `\
+{{range .Router.Multicast}}\
+{{printf "%-39v" .Group}} local={{len .Members}}{{if .Peers}} peers: {{join .Peers " "}}{{end}}
+{{end}}\
+`)
+
 var dnsEntriesTemplate = defTemplate("dnsEntries", `\
 {{$domain := printf ".%v" .DNS.Domain}}\
 {{range .DNS.Entries}}\
@@ -257,6 +286,7 @@ var dnsEntriesTemplate = defTemplate("dnsEntries", `\
 `)
 
 var ipamTemplate = defTemplate("ipamTemplate", `{{printIPAMRanges .Router .IPAM}}`)
+var ipam6Template = defTemplate("ipam6Template", `{{if .IPAM6}}{{printIPAMRanges .Router .IPAM6}}{{end}}`)
 
 type VersionCheck struct {
 	Enabled     bool
@@ -298,13 +328,14 @@ type WeaveStatus struct {
 	VersionCheck *VersionCheck              `json:"VersionCheck,omitempty"`
 	Router       *weave.NetworkRouterStatus `json:"Router,omitempty"`
 	IPAM         *ipam.Status               `json:"IPAM,omitempty"`
+	IPAM6        *ipam.Status               `json:"IPAM6,omitempty"`
 	DNS          *nameserver.Status         `json:"DNS,omitempty"`
 	Proxy        *proxy.Status              `json:"Proxy,omitempty"`
 	Plugin       *plugin.Status             `json:"Plugin,omitempty"`
 }
 
 // Read-only functions, suitable for exposing on an unprotected socket
-func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRouter, allocator *ipam.Allocator, defaultSubnet address.CIDR, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer, prxy *proxy.Proxy, plugin *plugin.Plugin, waitReady *common.WaitGroup) {
+func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRouter, allocator *ipam.Allocator, defaultSubnet address.CIDR, allocator6 *ipam.Allocator, defaultSubnet6 address.CIDR, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer, prxy *proxy.Proxy, plugin *plugin.Plugin, waitReady *common.WaitGroup) {
 	status := func() WeaveStatus {
 		return WeaveStatus{
 			waitReady.IsDone(),
@@ -312,6 +343,7 @@ func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRout
 			versionCheck(),
 			weave.NewNetworkRouterStatus(router),
 			ipam.NewStatus(allocator, defaultSubnet),
+			ipam.NewStatus(allocator6, defaultSubnet6),
 			nameserver.NewStatus(ns, dnsserver),
 			proxy.NewStatus(prxy),
 			plugin.NewStatus(),
@@ -371,6 +403,9 @@ func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRout
 	defHandler("/status/targets", targetsTemplate)
 	defHandler("/status/connections", connectionsTemplate)
 	defHandler("/status/peers", peersTemplate)
+	defHandler("/status/link-routes", linkRoutesTemplate)
+	defHandler("/status/multicast", multicastTemplate)
 	defHandler("/status/dns", dnsEntriesTemplate)
 	defHandler("/status/ipam", ipamTemplate)
+	defHandler("/status/ipam6", ipam6Template)
 }
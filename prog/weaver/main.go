@@ -39,6 +39,8 @@ var Log = common.Log
 type ipamConfig struct {
 	IPRangeCIDR   string
 	IPSubnetCIDR  string
+	IPRange6CIDR  string
+	IPSubnet6CIDR string
 	PeerCount     int
 	Mode          string
 	Observer      bool
@@ -82,6 +84,22 @@ func (c *ipamConfig) Enabled() bool {
 	return true
 }
 
+// Enabled6 says whether a second, IPv6, allocator is to be run
+// alongside the IPv4 one.
+func (c *ipamConfig) Enabled6() bool {
+	var (
+		hasRange6  = c.IPRange6CIDR != ""
+		hasSubnet6 = c.IPSubnet6CIDR != ""
+	)
+	switch {
+	case !hasRange6 && hasSubnet6:
+		Log.Fatal("--ipalloc-default-subnet6 specified without --ipalloc-range6.")
+	case hasRange6 && c.IPRangeCIDR == "":
+		Log.Fatal("--ipalloc-range6 specified without --ipalloc-range.")
+	}
+	return hasRange6
+}
+
 func (c ipamConfig) HasMode() bool {
 	return len(c.Mode) > 0
 }
@@ -146,10 +164,25 @@ func main() {
 		routerName         string
 		nickName           string
 		password           string
+		secondaryPasswords []string
+		peerCertConfig     weave.PeerCertConfig
 		pktdebug           bool
+		useWireGuard       bool
+		useTCPOverlay      bool
+		saLifetime         weave.IPSecSALifetime
+		vxlanGateways      []string
+		linkRouting        bool
+		multicastSnooping  bool
+		arpSuppression     bool
+		natTraversal       bool
+		segmentRules       []string
+		broadcastLimits    weave.BroadcastLimits
+		overlayOrder       string
+		overlayRules       string
+		encryptionRules    string
 		logLevel           = "info"
 		prof               string
-		bufSzMB            int
+		capture            captureConfig
 		noDiscovery        bool
 		httpAddr           string
 		statusAddr         string
@@ -182,12 +215,19 @@ func main() {
 	mflag.StringVar(&routerName, []string{"-name"}, "", "name of router (defaults to MAC of interface)")
 	mflag.StringVar(&nickName, []string{"-nickname"}, "", "nickname of peer (defaults to hostname)")
 	mflag.StringVar(&password, []string{"-password"}, "", "network password")
+	mflagext.ListVar(&secondaryPasswords, []string{"-secondary-password"}, nil, "additional network password accepted on incoming connections")
+	mflag.StringVar(&peerCertConfig.CertFile, []string{"-peer-cert"}, "", "PEM certificate authenticating this peer, with the peer name as its common name")
+	mflag.StringVar(&peerCertConfig.KeyFile, []string{"-peer-key"}, "", "PEM private key for --peer-cert")
+	mflag.StringVar(&peerCertConfig.CAFile, []string{"-peer-ca"}, "", "PEM certificates of the CAs which sign peer certificates")
+	mflag.StringVar(&peerCertConfig.CRLFile, []string{"-peer-crl"}, "", "CRL of revoked peer certificates, re-read when it changes")
 	mflag.StringVar(&logLevel, []string{"-log-level"}, "info", "logging level (debug, info, warning, error)")
 	mflag.BoolVar(&pktdebug, []string{"-pkt-debug"}, false, "enable per-packet debug logging")
 	mflag.StringVar(&prof, []string{"-profile"}, "", "enable profiling and write profiles to given path")
 	mflag.IntVar(&config.ConnLimit, []string{"-conn-limit"}, 200, "connection limit (0 for unlimited)")
 	mflag.BoolVar(&noDiscovery, []string{"-no-discovery"}, false, "disable peer discovery")
-	mflag.IntVar(&bufSzMB, []string{"-bufsz"}, 8, "capture buffer size in MB")
+	mflag.IntVar(&capture.BufSzMB, []string{"-bufsz"}, 8, "capture buffer size in MB")
+	mflag.StringVar(&capture.Mode, []string{"-capture"}, "pcap", "how to capture packets when not using fast datapath (pcap or ring)")
+	mflag.IntVar(&capture.Fanout, []string{"-capture-fanout"}, 1, "number of goroutines sharing the capture, with --capture ring")
 	mflag.IntVar(&bridgeConfig.MTU, []string{"-mtu"}, 0, "MTU size")
 	mflag.StringVar(&httpAddr, []string{"-http-addr"}, "", "address to bind HTTP interface to (disabled if blank, absolute path indicates unix domain socket)")
 	mflag.StringVar(&statusAddr, []string{"-status-addr"}, "", "address to bind status+metrics interface to (disabled if blank, absolute path indicates unix domain socket)")
@@ -195,6 +235,8 @@ func main() {
 	mflag.StringVar(&ipamConfig.Mode, []string{"-ipalloc-init"}, "", "allocator initialisation strategy (consensus, seed or observer)")
 	mflag.StringVar(&ipamConfig.IPRangeCIDR, []string{"-ipalloc-range"}, "", "IP address range reserved for automatic allocation, in CIDR notation")
 	mflag.StringVar(&ipamConfig.IPSubnetCIDR, []string{"-ipalloc-default-subnet"}, "", "subnet to allocate within by default, in CIDR notation")
+	mflag.StringVar(&ipamConfig.IPRange6CIDR, []string{"-ipalloc-range6"}, "", "IPv6 address range reserved for automatic allocation, in CIDR notation (addresses are allocated from at most its first /97)")
+	mflag.StringVar(&ipamConfig.IPSubnet6CIDR, []string{"-ipalloc-default-subnet6"}, "", "IPv6 subnet to allocate within by default, in CIDR notation")
 	mflag.StringVar(&dockerAPI, []string{"-docker-api"}, defaultDockerHost, "Docker API endpoint")
 	mflag.BoolVar(&noDNS, []string{"-no-dns"}, false, "disable DNS server")
 	mflag.StringVar(&dnsConfig.Domain, []string{"-dns-domain"}, nameserver.DefaultDomain, "local domain to server requests for")
@@ -202,9 +244,24 @@ func main() {
 	mflag.IntVar(&dnsConfig.TTL, []string{"-dns-ttl"}, nameserver.DefaultTTL, "TTL for DNS request from our domain")
 	mflag.DurationVar(&dnsConfig.ClientTimeout, []string{"-dns-fallback-timeout"}, nameserver.DefaultClientTimeout, "timeout for fallback DNS requests")
 	mflag.StringVar(&dnsConfig.ResolvConf, []string{"-resolv-conf"}, "", "path to resolver configuration for fallback DNS lookups")
-	mflag.StringVar(&bridgeConfig.DatapathName, []string{"-datapath"}, "", "ODP datapath name")
+	mflag.StringVar(&bridgeConfig.DatapathName, []string{"-datapath"}, "", "ODP datapath name, or \""+weavenet.TCDatapathName+"\" for the tc datapath")
 	mflag.BoolVar(&bridgeConfig.NoFastdp, []string{"-no-fastdp"}, false, "Disable Fast Datapath")
 	mflag.BoolVar(&bridgeConfig.NoBridgedFastdp, []string{"-no-bridged-fastdp"}, false, "Disable Bridged Fast Datapath")
+	mflag.DurationVar(&saLifetime.Time, []string{"-ipsec-sa-lifetime"}, 0, "time after which fast datapath IPsec keys are replaced (0 for no limit)")
+	mflag.Uint64Var(&saLifetime.Bytes, []string{"-ipsec-sa-lifetime-bytes"}, 0, "number of bytes after which fast datapath IPsec keys are replaced (0 for no limit)")
+	mflagext.ListVar(&vxlanGateways, []string{"-vxlan-gateway"}, nil, "act as gateway for an external VXLAN VTEP <vni>@<remote ip>[:<port>] (fast datapath only)")
+	mflag.BoolVar(&useWireGuard, []string{"-wireguard"}, false, "use WireGuard for encrypted connections, in preference to sleeve")
+	mflag.BoolVar(&useTCPOverlay, []string{"-tcp-overlay"}, false, "carry traffic over the TCP control connection to peers which can't be reached over UDP")
+	mflag.StringVar(&overlayOrder, []string{"-overlay-order"}, "", "comma-separated list of overlays in order of preference, e.g. fastdp,sleeve")
+	mflag.StringVar(&overlayRules, []string{"-overlay-rules"}, "", "space-separated list of per-peer overlay rules <pin|forbid>=<overlays>@<peer name, nickname or CIDR>")
+	mflag.StringVar(&encryptionRules, []string{"-encryption-policy"}, "", "space-separated list of encryption policy rules <require-encryption|allow-plain|deny>@<peer name, nickname or CIDR>")
+	mflag.BoolVar(&linkRouting, []string{"-link-quality-routing"}, false, "choose unicast routes by measured link RTT and loss, rather than topology alone")
+	mflag.BoolVar(&multicastSnooping, []string{"-multicast-snooping"}, false, "snoop IGMP/MLD, and forward multicast only to peers with members of the group; must be enabled on all peers")
+	mflag.BoolVar(&arpSuppression, []string{"-arp-suppression"}, false, "answer ARP requests for remote containers known to IPAM or DNS locally, rather than broadcasting them")
+	mflag.BoolVar(&natTraversal, []string{"-nat-traversal"}, false, "punch UDP holes, with the help of peers connected to both, to reach peers which cannot be connected to directly")
+	mflagext.ListVar(&segmentRules, []string{"-segment"}, nil, "put containers with addresses in a subnet into an isolated L2 segment <CIDR>=<segment id 2-4094>; must be the same on all peers")
+	mflag.IntVar(&broadcastLimits.PerMAC, []string{"-broadcast-limit-mac"}, 0, "maximum broadcast and unknown-unicast frames per second from each MAC address (0 for unlimited)")
+	mflag.IntVar(&broadcastLimits.PerPeer, []string{"-broadcast-limit-peer"}, 0, "maximum broadcast and unknown-unicast frames per second originating at each peer (0 for unlimited)")
 	mflag.StringVar(&trustedSubnetStr, []string{"-trusted-subnets"}, "", "comma-separated list of trusted subnets in CIDR notation")
 	mflag.StringVar(&dbPrefix, []string{"-db-prefix"}, "/weavedb/weave", "pathname/prefix of filename to store data")
 	mflag.StringVar(&procPath, []string{"-proc-path"}, "/proc", "path to reach host /proc filesystem")
@@ -304,11 +361,26 @@ func main() {
 
 	bridgeConfig.Mac = name.String()
 	bridgeConfig.Port = config.Port
+	bridgeConfig.TC = bridgeConfig.DatapathName == weavenet.TCDatapathName
 	if httpAddr != "" {
 		if _, port, err := net.SplitHostPort(httpAddr); err == nil {
 			bridgeConfig.ControlPort = port
 		}
 	}
+	var segments *weave.Segments
+	if len(segmentRules) > 0 {
+		if bridgeConfig.AWSVPC {
+			Log.Fatalf("--awsvpc mode is not compatible with the --segment option")
+		}
+		var rules []weave.SegmentRule
+		for _, s := range segmentRules {
+			rule, err := weave.ParseSegmentRule(s)
+			checkFatal(err)
+			rules = append(rules, rule)
+		}
+		segments = weave.NewSegments(rules)
+		bridgeConfig.Segments = segments.VLANs()
+	}
 	ips := ipset.New(common.LogLogger(), 0)
 	err = weavenet.ResetIPTables(&bridgeConfig, ips)
 	checkFatal(err)
@@ -317,9 +389,34 @@ func main() {
 
 	Log.Println("Bridge type is", bridgeType)
 
-	config.Password = determinePassword(password)
+	var peerAuth *weave.CertAuthenticator
+	if peerCertConfig.Enabled() {
+		peerAuth, err = weave.NewCertAuthenticator(peerCertConfig)
+		checkFatal(err)
+		if peerAuth.Name() != name {
+			Log.Fatalf("Peer certificate is for %s, but our name is %s", peerAuth.Name(), name)
+		}
+		config.Authenticator = peerAuth
+	}
+	config.Password = determinePassword(password, peerAuth != nil)
+	config.SecondaryPasswords = determineSecondaryPasswords(secondaryPasswords, config.Password)
 
-	overlay, injectorConsumer := createOverlay(bridgeType, bridgeConfig, config.Host, config.Port, bufSzMB, config.Password != nil)
+	if useWireGuard && config.Password == nil {
+		Log.Fatalf("--wireguard requires encryption (--password)")
+	}
+	var vteps []weave.ExternalVTEP
+	for _, s := range vxlanGateways {
+		vtep, err := weave.ParseExternalVTEP(s)
+		checkFatal(err)
+		vteps = append(vteps, vtep)
+	}
+	overlay, injectorConsumer := createOverlay(bridgeType, bridgeConfig, config.Host, config.Port, capture, config.Password != nil, saLifetime, useWireGuard, useTCPOverlay, vteps)
+	overlayPolicy, err := weave.ParseOverlayPolicy(overlayOrder, overlayRules)
+	checkFatal(err)
+	checkFatal(overlay.SetPolicy(overlayPolicy))
+	encryptionPolicy, err := weave.ParseEncryptionPolicy(encryptionRules)
+	checkFatal(err)
+	checkFatal(overlay.SetEncryptionPolicy(encryptionPolicy))
 	networkConfig.InjectorConsumer = injectorConsumer
 
 	if injectorConsumer != nil {
@@ -338,7 +435,7 @@ func main() {
 	config.TrustedSubnets = parseTrustedSubnets(trustedSubnetStr)
 	config.PeerDiscovery = !noDiscovery
 
-	if bridgeConfig.AWSVPC && len(config.Password) > 0 {
+	if bridgeConfig.AWSVPC && config.Password != nil {
 		Log.Fatalf("--awsvpc mode is not compatible with the --password option")
 	}
 	if bridgeConfig.AWSVPC && !ipamConfig.Enabled() {
@@ -355,6 +452,24 @@ func main() {
 	router, err := weave.NewNetworkRouter(config, networkConfig, bridgeConfig, name, nickName, overlay, db)
 	checkFatal(err)
 	Log.Println("Our name is", router.Ourself)
+	if peerAuth != nil {
+		router.WatchRevocations(peerAuth)
+	}
+	if linkRouting {
+		checkFatal(router.EnableLinkRouting())
+	}
+	if multicastSnooping {
+		checkFatal(router.EnableMulticastSnooping())
+	}
+	if broadcastLimits.Enabled() {
+		router.EnableBroadcastLimits(broadcastLimits)
+	}
+	if natTraversal {
+		checkFatal(router.EnableNATTraversal())
+	}
+	if segments != nil {
+		router.EnableSegments(segments)
+	}
 
 	if token != "" {
 		var addresses []string
@@ -404,33 +519,58 @@ func main() {
 	}
 
 	var (
-		allocator     *ipam.Allocator
-		defaultSubnet address.CIDR
+		allocator      *ipam.Allocator
+		defaultSubnet  address.CIDR
+		allocator6     *ipam.Allocator
+		defaultSubnet6 address.CIDR
+		enabled6       = ipamConfig.Enabled6()
 	)
 	if ipamConfig.Enabled() {
-		var t tracker.LocalRangeTracker
+		var (
+			t, t6   tracker.LocalRangeTracker
+			prefix6 *address.Prefix6
+			range6  address.CIDR
+		)
+		if enabled6 {
+			prefix, ipRange, err := ipam.ParseCIDRSubnet6(ipamConfig.IPRange6CIDR)
+			checkFatal(err)
+			prefix6, range6 = &prefix, ipRange
+		}
 		if bridgeConfig.AWSVPC {
-			t, err = tracker.NewAWSVPCTracker(bridgeConfig.WeaveBridgeName)
+			awsvpc, err := tracker.NewAWSVPCTracker(bridgeConfig.WeaveBridgeName)
 			if err != nil {
 				Log.Fatalf("Cannot create AWSVPC LocalRangeTracker: %s", err)
 			}
+			t = awsvpc
+			if prefix6 != nil {
+				t6 = awsvpc.IPv6(*prefix6)
+			}
 		} else if bridgeConfig.NoMasqLocal {
+			// Weave doesn't masquerade IPv6, so there is nothing to
+			// track for the IPv6 allocator
 			t = weavenet.NewNoMasqLocalTracker(ips)
 		}
 		if t != nil {
 			Log.Infof("Using %q LocalRangeTracker", t)
 		}
 
-		preClaims, err := findExistingAddresses(dockerCli, bridgeConfig.WeaveBridgeName)
+		preClaims, preClaims6, err := findExistingAddresses(dockerCli, bridgeConfig.WeaveBridgeName, prefix6)
 		checkFatal(err)
 
 		allocator, defaultSubnet = createAllocator(router, ipamConfig, preClaims, db, t, isKnownPeer)
 		observeContainers(allocator)
+		if prefix6 != nil {
+			allocator6, defaultSubnet6 = createAllocator6(router, ipamConfig, *prefix6, range6, preClaims6, db, t6, isKnownPeer)
+			observeContainers(allocator6)
+		}
 
 		if dockerCli != nil {
 			allContainerIDs, err := dockerCli.RunningContainerIDs()
 			checkFatal(err)
 			allocator.PruneOwned(allContainerIDs)
+			if allocator6 != nil {
+				allocator6.PruneOwned(allContainerIDs)
+			}
 		}
 	}
 
@@ -450,6 +590,21 @@ func main() {
 		defer dnsserver.Stop()
 	}
 
+	if arpSuppression {
+		var owners []weave.AddressOwner
+		if allocator != nil {
+			owners = append(owners, func(ip net.IP) (mesh.PeerName, bool) {
+				return allocator.Owner(address.FromIP4(ip))
+			})
+		}
+		if ns != nil {
+			owners = append(owners, func(ip net.IP) (mesh.PeerName, bool) {
+				return ns.Origin(address.FromIP4(ip))
+			})
+		}
+		router.EnableARPSuppression(owners...)
+	}
+
 	router.Start()
 	if errors := router.InitiateConnections(peers, false); len(errors) > 0 {
 		Log.Fatal(common.ErrorMessages(errors))
@@ -471,13 +626,16 @@ func main() {
 		if allocator != nil {
 			allocator.HandleHTTP(muxRouter, defaultSubnet, dockerCli)
 		}
+		if allocator6 != nil {
+			allocator6.HandleHTTP(muxRouter, defaultSubnet6, dockerCli)
+		}
 		if ns != nil {
 			ns.HandleHTTP(muxRouter, dockerCli)
 			dnsserver.HandleHTTP(muxRouter)
 		}
 		router.HandleHTTP(muxRouter)
-		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, ns, dnsserver, proxy, plugin, &waitReady)
-		HandleHTTPPeer(muxRouter, allocator, discoveryEndpoint, token, name.String())
+		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, allocator6, defaultSubnet6, ns, dnsserver, proxy, plugin, &waitReady)
+		HandleHTTPPeer(muxRouter, allocator, allocator6, discoveryEndpoint, token, name.String())
 		muxRouter.Methods("GET").Path("/metrics").Handler(metricsHandler)
 		if proxy != nil {
 			muxRouter.Methods("GET").Path("/proxyaddrs").HandlerFunc(proxy.StatusHTTP)
@@ -489,7 +647,7 @@ func main() {
 
 	if statusAddr != "" {
 		muxRouter := mux.NewRouter()
-		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, ns, dnsserver, proxy, plugin, &waitReady)
+		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, allocator6, defaultSubnet6, ns, dnsserver, proxy, plugin, &waitReady)
 		muxRouter.Methods("GET").Path("/metrics").Handler(metricsHandler)
 		statusMux := http.NewServeMux()
 		statusMux.Handle("/", muxRouter)
@@ -545,7 +703,7 @@ func options() map[string]string {
 	mflag.Visit(func(f *mflag.Flag) {
 		value := f.Value.String()
 		name := canonicalName(f)
-		if name == "password" || name == "token" {
+		if name == "password" || name == "secondary-password" || name == "token" {
 			value = "<redacted>"
 		}
 		options[name] = value
@@ -603,7 +761,24 @@ func newProxyConfig() *weaveproxy.Config {
 	return &proxyConfig
 }
 
-func createOverlay(bridgeType weavenet.Bridge, config weavenet.BridgeConfig, host string, port int, bufSzMB int, enableEncryption bool) (weave.NetworkOverlay, weave.InjectorConsumer) {
+type captureConfig struct {
+	Mode    string
+	BufSzMB int
+	Fanout  int
+}
+
+func (c captureConfig) create(iface *net.Interface) (weave.InjectorConsumer, error) {
+	bufSz := c.BufSzMB * 1024 * 1024 // bufsz flag is in MB
+	switch c.Mode {
+	case "pcap":
+		return weave.NewPcap(iface, bufSz)
+	case "ring":
+		return weave.NewPacketRing(iface, bufSz, c.Fanout)
+	}
+	return nil, fmt.Errorf("unknown capture mode %q", c.Mode)
+}
+
+func createOverlay(bridgeType weavenet.Bridge, config weavenet.BridgeConfig, host string, port int, capture captureConfig, enableEncryption bool, saLifetime weave.IPSecSALifetime, useWireGuard, useTCPOverlay bool, vteps []weave.ExternalVTEP) (*weave.OverlaySwitch, weave.InjectorConsumer) {
 	overlay := weave.NewOverlaySwitch()
 	var injectorConsumer weave.InjectorConsumer
 	var ignoreSleeve bool
@@ -617,26 +792,60 @@ func createOverlay(bridgeType weavenet.Bridge, config weavenet.BridgeConfig, hos
 		ignoreSleeve = true
 	case bridgeType == nil:
 		injectorConsumer = weave.NullInjectorConsumer{}
+	case bridgeType.IsTC():
+		iface, err := weavenet.EnsureInterface(weavenet.PcapIfName)
+		checkFatal(err)
+		inject, err := weave.NewPcap(iface, 0)
+		checkFatal(err)
+		missIface, err := weavenet.EnsureInterface(weavenet.TCMissIfName)
+		checkFatal(err)
+		miss, err := capture.create(missIface)
+		checkFatal(err)
+		tc, err := weave.NewTCDatapath(inject, miss, port)
+		checkFatal(err)
+		injectorConsumer = tc.InjectorConsumer()
+		// The tc datapath speaks the fast datapath's protocol
+		overlay.Add("fastdp", tc.Overlay())
 	case bridgeType.IsFastdp():
 		iface, err := weavenet.EnsureInterface(config.DatapathName)
 		checkFatal(err)
-		fastdp, err := weave.NewFastDatapath(iface, port, enableEncryption)
+		fastdp, err := weave.NewFastDatapath(iface, port, enableEncryption, saLifetime)
 		checkFatal(err)
 		injectorConsumer = fastdp.InjectorConsumer()
 		overlay.Add("fastdp", fastdp.Overlay())
+		for _, vtep := range vteps {
+			checkFatal(fastdp.AddExternalVTEP(vtep))
+		}
 	case !bridgeType.IsFastdp():
 		iface, err := weavenet.EnsureInterface(weavenet.PcapIfName)
 		checkFatal(err)
-		injectorConsumer, err = weave.NewPcap(iface, bufSzMB*1024*1024) // bufsz flag is in MB
+		injectorConsumer, err = capture.create(iface)
 		checkFatal(err)
 	}
 
+	if len(vteps) > 0 && (bridgeType == nil || !bridgeType.IsFastdp()) {
+		Log.Fatalf("--vxlan-gateway requires fast datapath")
+	}
+
+	if useWireGuard && !ignoreSleeve {
+		// WireGuard listens on the port after the vxlan one
+		wireGuard, err := weave.NewWireGuardOverlay(port+2, port)
+		checkFatal(err)
+		overlay.Add("wireguard", wireGuard)
+	}
+
 	if !ignoreSleeve {
 		sleeve := weave.NewSleeveOverlay(host, port)
 		overlay.Add("sleeve", sleeve)
 		overlay.SetCompatOverlay(sleeve)
 	}
 
+	if useTCPOverlay && !ignoreSleeve {
+		// Last, so least preferred: for peers which can only reach
+		// each other over TCP
+		overlay.Add("tcp", weave.NewTCPOverlay())
+	}
+
 	return overlay, injectorConsumer
 }
 
@@ -666,15 +875,52 @@ func createAllocator(router *weave.NetworkRouter, config ipamConfig, preClaims [
 		Tracker:     track,
 	}
 
+	return startAllocator(router, c, "IPallocation"), defaultSubnet
+}
+
+// The IPv6 allocator is a separate instance with its own gossip
+// channel and persisted state, which manages the low 32 bits of
+// addresses within a fixed /96 prefix: all of a range of /97 or
+// longer, or the first /97 of a shorter one.
+func createAllocator6(router *weave.NetworkRouter, config ipamConfig, prefix address.Prefix6, ipRange address.CIDR, preClaims []ipam.PreClaim, database db.DB, track tracker.LocalRangeTracker, isKnownPeer func(mesh.PeerName) bool) (*ipam.Allocator, address.CIDR) {
+	var err error
+	defaultSubnet := ipRange
+	if config.IPSubnet6CIDR != "" {
+		defaultSubnet, err = prefix.ParseCIDR(config.IPSubnet6CIDR)
+		checkFatal(err)
+		if !ipRange.Range().Overlaps(defaultSubnet.Range()) {
+			Log.Fatalf("IPv6 address allocation default subnet %s does not overlap with allocation range %s", config.IPSubnet6CIDR, config.IPRange6CIDR)
+		}
+	}
+
+	c := ipam.Config{
+		OurName:     router.Ourself.Peer.Name,
+		OurUID:      router.Ourself.Peer.UID,
+		OurNickname: router.Ourself.Peer.NickName,
+		Seed:        config.SeedPeerNames,
+		Universe:    ipRange,
+		Prefix6:     &prefix,
+		PreClaims:   preClaims,
+		IsObserver:  config.Observer,
+		Quorum:      func() uint { return determineQuorum(config.PeerCount, router) },
+		Db:          db.NewPrefixedDB(database, "ipv6:"),
+		IsKnownPeer: isKnownPeer,
+		Tracker:     track,
+	}
+
+	return startAllocator(router, c, "IPallocation6"), defaultSubnet
+}
+
+func startAllocator(router *weave.NetworkRouter, c ipam.Config, channelName string) *ipam.Allocator {
 	allocator := ipam.NewAllocator(c)
 
-	gossip, err := router.NewGossip("IPallocation", allocator)
+	gossip, err := router.NewGossip(channelName, allocator)
 	checkFatal(err)
 	allocator.SetInterfaces(gossip)
 	allocator.Start()
 	router.Peers.OnGC(func(peer *mesh.Peer) { allocator.PeerGone(peer.Name) })
 
-	return allocator, defaultSubnet
+	return allocator
 }
 
 func createDNSServer(config dnsConfig, router *mesh.Router, isKnownPeer func(mesh.PeerName) bool) (*nameserver.Nameserver, *nameserver.DNSServer) {
@@ -714,10 +960,15 @@ func determineQuorum(initPeerCountFlag int, router *weave.NetworkRouter) uint {
 	return quorum
 }
 
-func determinePassword(password string) []byte {
+func determinePassword(password string, peerAuth bool) []byte {
 	if password == "" {
 		password = os.Getenv("WEAVE_PASSWORD")
 	}
+	if peerAuth {
+		// Peer authentication needs encryption, but not a shared secret
+		Log.Println("Communication between peers via untrusted networks is encrypted; peers are authenticated by certificate.")
+		return []byte(password)
+	}
 	if password == "" {
 		Log.Println("Communication between peers is unencrypted.")
 		return nil
@@ -726,6 +977,20 @@ func determinePassword(password string) []byte {
 	return []byte(password)
 }
 
+func determineSecondaryPasswords(passwords []string, primary []byte) [][]byte {
+	if len(passwords) == 0 {
+		return nil
+	}
+	if primary == nil {
+		Log.Fatalf("--secondary-password requires encryption (--password)")
+	}
+	secondaries := make([][]byte, len(passwords))
+	for i, password := range passwords {
+		secondaries[i] = []byte(password)
+	}
+	return secondaries
+}
+
 func peerName(routerName, bridgeName, dbPrefix, hostRoot string) mesh.PeerName {
 	if routerName == "" {
 		iface, err := net.InterfaceByName(bridgeName)
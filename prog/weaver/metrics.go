@@ -40,6 +40,15 @@ func intGauge(desc *prometheus.Desc, val int, labels ...string) prometheus.Metri
 func uint64Counter(desc *prometheus.Desc, val uint64, labels ...string) prometheus.Metric {
 	return prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(val), labels...)
 }
+func histogram(desc *prometheus.Desc, h weave.Histogram, labels ...string) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(weave.HeartbeatHistogramBuckets))
+	var cumulative uint64
+	for i, bound := range weave.HeartbeatHistogramBuckets {
+		cumulative += h.Counts[i]
+		buckets[bound] = cumulative
+	}
+	return prometheus.MustNewConstHistogram(desc, h.Count, h.Sum, buckets, labels...)
+}
 
 var metrics = []metric{
 	{desc("weave_connections", "Number of peer-to-peer connections.", "state", "type", "encryption"),
@@ -72,6 +81,46 @@ var metrics = []metric{
 		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
 			ch <- uint64Counter(desc, uint64(s.Router.TerminationCount))
 		}},
+	{desc("weave_peer_bytes_total", "Number of bytes sent to and received from each connected peer.", "peer", "overlay", "direction"),
+		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
+			for _, t := range s.Router.Traffic {
+				ch <- uint64Counter(desc, t.TxBytes, t.Peer, t.Overlay, "tx")
+				ch <- uint64Counter(desc, t.RxBytes, t.Peer, t.Overlay, "rx")
+			}
+		}},
+	{desc("weave_peer_packets_total", "Number of packets sent to and received from each connected peer.", "peer", "overlay", "direction"),
+		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
+			for _, t := range s.Router.Traffic {
+				ch <- uint64Counter(desc, t.TxPackets, t.Peer, t.Overlay, "tx")
+				ch <- uint64Counter(desc, t.RxPackets, t.Peer, t.Overlay, "rx")
+			}
+		}},
+	{desc("weave_peer_rtt_seconds", "Round-trip time of heartbeats to each connected peer.", "peer", "overlay"),
+		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
+			for _, h := range s.Router.Heartbeats {
+				ch <- histogram(desc, h.RTTHistogram, h.Peer, h.Overlay)
+			}
+		}},
+	{desc("weave_peer_jitter_seconds", "Variation between successive heartbeat round-trip times to each connected peer.", "peer", "overlay"),
+		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
+			for _, h := range s.Router.Heartbeats {
+				ch <- histogram(desc, h.JitterHistogram, h.Peer, h.Overlay)
+			}
+		}},
+	{desc("weave_peer_missed_heartbeats_total", "Number of heartbeats to each connected peer which were not echoed back.", "peer", "overlay"),
+		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
+			for _, h := range s.Router.Heartbeats {
+				ch <- uint64Counter(desc, h.Missed, h.Peer, h.Overlay)
+			}
+		}},
+	{desc("weave_broadcast_drops_total", "Number of broadcast frames dropped by the rate limits, by the peer they originated at.", "peer", "limit"),
+		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
+			if s.Router.Broadcasts != nil {
+				for _, d := range s.Router.Broadcasts.Drops {
+					ch <- uint64Counter(desc, d.Dropped, d.Peer, d.Limit)
+				}
+			}
+		}},
 	{desc("weave_ips", "Number of IP addresses.", "state"),
 		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
 			if s.IPAM != nil {
@@ -134,8 +183,11 @@ var metrics = []metric{
 func fastDPMetrics(s WeaveStatus) *weave.FastDPMetrics {
 	if diagMap, ok := s.Router.OverlayDiagnostics.(map[string]interface{}); ok {
 		if diag, ok := diagMap["fastdp"]; ok {
-			if fastDPStats, ok := diag.(weave.FastDPStatus); ok {
-				return fastDPStats.Metrics().(*weave.FastDPMetrics)
+			switch stats := diag.(type) {
+			case weave.FastDPStatus:
+				return stats.Metrics().(*weave.FastDPMetrics)
+			case weave.TCStatus:
+				return stats.Metrics().(*weave.FastDPMetrics)
 			}
 		}
 	}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	weave "github.com/weaveworks/weave/router"
+)
+
+// The values of the named metric for the status, keyed by their
+// label values
+func collectMetric(t *testing.T, name string, s WeaveStatus) map[string]float64 {
+	for _, m := range metrics {
+		if !strings.Contains(m.Desc.String(), `"`+name+`"`) {
+			continue
+		}
+		ch := make(chan prometheus.Metric, 100)
+		m.Collect(s, m.Desc, ch)
+		close(ch)
+		values := make(map[string]float64)
+		for metric := range ch {
+			var pb dto.Metric
+			require.NoError(t, metric.Write(&pb))
+			labels := make(map[string]string)
+			for _, pair := range pb.Label {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			values[labels["peer"]+" "+labels["overlay"]+" "+labels["direction"]] = pb.Counter.GetValue()
+		}
+		return values
+	}
+	require.FailNow(t, "no such metric", name)
+	return nil
+}
+
+func TestPeerTrafficMetrics(t *testing.T) {
+	status := WeaveStatus{Router: &weave.NetworkRouterStatus{Traffic: []weave.PeerTrafficStatus{
+		{Peer: "00:00:00:00:00:01", Overlay: "fastdp", TrafficStats: weave.TrafficStats{TxBytes: 100, TxPackets: 1, RxBytes: 300, RxPackets: 2}},
+		{Peer: "00:00:00:00:00:01", Overlay: "sleeve", TrafficStats: weave.TrafficStats{TxBytes: 50, TxPackets: 1}},
+		{Peer: "00:00:00:00:00:02", Overlay: "fastdp", TrafficStats: weave.TrafficStats{RxBytes: 70, RxPackets: 1}},
+	}}}
+
+	require.Equal(t, map[string]float64{
+		"00:00:00:00:00:01 fastdp tx": 100,
+		"00:00:00:00:00:01 fastdp rx": 300,
+		"00:00:00:00:00:01 sleeve tx": 50,
+		"00:00:00:00:00:01 sleeve rx": 0,
+		"00:00:00:00:00:02 fastdp tx": 0,
+		"00:00:00:00:00:02 fastdp rx": 70,
+	}, collectMetric(t, "weave_peer_bytes_total", status))
+
+	require.Equal(t, map[string]float64{
+		"00:00:00:00:00:01 fastdp tx": 1,
+		"00:00:00:00:00:01 fastdp rx": 2,
+		"00:00:00:00:00:01 sleeve tx": 1,
+		"00:00:00:00:00:01 sleeve rx": 0,
+		"00:00:00:00:00:02 fastdp tx": 0,
+		"00:00:00:00:00:02 fastdp rx": 1,
+	}, collectMetric(t, "weave_peer_packets_total", status))
+}
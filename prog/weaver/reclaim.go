@@ -21,19 +21,35 @@ func a(cidr *net.IPNet) address.CIDR {
 	return address.CIDR{Addr: address.FromIP4(cidr.IP), PrefixLen: prefixLength}
 }
 
+// The IPv6 address in the prefix, or false if it is outside it
+func a6(prefix6 *address.Prefix6, cidr *net.IPNet) (address.CIDR, bool) {
+	if prefix6 == nil {
+		return address.CIDR{}, false
+	}
+	c, err := prefix6.ParseCIDR(cidr.String())
+	return c, err == nil
+}
+
 // Get all the existing Weave IPs at startup, so we can stop IPAM
-// giving out any as duplicates
-func findExistingAddresses(dockerCli *weavedocker.Client, bridgeName string) (addrs []ipam.PreClaim, err error) {
+// giving out any as duplicates.  IPv6 addresses are returned in
+// addrs6, if there is an IPv6 range.
+func findExistingAddresses(dockerCli *weavedocker.Client, bridgeName string, prefix6 *address.Prefix6) (addrs, addrs6 []ipam.PreClaim, err error) {
 	Log.Infof("Checking for pre-existing addresses on %s bridge", bridgeName)
 	// First get the address for the bridge
 	bridgeNetDev, err := weavenet.GetBridgeNetDev(bridgeName)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for _, cidr := range bridgeNetDev.CIDRs {
 		Log.Infof("%s bridge has address %v", bridgeName, cidr)
 		addrs = append(addrs, ipam.PreClaim{Ident: "weave:expose", Cidr: a(cidr)})
 	}
+	for _, cidr := range bridgeNetDev.CIDRs6 {
+		if c, ok := a6(prefix6, cidr); ok {
+			Log.Infof("%s bridge has address %v", bridgeName, cidr)
+			addrs6 = append(addrs6, ipam.PreClaim{Ident: "weave:expose", Cidr: c})
+		}
+	}
 
 	add := func(cid string, isContainer bool, netDevs []weavenet.Dev) {
 		for _, netDev := range netDevs {
@@ -41,13 +57,19 @@ func findExistingAddresses(dockerCli *weavedocker.Client, bridgeName string) (ad
 				Log.Infof("Found address %v for ID %s", cidr, cid)
 				addrs = append(addrs, ipam.PreClaim{Ident: cid, IsContainer: isContainer, Cidr: a(cidr)})
 			}
+			for _, cidr := range netDev.CIDRs6 {
+				if c, ok := a6(prefix6, cidr); ok {
+					Log.Infof("Found address %v for ID %s", cidr, cid)
+					addrs6 = append(addrs6, ipam.PreClaim{Ident: cid, IsContainer: isContainer, Cidr: c})
+				}
+			}
 		}
 	}
 
 	// Then find all veths connected to the bridge
 	peerIDs, err := weavenet.ConnectedToBridgeVethPeerIds(bridgeName)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Now iterate over all containers to see if they have a network
@@ -55,7 +77,7 @@ func findExistingAddresses(dockerCli *weavedocker.Client, bridgeName string) (ad
 	if dockerCli != nil {
 		containerIDs, err := dockerCli.RunningContainerIDs()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		for _, cid := range containerIDs {
@@ -64,12 +86,12 @@ func findExistingAddresses(dockerCli *weavedocker.Client, bridgeName string) (ad
 				if _, ok := err.(*docker.NoSuchContainer); ok {
 					continue
 				}
-				return nil, err
+				return nil, nil, err
 			}
 			if container.State.Pid != 0 {
 				netDevs, err := weavenet.GetNetDevsByVethPeerIds(container.State.Pid, peerIDs)
 				if err != nil {
-					return nil, err
+					return nil, nil, err
 				}
 				add(cid, true, netDevs)
 			}
@@ -78,17 +100,17 @@ func findExistingAddresses(dockerCli *weavedocker.Client, bridgeName string) (ad
 		// If we don't have a Docker connection, iterate over all processes
 		pids, err := common.AllPids("/proc")
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		for _, pid := range pids {
 			netDevs, err := weavenet.GetNetDevsByVethPeerIds(pid, peerIDs)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			add(api.NoContainerID, false, netDevs)
 		}
 	}
-	return addrs, nil
+	return addrs, addrs6, nil
 }
 
 func populateDNS(ns *nameserver.Nameserver, dockerCli *weavedocker.Client, ourName mesh.PeerName, bridgeName string) (addrs []ipam.PreClaim, err error) {
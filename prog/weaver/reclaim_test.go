@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+func TestPreClaim6(t *testing.T) {
+	ipnet := func(s string) *net.IPNet {
+		ip, ipnet, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		ipnet.IP = ip
+		return ipnet
+	}
+
+	_, ok := a6(nil, ipnet("fd00:1:2:3::5/64"))
+	require.False(t, ok, "no IPv6 range")
+
+	prefix, _, err := address.ParseCIDR6("fd00:1:2:3::/64")
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		cidr string
+		ok   bool
+	}{
+		{"fd00:1:2:3::5/64", true},
+		{"fd00:1:2:3::a00:0/120", true},
+		{"fd00:1:2:3:0:1:0:5/64", false},
+		{"fd00:1:2:4::5/64", false},
+		{"fd00:1:2:3::5/96", false},
+	} {
+		c, ok := a6(&prefix, ipnet(tc.cidr))
+		require.Equal(t, tc.ok, ok, tc.cidr)
+		if ok {
+			require.Equal(t, tc.cidr, prefix.FormatCIDR(c))
+		}
+	}
+}
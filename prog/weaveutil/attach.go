@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -15,12 +16,13 @@ import (
 
 func attach(args []string) error {
 	if len(args) < 3 {
-		cmdUsage("attach-container", "[--no-multicast-route] [--keep-tx-on] [--hairpin-mode=true|false] <container-id> <bridge-name> <cidr>...")
+		cmdUsage("attach-container", "[--no-multicast-route] [--keep-tx-on] [--hairpin-mode=true|false] [--segment=<id>] <container-id> <bridge-name> <cidr>...")
 	}
 
 	keepTXOn := false
 	withMulticastRoute := true
 	hairpinMode := true
+	var segment uint16
 	for i := 0; i < len(args); {
 		switch args[i] {
 		case "--no-multicast-route":
@@ -33,7 +35,16 @@ func attach(args []string) error {
 			hairpinMode = false
 			args = append(args[:i], args[i+1:]...)
 		default:
-			i++
+			if !strings.HasPrefix(args[i], "--segment=") {
+				i++
+				continue
+			}
+			id, err := strconv.ParseUint(strings.TrimPrefix(args[i], "--segment="), 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid segment %q", args[i])
+			}
+			segment = uint16(id)
+			args = append(args[:i], args[i+1:]...)
 		}
 	}
 
@@ -56,7 +67,7 @@ func attach(args []string) error {
 		return err
 	}
 
-	err = weavenet.AttachContainer(weavenet.NSPathByPid(pid), fmt.Sprint(pid), weavenet.VethName, args[1], 0, withMulticastRoute, cidrs, keepTXOn, hairpinMode)
+	err = weavenet.AttachContainer(weavenet.NSPathByPid(pid), fmt.Sprint(pid), weavenet.VethName, args[1], 0, withMulticastRoute, cidrs, keepTXOn, hairpinMode, segment)
 	// If we detected an error but the container has died, tell the user that instead.
 	if err != nil && !processExists(pid) {
 		err = fmt.Errorf("Container %s died", args[0])
@@ -503,9 +503,18 @@ func (proxy *Proxy) attach(containerID string) error {
 		}
 	}
 
+	var addrs []net.IP
+	for _, ip := range ips {
+		addrs = append(addrs, ip.IP)
+	}
+	segment, err := proxy.weave.Segment(addrs)
+	if err != nil {
+		return err
+	}
+
 	pid := container.State.Pid
 	// Passing 0 for mtu means it will be taken from the bridge
-	err = weavenet.AttachContainer(weavenet.NSPathByPid(pid), fmt.Sprint(pid), weavenet.VethName, weavenet.WeaveBridgeName, 0, !proxy.NoMulticastRoute, ips, proxy.KeepTXOn, true)
+	err = weavenet.AttachContainer(weavenet.NSPathByPid(pid), fmt.Sprint(pid), weavenet.VethName, weavenet.WeaveBridgeName, 0, !proxy.NoMulticastRoute, ips, proxy.KeepTXOn, true, segment)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,230 @@
+package router
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/weaveworks/mesh"
+)
+
+// ARP suppression answers ARP requests from local containers for the
+// addresses of remote containers, instead of broadcasting them to
+// the whole mesh.  The IP to MAC bindings come from the ARP packets
+// we see, and the MAC cache says which peer each MAC is at.  A
+// request is only answered if IPAM or DNS agree that the address
+// belongs to a container at that peer, so that stale bindings are
+// not used; requests for any other address are broadcast as usual.
+
+var broadcastMAC = MAC{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// AddressOwner says which peer a container's IP address belongs to,
+// if it is known.
+type AddressOwner func(ip net.IP) (mesh.PeerName, bool)
+
+type ARPSuppression struct {
+	answered uint64 // first, for 64-bit alignment
+	flooded  uint64
+
+	router *NetworkRouter
+	owners []AddressOwner
+
+	sync.Mutex
+	bindings map[[4]byte]MAC
+}
+
+type ARPSuppressionStatus struct {
+	Bindings int
+	Answered uint64 // requests answered locally
+	Flooded  uint64 // requests broadcast because the address was unknown
+}
+
+// EnableARPSuppression makes the router answer ARP requests for remote
+// containers' addresses itself.  It must be called before the router
+// is started.
+func (router *NetworkRouter) EnableARPSuppression(owners ...AddressOwner) {
+	arp := &ARPSuppression{
+		router:   router,
+		owners:   owners,
+		bindings: make(map[[4]byte]MAC),
+	}
+	router.arp = arp
+	go arp.run()
+}
+
+// Periodically forget the bindings for MACs which have expired from
+// the MAC cache.
+func (arp *ARPSuppression) run() {
+	for range time.Tick(macMaxAge) {
+		arp.Lock()
+		for ip, mac := range arp.bindings {
+			if arp.router.Macs.Lookup(net.HardwareAddr(mac[:]), arp.router.segmentOf(net.IP(ip[:]))) == nil {
+				delete(arp.bindings, ip)
+			}
+		}
+		arp.Unlock()
+	}
+}
+
+// arpFlowOp learns the bindings in ARP packets, and answers requests
+// from local containers where it can, in which case the request is
+// not passed on to the FlowOp it wraps.  Other broadcasts are just
+// passed on, so it is an ethertypeFlowOp.
+type arpFlowOp struct {
+	NonDiscardingFlowOp
+	arp     *ARPSuppression
+	local   bool // captured from the local bridge, rather than forwarded
+	segment Segment
+	fop     FlowOp
+}
+
+func (op arpFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	if op.arp.inspect(dec, op.local, op.segment) {
+		return
+	}
+	if op.fop != nil {
+		op.fop.Process(frame, dec, broadcast)
+	}
+}
+
+func (op arpFlowOp) inspectedEthertype() layers.EthernetType {
+	return layers.EthernetTypeARP
+}
+
+func (op arpFlowOp) wrappedFlowOp() FlowOp {
+	return op.fop
+}
+
+// Wrap the FlowOp for a packet in an arpFlowOp, if it is broadcast
+// and so might be an ARP request.
+func (arp *ARPSuppression) inspectPacket(key PacketKey, local bool, fop FlowOp) FlowOp {
+	if key.DstMAC != broadcastMAC {
+		return fop
+	}
+	return arpFlowOp{arp: arp, local: local, segment: key.Segment, fop: fop}
+}
+
+// Learn from an ARP packet, and answer it if it is a request from a
+// local container which we can answer.  Returns whether it was
+// answered.
+func (arp *ARPSuppression) inspect(dec *EthernetDecoder, local bool, segment Segment) bool {
+	if dec.etherType() != layers.EthernetTypeARP {
+		return false
+	}
+	var packet layers.ARP
+	if err := packet.DecodeFromBytes(dec.linkPayload(), gopacket.NilDecodeFeedback); err != nil {
+		return false
+	}
+	if packet.AddrType != layers.LinkTypeEthernet || packet.Protocol != layers.EthernetTypeIPv4 ||
+		len(packet.SourceHwAddress) != 6 || len(packet.SourceProtAddress) != 4 || len(packet.DstProtAddress) != 4 {
+		return false
+	}
+
+	var senderIP, targetIP [4]byte
+	var senderMAC MAC
+	copy(senderIP[:], packet.SourceProtAddress)
+	copy(targetIP[:], packet.DstProtAddress)
+	copy(senderMAC[:], packet.SourceHwAddress)
+	// A container can only bind addresses in its own segment
+	if senderIP != [4]byte{} && arp.router.segmentOf(net.IP(senderIP[:])) == segment {
+		arp.Lock()
+		arp.bindings[senderIP] = senderMAC
+		arp.Unlock()
+	}
+
+	// Gratuitous ARPs and address probes are for everyone to see
+	if !local || packet.Operation != layers.ARPRequest || senderIP == [4]byte{} || senderIP == targetIP {
+		return false
+	}
+	targetMAC, found := arp.resolve(targetIP, segment)
+	if !found {
+		atomic.AddUint64(&arp.flooded, 1)
+		return false
+	}
+	if err := arp.reply(senderMAC, senderIP, targetMAC, targetIP, segment); err != nil {
+		log.Warningln("Unable to answer ARP request:", err)
+		return false
+	}
+	atomic.AddUint64(&arp.answered, 1)
+	return true
+}
+
+// The MAC of a remote container's IP address in the segment, if we
+// know it and IPAM or DNS agree that the address is at the peer the
+// MAC is.
+func (arp *ARPSuppression) resolve(ip [4]byte, segment Segment) (MAC, bool) {
+	arp.Lock()
+	mac, found := arp.bindings[ip]
+	arp.Unlock()
+	if !found {
+		return mac, false
+	}
+	peer := arp.router.Macs.Lookup(net.HardwareAddr(mac[:]), segment)
+	if peer == nil || peer == arp.router.Ourself.Peer {
+		return mac, false
+	}
+	for _, owner := range arp.owners {
+		if name, found := owner(net.IP(ip[:])); found && name == peer.Name {
+			return mac, true
+		}
+	}
+	return mac, false
+}
+
+// Inject an ARP reply to a local container, tagged with its segment
+func (arp *ARPSuppression) reply(dstMAC MAC, dstIP [4]byte, srcMAC MAC, srcIP [4]byte, segment Segment) error {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{
+			SrcMAC:       srcMAC[:],
+			DstMAC:       dstMAC[:],
+			EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPReply,
+			SourceHwAddress:   srcMAC[:],
+			SourceProtAddress: srcIP[:],
+			DstHwAddress:      dstMAC[:],
+			DstProtAddress:    dstIP[:]})
+	if err != nil {
+		return err
+	}
+
+	frame := buf.Bytes()
+	if segment != 0 {
+		frame = pushSegmentTag(frame, segment)
+	}
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(frame)
+	if fop := arp.router.InjectorConsumer.InjectPacket(dec.PacketKey()); fop != nil {
+		fop.Process(frame, dec, false)
+	}
+	return nil
+}
+
+func (arp *ARPSuppression) Status() *ARPSuppressionStatus {
+	arp.Lock()
+	bindings := len(arp.bindings)
+	arp.Unlock()
+	return &ARPSuppressionStatus{
+		Bindings: bindings,
+		Answered: atomic.LoadUint64(&arp.answered),
+		Flooded:  atomic.LoadUint64(&arp.flooded),
+	}
+}
+
+// ARPSuppression describes ARP suppression, or returns nil if it is
+// not enabled.
+func (router *NetworkRouter) ARPSuppression() *ARPSuppressionStatus {
+	if router.arp == nil {
+		return nil
+	}
+	return router.arp.Status()
+}
@@ -0,0 +1,88 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+)
+
+type countingFlowOp struct {
+	NonDiscardingFlowOp
+	processed int
+}
+
+func (fop *countingFlowOp) Process([]byte, *EthernetDecoder, bool) {
+	fop.processed++
+}
+
+func testBroadcastFrame(t *testing.T, srcMAC MAC, payload ...gopacket.SerializableLayer) []byte {
+	eth := &layers.Ethernet{SrcMAC: srcMAC[:], DstMAC: broadcastMAC[:]}
+	switch layer := payload[0].(type) {
+	case *layers.ARP:
+		eth.EthernetType = layers.EthernetTypeARP
+	case *layers.IPv4:
+		eth.EthernetType = layers.EthernetTypeIPv4
+	default:
+		t.Fatalf("unexpected layer %T", layer)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, append([]gopacket.SerializableLayer{eth}, payload...)...))
+	return buf.Bytes()
+}
+
+// Only ARP frames are kept from the fast datapath: other broadcasts
+// from the same MAC may have flows, which match on their ethertype.
+func TestARPFlowOpEthertype(t *testing.T) {
+	arp := &ARPSuppression{router: &NetworkRouter{}, bindings: make(map[[4]byte]MAC)}
+	srcMAC := MAC{0x02, 0, 0, 0, 0, 1}
+
+	// Frames not to the broadcast MAC are left alone
+	fop := &countingFlowOp{}
+	require.Equal(t, FlowOp(fop), arp.inspectPacket(PacketKey{SrcMAC: srcMAC, DstMAC: MAC{0x02, 0, 0, 0, 0, 2}}, false, fop))
+
+	wrapped := arp.inspectPacket(PacketKey{SrcMAC: srcMAC, DstMAC: broadcastMAC}, false, fop)
+	efop, ok := wrapped.(ethertypeFlowOp)
+	require.True(t, ok)
+	require.Equal(t, layers.EthernetTypeARP, efop.inspectedEthertype())
+	require.Equal(t, FlowOp(fop), efop.wrappedFlowOp())
+
+	arpFrame := testBroadcastFrame(t, srcMAC, &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   srcMAC[:],
+		SourceProtAddress: []byte{10, 0, 0, 1},
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    []byte{10, 0, 0, 2},
+	})
+	ipFrame := testBroadcastFrame(t, srcMAC, &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    []byte{10, 0, 0, 1},
+		DstIP:    []byte{10, 255, 255, 255},
+	})
+
+	// The fast datapath only creates flows for the IP broadcast
+	require.Equal(t, layers.EthernetTypeARP, frameEthertype(arpFrame))
+	require.False(t, ethertypeFlowKeyUsable(frameEthertype(arpFrame), efop.inspectedEthertype()))
+	require.Equal(t, layers.EthernetTypeIPv4, frameEthertype(ipFrame))
+	require.True(t, ethertypeFlowKeyUsable(frameEthertype(ipFrame), efop.inspectedEthertype()))
+	require.False(t, ethertypeFlowKeyUsable(layers.EthernetTypeDot1Q, efop.inspectedEthertype()))
+	require.Equal(t, layers.EthernetType(0), frameEthertype(arpFrame[:13]))
+
+	// Both are passed on when forwarded, and the ARP binding is
+	// learnt
+	for _, frame := range [][]byte{arpFrame, ipFrame} {
+		dec := NewEthernetDecoder()
+		dec.DecodeLayers(frame)
+		wrapped.Process(frame, dec, true)
+	}
+	require.Equal(t, 2, fop.processed)
+	require.Equal(t, map[[4]byte]MAC{{10, 0, 0, 1}: srcMAC}, arp.bindings)
+}
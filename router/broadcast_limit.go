@@ -0,0 +1,207 @@
+package router
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Broadcast rate limits stop one misbehaving container, or peer, from
+// flooding the whole mesh with broadcasts and frames to unknown MACs.
+// Each source MAC, and each peer the frames originate at, has a token
+// bucket which fills at the limit rate and holds a second's worth of
+// frames; frames arriving when it is empty are dropped.
+//
+// Counting frames needs them to pass through the router, so while
+// limits are in force the fast datapath does not create flows for
+// broadcasts.
+
+const broadcastBucketIdle = 10 * time.Second
+
+type BroadcastLimits struct {
+	PerMAC  int // frames per second from each source MAC; 0 for no limit
+	PerPeer int // frames per second originating at each peer; 0 for no limit
+}
+
+func (limits BroadcastLimits) Enabled() bool {
+	return limits.PerMAC > 0 || limits.PerPeer > 0
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: float64(rate), last: now}
+}
+
+func (bucket *tokenBucket) take(rate int, now time.Time) bool {
+	bucket.tokens += now.Sub(bucket.last).Seconds() * float64(rate)
+	if bucket.tokens > float64(rate) {
+		bucket.tokens = float64(rate)
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+type broadcastLimiter struct {
+	limits BroadcastLimits
+	now    func() time.Time
+
+	sync.Mutex
+	macs      map[MAC]*tokenBucket
+	peers     map[mesh.PeerName]*tokenBucket
+	lastPrune time.Time
+	// frames dropped by each limit, by the peer they originated at
+	macLimitDrops  map[mesh.PeerName]uint64
+	peerLimitDrops map[mesh.PeerName]uint64
+}
+
+func newBroadcastLimiter(limits BroadcastLimits, now func() time.Time) *broadcastLimiter {
+	return &broadcastLimiter{
+		limits:         limits,
+		now:            now,
+		macs:           make(map[MAC]*tokenBucket),
+		peers:          make(map[mesh.PeerName]*tokenBucket),
+		lastPrune:      now(),
+		macLimitDrops:  make(map[mesh.PeerName]uint64),
+		peerLimitDrops: make(map[mesh.PeerName]uint64),
+	}
+}
+
+// EnableBroadcastLimits limits the rate of broadcasts the router
+// relays and delivers.  It must be called before the router is
+// started.
+func (router *NetworkRouter) EnableBroadcastLimits(limits BroadcastLimits) {
+	bl := newBroadcastLimiter(limits, time.Now)
+	router.Peers.OnGC(func(peer *mesh.Peer) { bl.forget(peer.Name) })
+	router.broadcastLimiter = bl
+}
+
+// Is another broadcast frame from the MAC, originating at the peer,
+// within the limits?
+func (bl *broadcastLimiter) allow(srcMAC MAC, srcPeer *mesh.Peer) bool {
+	now := bl.now()
+	bl.Lock()
+	defer bl.Unlock()
+
+	// Forget the buckets which have been idle long enough to be
+	// full, so that frames from many MACs cannot exhaust our
+	// memory.
+	if now.Sub(bl.lastPrune) > broadcastBucketIdle {
+		for mac, bucket := range bl.macs {
+			if now.Sub(bucket.last) > broadcastBucketIdle {
+				delete(bl.macs, mac)
+			}
+		}
+		bl.lastPrune = now
+	}
+
+	if rate := bl.limits.PerMAC; rate > 0 {
+		bucket := bl.macs[srcMAC]
+		if bucket == nil {
+			bucket = newTokenBucket(rate, now)
+			bl.macs[srcMAC] = bucket
+		}
+		if !bucket.take(rate, now) {
+			bl.macLimitDrops[srcPeer.Name]++
+			return false
+		}
+	}
+	if rate := bl.limits.PerPeer; rate > 0 {
+		bucket := bl.peers[srcPeer.Name]
+		if bucket == nil {
+			bucket = newTokenBucket(rate, now)
+			bl.peers[srcPeer.Name] = bucket
+		}
+		if !bucket.take(rate, now) {
+			bl.peerLimitDrops[srcPeer.Name]++
+			return false
+		}
+	}
+	return true
+}
+
+// Apply the limits to a frame being broadcast, returning fop if it is
+// allowed, and otherwise a FlowOp which drops it.  Either way, no
+// flow is created in the fast datapath, so that the next frame is
+// counted too.
+func (bl *broadcastLimiter) limit(key PacketKey, srcPeer *mesh.Peer, fop FlowOp) FlowOp {
+	if !bl.allow(key.SrcMAC, srcPeer) {
+		return vetoFlowCreationFlowOp{}
+	}
+	mfop := NewMultiFlowOp(false, vetoFlowCreationFlowOp{})
+	if fop != nil {
+		mfop.Add(fop)
+	}
+	return mfop
+}
+
+func (bl *broadcastLimiter) forget(name mesh.PeerName) {
+	bl.Lock()
+	defer bl.Unlock()
+	delete(bl.peers, name)
+	delete(bl.macLimitDrops, name)
+	delete(bl.peerLimitDrops, name)
+}
+
+// Status
+
+type BroadcastLimitStatus struct {
+	PerMAC  int
+	PerPeer int
+	Drops   []BroadcastDropStatus
+}
+
+type BroadcastDropStatus struct {
+	Peer     string // where the dropped frames originated
+	NickName string
+	Limit    string // "mac" or "peer"
+	Dropped  uint64
+}
+
+// BroadcastLimits describes the broadcast limits and what they have
+// dropped, or returns nil if there are none.
+func (router *NetworkRouter) BroadcastLimits() *BroadcastLimitStatus {
+	bl := router.broadcastLimiter
+	if bl == nil {
+		return nil
+	}
+	status := &BroadcastLimitStatus{PerMAC: bl.limits.PerMAC, PerPeer: bl.limits.PerPeer}
+	drop := func(name mesh.PeerName, limit string, dropped uint64) {
+		s := BroadcastDropStatus{Peer: name.String(), Limit: limit, Dropped: dropped}
+		if peer := router.Peers.Fetch(name); peer != nil {
+			s.NickName = peer.NickName
+		}
+		status.Drops = append(status.Drops, s)
+	}
+	bl.Lock()
+	macLimitDrops := make(map[mesh.PeerName]uint64, len(bl.macLimitDrops))
+	for name, dropped := range bl.macLimitDrops {
+		macLimitDrops[name] = dropped
+	}
+	peerLimitDrops := make(map[mesh.PeerName]uint64, len(bl.peerLimitDrops))
+	for name, dropped := range bl.peerLimitDrops {
+		peerLimitDrops[name] = dropped
+	}
+	bl.Unlock()
+
+	for name, dropped := range macLimitDrops {
+		drop(name, "mac", dropped)
+	}
+	for name, dropped := range peerLimitDrops {
+		drop(name, "peer", dropped)
+	}
+	sort.Slice(status.Drops, func(i, j int) bool {
+		a, b := status.Drops[i], status.Drops[j]
+		return a.Peer < b.Peer || (a.Peer == b.Peer && a.Limit < b.Limit)
+	})
+	return status
+}
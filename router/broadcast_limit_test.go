@@ -0,0 +1,124 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (clock *testClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock *testClock) Advance(d time.Duration) {
+	clock.now = clock.now.Add(d)
+}
+
+// How many of n frames, taken all at once, the bucket allows
+func takeN(bucket *tokenBucket, rate, n int, now time.Time) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if bucket.take(rate, now) {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestTokenBucket(t *testing.T) {
+	const rate = 10
+	clock := &testClock{now: time.Unix(1000, 0)}
+	bucket := newTokenBucket(rate, clock.Now())
+
+	// A new bucket holds a second's worth of frames
+	require.Equal(t, rate, takeN(bucket, rate, 2*rate, clock.Now()))
+
+	// It refills at the rate
+	clock.Advance(100 * time.Millisecond)
+	require.Equal(t, 1, takeN(bucket, rate, 2, clock.Now()))
+	clock.Advance(450 * time.Millisecond)
+	require.Equal(t, 4, takeN(bucket, rate, rate, clock.Now()))
+
+	// The fraction of a token left over carries forward
+	clock.Advance(50 * time.Millisecond)
+	require.Equal(t, 1, takeN(bucket, rate, rate, clock.Now()))
+
+	// It holds no more than a second's worth, however long idle
+	clock.Advance(time.Hour)
+	require.Equal(t, rate, takeN(bucket, rate, 2*rate, clock.Now()))
+
+	// A steady stream at the rate is allowed
+	for i := 0; i < 3*rate; i++ {
+		clock.Advance(time.Second / rate)
+		require.True(t, bucket.take(rate, clock.Now()), "frame %d", i)
+	}
+}
+
+func TestBroadcastLimiter(t *testing.T) {
+	var (
+		mac1  = MAC{2, 0, 0, 0, 0, 1}
+		mac2  = MAC{2, 0, 0, 0, 0, 2}
+		mac3  = MAC{2, 0, 0, 0, 0, 3}
+		mac4  = MAC{2, 0, 0, 0, 0, 4}
+		peer1 = testPeer(mesh.PeerName(0x000000000001), "host1")
+		peer2 = testPeer(mesh.PeerName(0x000000000002), "host2")
+	)
+	clock := &testClock{now: time.Unix(1000, 0)}
+	bl := newBroadcastLimiter(BroadcastLimits{PerMAC: 2, PerPeer: 3}, clock.Now)
+	allowN := func(mac MAC, peer *mesh.Peer, n int) int {
+		allowed := 0
+		for i := 0; i < n; i++ {
+			if bl.allow(mac, peer) {
+				allowed++
+			}
+		}
+		return allowed
+	}
+
+	// Each MAC is limited separately, and then the peer as a whole
+	require.Equal(t, 2, allowN(mac1, peer1, 3))
+	require.Equal(t, 1, allowN(mac2, peer1, 3))
+	require.Equal(t, 0, allowN(mac3, peer1, 1))
+	// Another peer is unaffected
+	require.Equal(t, 2, allowN(mac4, peer2, 2))
+
+	// Drops are counted by the peer the frames originated at
+	require.Equal(t, map[mesh.PeerName]uint64{peer1.Name: 2}, bl.macLimitDrops)
+	require.Equal(t, map[mesh.PeerName]uint64{peer1.Name: 2}, bl.peerLimitDrops)
+
+	// A frame dropped by the MAC limit does not use up the peer's
+	// allowance
+	clock.Advance(time.Second)
+	require.Equal(t, 2, allowN(mac1, peer1, 4))
+	require.Equal(t, 1, allowN(mac2, peer1, 1))
+	require.Equal(t, uint64(4), bl.macLimitDrops[peer1.Name])
+	require.Equal(t, uint64(2), bl.peerLimitDrops[peer1.Name])
+
+	// Idle MAC buckets are forgotten
+	clock.Advance(broadcastBucketIdle + time.Second)
+	require.True(t, bl.allow(mac1, peer2))
+	require.Len(t, bl.macs, 1)
+
+	// As is everything about a peer which has gone
+	bl.forget(peer1.Name)
+	require.NotContains(t, bl.peers, peer1.Name)
+	require.NotContains(t, bl.macLimitDrops, peer1.Name)
+	require.NotContains(t, bl.peerLimitDrops, peer1.Name)
+}
+
+func TestBroadcastLimiterPerPeerOnly(t *testing.T) {
+	peer := testPeer(mesh.PeerName(0x000000000001), "host1")
+	clock := &testClock{now: time.Unix(1000, 0)}
+	bl := newBroadcastLimiter(BroadcastLimits{PerPeer: 2}, clock.Now)
+	require.True(t, bl.allow(MAC{2, 0, 0, 0, 0, 1}, peer))
+	require.True(t, bl.allow(MAC{2, 0, 0, 0, 0, 1}, peer))
+	require.False(t, bl.allow(MAC{2, 0, 0, 0, 0, 2}, peer))
+	require.Empty(t, bl.macs)
+	require.Empty(t, bl.macLimitDrops)
+}
@@ -0,0 +1,272 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/weaveworks/mesh"
+)
+
+// Packet captures let the user see the frames which the router
+// handles, without having to run tcpdump on the bridge or the
+// datapath.  They are taken where handleCapturedPacket and
+// handleForwardedPacket see frames, and streamed in pcap format.
+
+const (
+	captureSnapLen         = 65535
+	captureBufferSize      = 1024
+	DefaultCaptureDuration = 10 * time.Second
+	MaxCaptureDuration     = 10 * time.Minute
+)
+
+// CaptureFilter selects the frames to capture.  Within each field
+// any value may match; all the non-empty fields must match.
+type CaptureFilter struct {
+	MACs     []net.HardwareAddr // source or destination
+	IPs      []net.IP           // source or destination
+	Peers    []string           // remote peer name or nickname
+	Overlays []string           // overlay of the connection to the remote peer
+}
+
+func (filter *CaptureFilter) matchesKey(key PacketKey) bool {
+	if len(filter.MACs) == 0 {
+		return true
+	}
+	for _, mac := range filter.MACs {
+		if string(mac) == string(key.SrcMAC[:]) || string(mac) == string(key.DstMAC[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Frames broadcast from this peer go to every remote peer, so the
+// remote peer of a frame may be unknown; such frames match any peer
+// and overlay.
+func (filter *CaptureFilter) matchesPeer(router *NetworkRouter, peer *mesh.Peer) bool {
+	if peer == nil {
+		return true
+	}
+	if len(filter.Peers) > 0 && !contains(filter.Peers, peer.Name.String()) && !contains(filter.Peers, peer.NickName) {
+		return false
+	}
+	return len(filter.Overlays) == 0 || contains(filter.Overlays, router.overlayTo(peer))
+}
+
+func (filter *CaptureFilter) matchesFrame(dec *EthernetDecoder) bool {
+	if len(filter.IPs) == 0 {
+		return true
+	}
+	src, dst := dec.ipAddrs()
+	for _, ip := range filter.IPs {
+		if ip.Equal(src) || ip.Equal(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// The name of the overlay carrying frames to the given peer, or ""
+// if there is no route to it.
+func (router *NetworkRouter) overlayTo(peer *mesh.Peer) string {
+	hop, found := router.Routes.Unicast(peer.Name)
+	if !found {
+		return ""
+	}
+	conn, found := router.Ourself.ConnectionTo(hop)
+	if !found {
+		return ""
+	}
+	name, _ := conn.(*mesh.LocalConnection).OverlayConn.Attrs()["name"].(string)
+	return name
+}
+
+type capturedFrame struct {
+	timestamp time.Time
+	frame     []byte
+}
+
+type packetCapture struct {
+	dropped uint64 // first, for 64-bit alignment
+	filter  CaptureFilter
+	frames  chan capturedFrame
+}
+
+// captureFlowOp passes the frames of matching packets to the
+// captures, for as long as they are being captured.
+type captureFlowOp struct {
+	inspectingFlowOp
+	captures []*packetCapture
+}
+
+func (op captureFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	var cf *capturedFrame
+	for _, capture := range op.captures {
+		if !capture.filter.matchesFrame(dec) {
+			continue
+		}
+		if cf == nil {
+			cf = &capturedFrame{timestamp: time.Now(), frame: append([]byte(nil), frame...)}
+		}
+		select {
+		case capture.frames <- *cf:
+		default:
+			atomic.AddUint64(&capture.dropped, 1)
+		}
+	}
+}
+
+// The set of captures in progress
+type captureSet struct {
+	sync.Mutex
+	count    int32 // for a lock-free check on the packet handling paths
+	captures []*packetCapture
+}
+
+func (cs *captureSet) active() bool {
+	return atomic.LoadInt32(&cs.count) > 0
+}
+
+func (cs *captureSet) add(capture *packetCapture) {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.captures = append(cs.captures, capture)
+	atomic.StoreInt32(&cs.count, int32(len(cs.captures)))
+}
+
+func (cs *captureSet) remove(capture *packetCapture) {
+	cs.Lock()
+	defer cs.Unlock()
+	for i, c := range cs.captures {
+		if c == capture {
+			cs.captures = append(cs.captures[:i], cs.captures[i+1:]...)
+			break
+		}
+	}
+	atomic.StoreInt32(&cs.count, int32(len(cs.captures)))
+}
+
+// Add a captureFlowOp to the FlowOp for a packet, if any capture
+// might want it.  peer is the remote peer the packet is going to or
+// coming from, or nil if not known.
+func (router *NetworkRouter) capturePacket(key PacketKey, peer *mesh.Peer, fop FlowOp) FlowOp {
+	router.captures.Lock()
+	var matching []*packetCapture
+	for _, capture := range router.captures.captures {
+		if capture.filter.matchesKey(key) && capture.filter.matchesPeer(router, peer) {
+			matching = append(matching, capture)
+		}
+	}
+	router.captures.Unlock()
+
+	if len(matching) == 0 {
+		return fop
+	}
+	mfop := NewMultiFlowOp(false, captureFlowOp{captures: matching})
+	if fop != nil {
+		mfop.Add(fop)
+	}
+	return mfop
+}
+
+// Capture matching frames, writing them to w in pcap format until the
+// duration elapses, maxPackets have been written (if non-zero), or
+// stop is closed.
+func (router *NetworkRouter) Capture(w http.ResponseWriter, filter CaptureFilter, duration time.Duration, maxPackets int, stop <-chan struct{}) error {
+	writer := pcapgo.NewWriter(w)
+	if err := writer.WriteFileHeader(captureSnapLen, layers.LinkTypeEthernet); err != nil {
+		return err
+	}
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	capture := &packetCapture{filter: filter, frames: make(chan capturedFrame, captureBufferSize)}
+	router.captures.add(capture)
+	defer router.captures.remove(capture)
+	// Flows installed in the fast datapath would hide packets
+	// from us, so clear them out.
+	router.Overlay.(NetworkOverlay).InvalidateRoutes()
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	packets := 0
+	for maxPackets == 0 || packets < maxPackets {
+		select {
+		case cf := <-capture.frames:
+			info := gopacket.CaptureInfo{Timestamp: cf.timestamp, CaptureLength: len(cf.frame), Length: len(cf.frame)}
+			if err := writer.WritePacket(info, cf.frame); err != nil {
+				return err
+			}
+			packets++
+			if flusher != nil && len(capture.frames) == 0 {
+				flusher.Flush()
+			}
+		case <-timer.C:
+			return capture.finished(packets)
+		case <-stop:
+			return capture.finished(packets)
+		}
+	}
+	return capture.finished(packets)
+}
+
+func (capture *packetCapture) finished(packets int) error {
+	if dropped := atomic.LoadUint64(&capture.dropped); dropped > 0 {
+		log.Warningf("Packet capture: %d packets written, %d dropped", packets, dropped)
+	}
+	return nil
+}
+
+// ParseCaptureRequest reads the filter and limits of a capture from
+// the query parameters mac, ip, peer, overlay, duration and count.
+func ParseCaptureRequest(r *http.Request) (filter CaptureFilter, duration time.Duration, maxPackets int, err error) {
+	if err = r.ParseForm(); err != nil {
+		return
+	}
+	for _, s := range r.Form["mac"] {
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			return filter, 0, 0, err
+		}
+		filter.MACs = append(filter.MACs, mac)
+	}
+	for _, s := range r.Form["ip"] {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return filter, 0, 0, fmt.Errorf("invalid IP address %q", s)
+		}
+		filter.IPs = append(filter.IPs, ip)
+	}
+	filter.Peers = r.Form["peer"]
+	filter.Overlays = r.Form["overlay"]
+
+	duration = DefaultCaptureDuration
+	if s := r.FormValue("duration"); s != "" {
+		if duration, err = time.ParseDuration(s); err != nil {
+			return
+		}
+		if duration <= 0 || duration > MaxCaptureDuration {
+			err = fmt.Errorf("capture duration must be positive and at most %v", MaxCaptureDuration)
+			return
+		}
+	}
+	if s := r.FormValue("count"); s != "" {
+		if maxPackets, err = strconv.Atoi(s); err != nil {
+			return
+		}
+		if maxPackets < 0 {
+			err = fmt.Errorf("invalid packet count %d", maxPackets)
+		}
+	}
+	return
+}
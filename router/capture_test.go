@@ -0,0 +1,246 @@
+package router
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func testCaptureRouter(t *testing.T) *NetworkRouter {
+	meshRouter, err := mesh.NewRouter(mesh.Config{}, mesh.PeerName(0x000000000001), "host1", NullNetworkOverlay{}, log)
+	require.NoError(t, err)
+	return &NetworkRouter{Router: meshRouter}
+}
+
+// Wait for the number of captures in progress to reach n
+func waitForCaptures(t *testing.T, router *NetworkRouter, n int32) {
+	for i := 0; i < 100; i++ {
+		if atomic.LoadInt32(&router.captures.count) == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.FailNow(t, "captures not in progress", "want %d, have %d", n, atomic.LoadInt32(&router.captures.count))
+}
+
+// Hand a frame to the captures, as handleCapturedPacket does
+func testCaptureFrame(router *NetworkRouter, peer *mesh.Peer, frame []byte) {
+	if !router.captures.active() {
+		return
+	}
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(frame)
+	var key PacketKey
+	copy(key.SrcMAC[:], dec.Eth.SrcMAC)
+	copy(key.DstMAC[:], dec.Eth.DstMAC)
+	if fop := router.capturePacket(key, peer, nil); fop != nil {
+		fop.Process(frame, dec, false)
+	}
+}
+
+func TestParseCaptureRequest(t *testing.T) {
+	parse := func(query string) (CaptureFilter, time.Duration, int, error) {
+		return ParseCaptureRequest(httptest.NewRequest("GET", "/capture?"+query, nil))
+	}
+
+	filter, duration, maxPackets, err := parse("")
+	require.NoError(t, err)
+	require.Equal(t, CaptureFilter{}, filter)
+	require.Equal(t, DefaultCaptureDuration, duration)
+	require.Equal(t, 0, maxPackets)
+
+	filter, duration, maxPackets, err = parse("mac=02:00:00:00:00:01&mac=02:00:00:00:00:02&ip=10.32.0.1&ip=fd00::1&peer=host2&overlay=fastdp&overlay=sleeve&duration=1m&count=5")
+	require.NoError(t, err)
+	require.Equal(t, []net.HardwareAddr{testSrcMAC[:], testDstMAC[:]}, filter.MACs)
+	require.Equal(t, []net.IP{net.ParseIP("10.32.0.1"), net.ParseIP("fd00::1")}, filter.IPs)
+	require.Equal(t, []string{"host2"}, filter.Peers)
+	require.Equal(t, []string{"fastdp", "sleeve"}, filter.Overlays)
+	require.Equal(t, time.Minute, duration)
+	require.Equal(t, 5, maxPackets)
+
+	for _, query := range []string{
+		"mac=02:00:00:00:00",
+		"mac=02:00:00:00:00:01&mac=host2",
+		"ip=10.32.0",
+		"ip=10.32.0.0/12",
+		"duration=10",
+		"duration=0s",
+		"duration=-1s",
+		"duration=11m",
+		"count=ten",
+		"count=-1",
+	} {
+		_, _, _, err := parse(query)
+		require.Error(t, err, query)
+	}
+}
+
+func TestCaptureFilter(t *testing.T) {
+	router := testCaptureRouter(t)
+	peer := testPeer(mesh.PeerName(0x000000000002), "host2")
+	frame := testIPv6Frame(t, 10)
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(frame)
+	key := PacketKey{SrcMAC: testSrcMAC, DstMAC: testDstMAC}
+	otherMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 3}
+
+	for _, tc := range []struct {
+		name    string
+		filter  CaptureFilter
+		peer    *mesh.Peer
+		matches bool
+	}{
+		{name: "no filter", matches: true},
+		{name: "source MAC", filter: CaptureFilter{MACs: []net.HardwareAddr{otherMAC, testSrcMAC[:]}}, matches: true},
+		{name: "destination MAC", filter: CaptureFilter{MACs: []net.HardwareAddr{testDstMAC[:]}}, matches: true},
+		{name: "other MAC", filter: CaptureFilter{MACs: []net.HardwareAddr{otherMAC}}},
+		{name: "source IP", filter: CaptureFilter{IPs: []net.IP{testSrcIP6}}, matches: true},
+		{name: "destination IP", filter: CaptureFilter{IPs: []net.IP{net.ParseIP("10.32.0.1"), testDstIP6}}, matches: true},
+		{name: "other IP", filter: CaptureFilter{IPs: []net.IP{net.ParseIP("fd00::3")}}},
+		{name: "MAC and other IP", filter: CaptureFilter{MACs: []net.HardwareAddr{testSrcMAC[:]}, IPs: []net.IP{net.ParseIP("fd00::3")}}},
+		{name: "peer nickname", filter: CaptureFilter{Peers: []string{"host2"}}, peer: peer, matches: true},
+		{name: "peer name", filter: CaptureFilter{Peers: []string{"00:00:00:00:00:02"}}, peer: peer, matches: true},
+		{name: "other peer", filter: CaptureFilter{Peers: []string{"host3"}}, peer: peer},
+		{name: "unknown peer", filter: CaptureFilter{Peers: []string{"host3"}}, matches: true},
+		{name: "overlay, no route to peer", filter: CaptureFilter{Overlays: []string{"sleeve"}}, peer: peer},
+		{name: "overlay, unknown peer", filter: CaptureFilter{Overlays: []string{"sleeve"}}, matches: true},
+	} {
+		matches := tc.filter.matchesKey(key) && tc.filter.matchesPeer(router, tc.peer) && tc.filter.matchesFrame(dec)
+		require.Equal(t, tc.matches, matches, tc.name)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	router := testCaptureRouter(t)
+	frames := [][]byte{testIPv6Frame(t, 10), testIPv6Frame(t, 20), testIPv6Frame(t, 30)}
+	other := testIPv6Frame(t, 40)
+	copy(other[6:12], []byte{0x02, 0, 0, 0, 0, 3})
+
+	// The capture ends after the given number of packets, having
+	// written only the matching frames
+	w := httptest.NewRecorder()
+	done := make(chan error)
+	filter := CaptureFilter{MACs: []net.HardwareAddr{testSrcMAC[:]}}
+	go func() { done <- router.Capture(w, filter, time.Minute, 2, nil) }()
+	waitForCaptures(t, router, 1)
+	testCaptureFrame(router, nil, other)
+	for _, frame := range frames {
+		testCaptureFrame(router, nil, frame)
+	}
+	require.NoError(t, <-done)
+	require.False(t, router.captures.active())
+	require.True(t, w.Flushed)
+
+	r, err := pcapgo.NewReader(w.Body)
+	require.NoError(t, err)
+	require.Equal(t, layers.LinkTypeEthernet, r.LinkType())
+	require.Equal(t, uint32(captureSnapLen), r.Snaplen())
+	for _, frame := range frames[:2] {
+		data, ci, err := r.ReadPacketData()
+		require.NoError(t, err)
+		require.Equal(t, frame, data)
+		require.Equal(t, len(frame), ci.CaptureLength)
+		require.Equal(t, len(frame), ci.Length)
+		require.WithinDuration(t, time.Now(), ci.Timestamp, time.Minute)
+	}
+	_, _, err = r.ReadPacketData()
+	require.Equal(t, io.EOF, err)
+
+	// The capture ends after the duration, or when stopped, with
+	// just the header if there were no frames
+	for _, stop := range []bool{false, true} {
+		w = httptest.NewRecorder()
+		stopCh := make(chan struct{})
+		duration := 10 * time.Millisecond
+		if stop {
+			duration = time.Minute
+			close(stopCh)
+		}
+		require.NoError(t, router.Capture(w, CaptureFilter{}, duration, 0, stopCh))
+		require.False(t, router.captures.active())
+		r, err = pcapgo.NewReader(w.Body)
+		require.NoError(t, err)
+		_, _, err = r.ReadPacketData()
+		require.Equal(t, io.EOF, err)
+	}
+}
+
+// Frames which arrive faster than they can be written are dropped,
+// rather than holding up the packet handling paths
+func TestCaptureDropped(t *testing.T) {
+	router := testCaptureRouter(t)
+	capture := &packetCapture{frames: make(chan capturedFrame, 1)}
+	router.captures.add(capture)
+	require.True(t, router.captures.active())
+	frame := testIPv6Frame(t, 10)
+	for i := 0; i < 3; i++ {
+		testCaptureFrame(router, nil, frame)
+	}
+	require.Equal(t, uint64(2), atomic.LoadUint64(&capture.dropped))
+
+	// The captured frame is a copy
+	frame[0] ^= 1
+	require.Equal(t, testIPv6Frame(t, 10), (<-capture.frames).frame)
+
+	router.captures.remove(capture)
+	require.False(t, router.captures.active())
+}
+
+func TestCaptureHTTP(t *testing.T) {
+	router := testCaptureRouter(t)
+	muxRouter := mux.NewRouter()
+	router.HandleHTTP(muxRouter)
+	server := httptest.NewServer(muxRouter)
+	defer server.Close()
+
+	for _, query := range []string{"mac=host2", "ip=10.32.0", "duration=forever", "count=-1"} {
+		resp, err := http.Get(server.URL + "/capture?" + query)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+		require.Contains(t, string(body), "unable to parse capture request", query)
+		require.False(t, router.captures.active())
+	}
+
+	// The header is streamed straight away, then the frames as they
+	// are captured
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	query := url.Values{"duration": {"10m"}, "ip": {testDstIP6.String()}}
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/capture?"+query.Encode(), nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/vnd.tcpdump.pcap", resp.Header.Get("Content-Type"))
+	r, err := pcapgo.NewReader(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, layers.LinkTypeEthernet, r.LinkType())
+
+	waitForCaptures(t, router, 1)
+	frame := testIPv6Frame(t, 10)
+	testCaptureFrame(router, nil, frame)
+	data, _, err := r.ReadPacketData()
+	require.NoError(t, err)
+	require.Equal(t, frame, data)
+
+	// The capture is removed when the client goes away
+	cancel()
+	waitForCaptures(t, router, 0)
+}
@@ -0,0 +1,246 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// EncryptionPolicy says which connections must be encrypted, may be
+// plain, or are not allowed at all, by peer or remote address.
+// Whether a connection is encrypted is still decided by the password
+// and trusted subnets; the policy only refuses the connections which
+// violate it, so that a misconfiguration cannot lead to plaintext
+// traffic where it is not wanted.
+
+type EncryptionPolicy struct {
+	Rules []EncryptionRule `json:"rules,omitempty"`
+}
+
+const (
+	EncryptionRequire    = "require-encryption"
+	EncryptionAllowPlain = "allow-plain"
+	EncryptionDeny       = "deny"
+
+	maxRefusedConnections = 16
+)
+
+// An EncryptionRule applies to connections to a peer, identified by
+// name or nickname, or to connections whose remote address is in a
+// CIDR.  Its textual form is <action>@<peer or cidr>, e.g.
+// "require-encryption@0.0.0.0/0" or "allow-plain@10.0.0.0/8".
+type EncryptionRule struct {
+	Action string `json:"action"`
+	Match  string `json:"match"`
+
+	cidr *net.IPNet
+}
+
+func ParseEncryptionRule(s string) (EncryptionRule, error) {
+	var rule EncryptionRule
+	at := strings.LastIndex(s, "@")
+	if at < 0 {
+		return rule, fmt.Errorf("invalid encryption rule %q: expected <action>@<peer or cidr>", s)
+	}
+	rule.Action = s[:at]
+	rule.Match = s[at+1:]
+	return rule, rule.validate()
+}
+
+func (rule *EncryptionRule) validate() error {
+	switch rule.Action {
+	case EncryptionRequire, EncryptionAllowPlain, EncryptionDeny:
+	default:
+		return fmt.Errorf("invalid encryption rule action %q", rule.Action)
+	}
+	if rule.Match == "" {
+		return fmt.Errorf("encryption rule %s has nothing to match", rule)
+	}
+	rule.cidr = nil
+	if _, cidr, err := net.ParseCIDR(rule.Match); err == nil {
+		rule.cidr = cidr
+	}
+	return nil
+}
+
+func (rule EncryptionRule) String() string {
+	return rule.Action + "@" + rule.Match
+}
+
+// How specific the match of a rule is: rules naming the peer beat
+// any CIDR, and longer prefixes beat shorter ones.  -1 if the rule
+// does not match.
+func (rule *EncryptionRule) specificity(peer *mesh.Peer, ip net.IP) int {
+	if rule.cidr != nil {
+		if ip == nil || !rule.cidr.Contains(ip) {
+			return -1
+		}
+		ones, _ := rule.cidr.Mask.Size()
+		return ones
+	}
+	if rule.Match == peer.Name.String() || rule.Match == peer.NickName {
+		return 129
+	}
+	return -1
+}
+
+func (rule *EncryptionRule) strictness() int {
+	switch rule.Action {
+	case EncryptionDeny:
+		return 2
+	case EncryptionRequire:
+		return 1
+	}
+	return 0
+}
+
+// ParseEncryptionPolicy parses a whitespace-separated list of rules.
+func ParseEncryptionPolicy(rules string) (EncryptionPolicy, error) {
+	var policy EncryptionPolicy
+	for _, s := range strings.Fields(rules) {
+		rule, err := ParseEncryptionRule(s)
+		if err != nil {
+			return policy, err
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return policy, nil
+}
+
+func (policy *EncryptionPolicy) Validate() error {
+	for i := range policy.Rules {
+		if err := policy.Rules[i].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The most specific rule which matches, or nil.  Where equally
+// specific rules disagree, the strictest wins.
+func (policy *EncryptionPolicy) ruleFor(peer *mesh.Peer, ip net.IP) *EncryptionRule {
+	var best *EncryptionRule
+	bestSpecificity := -1
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		specificity := rule.specificity(peer, ip)
+		if specificity < 0 || specificity < bestSpecificity {
+			continue
+		}
+		if specificity > bestSpecificity || rule.strictness() > best.strictness() {
+			best, bestSpecificity = rule, specificity
+		}
+	}
+	return best
+}
+
+// Check a connection against the policy; connections with no matching
+// rule are allowed.
+func (policy *EncryptionPolicy) check(peer *mesh.Peer, ip net.IP, encrypted bool) error {
+	rule := policy.ruleFor(peer, ip)
+	if rule == nil {
+		return nil
+	}
+	switch {
+	case rule.Action == EncryptionDeny:
+		return fmt.Errorf("connection denied by encryption policy rule %s", rule)
+	case rule.Action == EncryptionRequire && !encrypted:
+		return fmt.Errorf("connection is not encrypted, but encryption policy rule %s requires it", rule)
+	}
+	return nil
+}
+
+// A connection which the encryption policy refused
+type RefusedConnection struct {
+	Address  string
+	Peer     string
+	NickName string
+	Error    string
+	Time     time.Time
+}
+
+// SetEncryptionPolicy replaces the encryption policy.  Established
+// connections which it does not allow are closed, including those on
+// the compat overlay.
+func (osw *OverlaySwitch) SetEncryptionPolicy(policy EncryptionPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+
+	osw.lock.Lock()
+	osw.encryptionPolicy = policy
+	connections := make([]*overlaySwitchForwarder, 0, len(osw.connections))
+	for fwd := range osw.connections {
+		connections = append(connections, fwd)
+	}
+	compatConns := make([]*compatForwarder, 0, len(osw.compatConns))
+	for fwd := range osw.compatConns {
+		compatConns = append(compatConns, fwd)
+	}
+	osw.lock.Unlock()
+
+	for _, fwd := range compatConns {
+		if err := policy.check(fwd.remotePeer, fwd.remoteIP, fwd.encrypted); err != nil {
+			fwd.fail(err)
+		}
+	}
+
+	for _, fwd := range connections {
+		if err := policy.check(fwd.remotePeer, fwd.remoteIP, fwd.encrypted); err != nil {
+			select {
+			case fwd.errorChan <- err:
+			default:
+			}
+		}
+	}
+	if osw.onPolicyChange != nil {
+		osw.onPolicyChange()
+	}
+	return nil
+}
+
+func (osw *OverlaySwitch) EncryptionPolicy() EncryptionPolicy {
+	osw.lock.Lock()
+	defer osw.lock.Unlock()
+	return osw.encryptionPolicy
+}
+
+// Check a new connection against the encryption policy, remembering
+// refused incoming connections for the status report.  Refused
+// outgoing connections already show up there, as failed.
+func (osw *OverlaySwitch) checkEncryptionPolicy(params mesh.OverlayConnectionParams) error {
+	var remoteIP net.IP
+	if params.RemoteAddr != nil {
+		remoteIP = params.RemoteAddr.IP
+	}
+	osw.lock.Lock()
+	defer osw.lock.Unlock()
+	err := osw.encryptionPolicy.check(params.RemotePeer, remoteIP, params.SessionKey != nil)
+	if err == nil || params.Outbound {
+		return err
+	}
+	refused := RefusedConnection{
+		Peer:     params.RemotePeer.Name.String(),
+		NickName: params.RemotePeer.NickName,
+		Error:    err.Error(),
+		Time:     time.Now(),
+	}
+	if params.RemoteAddr != nil {
+		refused.Address = params.RemoteAddr.String()
+	}
+	osw.refused = append(osw.refused, refused)
+	if len(osw.refused) > maxRefusedConnections {
+		osw.refused = osw.refused[len(osw.refused)-maxRefusedConnections:]
+	}
+	return err
+}
+
+// The most recently refused incoming connections
+func (osw *OverlaySwitch) RefusedConnections() []RefusedConnection {
+	osw.lock.Lock()
+	defer osw.lock.Unlock()
+	return append([]RefusedConnection(nil), osw.refused...)
+}
@@ -0,0 +1,158 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func testPeer(name mesh.PeerName, nickName string) *mesh.Peer {
+	peer := &mesh.Peer{Name: name}
+	peer.NickName = nickName
+	return peer
+}
+
+func TestParseEncryptionRule(t *testing.T) {
+	for _, tc := range []struct {
+		rule   string
+		action string
+		match  string
+		cidr   string
+		err    bool
+	}{
+		{rule: "require-encryption@0.0.0.0/0", action: EncryptionRequire, match: "0.0.0.0/0", cidr: "0.0.0.0/0"},
+		{rule: "allow-plain@10.0.0.0/8", action: EncryptionAllowPlain, match: "10.0.0.0/8", cidr: "10.0.0.0/8"},
+		{rule: "deny@host1", action: EncryptionDeny, match: "host1"},
+		{rule: "deny@00:00:00:00:00:01", action: EncryptionDeny, match: "00:00:00:00:00:01"},
+		{rule: "deny@10.0.0.1", action: EncryptionDeny, match: "10.0.0.1"},
+		{rule: "allow-plain@fd00::/8", action: EncryptionAllowPlain, match: "fd00::/8", cidr: "fd00::/8"},
+		{rule: "require-encryption", err: true},
+		{rule: "encrypt@0.0.0.0/0", err: true},
+		{rule: "@host1", err: true},
+		{rule: "deny@", err: true},
+		{rule: "", err: true},
+	} {
+		rule, err := ParseEncryptionRule(tc.rule)
+		if tc.err {
+			require.Error(t, err, tc.rule)
+			continue
+		}
+		require.NoError(t, err, tc.rule)
+		require.Equal(t, tc.action, rule.Action, tc.rule)
+		require.Equal(t, tc.match, rule.Match, tc.rule)
+		require.Equal(t, tc.rule, rule.String())
+		if tc.cidr == "" {
+			require.Nil(t, rule.cidr, tc.rule)
+		} else {
+			require.Equal(t, tc.cidr, rule.cidr.String(), tc.rule)
+		}
+	}
+}
+
+func TestEncryptionPolicyPrecedence(t *testing.T) {
+	peer := testPeer(mesh.PeerName(0x000000000001), "host1")
+	for _, tc := range []struct {
+		name  string
+		rules string
+		ip    string
+		rule  string // the rule which applies, or "" for none
+	}{
+		{name: "no rules", rules: "", ip: "10.0.0.1"},
+		{name: "no match", rules: "deny@192.168.0.0/16 deny@host2", ip: "10.0.0.1"},
+		{name: "cidr", rules: "require-encryption@0.0.0.0/0", ip: "10.0.0.1", rule: "require-encryption@0.0.0.0/0"},
+		{name: "longer prefix wins", rules: "require-encryption@0.0.0.0/0 allow-plain@10.0.0.0/8", ip: "10.0.0.1", rule: "allow-plain@10.0.0.0/8"},
+		{name: "longer prefix wins whatever the order", rules: "allow-plain@10.0.0.0/8 require-encryption@0.0.0.0/0", ip: "10.0.0.1", rule: "allow-plain@10.0.0.0/8"},
+		{name: "longer prefix not matching", rules: "require-encryption@0.0.0.0/0 allow-plain@10.0.0.0/8", ip: "11.0.0.1", rule: "require-encryption@0.0.0.0/0"},
+		{name: "nickname beats cidr", rules: "allow-plain@10.0.0.1/32 require-encryption@host1", ip: "10.0.0.1", rule: "require-encryption@host1"},
+		{name: "name beats cidr", rules: "deny@10.0.0.0/8 allow-plain@00:00:00:00:00:01", ip: "10.0.0.1", rule: "allow-plain@00:00:00:00:00:01"},
+		{name: "stricter wins a tie", rules: "allow-plain@10.0.0.0/8 deny@10.0.0.0/8 require-encryption@10.0.0.0/8", ip: "10.0.0.1", rule: "deny@10.0.0.0/8"},
+		{name: "require beats allow in a tie", rules: "allow-plain@host1 require-encryption@00:00:00:00:00:01", ip: "10.0.0.1", rule: "require-encryption@00:00:00:00:00:01"},
+		{name: "no address matches only peers", rules: "deny@0.0.0.0/0 allow-plain@host1", rule: "allow-plain@host1"},
+		{name: "no address", rules: "deny@0.0.0.0/0"},
+	} {
+		policy, err := ParseEncryptionPolicy(tc.rules)
+		require.NoError(t, err, tc.name)
+		rule := policy.ruleFor(peer, net.ParseIP(tc.ip))
+		if tc.rule == "" {
+			require.Nil(t, rule, tc.name)
+		} else {
+			require.NotNil(t, rule, tc.name)
+			require.Equal(t, tc.rule, rule.String(), tc.name)
+		}
+	}
+}
+
+func TestEncryptionPolicyCheck(t *testing.T) {
+	peer := testPeer(mesh.PeerName(0x000000000001), "host1")
+	policy, err := ParseEncryptionPolicy("require-encryption@0.0.0.0/0 allow-plain@10.0.0.0/8 deny@192.168.0.0/16")
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		ip        string
+		encrypted bool
+		err       bool
+	}{
+		{ip: "1.2.3.4", encrypted: true},
+		{ip: "1.2.3.4", encrypted: false, err: true},
+		{ip: "10.1.2.3", encrypted: false},
+		{ip: "10.1.2.3", encrypted: true},
+		{ip: "192.168.1.1", encrypted: true, err: true},
+		{ip: "192.168.1.1", encrypted: false, err: true},
+	} {
+		err := policy.check(peer, net.ParseIP(tc.ip), tc.encrypted)
+		if tc.err {
+			require.Error(t, err, tc.ip)
+		} else {
+			require.NoError(t, err, tc.ip)
+		}
+	}
+}
+
+type testCompatOverlay struct{ NullNetworkOverlay }
+
+func (testCompatOverlay) PrepareConnection(mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	return testCompatConnection{}, nil
+}
+
+type testCompatConnection struct{ NullNetworkOverlay }
+
+func (testCompatConnection) HealthChannel() <-chan bool {
+	return nil
+}
+
+// Connections on the compat overlay are closed when the policy
+// changes to forbid them, as switched connections are.
+func TestSetEncryptionPolicyCompatConnection(t *testing.T) {
+	osw := NewOverlaySwitch()
+	osw.SetCompatOverlay(testCompatOverlay{})
+	conn, err := osw.PrepareConnection(mesh.OverlayConnectionParams{
+		RemotePeer: testPeer(mesh.PeerName(0x000000000001), "host1"),
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6783},
+		Outbound:   true,
+		Features:   map[string]string{},
+	})
+	require.NoError(t, err)
+
+	policy, err := ParseEncryptionPolicy("allow-plain@10.0.0.0/8")
+	require.NoError(t, err)
+	require.NoError(t, osw.SetEncryptionPolicy(policy))
+	select {
+	case err := <-conn.ErrorChannel():
+		require.FailNow(t, "connection closed by a policy which allows it", "%v", err)
+	default:
+	}
+
+	policy, err = ParseEncryptionPolicy("require-encryption@0.0.0.0/0")
+	require.NoError(t, err)
+	require.NoError(t, osw.SetEncryptionPolicy(policy))
+	select {
+	case err := <-conn.ErrorChannel():
+		require.Error(t, err)
+	default:
+		require.FailNow(t, "plain connection not closed by a policy requiring encryption")
+	}
+
+	conn.Stop()
+	require.Empty(t, osw.compatConns)
+}
@@ -2,22 +2,42 @@ package router
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"net"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
+// The minimum link MTU that IPv6 requires; see RFC 8200 section 5.
+const IPv6MinMTU = 1280
+
 type EthernetDecoder struct {
 	Eth     layers.Ethernet
+	Dot1Q   dot1Q // the 802.1Q tag of a frame in a segment
 	IP      layers.IPv4
+	IP6     layers.IPv6
 	decoded []gopacket.LayerType
 	parser  *gopacket.DecodingLayerParser
 }
 
+// dot1Q is layers.Dot1Q, refusing tags cut short, which it does not
+// check for
+type dot1Q struct {
+	layers.Dot1Q
+}
+
+func (d *dot1Q) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < segmentTagSize {
+		return fmt.Errorf("truncated 802.1Q tag")
+	}
+	return d.Dot1Q.DecodeFromBytes(data, df)
+}
+
 func NewEthernetDecoder() *EthernetDecoder {
 	dec := &EthernetDecoder{}
-	dec.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &dec.Eth, &dec.IP)
+	dec.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &dec.Eth, &dec.Dot1Q, &dec.IP, &dec.IP6)
 	return dec
 }
 
@@ -32,10 +52,105 @@ func (dec *EthernetDecoder) DecodeLayers(data []byte) {
 func (dec *EthernetDecoder) PacketKey() (key PacketKey) {
 	copy(key.SrcMAC[:], dec.Eth.SrcMAC)
 	copy(key.DstMAC[:], dec.Eth.DstMAC)
+	key.Segment = dec.segment()
 	return
 }
 
+// Does the frame have an 802.1Q tag?
+func (dec *EthernetDecoder) tagged() bool {
+	return len(dec.decoded) >= 2 && dec.decoded[1] == layers.LayerTypeDot1Q
+}
+
+// The segment of the frame, which is the VLAN ID of its tag
+func (dec *EthernetDecoder) segment() Segment {
+	if !dec.tagged() {
+		return 0
+	}
+	return Segment(dec.Dot1Q.VLANIdentifier)
+}
+
+func (dec *EthernetDecoder) tagSize() int {
+	if !dec.tagged() {
+		return 0
+	}
+	return segmentTagSize
+}
+
+// The ethertype and payload of the frame, after any tag
+func (dec *EthernetDecoder) etherType() layers.EthernetType {
+	if dec.tagged() {
+		return dec.Dot1Q.Type
+	}
+	return dec.Eth.EthernetType
+}
+
+func (dec *EthernetDecoder) linkPayload() []byte {
+	if dec.tagged() {
+		return dec.Dot1Q.Payload
+	}
+	return dec.Eth.Payload
+}
+
+// The ethernet header for frames made from the decoded frame's
+// layers, which get its tag back from retag.
+func (dec *EthernetDecoder) untaggedEth() layers.Ethernet {
+	eth := dec.Eth
+	eth.EthernetType = dec.etherType()
+	return eth
+}
+
+func (dec *EthernetDecoder) retag(frame []byte) []byte {
+	if !dec.tagged() {
+		return frame
+	}
+	return pushSegmentTag(frame, dec.segment())
+}
+
+func (dec *EthernetDecoder) networkLayer() gopacket.LayerType {
+	if len(dec.decoded) < 2 {
+		return gopacket.LayerTypeZero
+	}
+	return dec.decoded[len(dec.decoded)-1]
+}
+
+func (dec *EthernetDecoder) isIPv4() bool {
+	return dec.networkLayer() == layers.LayerTypeIPv4
+}
+
+func (dec *EthernetDecoder) isIPv6() bool {
+	return dec.networkLayer() == layers.LayerTypeIPv6
+}
+
+func (dec *EthernetDecoder) hasIP() bool {
+	return dec.isIPv4() || dec.isIPv6()
+}
+
+// The source and destination addresses of the decoded IP packet, if
+// any.
+func (dec *EthernetDecoder) ipAddrs() (net.IP, net.IP) {
+	switch {
+	case dec.isIPv4():
+		return dec.IP.SrcIP, dec.IP.DstIP
+	case dec.isIPv6():
+		return dec.IP6.SrcIP, dec.IP6.DstIP
+	}
+	return nil, nil
+}
+
+// Construct the ICMP error telling the sender of the decoded packet
+// that it exceeds the given MTU: "fragmentation needed" for IPv4, and
+// "packet too big" for IPv6.
 func (dec *EthernetDecoder) makeICMPFragNeeded(mtu int) ([]byte, error) {
+	switch {
+	case dec.isIPv4():
+		return dec.makeICMPv4FragNeeded(mtu)
+	case dec.isIPv6():
+		return dec.makeICMPv6PacketTooBig(mtu)
+	}
+	return nil, fmt.Errorf("cannot make ICMP frag needed for non-IP frame")
+}
+
+func (dec *EthernetDecoder) makeICMPv4FragNeeded(mtu int) ([]byte, error) {
 	buf := gopacket.NewSerializeBuffer()
 	opts := gopacket.SerializeOptions{
 		FixLengths:       true,
@@ -46,7 +161,7 @@ func (dec *EthernetDecoder) makeICMPFragNeeded(mtu int) ([]byte, error) {
 		&layers.Ethernet{
 			SrcMAC:       dec.Eth.DstMAC,
 			DstMAC:       dec.Eth.SrcMAC,
-			EthernetType: dec.Eth.EthernetType},
+			EthernetType: layers.EthernetTypeIPv4},
 		&layers.IPv4{
 			Version:    4,
 			TOS:        dec.IP.TOS,
@@ -67,7 +182,57 @@ func (dec *EthernetDecoder) makeICMPFragNeeded(mtu int) ([]byte, error) {
 	}
 
 	log.Printf("Sending ICMP 3,4 (%v -> %v): PMTU=%v", dec.IP.DstIP, dec.IP.SrcIP, mtu)
-	return buf.Bytes(), nil
+	return dec.retag(buf.Bytes()), nil
+}
+
+func (dec *EthernetDecoder) makeICMPv6PacketTooBig(mtu int) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true}
+
+	// The ICMPv6 message body is the MTU, followed by as much of
+	// the invoking packet as will fit without the ICMPv6 packet
+	// exceeding the minimum IPv6 MTU (RFC 4443 section 3.2).
+	invoking := dec.linkPayload()
+	if ipLen := 40 + int(dec.IP6.Length); len(invoking) > ipLen {
+		invoking = invoking[:ipLen]
+	}
+	if maxLen := IPv6MinMTU - 40 - 8; len(invoking) > maxLen {
+		invoking = invoking[:maxLen]
+	}
+	body := make([]byte, 4+len(invoking))
+	binary.BigEndian.PutUint32(body, uint32(mtu))
+	copy(body[4:], invoking)
+	payload := gopacket.Payload(body)
+
+	ip := &layers.IPv6{
+		Version:      6,
+		TrafficClass: dec.IP6.TrafficClass,
+		NextHeader:   layers.IPProtocolICMPv6,
+		HopLimit:     64,
+		DstIP:        dec.IP6.SrcIP,
+		SrcIP:        dec.IP6.DstIP}
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypePacketTooBig, 0)}
+	if err := icmp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, err
+	}
+
+	err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{
+			SrcMAC:       dec.Eth.DstMAC,
+			DstMAC:       dec.Eth.SrcMAC,
+			EthernetType: layers.EthernetTypeIPv6},
+		ip,
+		icmp,
+		&payload)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Sending ICMPv6 2,0 (%v -> %v): PMTU=%v", dec.IP6.DstIP, dec.IP6.SrcIP, mtu)
+	return dec.retag(buf.Bytes()), nil
 }
 
 var (
@@ -79,6 +244,9 @@ func (dec *EthernetDecoder) IsSpecial() bool {
 		bytes.Equal(zeroMAC, dec.Eth.SrcMAC) && bytes.Equal(zeroMAC, dec.Eth.DstMAC)
 }
 
+// Must the decoded packet be delivered without fragmentation?  IPv6
+// packets are never fragmented by routers, so they behave as if DF
+// were always set.
 func (dec *EthernetDecoder) DF() bool {
-	return len(dec.decoded) == 2 && (dec.IP.Flags&layers.IPv4DontFragment != 0)
+	return (dec.isIPv4() && dec.IP.Flags&layers.IPv4DontFragment != 0) || dec.isIPv6()
 }
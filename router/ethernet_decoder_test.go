@@ -0,0 +1,112 @@
+package router
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testSrcMAC = MAC{0x02, 0, 0, 0, 0, 1}
+	testDstMAC = MAC{0x02, 0, 0, 0, 0, 2}
+	testSrcIP6 = net.ParseIP("fd00::1")
+	testDstIP6 = net.ParseIP("fd00::2")
+)
+
+// An ethernet frame holding an IPv6 UDP packet with payloadLen bytes
+// of UDP payload
+func testIPv6Frame(t *testing.T, payloadLen int) []byte {
+	ip := &layers.IPv6{
+		Version:      6,
+		TrafficClass: 0x28,
+		NextHeader:   layers.IPProtocolUDP,
+		HopLimit:     64,
+		SrcIP:        testSrcIP6,
+		DstIP:        testDstIP6,
+	}
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 5678}
+	require.NoError(t, udp.SetNetworkLayerForChecksum(ip))
+	payload := make([]byte, payloadLen)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{SrcMAC: testSrcMAC[:], DstMAC: testDstMAC[:], EthernetType: layers.EthernetTypeIPv6},
+		ip, udp, gopacket.Payload(payload)))
+	return buf.Bytes()
+}
+
+// The one's complement sum over the ICMPv6 message and its
+// pseudo-header, which is all ones if the checksum is right
+func icmpv6ChecksumSum(ip *layers.IPv6) uint16 {
+	msg := ip.Payload
+	pseudo := make([]byte, 40)
+	copy(pseudo, ip.SrcIP.To16())
+	copy(pseudo[16:], ip.DstIP.To16())
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(msg)))
+	pseudo[39] = byte(layers.IPProtocolICMPv6)
+	var sum uint32
+	for _, data := range [][]byte{pseudo, msg} {
+		for i := 0; i+1 < len(data); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(data[i:]))
+		}
+		if len(data)%2 == 1 {
+			sum += uint32(data[len(data)-1]) << 8
+		}
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+func TestMakeICMPv6PacketTooBig(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		payloadLen int
+		padding    int // ethernet trailer after the IPv6 packet
+		invoking   int // how much of the IPv6 packet is returned
+	}{
+		{name: "truncated to fit the minimum MTU", payloadLen: 1452, invoking: IPv6MinMTU - 40 - 8},
+		{name: "whole, without ethernet padding", payloadLen: 100, padding: 20, invoking: 148},
+	} {
+		frame := testIPv6Frame(t, tc.payloadLen)
+		invoking := append([]byte(nil), frame[EthernetOverhead:]...)
+		frame = append(frame, make([]byte, tc.padding)...)
+
+		dec := NewEthernetDecoder()
+		dec.DecodeLayers(frame)
+		require.True(t, dec.isIPv6(), tc.name)
+		require.True(t, dec.DF(), tc.name)
+
+		reply, err := dec.makeICMPFragNeeded(1400)
+		require.NoError(t, err, tc.name)
+		require.True(t, len(reply)-EthernetOverhead <= IPv6MinMTU, tc.name)
+
+		packet := gopacket.NewPacket(reply, layers.LayerTypeEthernet, gopacket.Default)
+		eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		require.Equal(t, net.HardwareAddr(testDstMAC[:]), eth.SrcMAC, tc.name)
+		require.Equal(t, net.HardwareAddr(testSrcMAC[:]), eth.DstMAC, tc.name)
+		require.Equal(t, layers.EthernetTypeIPv6, eth.EthernetType, tc.name)
+
+		ip := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+		require.True(t, testDstIP6.Equal(ip.SrcIP), tc.name)
+		require.True(t, testSrcIP6.Equal(ip.DstIP), tc.name)
+		require.Equal(t, layers.IPProtocolICMPv6, ip.NextHeader, tc.name)
+		require.Equal(t, uint8(0x28), ip.TrafficClass, tc.name)
+		require.Equal(t, int(ip.Length), len(ip.Payload), tc.name)
+		require.Equal(t, uint16(0xffff), icmpv6ChecksumSum(ip), tc.name)
+
+		icmp := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+		require.Equal(t, layers.CreateICMPv6TypeCode(layers.ICMPv6TypePacketTooBig, 0), icmp.TypeCode, tc.name)
+		body := ip.Payload[4:]
+		require.Equal(t, uint32(1400), binary.BigEndian.Uint32(body), tc.name)
+		require.Equal(t, invoking[:tc.invoking], body[4:], tc.name)
+	}
+}
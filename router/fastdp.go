@@ -9,6 +9,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/google/gopacket/layers"
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netlink"
 	"github.com/weaveworks/go-odp/odp"
@@ -17,12 +18,13 @@ import (
 	"github.com/weaveworks/weave/net/ipsec"
 )
 
-// The virtual bridge accepts packets from ODP vports and the router
-// port (i.e. InjectPacket).  We need a map key to index those
-// possibilities:
+// The virtual bridge accepts packets from ODP vports, the router
+// port (i.e. InjectPacket) and external VTEPs.  We need a map key to
+// index those possibilities:
 type bridgePortID struct {
 	vport  odp.VportID
 	router bool
+	vtep   string
 }
 
 // A bridgeSender sends out a packet from the virtual bridge
@@ -31,11 +33,24 @@ type bridgeSender func(key PacketKey, lock *fastDatapathLock) FlowOp
 // A missHandler handles an ODP miss
 type missHandler func(fks odp.FlowKeys, lock *fastDatapathLock) FlowOp
 
+// The ODP datapath, as the fast datapath uses it once set up
+type odpDatapath interface {
+	CreateVport(spec odp.VportSpec) (odp.VportID, error)
+	LookupVport(id odp.VportID) (odp.Vport, error)
+	EnumerateVports() ([]odp.Vport, error)
+	DeleteVport(id odp.VportID) error
+	CreateFlow(flow odp.FlowSpec) error
+	DeleteFlow(fks odp.FlowKeys) error
+	ClearFlow(flow odp.FlowSpec) error
+	EnumerateFlows() ([]odp.FlowInfo, error)
+	Execute(packet []byte, fks odp.FlowKeys, actions []odp.Action) error
+}
+
 type FastDatapath struct {
 	lock             sync.Mutex // guards state and synchronises use of dpif
 	iface            *net.Interface
 	dpif             *odp.Dpif
-	dp               odp.DatapathHandle
+	dp               odpDatapath
 	deleteFlowsCount uint64
 	missCount        uint64
 	missHandlers     map[odp.VportID]missHandler
@@ -43,6 +58,7 @@ type FastDatapath struct {
 	peers            *mesh.Peers
 	overlayConsumer  OverlayConsumer
 	ipsec            *ipsec.IPSec
+	saLifetime       IPSecSALifetime
 
 	// Bridge state: How to send to the given bridge port
 	sendToPort map[bridgePortID]bridgeSender
@@ -59,15 +75,33 @@ type FastDatapath struct {
 	mainVxlanVportID odp.VportID
 	mainVxlanUDPPort int
 
+	// bridge ports for the external VTEPs we are the gateway for
+	vteps map[vtepKey]bridgePortID
+
 	// A singleton pool for the occasions when we need to decode
 	// the packet.
 	dec *EthernetDecoder
 
 	// forwarders by remote peer
 	forwarders map[mesh.PeerName]*fastDatapathForwarder
+
+	// forwarders by remote IP, to attribute flow traffic to them
+	forwardersByIP map[[4]byte]*fastDatapathForwarder
+
+	// The traffic counted by the current flows, per forwarder, and
+	// when it was gathered
+	flowTraffic     map[*fastDatapathForwarder]TrafficStats
+	flowTrafficTime time.Time
+}
+
+// IPSecSALifetime limits how long an IPsec SA is used for before it
+// is replaced with one using a fresh key.  Zero values mean no limit.
+type IPSecSALifetime struct {
+	Time  time.Duration
+	Bytes uint64
 }
 
-func NewFastDatapath(iface *net.Interface, port int, encryptionEnabled bool) (*FastDatapath, error) {
+func NewFastDatapath(iface *net.Interface, port int, encryptionEnabled bool, saLifetime IPSecSALifetime) (*FastDatapath, error) {
 	var ipSec *ipsec.IPSec
 
 	dpif, err := odp.NewDpif()
@@ -103,12 +137,16 @@ func NewFastDatapath(iface *net.Interface, port int, encryptionEnabled bool) (*F
 		dp:            dp,
 		missHandlers:  make(map[odp.VportID]missHandler),
 		ipsec:         ipSec,
+		saLifetime:    saLifetime,
 		sendToPort:    nil,
 		sendToMAC:     make(map[MAC]bridgeSender),
 		seenMACs:      make(map[MAC]struct{}),
 		vxlanUDPPorts: make(map[int]odp.VportID),
 		vxlanVportIDs: make(map[odp.VportID]struct{}),
+		vteps:         make(map[vtepKey]bridgePortID),
 		forwarders:    make(map[mesh.PeerName]*fastDatapathForwarder),
+
+		forwardersByIP: make(map[[4]byte]*fastDatapathForwarder),
 	}
 
 	// This delete happens asynchronously in the kernel, meaning that
@@ -342,14 +380,20 @@ func (fastdp fastDatapathOverlay) Stop() {
 	}
 }
 
-func (fastDatapathOverlay) AddFeaturesTo(features map[string]string) {
-	// Nothing needed.  Fast datapath support is indicated through
+func (fastdp fastDatapathOverlay) AddFeaturesTo(features map[string]string) {
+	// Fast datapath support itself is indicated through
 	// OverlaySwitch.
+	features[heartbeatEchoFeature] = "1"
+	features[fastdpPMTUFeature] = "1"
+	if fastdp.ipsec != nil {
+		features[ipsecRekeyFeature] = "1"
+	}
 }
 
 type FastDPStatus struct {
-	Vports []VportStatus
-	Flows  []FlowStatus
+	Vports        []VportStatus
+	Flows         []FlowStatus
+	ExternalVTEPs []string `json:",omitempty"`
 }
 
 type FlowStatus odp.FlowInfo
@@ -411,6 +455,7 @@ func (fastdp fastDatapathOverlay) Diagnostics() interface{} {
 	return FastDPStatus{
 		vportStatuses,
 		flowStatuses,
+		fastdp.externalVTEPs(),
 	}
 }
 
@@ -495,7 +540,16 @@ func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
 		tunnel := fks[odp.OVS_KEY_ATTR_TUNNEL].(odp.TunnelFlowKey)
 		tunKey := tunnel.Key()
 
+		var tunnelFlowKey odp.TunnelFlowKey
+		tunnelFlowKey.SetTunnelId(tunKey.TunnelId)
+		tunnelFlowKey.SetIpv4Src(tunKey.Ipv4Src)
+		tunnelFlowKey.SetIpv4Dst(tunKey.Ipv4Dst)
+
 		lock.relock()
+		if portID, found := fastdp.vtepPort(vxlanVportID, tunKey); found {
+			return NewMultiFlowOp(false, odpFlowKey(tunnelFlowKey), fastdp.bridge(portID, flowKeysToPacketKey(fks), lock))
+		}
+
 		consumer := fastdp.overlayConsumer
 		if consumer == nil {
 			return vetoFlowCreationFlowOp{}
@@ -526,11 +580,6 @@ func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
 			PacketKey: pk,
 		}
 
-		var tunnelFlowKey odp.TunnelFlowKey
-		tunnelFlowKey.SetTunnelId(tunKey.TunnelId)
-		tunnelFlowKey.SetIpv4Src(tunKey.Ipv4Src)
-		tunnelFlowKey.SetIpv4Dst(tunKey.Ipv4Dst)
-
 		return NewMultiFlowOp(false, odpFlowKey(tunnelFlowKey), consumer(key))
 	}
 
@@ -573,6 +622,29 @@ type fastDatapathForwarder struct {
 	isEncrypted                bool
 	isOutboundIPSecEstablished bool
 
+	// IPsec rekeying, guarded by lock
+	ipsecRekey     bool      // the remote peer is able to rekey
+	saInstalled    time.Time // of our current inbound SA
+	saRekey        *saRekey  // awaiting the remote peer's switch to a new inbound SA
+	saRekeyAfter   time.Time // no rekey before this, after one was abandoned
+	rekeysInbound  uint64
+	rekeysOutbound uint64
+
+	// Traffic sent or received in userspace, and counted by flows
+	// which have since been cleared or deleted.  Guarded by the
+	// fastdp lock.
+	traffic TrafficStats
+
+	heartbeats    *heartbeatMonitor
+	heartbeatEcho bool // the remote peer echoes heartbeats
+
+	// Path MTU discovery, guarded by lock
+	pmtuDiscovery   bool // the remote peer answers PMTU probes
+	pmtu            int  // the verified path MTU; 0 until known
+	pmtuSearch      pmtuSearch
+	pmtuTimer       *time.Timer // for probe timeouts and rechecks
+	mtuChan         chan bool
+
 	lock              sync.RWMutex
 	confirmed         bool
 	remoteAddr        *net.UDPAddr
@@ -624,6 +696,12 @@ func (fastdp fastDatapathOverlay) PrepareConnection(params mesh.OverlayConnectio
 		connUID:        params.ConnUID,
 		vxlanVportID:   vxlanVportID,
 		sessionKey:     params.SessionKey,
+		heartbeats:     newHeartbeatMonitor(time.Now),
+		heartbeatEcho:  params.Features[heartbeatEchoFeature] != "",
+		ipsecRekey:     params.Features[ipsecRekeyFeature] != "",
+		pmtuDiscovery:  params.Features[fastdpPMTUFeature] != "",
+		pmtuTimer:      time.NewTimer(MaxDuration),
+		mtuChan:        make(chan bool),
 		healthy:        true,
 
 		remoteAddr:        remoteAddr,
@@ -676,10 +754,14 @@ func (fwd *fastDatapathForwarder) Confirm() {
 			fwd.lock.Unlock()
 			return
 		}
+		fwd.saInstalled = time.Now()
 	}
 
 	log.Debug(fwd.logPrefix(), "confirmed")
 	fwd.fastdp.addForwarder(fwd.remotePeer.Name, fwd)
+	if fwd.remoteAddr != nil {
+		fwd.fastdp.setForwarderIP(fwd, fwd.remoteAddr.IP)
+	}
 	fwd.confirmed = true
 
 	if fwd.remoteAddr != nil && (!fwd.isEncrypted || fwd.isOutboundIPSecEstablished) {
@@ -717,6 +799,10 @@ func (fwd *fastDatapathForwarder) HealthChannel() <-chan bool {
 	return fwd.healthChan
 }
 
+func (fwd *fastDatapathForwarder) MTUChannel() <-chan bool {
+	return fwd.mtuChan
+}
+
 func (fwd *fastDatapathForwarder) doHeartbeats() {
 	var err error
 	for err == nil {
@@ -725,6 +811,7 @@ func (fwd *fastDatapathForwarder) doHeartbeats() {
 			if fwd.confirmed {
 				log.Debug(fwd.logPrefix(), "sending Heartbeat to peer")
 				fwd.sendHeartbeat()
+				fwd.rekeyIfDue()
 			}
 			fwd.heartbeatTimer.Reset(fwd.heartbeatInterval)
 
@@ -748,6 +835,11 @@ func (fwd *fastDatapathForwarder) doHeartbeats() {
 				fwd.healthy = false
 			}
 
+		case <-fwd.pmtuTimer.C:
+			fwd.lock.Lock()
+			fwd.handlePMTUTimer()
+			fwd.lock.Unlock()
+
 		case <-fwd.stopChan:
 			return
 		}
@@ -781,11 +873,32 @@ func (fwd *fastDatapathForwarder) sendHeartbeat() {
 	fwd.lock.RLock()
 
 	// the heartbeat payload consists of the 64-bit connection uid
-	// followed by the 16-bit packet size.
-	buf := make([]byte, EthernetOverhead+fwd.fastdp.iface.MTU)
+	// followed by the 16-bit packet size.  Once the connection is
+	// established, and if the peer is able to echo heartbeats, that
+	// is followed by the kind of echo frame and a 64-bit stamp to
+	// identify the heartbeat by, so we can measure the RTT.
+	//
+	// Heartbeats are padded to the MTU, so that the connection is
+	// only established if the path carries full-sized frames,
+	// unless the peer answers PMTU probes, which tell us that
+	// instead.
+	size := EthernetOverhead + fwd.fastdp.iface.MTU
+	if fwd.pmtuDiscovery {
+		size = EthernetOverhead + heartbeatMinSize
+	}
+	buf := make([]byte, size)
 	binary.BigEndian.PutUint64(buf[EthernetOverhead:], fwd.connUID)
 	binary.BigEndian.PutUint16(buf[EthernetOverhead+8:], uint16(len(buf)))
+	if fwd.heartbeatEcho && fwd.established {
+		buf[EthernetOverhead+10] = heartbeatEchoRequest
+		binary.BigEndian.PutUint64(buf[EthernetOverhead+11:], fwd.heartbeats.sent())
+	}
+	fwd.lock.RUnlock()
 
+	fwd.sendSpecial(buf)
+}
+
+func (fwd *fastDatapathForwarder) sendSpecial(buf []byte) {
 	dec := NewEthernetDecoder()
 	dec.DecodeLayers(buf)
 	pk := ForwardPacketKey{
@@ -793,7 +906,6 @@ func (fwd *fastDatapathForwarder) sendHeartbeat() {
 		SrcPeer:   fwd.fastdp.localPeer,
 		DstPeer:   fwd.remotePeer,
 	}
-	fwd.lock.RUnlock()
 
 	if fop := fwd.Forward(pk); fop != nil {
 		fop.Process(buf, dec, false)
@@ -803,15 +915,73 @@ func (fwd *fastDatapathForwarder) sendHeartbeat() {
 const (
 	FastDatapathHeartbeatAck = iota
 	FastDatapathCryptoInitSARemote
+	FastDatapathCryptoRekeySA
+	FastDatapathCryptoRekeyAck
+	FastDatapathPMTUVerified
+)
+
+// Peers which can replace IPsec SAs on an established connection
+// advertise this feature.
+const ipsecRekeyFeature = "IPSecRekey"
+
+// Peers which answer path MTU probes advertise this feature.  Their
+// heartbeats need not be padded to the MTU.
+const fastdpPMTUFeature = "FastdpPMTU"
+
+const (
+	// The kind of special packet, in the place of the heartbeat
+	// echo kind, which probes the path MTU
+	fastdpPMTUProbe = 3
+	// Big enough for a heartbeat with an echo request
+	heartbeatMinSize = 19
+	// How often to check that the path MTU has not changed
+	PMTURecheckInterval = 10 * time.Minute
 )
 
+const (
+	// How long to keep an inbound SA after the remote peer has
+	// switched away from it, for packets still in flight
+	saRetireDelay = 5 * time.Second
+	// How long to wait for the remote peer to acknowledge a new
+	// inbound SA before sending the RekeySA again
+	saRekeyRetryInterval = 15 * time.Second
+	// How long to wait for the remote peer to switch to a new
+	// inbound SA before abandoning it, and then before trying again
+	saRekeyTimeout = time.Minute
+)
+
+// A rekey of our inbound SA, awaiting the remote peer's
+// acknowledgement
+type saRekey struct {
+	msg         []byte // the RekeySA, to send again
+	started     time.Time
+	sent        time.Time
+	prevInstall time.Time // saInstalled before the rekey
+	acked       bool
+}
+
+// What to do about a rekey at the given time: send the RekeySA again
+// if the last one has had time to be acknowledged, or abandon the
+// rekey if the remote peer has had long enough.
+func (rekey *saRekey) next(now time.Time) (resend, abandon bool) {
+	switch {
+	case rekey.acked:
+		return false, false
+	case now.Sub(rekey.started) >= saRekeyTimeout:
+		return false, true
+	case now.Sub(rekey.sent) >= saRekeyRetryInterval:
+		return true, false
+	}
+	return false, false
+}
+
 func (fwd *fastDatapathForwarder) handleVxlanSpecialPacket(frame []byte, sender *net.UDPAddr) {
 	fwd.lock.Lock()
 	defer fwd.lock.Unlock()
 
 	log.Debug(fwd.logPrefix(), "handleVxlanSpecialPacket")
 
-	// the only special packet type is a heartbeat
+	// special packets are heartbeats, or PMTU probes
 	if len(frame) < EthernetOverhead+10 {
 		log.Warning(fwd.logPrefix(), "short vxlan special packet: ", len(frame), " bytes")
 		return
@@ -822,8 +992,33 @@ func (fwd *fastDatapathForwarder) handleVxlanSpecialPacket(frame []byte, sender
 		return
 	}
 
+	if len(frame) > EthernetOverhead+10 && frame[EthernetOverhead+10] == fastdpPMTUProbe {
+		buf := make([]byte, 2)
+		binary.BigEndian.PutUint16(buf, uint16(len(frame)-EthernetOverhead))
+		fwd.handleError(fwd.sendControlMsg(FastDatapathPMTUVerified, buf))
+		return
+	}
+
+	if len(frame) >= EthernetOverhead+heartbeatMinSize {
+		stamp := binary.BigEndian.Uint64(frame[EthernetOverhead+11:])
+		switch frame[EthernetOverhead+10] {
+		case heartbeatEchoReply:
+			fwd.heartbeats.echoed(stamp)
+			return
+
+		case heartbeatEchoRequest:
+			// Forward needs the lock, so send the echo
+			// asynchronously
+			reply := make([]byte, len(frame))
+			copy(reply, frame)
+			reply[EthernetOverhead+10] = heartbeatEchoReply
+			go fwd.sendSpecial(reply)
+		}
+	}
+
 	if fwd.remoteAddr == nil {
 		fwd.remoteAddr = sender
+		fwd.fastdp.setForwarderIP(fwd, sender.IP)
 
 		if fwd.confirmed {
 			fwd.heartbeatTimer.Reset(0)
@@ -831,6 +1026,7 @@ func (fwd *fastDatapathForwarder) handleVxlanSpecialPacket(frame []byte, sender
 	} else if !udpAddrsEqual(fwd.remoteAddr, sender) {
 		log.Info(fwd.logPrefix(), "Peer IP address changed to ", sender)
 		fwd.remoteAddr = sender
+		fwd.fastdp.setForwarderIP(fwd, sender.IP)
 	}
 
 	if !fwd.ackedHeartbeat {
@@ -864,6 +1060,12 @@ func (fwd *fastDatapathForwarder) ControlMessage(tag byte, msg []byte) {
 		fwd.handleHeartbeatAck()
 	case FastDatapathCryptoInitSARemote:
 		fwd.handleCryptoInitSARemote(msg)
+	case FastDatapathCryptoRekeySA:
+		fwd.handleCryptoRekeySA(msg)
+	case FastDatapathCryptoRekeyAck:
+		fwd.handleCryptoRekeyAck(msg)
+	case FastDatapathPMTUVerified:
+		fwd.handlePMTUVerified(msg)
 
 	default:
 		log.Info(fwd.logPrefix(), "Ignoring unknown control message: ", tag)
@@ -871,13 +1073,38 @@ func (fwd *fastDatapathForwarder) ControlMessage(tag byte, msg []byte) {
 }
 
 func (fwd *fastDatapathForwarder) Attrs() map[string]interface{} {
-	return map[string]interface{}{"name": "fastdp", "mtu": fwd.fastdp.iface.MTU}
+	attrs := map[string]interface{}{"name": "fastdp", "mtu": fwd.fastdp.iface.MTU}
+	fwd.heartbeats.addAttrs(attrs)
+	fwd.lock.RLock()
+	if fwd.pmtu != 0 {
+		attrs["mtu"] = fwd.pmtu
+	}
+	if fwd.isEncrypted && fwd.ipsecRekey {
+		attrs["ipsec-rekeys-in"] = fwd.rekeysInbound
+		attrs["ipsec-rekeys-out"] = fwd.rekeysOutbound
+	}
+	fwd.lock.RUnlock()
+	return attrs
+}
+
+func (fwd *fastDatapathForwarder) HeartbeatStats() map[string]HeartbeatStats {
+	return map[string]HeartbeatStats{"fastdp": fwd.heartbeats.Stats()}
+}
+
+func (fwd *fastDatapathForwarder) Traffic() map[string]TrafficStats {
+	return map[string]TrafficStats{"fastdp": fwd.fastdp.forwarderTraffic(fwd)}
 }
 
 func (fwd *fastDatapathForwarder) handleHeartbeatAck() {
 	log.Debug(fwd.logPrefix(), "handleHeartbeatAck")
 
-	if !fwd.established {
+	// With PMTU discovery, we are established once we know how
+	// big a frame the path carries
+	if fwd.pmtuDiscovery {
+		if !fwd.established && !fwd.pmtuSearch.searching() {
+			fwd.startPMTUSearch()
+		}
+	} else if !fwd.established {
 		close(fwd.establishedChan)
 		fwd.established = true
 	}
@@ -890,6 +1117,103 @@ func (fwd *fastDatapathForwarder) handleHeartbeatAck() {
 	}
 }
 
+// Probe the path MTU by sending special packets, which the remote
+// peer acknowledges, until we find the largest which gets through.
+// Called with the lock held.
+func (fwd *fastDatapathForwarder) startPMTUSearch() {
+	fwd.pmtuSearch.start(pmtuFloor, fwd.fastdp.iface.MTU)
+	fwd.sendPMTUProbe()
+}
+
+func (fwd *fastDatapathForwarder) sendPMTUProbe() {
+	log.Debug(fwd.logPrefix(), "sendPMTUProbe: mtu candidate ", fwd.pmtuSearch.candidate)
+
+	buf := make([]byte, EthernetOverhead+fwd.pmtuSearch.candidate)
+	binary.BigEndian.PutUint64(buf[EthernetOverhead:], fwd.connUID)
+	binary.BigEndian.PutUint16(buf[EthernetOverhead+8:], uint16(len(buf)))
+	buf[EthernetOverhead+10] = fastdpPMTUProbe
+	// Forward needs the lock, so send the probe asynchronously
+	go fwd.sendSpecial(buf)
+
+	fwd.pmtuTimer.Reset(fwd.pmtuSearch.probeTimeout())
+}
+
+func (fwd *fastDatapathForwarder) handlePMTUVerified(msg []byte) {
+	if len(msg) < 2 {
+		log.Print(fwd.logPrefix(), "Received truncated PMTUVerified")
+		return
+	}
+
+	mtu := int(binary.BigEndian.Uint16(msg))
+	log.Debug(fwd.logPrefix(), "handlePMTUVerified: for mtu candidate ", mtu)
+	if !fwd.pmtuSearch.searching() || mtu != fwd.pmtuSearch.candidate {
+		return
+	}
+
+	fwd.pmtuSearch.update(true)
+	fwd.searchPMTU()
+}
+
+// The timer either says that a probe has gone unanswered, or that it
+// is time to check the path MTU again.
+func (fwd *fastDatapathForwarder) handlePMTUTimer() {
+	if fwd.stopped {
+		return
+	}
+	if !fwd.pmtuSearch.searching() {
+		fwd.startPMTUSearch()
+		return
+	}
+	if fwd.pmtuSearch.retry() {
+		fwd.sendPMTUProbe()
+		return
+	}
+
+	log.Debug(fwd.logPrefix(), "handlePMTUTimer: no answer for mtu candidate ", fwd.pmtuSearch.candidate)
+	fwd.pmtuSearch.update(false)
+	fwd.searchPMTU()
+}
+
+func (fwd *fastDatapathForwarder) searchPMTU() {
+	log.Debug(fwd.logPrefix(), "searchPMTU: ", fwd.pmtuSearch.highestGood, fwd.pmtuSearch.lowestBad)
+
+	if fwd.pmtuSearch.searching() {
+		fwd.sendPMTUProbe()
+		return
+	}
+
+	mtu := fwd.pmtuSearch.result()
+	if mtu == 0 {
+		// Sleeve can carry the traffic instead
+		fwd.handleError(fmt.Errorf("path MTU below %d; no PMTU probes got through", pmtuFloor))
+		return
+	}
+	fwd.pmtuTimer.Reset(PMTURecheckInterval)
+
+	if mtu != fwd.pmtu {
+		fwd.pmtu = mtu
+		ok := mtu >= fwd.fastdp.iface.MTU
+		if ok {
+			log.Print(fwd.logPrefix(), "Effective MTU verified at ", mtu)
+		} else {
+			log.Warning(fwd.logPrefix(), "Effective MTU verified at ", mtu,
+				", which is below the bridge MTU of ", fwd.fastdp.iface.MTU,
+				"; larger packets would be dropped")
+		}
+		go func() {
+			select {
+			case fwd.mtuChan <- ok:
+			case <-fwd.stopChan:
+			}
+		}()
+	}
+
+	if !fwd.established {
+		close(fwd.establishedChan)
+		fwd.established = true
+	}
+}
+
 func (fwd *fastDatapathForwarder) handleCryptoInitSARemote(msg []byte) {
 	if fwd.stopped {
 		log.Info(fwd.logPrefix(), "IPSec init SA remote failed: forwarder has already been stopped")
@@ -917,6 +1241,165 @@ func (fwd *fastDatapathForwarder) handleCryptoInitSARemote(msg []byte) {
 	}
 }
 
+// Replace our inbound SA if it has exceeded its lifetime.  The new SA
+// is installed alongside the old one, which is only removed once the
+// remote peer has switched to the new one.  The RekeySA is sent again
+// until the remote peer acknowledges it, and the rekey abandoned if it
+// never does.
+func (fwd *fastDatapathForwarder) rekeyIfDue() {
+	fwd.lock.Lock()
+	if !fwd.isEncrypted || !fwd.ipsecRekey || fwd.stopped {
+		fwd.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	if rekey := fwd.saRekey; rekey != nil {
+		resend, abandon := rekey.next(now)
+		switch {
+		case resend:
+			log.Info(fwd.logPrefix(), "IPSec rekey not acknowledged by peer, sending again")
+			rekey.sent = now
+			sendControlMsg := fwd.sendControlMsg
+			fwd.lock.Unlock()
+			fwd.sendRekeySA(sendControlMsg, rekey.msg)
+		case abandon:
+			fwd.abandonRekey(now)
+			fwd.lock.Unlock()
+		default:
+			fwd.lock.Unlock()
+		}
+		return
+	}
+	if now.Before(fwd.saRekeyAfter) || !fwd.saLifetimeExceeded() {
+		fwd.lock.Unlock()
+		return
+	}
+
+	log.Info(fwd.logPrefix(), "IPSec rekey")
+	controlMsg, err := fwd.fastdp.ipsec.RekeySALocal(
+		fwd.fastdp.localPeer.Name, fwd.remotePeer.Name, fwd.connUID,
+		net.IP(fwd.localIP[:]), fwd.remoteAddr.IP, fwd.remoteAddr.Port,
+		fwd.sessionKey,
+	)
+	if err != nil {
+		// the current SA remains usable, so try again later
+		log.Warning(fwd.logPrefix(), "IPSec rekey SA local failed: ", err)
+		fwd.lock.Unlock()
+		return
+	}
+	fwd.saRekey = &saRekey{msg: controlMsg, started: now, sent: now, prevInstall: fwd.saInstalled}
+	fwd.saInstalled = now
+	sendControlMsg := fwd.sendControlMsg
+	fwd.lock.Unlock() // unlock before calling send() which may block
+
+	fwd.sendRekeySA(sendControlMsg, controlMsg)
+}
+
+func (fwd *fastDatapathForwarder) sendRekeySA(sendControlMsg func(byte, []byte) error, msg []byte) {
+	if err := sendControlMsg(FastDatapathCryptoRekeySA, msg); err != nil {
+		log.Warning(fwd.logPrefix(), "IPSec send RekeySA failed: ", err)
+	}
+}
+
+// Give up on a rekey the remote peer has not acknowledged.  Unless
+// the remote peer has in fact switched to the new SA, the old one
+// stays in use, and the rekey is tried again later.  Called with the
+// lock held.
+func (fwd *fastDatapathForwarder) abandonRekey(now time.Time) {
+	log.Warning(fwd.logPrefix(), "IPSec rekey not acknowledged by peer after ", now.Sub(fwd.saRekey.started).Round(time.Second))
+	kept, err := fwd.fastdp.ipsec.AbandonRekeySALocal(
+		fwd.fastdp.localPeer.Name, fwd.remotePeer.Name, fwd.connUID,
+		net.IP(fwd.localIP[:]), fwd.remoteAddr.IP, fwd.remoteAddr.Port,
+	)
+	switch {
+	case err != nil:
+		log.Warning(fwd.logPrefix(), "IPSec abandon rekey failed: ", err)
+	case kept:
+		log.Info(fwd.logPrefix(), "IPSec rekey completed: peer is using the new SA")
+		fwd.rekeysInbound++
+	default:
+		fwd.saInstalled = fwd.saRekey.prevInstall
+		fwd.saRekeyAfter = now.Add(saRekeyTimeout)
+	}
+	fwd.saRekey = nil
+}
+
+func (fwd *fastDatapathForwarder) saLifetimeExceeded() bool {
+	lifetime := fwd.fastdp.saLifetime
+	if lifetime.Time > 0 && time.Since(fwd.saInstalled) >= lifetime.Time {
+		return true
+	}
+	if lifetime.Bytes > 0 {
+		bytes, err := fwd.fastdp.ipsec.InboundSABytes(
+			fwd.fastdp.localPeer.Name, fwd.remotePeer.Name, fwd.connUID,
+			net.IP(fwd.localIP[:]), fwd.remoteAddr.IP,
+		)
+		if err != nil {
+			log.Warning(fwd.logPrefix(), "IPSec SA lifetime check failed: ", err)
+			return false
+		}
+		return bytes >= lifetime.Bytes
+	}
+	return false
+}
+
+func (fwd *fastDatapathForwarder) handleCryptoRekeySA(msg []byte) {
+	if fwd.stopped || !fwd.isOutboundIPSecEstablished {
+		log.Info(fwd.logPrefix(), "IPSec rekey SA remote ignored: outbound SA not established")
+		return
+	}
+
+	log.Info(fwd.logPrefix(), "IPSec rekey SA remote")
+	ack, err := fwd.fastdp.ipsec.RekeySARemote(
+		msg,
+		fwd.fastdp.localPeer.Name, fwd.remotePeer.Name, fwd.connUID,
+		net.IP(fwd.localIP[:]), fwd.remoteAddr.IP, fwd.remoteAddr.Port,
+		fwd.sessionKey,
+	)
+	if err != nil {
+		// the old SA may still be in use, so carry on with it
+		log.Warning(fwd.logPrefix(), "IPSec rekey SA remote failed: ", err)
+		return
+	}
+	fwd.rekeysOutbound++
+
+	sendControlMsg := fwd.sendControlMsg
+	go func() {
+		if err := sendControlMsg(FastDatapathCryptoRekeyAck, ack); err != nil {
+			log.Warning(fwd.logPrefix(), "IPSec send RekeyAck failed: ", err)
+		}
+	}()
+}
+
+func (fwd *fastDatapathForwarder) handleCryptoRekeyAck(msg []byte) {
+	if fwd.stopped || fwd.saRekey == nil || fwd.saRekey.acked {
+		log.Info(fwd.logPrefix(), "IPSec rekey ack ignored: no rekey in progress")
+		return
+	}
+
+	rekey := fwd.saRekey
+	rekey.acked = true
+	time.AfterFunc(saRetireDelay, func() {
+		fwd.lock.Lock()
+		defer fwd.lock.Unlock()
+		if fwd.stopped || fwd.saRekey != rekey {
+			return
+		}
+
+		fwd.saRekey = nil
+		err := fwd.fastdp.ipsec.RetireSALocal(
+			msg,
+			fwd.fastdp.localPeer.Name, fwd.remotePeer.Name, fwd.connUID,
+			net.IP(fwd.localIP[:]), fwd.remoteAddr.IP, fwd.remoteAddr.Port,
+		)
+		if err != nil {
+			log.Warning(fwd.logPrefix(), "IPSec retire SA local failed: ", err)
+			return
+		}
+		fwd.rekeysInbound++
+	})
+}
+
 func (fwd *fastDatapathForwarder) Forward(key ForwardPacketKey) FlowOp {
 	if !key.SrcPeer.HasShortID || !key.DstPeer.HasShortID {
 		return nil
@@ -945,6 +1428,12 @@ func (fwd *fastDatapathForwarder) Forward(key ForwardPacketKey) FlowOp {
 	sta.SetIpv4Dst(remoteIP)
 	sta.SetTos(0)
 	sta.SetTtl(64)
+	// The kernel forwards frames matching this flow without looking
+	// at their size, so unlike sleeve we cannot answer packets too
+	// big for the path with ICMP "fragmentation needed" or ICMPv6
+	// "packet too big"; with DF set they are dropped instead.  That
+	// is why a path MTU below the configured one makes the overlay
+	// switch prefer other overlays for the connection.
 	sta.SetDf(true)
 	sta.SetCsum(false)
 	return fwd.fastdp.odpActions(sta, odp.NewOutputAction(fwd.vxlanVportID))
@@ -1000,6 +1489,92 @@ func (fastdp *FastDatapath) removeForwarder(peer mesh.PeerName, fwd *fastDatapat
 	if fastdp.forwarders[peer] == fwd {
 		delete(fastdp.forwarders, peer)
 	}
+	for ip, f := range fastdp.forwardersByIP {
+		if f == fwd {
+			delete(fastdp.forwardersByIP, ip)
+		}
+	}
+}
+
+// Called with the forwarder's lock held
+func (fastdp *FastDatapath) setForwarderIP(fwd *fastDatapathForwarder, ip net.IP) {
+	remoteIP, err := ipv4Bytes(ip)
+	if err != nil {
+		return
+	}
+
+	fastdp.lock.Lock()
+	defer fastdp.lock.Unlock()
+	for ip, f := range fastdp.forwardersByIP {
+		if f == fwd {
+			delete(fastdp.forwardersByIP, ip)
+		}
+	}
+	fastdp.forwardersByIP[remoteIP] = fwd
+}
+
+// Call f for each forwarder that traffic matching the flow passes
+// through: received from the remote IP in the tunnel key, or sent to
+// the remote IP of a set-tunnel action.  Called with the fastdp lock
+// held.
+func (fastdp *FastDatapath) flowForwarders(flow *odp.FlowSpec, f func(fwd *fastDatapathForwarder, tx bool)) {
+	for _, key := range flow.FlowKeys {
+		if k, ok := key.(odp.TunnelFlowKey); ok {
+			if fwd := fastdp.forwardersByIP[k.Key().Ipv4Src]; fwd != nil {
+				f(fwd, false)
+			}
+		}
+	}
+
+	for _, action := range flow.Actions {
+		if a, ok := action.(odp.SetTunnelAction); ok {
+			if fwd := fastdp.forwardersByIP[a.Ipv4Dst]; fwd != nil {
+				f(fwd, true)
+			}
+		}
+	}
+}
+
+// Add the traffic counted by a flow which is about to be cleared or
+// deleted to the forwarders' totals.  Called with the fastdp lock
+// held.
+func (fastdp *FastDatapath) harvestFlowTraffic(flow *odp.FlowInfo) {
+	fastdp.flowForwarders(&flow.FlowSpec, func(fwd *fastDatapathForwarder, tx bool) {
+		fwd.traffic.count(tx, flow.Packets, flow.Bytes)
+	})
+
+	// The gathered counts of current flows now overlap with the
+	// totals.
+	fastdp.flowTrafficTime = time.Time{}
+}
+
+// How long the gathered traffic of current flows remains valid, to
+// avoid enumerating the flows for each connection in a status report
+const flowTrafficMaxAge = time.Second
+
+func (fastdp *FastDatapath) forwarderTraffic(fwd *fastDatapathForwarder) TrafficStats {
+	fastdp.lock.Lock()
+	defer fastdp.lock.Unlock()
+
+	if time.Since(fastdp.flowTrafficTime) > flowTrafficMaxAge {
+		flows, err := fastdp.dp.EnumerateFlows()
+		checkWarn(err)
+		flowTraffic := make(map[*fastDatapathForwarder]TrafficStats)
+		for i := range flows {
+			flow := &flows[i]
+			fastdp.flowForwarders(&flow.FlowSpec, func(fwd *fastDatapathForwarder, tx bool) {
+				stats := flowTraffic[fwd]
+				stats.count(tx, flow.Packets, flow.Bytes)
+				flowTraffic[fwd] = stats
+			})
+		}
+		fastdp.flowTraffic = flowTraffic
+		fastdp.flowTrafficTime = time.Now()
+	}
+
+	stats := fwd.traffic
+	stats.Add(fastdp.flowTraffic[fwd])
+	return stats
 }
 
 func (fastdp *FastDatapath) deleteFlows() error {
@@ -1011,6 +1586,7 @@ func (fastdp *FastDatapath) deleteFlows() error {
 	}
 
 	for _, flow := range flows {
+		fastdp.harvestFlowTraffic(&flow)
 		err = fastdp.dp.DeleteFlow(flow.FlowKeys)
 		if err != nil && !odp.IsNoSuchFlowError(err) {
 			return err
@@ -1076,6 +1652,7 @@ func (fastdp *FastDatapath) expireFlows() {
 	checkWarn(err)
 
 	for _, flow := range flows {
+		fastdp.harvestFlowTraffic(&flow)
 		if flow.Used == 0 {
 			log.Debug("Expiring flow ", flow.FlowSpec)
 			err = fastdp.dp.DeleteFlow(flow.FlowKeys)
@@ -1136,7 +1713,11 @@ func (fastdp *FastDatapath) Miss(packet []byte, fks odp.FlowKeys) error {
 	// delivery to a local netdev based on the dest MAC),
 	// including the ingress in every flow makes things simpler
 	// in touchFlow.
-	mfop := NewMultiFlowOp(false, handler(fks, &lock), odpFlowKey(odp.NewInPortFlowKey(ingress)))
+	fop := handler(fks, &lock)
+	lock.relock()
+	fastdp.countTraffic(&odp.FlowSpec{FlowKeys: fks}, packet)
+
+	mfop := NewMultiFlowOp(false, fop, odpFlowKey(odp.NewInPortFlowKey(ingress)))
 	fastdp.send(mfop, packet, &lock)
 	return nil
 }
@@ -1208,9 +1789,17 @@ func (fastdp *FastDatapath) makeBridgeVport(vport odp.Vport) {
 	}
 }
 
+// A frame in a segment has the VLAN tag the bridge gave it, which the
+// kernel leaves in the frame.
 func flowKeysToPacketKey(fks odp.FlowKeys) PacketKey {
 	eth := fks[odp.OVS_KEY_ATTR_ETHERNET].(odp.EthernetFlowKey).Key()
-	return PacketKey{SrcMAC: eth.EthSrc, DstMAC: eth.EthDst}
+	key := PacketKey{SrcMAC: eth.EthSrc, DstMAC: eth.EthDst}
+	if vlan, ok := fks[odp.OVS_KEY_ATTR_VLAN].(odp.VlanFlowKey); ok {
+		if vid, tagged := vlan.VlanID(); tagged {
+			key.Segment = Segment(vid)
+		}
+	}
+	return key
 }
 
 // The sendToPort map is read-only, so this method does the copy in
@@ -1240,7 +1829,21 @@ func (fastdp *FastDatapath) send(fops FlowOp, frame []byte, lock *fastDatapathLo
 	flow := odp.NewFlowSpec()
 	createFlow := true
 
-	for _, xfop := range FlattenFlowOp(fops) {
+	xfops := FlattenFlowOp(fops)
+	for i := 0; i < len(xfops); i++ {
+		xfop := xfops[i]
+		if efop, ok := xfop.(ethertypeFlowOp); ok {
+			if ethertype := frameEthertype(frame); ethertypeFlowKeyUsable(ethertype, efop.inspectedEthertype()) {
+				// The FlowOp stands aside for this frame,
+				// so the flow must match on the ethertype
+				flow.AddKey(odp.NewEthertypeFlowKey(uint16(ethertype)))
+				if wrapped := efop.wrappedFlowOp(); wrapped != nil {
+					xfops = append(xfops, FlattenFlowOp(wrapped)...)
+				}
+				continue
+			}
+		}
+
 		switch fop := xfop.(type) {
 		case interface {
 			updateFlowSpec(*odp.FlowSpec)
@@ -1289,7 +1892,7 @@ func (fastdp *FastDatapath) send(fops FlowOp, frame []byte, lock *fastDatapathLo
 
 	if len(flow.Actions) != 0 {
 		lock.relock()
-		checkWarn(fastdp.dp.Execute(frame, nil, flow.Actions))
+		fastdp.execute(frame, flow.Actions)
 	}
 
 	if createFlow {
@@ -1306,6 +1909,15 @@ func (fastdp *FastDatapath) send(fops FlowOp, frame []byte, lock *fastDatapathLo
 	}
 }
 
+// Whether a flow for a frame of the given ethertype can match on it,
+// leaving frames of the inspected ethertype to miss.  Flows only
+// match on the ethertypes of IP, as the kernel would expect keys for
+// the payloads of others, and VLAN tags move the ethertype.
+func ethertypeFlowKeyUsable(ethertype, inspected layers.EthernetType) bool {
+	return ethertype != inspected &&
+		(ethertype == layers.EthernetTypeIPv4 || ethertype == layers.EthernetTypeIPv6)
+}
+
 // Get the EthernetDecoder from the singleton pool
 func (fastdp *FastDatapath) takeDecoder(lock *fastDatapathLock) *EthernetDecoder {
 	lock.relock()
@@ -1383,7 +1995,25 @@ func (fop odpActionsFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcas
 	fastdp := fop.fastdp
 	fastdp.lock.Lock()
 	defer fastdp.lock.Unlock()
-	checkWarn(fastdp.dp.Execute(frame, nil, fop.actions))
+	fastdp.execute(frame, fop.actions)
+}
+
+// Execute actions on a packet in the datapath.  Called with the
+// fastdp lock held.
+func (fastdp *FastDatapath) execute(frame []byte, actions []odp.Action) {
+	if err := fastdp.dp.Execute(frame, nil, actions); err != nil {
+		log.Warning(err)
+		return
+	}
+	fastdp.countTraffic(&odp.FlowSpec{Actions: actions}, frame)
+}
+
+// Count a packet handled in userspace.  Called with the fastdp lock
+// held.
+func (fastdp *FastDatapath) countTraffic(flow *odp.FlowSpec, frame []byte) {
+	fastdp.flowForwarders(flow, func(fwd *fastDatapathForwarder, tx bool) {
+		fwd.traffic.count(tx, 1, uint64(len(frame)))
+	})
 }
 
 // A vetoFlowCreationFlowOp flags that no flow should be created
@@ -1409,5 +2039,12 @@ func odpEthernetFlowKey(key PacketKey) FlowOp {
 	fk := odp.NewEthernetFlowKey()
 	fk.SetEthSrc(key.SrcMAC)
 	fk.SetEthDst(key.DstMAC)
-	return odpFlowKeyFlowOp{key: fk}
+	if key.Segment == 0 {
+		// The kernel only matches untagged frames against a
+		// flow without a VLAN key
+		return odpFlowKeyFlowOp{key: fk}
+	}
+
+	return NewMultiFlowOp(false, odpFlowKeyFlowOp{key: fk},
+		odpFlowKey(odp.NewVlanFlowKey(uint16(key.Segment))))
 }
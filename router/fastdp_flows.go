@@ -0,0 +1,299 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/weaveworks/go-odp/odp"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common"
+)
+
+// Structured views of the ODP flows, for inspecting and deleting
+// individual flows through the HTTP API.  Unlike FlowStatus, which
+// renders whole flows as strings for the status report, these can be
+// filtered.
+
+type FastDPFlow struct {
+	// Identifies the flow for deletion.  It is derived from the
+	// flow keys, so it is stable for the lifetime of the flow.
+	ID      string
+	Keys    FastDPFlowKeys
+	Actions []FastDPFlowAction
+	Packets uint64
+	Bytes   uint64
+	Used    uint64
+}
+
+type FastDPFlowKeys struct {
+	InPort *FastDPVport  `json:",omitempty"`
+	EthSrc string        `json:",omitempty"`
+	EthDst string        `json:",omitempty"`
+	Tunnel *FastDPTunnel `json:",omitempty"`
+	Other  []string      `json:",omitempty"`
+}
+
+type FastDPFlowAction struct {
+	Output    *FastDPVport  `json:",omitempty"`
+	SetTunnel *FastDPTunnel `json:",omitempty"`
+	Other     string        `json:",omitempty"`
+}
+
+type FastDPVport struct {
+	ID   odp.VportID
+	Name string `json:",omitempty"`
+}
+
+type FastDPTunnel struct {
+	SrcPeer string `json:",omitempty"`
+	DstPeer string `json:",omitempty"`
+	Ipv4Src string `json:",omitempty"`
+	Ipv4Dst string `json:",omitempty"`
+}
+
+// A FastDPFlowFilter selects flows with a key or action involving
+// the MAC, peer (by name or nickname) and vport (by number or name),
+// where given.
+type FastDPFlowFilter struct {
+	MAC   net.HardwareAddr
+	Peer  string
+	Vport string
+}
+
+func (filter *FastDPFlowFilter) matches(flow *FastDPFlow) bool {
+	if filter.MAC != nil {
+		mac := filter.MAC.String()
+		if flow.Keys.EthSrc != mac && flow.Keys.EthDst != mac {
+			return false
+		}
+	}
+	if filter.Peer != "" {
+		found := flow.Keys.Tunnel.involves(filter.Peer)
+		for _, action := range flow.Actions {
+			found = found || action.SetTunnel.involves(filter.Peer)
+		}
+		if !found {
+			return false
+		}
+	}
+	if filter.Vport != "" {
+		found := flow.Keys.InPort.is(filter.Vport)
+		for _, action := range flow.Actions {
+			found = found || action.Output.is(filter.Vport)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (vport *FastDPVport) is(s string) bool {
+	return vport != nil && (strconv.FormatUint(uint64(vport.ID), 10) == s || vport.Name == s)
+}
+
+func (tunnel *FastDPTunnel) involves(peer string) bool {
+	return tunnel != nil && (tunnel.SrcPeer == peer || tunnel.DstPeer == peer)
+}
+
+func flowID(fks odp.FlowKeys) string {
+	types := make([]int, 0, len(fks))
+	for typ := range fks {
+		types = append(types, int(typ))
+	}
+	sort.Ints(types)
+	hash := fnv.New64a()
+	for _, typ := range types {
+		fmt.Fprint(hash, typ, ":", fks[uint16(typ)], ";")
+	}
+	return fmt.Sprintf("%016x", hash.Sum64())
+}
+
+func (fastdp fastDatapathOverlay) flows(filter FastDPFlowFilter) ([]FastDPFlow, error) {
+	lock := fastdp.startLock()
+	defer lock.unlock()
+
+	vports, err := fastdp.dp.EnumerateVports()
+	if err != nil {
+		return nil, err
+	}
+	vportNames := make(map[odp.VportID]string, len(vports))
+	for _, vport := range vports {
+		vportNames[vport.ID] = vport.Spec.Name()
+	}
+
+	// Tunnels are reported by peer name, so resolve nicknames
+	if filter.Peer != "" && fastdp.peers != nil {
+		for _, desc := range fastdp.peers.Descriptions() {
+			if desc.NickName == filter.Peer {
+				filter.Peer = desc.Name.String()
+			}
+		}
+	}
+
+	flowInfos, err := fastdp.dp.EnumerateFlows()
+	if err != nil {
+		return nil, err
+	}
+	flows := []FastDPFlow{}
+	for _, flowInfo := range flowInfos {
+		flow := fastdp.flowView(&flowInfo, vportNames)
+		if filter.matches(&flow) {
+			flows = append(flows, flow)
+		}
+	}
+	return flows, nil
+}
+
+func (fastdp fastDatapathOverlay) flowView(flowInfo *odp.FlowInfo, vportNames map[odp.VportID]string) FastDPFlow {
+	flow := FastDPFlow{
+		ID:      flowID(flowInfo.FlowKeys),
+		Packets: flowInfo.Packets,
+		Bytes:   flowInfo.Bytes,
+		Used:    flowInfo.Used,
+	}
+	vport := func(id odp.VportID) *FastDPVport {
+		return &FastDPVport{ID: id, Name: vportNames[id]}
+	}
+
+	for _, fk := range flowInfo.FlowKeys {
+		switch fk := fk.(type) {
+		case odp.InPortFlowKey:
+			flow.Keys.InPort = vport(fk.VportID())
+		case odp.EthernetFlowKey:
+			key, mask := fk.Key(), fk.Mask()
+			flow.Keys.EthSrc = maskedMAC(key.EthSrc, mask.EthSrc)
+			flow.Keys.EthDst = maskedMAC(key.EthDst, mask.EthDst)
+		case odp.TunnelFlowKey:
+			flow.Keys.Tunnel = fastdp.tunnelView(fk.Key())
+		default:
+			if !fk.Ignored() {
+				flow.Keys.Other = append(flow.Keys.Other, fmt.Sprint(fk))
+			}
+		}
+	}
+	sort.Strings(flow.Keys.Other)
+
+	for _, action := range flowInfo.Actions {
+		switch action := action.(type) {
+		case odp.OutputAction:
+			flow.Actions = append(flow.Actions, FastDPFlowAction{Output: vport(action.VportID())})
+		case odp.SetTunnelAction:
+			flow.Actions = append(flow.Actions, FastDPFlowAction{SetTunnel: fastdp.tunnelView(action.TunnelAttrs)})
+		default:
+			flow.Actions = append(flow.Actions, FastDPFlowAction{Other: fmt.Sprint(action)})
+		}
+	}
+	return flow
+}
+
+// MACs which are wildcarded are omitted, and partially masked ones
+// are shown with their mask.
+func maskedMAC(mac, mask [6]byte) string {
+	switch mask {
+	case [6]byte{}:
+		return ""
+	case [...]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}:
+		return MAC(mac).String()
+	}
+	return MAC(mac).String() + "/" + MAC(mask).String()
+}
+
+func (fastdp fastDatapathOverlay) tunnelView(attrs odp.TunnelAttrs) *FastDPTunnel {
+	tunnel := &FastDPTunnel{
+		Ipv4Src: net.IP(attrs.Ipv4Src[:]).String(),
+		Ipv4Dst: net.IP(attrs.Ipv4Dst[:]).String(),
+	}
+	if fastdp.peers != nil && !fastdp.isVTEPTunnel(attrs) {
+		srcPeer, dstPeer := fastdp.extractPeers(attrs.TunnelId)
+		tunnel.SrcPeer = peerString(srcPeer)
+		tunnel.DstPeer = peerString(dstPeer)
+	}
+	return tunnel
+}
+
+func peerString(peer *mesh.Peer) string {
+	if peer == nil {
+		return ""
+	}
+	return peer.Name.String()
+}
+
+// Delete the flow with the given ID, returning false if there was no
+// such flow.
+func (fastdp fastDatapathOverlay) deleteFlow(id string) (bool, error) {
+	lock := fastdp.startLock()
+	defer lock.unlock()
+
+	flows, err := fastdp.dp.EnumerateFlows()
+	if err != nil {
+		return false, err
+	}
+	for _, flow := range flows {
+		if flowID(flow.FlowKeys) != id {
+			continue
+		}
+		// A miss being handled concurrently might be about to
+		// recreate the flow on the basis of stale information
+		fastdp.deleteFlowsCount++
+		fastdp.harvestFlowTraffic(&flow)
+		if err := fastdp.dp.DeleteFlow(flow.FlowKeys); err != nil && !odp.IsNoSuchFlowError(err) {
+			return false, err
+		}
+		log.Info("Deleted ODP flow ", flow.FlowSpec)
+		return true, nil
+	}
+	return false, nil
+}
+
+func parseFastDPFlowFilter(r *http.Request) (FastDPFlowFilter, error) {
+	var filter FastDPFlowFilter
+	if s := r.FormValue("mac"); s != "" {
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			return filter, err
+		}
+		filter.MAC = mac
+	}
+	filter.Peer = r.FormValue("peer")
+	filter.Vport = r.FormValue("vport")
+	return filter, nil
+}
+
+func (fastdp fastDatapathOverlay) HandleHTTP(muxRouter *mux.Router) {
+	muxRouter.Methods("GET").Path("/fastdp/flows").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseFastDPFlowFilter(r)
+		if err != nil {
+			http.Error(w, fmt.Sprint("unable to parse flow filter: ", err.Error()), http.StatusBadRequest)
+			return
+		}
+		flows, err := fastdp.flows(filter)
+		if err != nil {
+			http.Error(w, fmt.Sprint("unable to enumerate flows: ", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(flows); err != nil {
+			common.Log.Warningln("[fastdp/flows]:", err.Error())
+		}
+	})
+
+	muxRouter.Methods("DELETE").Path("/fastdp/flows/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		found, err := fastdp.deleteFlow(mux.Vars(r)["id"])
+		switch {
+		case err != nil:
+			http.Error(w, fmt.Sprint("unable to delete flow: ", err.Error()), http.StatusInternalServerError)
+		case !found:
+			http.Error(w, "no such flow", http.StatusNotFound)
+		default:
+			w.WriteHeader(204)
+		}
+	})
+}
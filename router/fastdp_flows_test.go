@@ -0,0 +1,279 @@
+package router
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/go-odp/odp"
+	"github.com/weaveworks/mesh"
+)
+
+// fakeODPDatapath holds flows and vports, for the flow views
+type fakeODPDatapath struct {
+	odpDatapath // the rest is not used by the flow views
+	vports      []odp.Vport
+	flows       []odp.FlowInfo
+	err         error // from DeleteFlow, if set
+}
+
+func (dp *fakeODPDatapath) EnumerateVports() ([]odp.Vport, error) {
+	return dp.vports, nil
+}
+
+func (dp *fakeODPDatapath) EnumerateFlows() ([]odp.FlowInfo, error) {
+	return append([]odp.FlowInfo(nil), dp.flows...), nil
+}
+
+func (dp *fakeODPDatapath) DeleteFlow(fks odp.FlowKeys) error {
+	if dp.err != nil {
+		return dp.err
+	}
+	for i, flow := range dp.flows {
+		if flow.FlowKeys.Equals(fks) {
+			dp.flows = append(dp.flows[:i], dp.flows[i+1:]...)
+			return nil
+		}
+	}
+	return odp.NetlinkError(syscall.ENOENT)
+}
+
+func testTunnelID(src, dst *mesh.Peer) (tunnelID [8]byte) {
+	binary.BigEndian.PutUint64(tunnelID[:], uint64(src.ShortID)|uint64(dst.ShortID)<<12)
+	return
+}
+
+func testEthernetFlowKey(src, dst MAC) odp.EthernetFlowKey {
+	fk := odp.NewEthernetFlowKey()
+	fk.SetEthSrc(src)
+	fk.SetEthDst(dst)
+	return fk
+}
+
+// A fast datapath of peer B, which knows of peer A (host1), with
+// flows to A, from A, and from the bridge to a port with no name
+func testFastDPFlows(t *testing.T) (fastDatapathOverlay, *fakeODPDatapath, []odp.FlowInfo) {
+	routerA, err := mesh.NewRouter(mesh.Config{}, mesh.PeerName(0x000000000001), "host1", nil, log)
+	require.NoError(t, err)
+	routerB := testMeshRouter(t, mesh.PeerName(0x000000000002), routerA)
+	peerA := routerB.Peers.Fetch(routerA.Ourself.Name)
+	peerB := routerB.Peers.Fetch(routerB.Ourself.Name)
+
+	toA := odp.NewFlowSpec()
+	toA.AddKey(odp.NewInPortFlowKey(1))
+	toA.AddKey(testEthernetFlowKey(testSrcMAC, testDstMAC))
+	var sta odp.SetTunnelAction
+	sta.SetTunnelId(testTunnelID(peerB, peerA))
+	sta.SetIpv4Src([4]byte{10, 0, 0, 2})
+	sta.SetIpv4Dst([4]byte{10, 0, 0, 1})
+	toA.AddAction(sta)
+	toA.AddAction(odp.NewOutputAction(2))
+
+	fromA := odp.NewFlowSpec()
+	fromA.AddKey(odp.NewInPortFlowKey(2))
+	var tunnel odp.TunnelFlowKey
+	tunnel.SetTunnelId(testTunnelID(peerA, peerB))
+	tunnel.SetIpv4Src([4]byte{10, 0, 0, 1})
+	tunnel.SetIpv4Dst([4]byte{10, 0, 0, 2})
+	fromA.AddKey(tunnel)
+	fromA.AddKey(testEthernetFlowKey(testDstMAC, testSrcMAC))
+	fromA.AddAction(odp.NewOutputAction(1))
+
+	other := odp.NewFlowSpec()
+	other.AddKey(odp.NewInPortFlowKey(1))
+	otherEth := testEthernetFlowKey(MAC{0x02, 0, 0, 0, 0, 3}, MAC{})
+	otherEth.SetMaskedEthDst(MAC{}, MAC{}) // wildcarded
+	other.AddKey(otherEth)
+	other.AddKey(odp.NewEthertypeFlowKey(0x0806))
+	other.AddAction(odp.NewOutputAction(3))
+
+	flows := []odp.FlowInfo{
+		{FlowSpec: toA, Packets: 1, Bytes: 100, Used: 1000},
+		{FlowSpec: fromA, Packets: 2, Bytes: 200},
+		{FlowSpec: other},
+	}
+	dp := &fakeODPDatapath{
+		vports: []odp.Vport{
+			{ID: 1, Spec: odp.NewNetdevVportSpec("vethwe-datapath")},
+			{ID: 2, Spec: odp.NewVxlanVportSpec("vxlan-6784", 6784)},
+		},
+		flows: append([]odp.FlowInfo(nil), flows...),
+	}
+	fastdp := fastDatapathOverlay{&FastDatapath{dp: dp, peers: routerB.Peers, localPeer: peerB}}
+	return fastdp, dp, flows
+}
+
+func TestFastDPFlowView(t *testing.T) {
+	fastdp, _, flowInfos := testFastDPFlows(t)
+	flows, err := fastdp.flows(FastDPFlowFilter{})
+	require.NoError(t, err)
+	require.Equal(t, []FastDPFlow{
+		{
+			ID: flowID(flowInfos[0].FlowKeys),
+			Keys: FastDPFlowKeys{
+				InPort: &FastDPVport{ID: 1, Name: "vethwe-datapath"},
+				EthSrc: testSrcMAC.String(),
+				EthDst: testDstMAC.String(),
+			},
+			Actions: []FastDPFlowAction{
+				{SetTunnel: &FastDPTunnel{SrcPeer: "00:00:00:00:00:02", DstPeer: "00:00:00:00:00:01", Ipv4Src: "10.0.0.2", Ipv4Dst: "10.0.0.1"}},
+				{Output: &FastDPVport{ID: 2, Name: "vxlan-6784"}},
+			},
+			Packets: 1, Bytes: 100, Used: 1000,
+		},
+		{
+			ID: flowID(flowInfos[1].FlowKeys),
+			Keys: FastDPFlowKeys{
+				InPort: &FastDPVport{ID: 2, Name: "vxlan-6784"},
+				EthSrc: testDstMAC.String(),
+				EthDst: testSrcMAC.String(),
+				Tunnel: &FastDPTunnel{SrcPeer: "00:00:00:00:00:01", DstPeer: "00:00:00:00:00:02", Ipv4Src: "10.0.0.1", Ipv4Dst: "10.0.0.2"},
+			},
+			Actions: []FastDPFlowAction{{Output: &FastDPVport{ID: 1, Name: "vethwe-datapath"}}},
+			Packets: 2, Bytes: 200,
+		},
+		{
+			ID: flowID(flowInfos[2].FlowKeys),
+			Keys: FastDPFlowKeys{
+				InPort: &FastDPVport{ID: 1, Name: "vethwe-datapath"},
+				EthSrc: "02:00:00:00:00:03",
+				Other:  []string{fmt.Sprint(odp.NewEthertypeFlowKey(0x0806))},
+			},
+			Actions: []FastDPFlowAction{{Output: &FastDPVport{ID: 3}}},
+		},
+	}, flows)
+
+	// The IDs are those of the keys, whatever the actions
+	require.NotEqual(t, flows[0].ID, flows[1].ID)
+	require.NotEqual(t, flows[0].ID, flows[2].ID)
+	same := odp.NewFlowSpec()
+	same.AddKey(testEthernetFlowKey(testSrcMAC, testDstMAC))
+	same.AddKey(odp.NewInPortFlowKey(1))
+	require.Equal(t, flows[0].ID, flowID(same.FlowKeys))
+
+	// Partially masked MACs are shown with their mask
+	require.Equal(t, "", maskedMAC(testSrcMAC, MAC{}))
+	require.Equal(t, "02:00:00:00:00:01/ff:ff:ff:00:00:00", maskedMAC(testSrcMAC, MAC{0xff, 0xff, 0xff}))
+}
+
+func TestFastDPFlowFilter(t *testing.T) {
+	fastdp, _, _ := testFastDPFlows(t)
+	for _, tc := range []struct {
+		query string
+		flows []int
+	}{
+		{"", []int{0, 1, 2}},
+		{"mac=02:00:00:00:00:01", []int{0, 1}},
+		{"mac=02-00-00-00-00-03", []int{2}},
+		{"mac=02:00:00:00:00:04", nil},
+		{"peer=00:00:00:00:00:01", []int{0, 1}},
+		{"peer=00:00:00:00:00:02", []int{0, 1}},
+		{"peer=00:00:00:00:00:01&mac=02:00:00:00:00:03", nil},
+		{"peer=00:00:00:00:00:03", nil},
+		{"vport=1", []int{0, 1, 2}},
+		{"vport=vxlan-6784", []int{0, 1}},
+		{"vport=3", []int{2}},
+		{"vport=vxlan-6784&mac=02:00:00:00:00:03", nil},
+		{"vport=4", nil},
+	} {
+		filter, err := parseFastDPFlowFilter(httptest.NewRequest("GET", "/fastdp/flows?"+tc.query, nil))
+		require.NoError(t, err, tc.query)
+		flows, err := fastdp.flows(filter)
+		require.NoError(t, err, tc.query)
+		var indexes []int
+		all, _ := fastdp.flows(FastDPFlowFilter{})
+		for _, flow := range flows {
+			for i := range all {
+				if all[i].ID == flow.ID {
+					indexes = append(indexes, i)
+				}
+			}
+		}
+		require.Equal(t, tc.flows, indexes, tc.query)
+	}
+
+	// Peers are also known by nickname
+	flows, err := fastdp.flows(FastDPFlowFilter{Peer: "host1"})
+	require.NoError(t, err)
+	require.Len(t, flows, 2)
+
+	for _, query := range []string{"mac=02:00:00:00:00", "mac=host1"} {
+		_, err := parseFastDPFlowFilter(httptest.NewRequest("GET", "/fastdp/flows?"+query, nil))
+		require.Error(t, err, query)
+	}
+}
+
+func TestFastDPDeleteFlow(t *testing.T) {
+	fastdp, dp, flowInfos := testFastDPFlows(t)
+	id := flowID(flowInfos[1].FlowKeys)
+
+	found, err := fastdp.deleteFlow(id)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []odp.FlowInfo{flowInfos[0], flowInfos[2]}, dp.flows)
+	// so that a miss being handled doesn't recreate it
+	require.Equal(t, uint64(1), fastdp.deleteFlowsCount)
+
+	// A flow which doesn't exist, or no longer does
+	found, err = fastdp.deleteFlow(id)
+	require.NoError(t, err)
+	require.False(t, found)
+	found, err = fastdp.deleteFlow("")
+	require.NoError(t, err)
+	require.False(t, found)
+	require.Equal(t, uint64(1), fastdp.deleteFlowsCount)
+	require.Len(t, dp.flows, 2)
+
+	// A flow which the kernel deleted after it was enumerated
+	dp.err = odp.NetlinkError(syscall.ENOENT)
+	found, err = fastdp.deleteFlow(flowID(flowInfos[0].FlowKeys))
+	require.NoError(t, err)
+	require.True(t, found)
+
+	dp.err = odp.NetlinkError(syscall.EPERM)
+	_, err = fastdp.deleteFlow(flowID(flowInfos[0].FlowKeys))
+	require.Error(t, err)
+}
+
+func TestFastDPFlowsHTTP(t *testing.T) {
+	fastdp, dp, flowInfos := testFastDPFlows(t)
+	muxRouter := mux.NewRouter()
+	fastdp.HandleHTTP(muxRouter)
+	server := httptest.NewServer(muxRouter)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/fastdp/flows?mac=" + net.HardwareAddr(testSrcMAC[:]).String() + "&vport=vxlan-6784")
+	require.NoError(t, err)
+	var flows []FastDPFlow
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&flows))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, flows, 2)
+
+	resp, err = http.Get(server.URL + "/fastdp/flows?mac=02:00")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	del := func(id string) int {
+		req, err := http.NewRequest("DELETE", server.URL+"/fastdp/flows/"+id, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	id := flowID(flowInfos[2].FlowKeys)
+	require.Equal(t, http.StatusNoContent, del(id))
+	require.Len(t, dp.flows, 2)
+	require.Equal(t, http.StatusNotFound, del(id))
+	dp.err = odp.NetlinkError(syscall.EPERM)
+	require.Equal(t, http.StatusInternalServerError, del(flowID(flowInfos[0].FlowKeys)))
+}
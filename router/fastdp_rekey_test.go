@@ -0,0 +1,42 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSARekeyNext(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000, 0)}
+	rekey := &saRekey{started: clock.Now(), sent: clock.Now()}
+	next := func() [2]bool {
+		resend, abandon := rekey.next(clock.Now())
+		return [2]bool{resend, abandon}
+	}
+
+	// Waiting for the first ack
+	require.Equal(t, [2]bool{false, false}, next())
+	clock.Advance(saRekeyRetryInterval - time.Second)
+	require.Equal(t, [2]bool{false, false}, next())
+
+	// Then sending again, each retry interval
+	clock.Advance(time.Second)
+	require.Equal(t, [2]bool{true, false}, next())
+	rekey.sent = clock.Now()
+	clock.Advance(saRekeyRetryInterval / 2)
+	require.Equal(t, [2]bool{false, false}, next())
+	clock.Advance(saRekeyRetryInterval / 2)
+	require.Equal(t, [2]bool{true, false}, next())
+	rekey.sent = clock.Now()
+
+	// Until the peer has had long enough, even if a RekeySA went
+	// recently
+	clock.now = rekey.started.Add(saRekeyTimeout)
+	rekey.sent = clock.Now()
+	require.Equal(t, [2]bool{false, true}, next())
+
+	// Nothing is due once the rekey is acknowledged
+	rekey.acked = true
+	require.Equal(t, [2]bool{false, false}, next())
+}
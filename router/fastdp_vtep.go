@@ -0,0 +1,146 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/go-odp/odp"
+)
+
+// Gateway to external VXLAN tunnel endpoints, such as ToR switches or
+// Linux vxlan devices.  Their tunnel IDs do not encode weave short
+// peer IDs, so they cannot be weave peers.  Instead, each one appears
+// as a port on the fast datapath bridge of the peer acting as its
+// gateway, so the hosts behind it share L2 with the weave containers.
+// Only one peer should be the gateway for a given VTEP and VNI, or
+// broadcasts will loop.
+
+const DefaultVXLANPort = 4789
+
+type ExternalVTEP struct {
+	VNI      uint32
+	RemoteIP net.IP
+	Port     int // UDP
+}
+
+// ParseExternalVTEP parses <vni>@<remote ip>[:<udp port>]
+func ParseExternalVTEP(s string) (ExternalVTEP, error) {
+	vtep := ExternalVTEP{Port: DefaultVXLANPort}
+	at := strings.Index(s, "@")
+	if at < 0 {
+		return vtep, fmt.Errorf("invalid VTEP %q: expected <vni>@<remote ip>[:<port>]", s)
+	}
+	vni, err := strconv.ParseUint(s[:at], 10, 24)
+	if err != nil {
+		return vtep, fmt.Errorf("invalid VNI in VTEP %q: %s", s, err)
+	}
+	vtep.VNI = uint32(vni)
+	addr := s[at+1:]
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if vtep.Port, err = strconv.Atoi(port); err != nil || vtep.Port <= 0 || vtep.Port > 65535 {
+			return vtep, fmt.Errorf("invalid port in VTEP %q", s)
+		}
+		addr = host
+	}
+	if vtep.RemoteIP = net.ParseIP(addr).To4(); vtep.RemoteIP == nil {
+		return vtep, fmt.Errorf("invalid IPv4 address in VTEP %q", s)
+	}
+	return vtep, nil
+}
+
+func (vtep ExternalVTEP) String() string {
+	return fmt.Sprintf("%d@%s", vtep.VNI, net.JoinHostPort(vtep.RemoteIP.String(), strconv.Itoa(vtep.Port)))
+}
+
+func (vtep ExternalVTEP) tunnelID() (tunnelID [8]byte) {
+	binary.BigEndian.PutUint64(tunnelID[:], uint64(vtep.VNI))
+	return
+}
+
+// Identifies packets from an external VTEP
+type vtepKey struct {
+	vxlanVportID odp.VportID
+	remoteIP     [4]byte
+	tunnelID     [8]byte
+}
+
+// AddExternalVTEP adds a port for the external VTEP to the bridge.
+func (fastdp *FastDatapath) AddExternalVTEP(vtep ExternalVTEP) error {
+	remoteIP, err := ipv4Bytes(vtep.RemoteIP)
+	if err != nil {
+		return err
+	}
+	// Find the local address for the tunnel the same way as the
+	// kernel would, without sending anything.
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: vtep.RemoteIP, Port: vtep.Port})
+	if err != nil {
+		return err
+	}
+	localIP, err := ipv4Bytes(conn.LocalAddr().(*net.UDPAddr).IP)
+	conn.Close()
+	if err != nil {
+		return err
+	}
+
+	vxlanVportID, err := fastdp.getVxlanVportIDHarder(vtep.Port, 5, time.Millisecond*10)
+	if err != nil {
+		return err
+	}
+
+	var sta odp.SetTunnelAction
+	sta.SetTunnelId(vtep.tunnelID())
+	sta.SetIpv4Src(localIP)
+	sta.SetIpv4Dst(remoteIP)
+	sta.SetTos(0)
+	sta.SetTtl(64)
+	sta.SetDf(true)
+	sta.SetCsum(false)
+
+	fastdp.lock.Lock()
+	defer fastdp.lock.Unlock()
+
+	key := vtepKey{vxlanVportID: vxlanVportID, remoteIP: remoteIP, tunnelID: vtep.tunnelID()}
+	if _, found := fastdp.vteps[key]; found {
+		return fmt.Errorf("duplicate VTEP %s", vtep)
+	}
+	portID := bridgePortID{vtep: vtep.String()}
+	fastdp.vteps[key] = portID
+	fastdp.addSendToPort(portID, func(_ PacketKey, _ *fastDatapathLock) FlowOp {
+		return fastdp.odpActions(sta, odp.NewOutputAction(vxlanVportID))
+	})
+	// Recalculate flows for broadcasts on the bridge
+	checkWarn(fastdp.deleteFlows())
+	log.Infof("Acting as gateway for external VTEP %s", vtep)
+	return nil
+}
+
+// The bridge port for packets arriving on a vxlan vport, if they come
+// from an external VTEP.  Called with the fastdp lock held.
+func (fastdp *FastDatapath) vtepPort(vxlanVportID odp.VportID, tunnel odp.TunnelAttrs) (bridgePortID, bool) {
+	portID, found := fastdp.vteps[vtepKey{vxlanVportID: vxlanVportID, remoteIP: tunnel.Ipv4Src, tunnelID: tunnel.TunnelId}]
+	return portID, found
+}
+
+// Whether the tunnel, in either direction, is to an external VTEP, in
+// which case its ID is a VNI rather than a pair of peer short IDs.
+// Called with the fastdp lock held.
+func (fastdp *FastDatapath) isVTEPTunnel(tunnel odp.TunnelAttrs) bool {
+	for key := range fastdp.vteps {
+		if key.tunnelID == tunnel.TunnelId && (key.remoteIP == tunnel.Ipv4Src || key.remoteIP == tunnel.Ipv4Dst) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fastdp *FastDatapath) externalVTEPs() []string {
+	var vteps []string
+	for _, portID := range fastdp.vteps {
+		vteps = append(vteps, portID.vtep)
+	}
+	return vteps
+}
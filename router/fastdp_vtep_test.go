@@ -0,0 +1,62 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExternalVTEP(t *testing.T) {
+	for _, tc := range []struct {
+		vtep string
+		vni  uint32
+		ip   string
+		port int
+		str  string
+		err  bool
+	}{
+		{vtep: "5000@192.168.48.10", vni: 5000, ip: "192.168.48.10", port: DefaultVXLANPort, str: "5000@192.168.48.10:4789"},
+		{vtep: "5000@192.168.48.10:8472", vni: 5000, ip: "192.168.48.10", port: 8472, str: "5000@192.168.48.10:8472"},
+		{vtep: "0@10.0.0.1", vni: 0, ip: "10.0.0.1", port: DefaultVXLANPort, str: "0@10.0.0.1:4789"},
+		{vtep: "16777215@10.0.0.1:1", vni: 16777215, ip: "10.0.0.1", port: 1, str: "16777215@10.0.0.1:1"},
+		{vtep: "16777216@10.0.0.1", err: true},
+		{vtep: "-1@10.0.0.1", err: true},
+		{vtep: "vni@10.0.0.1", err: true},
+		{vtep: "@10.0.0.1", err: true},
+		{vtep: "5000", err: true},
+		{vtep: "5000@", err: true},
+		{vtep: "5000@vtep.example.com", err: true},
+		{vtep: "5000@10.0.0.256", err: true},
+		{vtep: "5000@10.0.0.1:", err: true},
+		{vtep: "5000@10.0.0.1:0", err: true},
+		{vtep: "5000@10.0.0.1:65536", err: true},
+		{vtep: "5000@10.0.0.1:port", err: true},
+		{vtep: "5000@10.0.0.1:4789:1", err: true},
+		{vtep: "5000@fd00::1", err: true},
+		{vtep: "5000@[fd00::1]:4789", err: true},
+		{vtep: "", err: true},
+	} {
+		vtep, err := ParseExternalVTEP(tc.vtep)
+		if tc.err {
+			require.Error(t, err, tc.vtep)
+			continue
+		}
+		require.NoError(t, err, tc.vtep)
+		require.Equal(t, tc.vni, vtep.VNI, tc.vtep)
+		require.True(t, net.ParseIP(tc.ip).Equal(vtep.RemoteIP), tc.vtep)
+		require.Len(t, vtep.RemoteIP, net.IPv4len, tc.vtep)
+		require.Equal(t, tc.port, vtep.Port, tc.vtep)
+		require.Equal(t, tc.str, vtep.String())
+
+		// The canonical form parses to the same VTEP
+		again, err := ParseExternalVTEP(vtep.String())
+		require.NoError(t, err, tc.vtep)
+		require.Equal(t, vtep, again)
+	}
+}
+
+func TestExternalVTEPTunnelID(t *testing.T) {
+	vtep := ExternalVTEP{VNI: 0x123456}
+	require.Equal(t, [8]byte{0, 0, 0, 0, 0, 0x12, 0x34, 0x56}, vtep.tunnelID())
+}
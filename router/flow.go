@@ -1,8 +1,10 @@
 package router
 
 import (
+	"encoding/binary"
 	"net"
 
+	"github.com/google/gopacket/layers"
 	"github.com/weaveworks/mesh"
 )
 
@@ -15,8 +17,9 @@ func (mac MAC) String() string {
 }
 
 type PacketKey struct {
-	SrcMAC MAC
-	DstMAC MAC
+	SrcMAC  MAC
+	DstMAC  MAC
+	Segment Segment // from the frame's 802.1Q tag, if any
 }
 
 type ForwardPacketKey struct {
@@ -51,6 +54,35 @@ func (NonDiscardingFlowOp) Discards() bool {
 	return false
 }
 
+// FlowOps which need to see every frame they are used for, to
+// inspect or classify it, embed inspectingFlowOp.  The datapaths
+// only create kernel flows for FlowOps they can express there; any
+// other FlowOp which does not discard the frame stops a flow being
+// created (see FastDatapath.send and TCDatapath.send), so similar
+// frames keep reaching the router.
+type inspectingFlowOp struct {
+	NonDiscardingFlowOp
+}
+
+// FlowOps which only need to see frames of one ethertype, and pass
+// the others to the FlowOp they wrap, implement ethertypeFlowOp.
+// The fast datapath can then create a flow for frames of other
+// ethertypes, matching on the ethertype so that frames of the
+// inspected one still reach the router.
+type ethertypeFlowOp interface {
+	FlowOp
+	inspectedEthertype() layers.EthernetType
+	wrappedFlowOp() FlowOp
+}
+
+// The ethertype of a frame, or 0 if it is too short to have one
+func frameEthertype(frame []byte) layers.EthernetType {
+	if len(frame) < 14 {
+		return 0
+	}
+	return layers.EthernetType(binary.BigEndian.Uint16(frame[12:14]))
+}
+
 type MultiFlowOp struct {
 	broadcast bool
 	ops       []FlowOp
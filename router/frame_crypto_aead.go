@@ -0,0 +1,196 @@
+package router
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/sys/cpu"
+)
+
+// Sleeve cipher suites.  Peers advertise the suites they support, in
+// order of preference, through the sleeveCiphersFeature; peers which
+// do not advertise it only support NaCl.
+const (
+	CipherNaCl             = "nacl"
+	CipherAESGCM           = "aes-gcm"
+	CipherChaCha20Poly1305 = "chacha20-poly1305"
+
+	sleeveCiphersFeature = "SleeveCiphers"
+)
+
+// AES-GCM is only faster than ChaCha20-Poly1305 when the CPU has
+// instructions to accelerate it.
+func sleeveCipherPreference() []string {
+	if (cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ) || (cpu.ARM64.HasAES && cpu.ARM64.HasPMULL) || cpu.S390X.HasAESGCM {
+		return []string{CipherAESGCM, CipherChaCha20Poly1305, CipherNaCl}
+	}
+	return []string{CipherChaCha20Poly1305, CipherAESGCM, CipherNaCl}
+}
+
+// Choose the cipher suite for a connection.  Both ends must reach the
+// same result without further negotiation, so the preference of the
+// peer which initiated the connection wins.
+func chooseSleeveCipher(outbound bool, local []string, remoteFeature string) string {
+	if remoteFeature == "" {
+		return CipherNaCl
+	}
+	remote := strings.Split(remoteFeature, ",")
+	initiator, acceptor := remote, local
+	if outbound {
+		initiator, acceptor = local, remote
+	}
+	for _, suite := range initiator {
+		if contains(acceptor, suite) {
+			return suite
+		}
+	}
+	return CipherNaCl
+}
+
+// Each suite uses its own key, derived from the session key, so that
+// the same key is never used with different ciphers.
+func newSleeveAEAD(suite string, sessionKey *[32]byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, sessionKey[:], nil, []byte("weave sleeve "+suite)), key); err != nil {
+		return nil, err
+	}
+	switch suite {
+	case CipherAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+	return nil, fmt.Errorf("unknown sleeve cipher %q", suite)
+}
+
+// AEADEncryptor seals packets with an AEAD cipher, in the same way as
+// NaClEncryptor: the sequence number and DF flag are sent in the
+// clear, and form the variable part of the nonce.
+type AEADEncryptor struct {
+	NonEncryptor
+	buf       []byte
+	prefixLen int
+	aead      cipher.AEAD
+	nonce     []byte
+	seqNo     uint64
+	df        bool
+}
+
+func NewAEADEncryptor(prefix []byte, aead cipher.AEAD, outbound bool, df bool) *AEADEncryptor {
+	buf := make([]byte, MaxUDPPacketSize)
+	prefixLen := copy(buf, prefix)
+	ae := &AEADEncryptor{
+		NonEncryptor: *NewNonEncryptor([]byte{}),
+		buf:          buf,
+		prefixLen:    prefixLen,
+		aead:         aead,
+		nonce:        make([]byte, aead.NonceSize()),
+		df:           df}
+	if outbound {
+		ae.nonce[0] |= (1 << 7)
+	}
+	return ae
+}
+
+func (ae *AEADEncryptor) Bytes() ([]byte, error) {
+	plaintext, err := ae.NonEncryptor.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	seqNoAndDF := ae.seqNo
+	if ae.df {
+		seqNoAndDF |= (1 << 63)
+	}
+	ciphertext := ae.buf
+	binary.BigEndian.PutUint64(ciphertext[ae.prefixLen:], seqNoAndDF)
+	binary.BigEndian.PutUint64(ae.nonce[len(ae.nonce)-8:], seqNoAndDF)
+	// Seal *appends* to ciphertext
+	ciphertext = ae.aead.Seal(ciphertext[:ae.prefixLen+8], ae.nonce, plaintext, nil)
+	ae.seqNo++
+	return ciphertext, nil
+}
+
+func (ae *AEADEncryptor) PacketOverhead() int {
+	return ae.prefixLen + 8 + ae.aead.Overhead() + ae.NonEncryptor.PacketOverhead()
+}
+
+func (ae *AEADEncryptor) TotalLen() int {
+	return ae.PacketOverhead() + ae.NonEncryptor.TotalLen()
+}
+
+type AEADDecryptor struct {
+	NonDecryptor
+	aead       cipher.AEAD
+	instance   *AEADDecryptorInstance
+	instanceDF *AEADDecryptorInstance
+}
+
+// The replay protection is the same as for NaCl; only the nonce
+// differs.
+type AEADDecryptorInstance struct {
+	nonce  []byte
+	window *NaClDecryptorInstance
+}
+
+func NewAEADDecryptorInstance(aead cipher.AEAD, outbound bool) *AEADDecryptorInstance {
+	di := &AEADDecryptorInstance{
+		nonce:  make([]byte, aead.NonceSize()),
+		window: NewNaClDecryptorInstance(outbound)}
+	if !outbound {
+		di.nonce[0] |= (1 << 7)
+	}
+	return di
+}
+
+func NewAEADDecryptor(aead cipher.AEAD, outbound bool) *AEADDecryptor {
+	return &AEADDecryptor{
+		NonDecryptor: *NewNonDecryptor(),
+		aead:         aead,
+		instance:     NewAEADDecryptorInstance(aead, outbound),
+		instanceDF:   NewAEADDecryptorInstance(aead, outbound)}
+}
+
+func (ad *AEADDecryptor) IterateFrames(packet []byte, consumer FrameConsumer) error {
+	if len(packet) < 8 {
+		return PacketDecodingError{Desc: fmt.Sprintf("encrypted UDP packet too short; expected length >= 8, got %d", len(packet))}
+	}
+	buf, success := ad.decrypt(packet)
+	if !success {
+		return PacketDecodingError{Desc: fmt.Sprint("UDP packet decryption failed")}
+	}
+	return ad.NonDecryptor.IterateFrames(buf, consumer)
+}
+
+func (ad *AEADDecryptor) decrypt(buf []byte) ([]byte, bool) {
+	seqNoAndDF := binary.BigEndian.Uint64(buf[:8])
+	df := (seqNoAndDF & (1 << 63)) != 0
+	seqNo := seqNoAndDF & ((1 << 63) - 1)
+	di := ad.instance
+	if df {
+		di = ad.instanceDF
+	}
+	binary.BigEndian.PutUint64(di.nonce[len(di.nonce)-8:], seqNoAndDF)
+	result, err := ad.aead.Open(nil, di.nonce, buf[8:], nil)
+	if err != nil {
+		return nil, false
+	}
+	// As in NaClDecryptor, drop duplicates only after successful
+	// decryption.
+	offset, usedOffsets := di.window.advanceState(seqNo)
+	if usedOffsets == nil || usedOffsets.Contains(offset) {
+		return nil, true
+	}
+	usedOffsets.Add(offset)
+	return result, true
+}
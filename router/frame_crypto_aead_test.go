@@ -0,0 +1,163 @@
+package router
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testSrcName = []byte{0, 0, 0, 0, 0, 1}
+	testDstName = []byte{0, 0, 0, 0, 0, 2}
+)
+
+func TestChooseSleeveCipher(t *testing.T) {
+	aes := []string{CipherAESGCM, CipherChaCha20Poly1305, CipherNaCl}
+	chacha := []string{CipherChaCha20Poly1305, CipherAESGCM, CipherNaCl}
+	for _, tc := range []struct {
+		name     string
+		outbound bool
+		local    []string
+		remote   string
+		suite    string
+	}{
+		{name: "outbound, local preference wins", outbound: true, local: aes, remote: "chacha20-poly1305,aes-gcm,nacl", suite: CipherAESGCM},
+		{name: "inbound, remote preference wins", outbound: false, local: aes, remote: "chacha20-poly1305,aes-gcm,nacl", suite: CipherChaCha20Poly1305},
+		{name: "inbound, same preference", outbound: false, local: chacha, remote: "chacha20-poly1305,aes-gcm,nacl", suite: CipherChaCha20Poly1305},
+		{name: "only one shared", outbound: true, local: aes, remote: "nacl,chacha20-poly1305", suite: CipherChaCha20Poly1305},
+		{name: "none shared", outbound: true, local: []string{CipherAESGCM}, remote: "chacha20-poly1305", suite: CipherNaCl},
+		{name: "unknown suites", outbound: false, local: aes, remote: "rot13,xor", suite: CipherNaCl},
+		{name: "legacy peer, outbound", outbound: true, local: aes, remote: "", suite: CipherNaCl},
+		{name: "legacy peer, inbound", outbound: false, local: aes, remote: "", suite: CipherNaCl},
+	} {
+		require.Equal(t, tc.suite, chooseSleeveCipher(tc.outbound, tc.local, tc.remote), tc.name)
+	}
+
+	// Both ends of a connection choose the same suite
+	for _, local := range [][]string{aes, chacha} {
+		for _, remote := range [][]string{aes, chacha} {
+			require.Equal(t,
+				chooseSleeveCipher(true, local, strings.Join(remote, ",")),
+				chooseSleeveCipher(false, remote, strings.Join(local, ",")))
+		}
+	}
+
+	_, err := newSleeveAEAD(CipherNaCl, &[32]byte{})
+	require.Error(t, err)
+}
+
+type testFrame struct {
+	src, dst, frame []byte
+}
+
+// Decrypt a packet, returning the frames in it
+func testDecryptFrames(t *testing.T, dec Decryptor, packet []byte) ([]testFrame, error) {
+	var frames []testFrame
+	err := dec.IterateFrames(packet, func(src, dst, frame []byte) {
+		frames = append(frames, testFrame{append([]byte(nil), src...), append([]byte(nil), dst...), append([]byte(nil), frame...)})
+	})
+	return frames, err
+}
+
+// Encrypt the frames into a packet, checking its length, and return
+// it without the prefix
+func testEncryptFrames(t *testing.T, enc Encryptor, prefix []byte, frames ...[]byte) []byte {
+	for _, frame := range frames {
+		enc.AppendFrame(testSrcName, testDstName, frame)
+	}
+	totalLen := enc.TotalLen()
+	packet, err := enc.Bytes()
+	require.NoError(t, err)
+	require.Len(t, packet, totalLen)
+	require.Equal(t, prefix, packet[:len(prefix)])
+	return append([]byte(nil), packet[len(prefix):]...)
+}
+
+func TestSleeveAEAD(t *testing.T) {
+	sessionKey := &[32]byte{1, 2, 3}
+	otherKey := &[32]byte{3, 2, 1}
+	prefix := []byte("prefix")
+	frames := [][]byte{[]byte("first frame"), []byte("second frame")}
+	expected := []testFrame{{testSrcName, testDstName, frames[0]}, {testSrcName, testDstName, frames[1]}}
+
+	for _, suite := range []string{CipherAESGCM, CipherChaCha20Poly1305} {
+		aead, err := newSleeveAEAD(suite, sessionKey)
+		require.NoError(t, err, suite)
+		enc := NewAEADEncryptor(prefix, aead, true, false)
+		require.Equal(t, len(prefix)+8+aead.Overhead(), enc.PacketOverhead(), suite)
+		packet := testEncryptFrames(t, enc, prefix, frames...)
+
+		// Round trip
+		dec := NewAEADDecryptor(aead, false)
+		got, err := testDecryptFrames(t, dec, packet)
+		require.NoError(t, err, suite)
+		require.Equal(t, expected, got, suite)
+
+		// Tampering with the ciphertext, or with the sequence
+		// number, which is part of the nonce
+		for _, i := range []int{0, 7, 8, len(packet) - 1} {
+			tampered := append([]byte(nil), packet...)
+			tampered[i] ^= 1
+			_, err = testDecryptFrames(t, NewAEADDecryptor(aead, false), tampered)
+			require.Error(t, err, "%s: byte %d", suite, i)
+		}
+		_, err = testDecryptFrames(t, NewAEADDecryptor(aead, false), packet[:7])
+		require.Error(t, err, suite)
+
+		// The wrong key, the other suite's key, or the other
+		// direction's nonces
+		wrongKey, err := newSleeveAEAD(suite, otherKey)
+		require.NoError(t, err, suite)
+		_, err = testDecryptFrames(t, NewAEADDecryptor(wrongKey, false), packet)
+		require.Error(t, err, suite)
+		otherSuite := CipherAESGCM
+		if suite == CipherAESGCM {
+			otherSuite = CipherChaCha20Poly1305
+		}
+		otherAEAD, err := newSleeveAEAD(otherSuite, sessionKey)
+		require.NoError(t, err, suite)
+		_, err = testDecryptFrames(t, NewAEADDecryptor(otherAEAD, false), packet)
+		require.Error(t, err, suite)
+		_, err = testDecryptFrames(t, NewAEADDecryptor(aead, true), packet)
+		require.Error(t, err, suite)
+
+		// A replayed packet is dropped silently
+		got, err = testDecryptFrames(t, dec, packet)
+		require.NoError(t, err, suite)
+		require.Empty(t, got, suite)
+
+		// The DF and non-DF encryptors number their packets
+		// separately, and so does the decryptor
+		encDF := NewAEADEncryptor(prefix, aead, true, true)
+		packetDF := testEncryptFrames(t, encDF, prefix, frames[0])
+		require.Equal(t, packet[1:8], packetDF[1:8], "%s: same sequence number", suite)
+		got, err = testDecryptFrames(t, dec, packetDF)
+		require.NoError(t, err, suite)
+		require.Equal(t, expected[:1], got, suite)
+		got, err = testDecryptFrames(t, dec, packetDF)
+		require.NoError(t, err, suite)
+		require.Empty(t, got, suite)
+
+		// Later packets are still accepted, out of order too
+		later := testEncryptFrames(t, enc, prefix, frames[1])
+		latest := testEncryptFrames(t, enc, prefix, frames[0])
+		got, err = testDecryptFrames(t, dec, latest)
+		require.NoError(t, err, suite)
+		require.Equal(t, expected[:1], got, suite)
+		got, err = testDecryptFrames(t, dec, later)
+		require.NoError(t, err, suite)
+		require.Equal(t, expected[1:], got, suite)
+
+		// A packet far below the window is dropped, even if it
+		// was never seen
+		unseen := testEncryptFrames(t, enc, prefix, frames[0])
+		enc.seqNo += 2 << WindowSize
+		newest := testEncryptFrames(t, enc, prefix, frames[0])
+		_, err = testDecryptFrames(t, dec, newest)
+		require.NoError(t, err, suite)
+		got, err = testDecryptFrames(t, dec, unseen)
+		require.NoError(t, err, suite)
+		require.Empty(t, got, suite)
+	}
+}
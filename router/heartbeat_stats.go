@@ -0,0 +1,154 @@
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+// Peers which echo heartbeats back to the sender advertise this
+// feature.  The echoes let the sender measure the round-trip time of
+// the overlay's data path, rather than of the TCP connection.
+const heartbeatEchoFeature = "HeartbeatEcho"
+
+// Kinds of heartbeat echo frame
+const (
+	heartbeatEchoRequest = 1
+	heartbeatEchoReply   = 2
+)
+
+// Upper bounds of the RTT and jitter histogram buckets, in seconds
+var HeartbeatHistogramBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+type Histogram struct {
+	Count  uint64
+	Sum    float64  // in seconds
+	Counts []uint64 // per bucket of HeartbeatHistogramBuckets, not cumulative
+}
+
+func newHistogram() Histogram {
+	return Histogram{Counts: make([]uint64, len(HeartbeatHistogramBuckets))}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	h.Count++
+	h.Sum += v
+	for i, bound := range HeartbeatHistogramBuckets {
+		if v <= bound {
+			h.Counts[i]++
+			break
+		}
+	}
+}
+
+func (h Histogram) copy() Histogram {
+	h.Counts = append([]uint64(nil), h.Counts...)
+	return h
+}
+
+// HeartbeatStats describes the quality of a link, as seen by the
+// heartbeats a forwarder sends and has echoed back to it.
+type HeartbeatStats struct {
+	RTT         time.Duration // of the most recent heartbeat
+	SmoothedRTT time.Duration
+	Jitter      time.Duration // mean deviation between successive RTTs
+	Samples     uint64
+	Missed      uint64 // heartbeats which were not echoed back
+
+	RTTHistogram    Histogram
+	JitterHistogram Histogram
+}
+
+// Forwarders which gather heartbeat statistics implement
+// heartbeatReporter.  As with trafficReporter, the result is keyed by
+// overlay name.
+type heartbeatReporter interface {
+	HeartbeatStats() map[string]HeartbeatStats
+}
+
+// heartbeatMonitor matches echoed heartbeats with those sent.  Only
+// one heartbeat is outstanding at a time: if no echo has arrived by
+// the time the next heartbeat is sent, the first counts as missed.
+type heartbeatMonitor struct {
+	now       func() time.Time
+	lock      sync.Mutex
+	stats     HeartbeatStats
+	sentStamp uint64
+	sentAt    time.Time
+}
+
+func newHeartbeatMonitor(now func() time.Time) *heartbeatMonitor {
+	return &heartbeatMonitor{now: now, stats: HeartbeatStats{
+		RTTHistogram:    newHistogram(),
+		JitterHistogram: newHistogram(),
+	}}
+}
+
+// Record that a heartbeat is being sent, returning the stamp to
+// identify it by.
+func (m *heartbeatMonitor) sent() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.sentStamp != 0 {
+		m.stats.Missed++
+	}
+	m.sentAt = m.now()
+	m.sentStamp = uint64(m.sentAt.UnixNano())
+	return m.sentStamp
+}
+
+// Record the echo of the heartbeat with the given stamp.  Late echoes
+// are ignored, since their heartbeat was already counted as missed.
+func (m *heartbeatMonitor) echoed(stamp uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if stamp == 0 || stamp != m.sentStamp {
+		return
+	}
+	m.sentStamp = 0
+	rtt := m.now().Sub(m.sentAt)
+
+	stats := &m.stats
+	if stats.Samples == 0 {
+		stats.SmoothedRTT = rtt
+	} else {
+		// as in RFC 6298 and RFC 3550 respectively
+		stats.SmoothedRTT += (rtt - stats.SmoothedRTT) / 8
+		delta := rtt - stats.RTT
+		if delta < 0 {
+			delta = -delta
+		}
+		stats.Jitter += (delta - stats.Jitter) / 16
+		stats.JitterHistogram.observe(delta)
+	}
+	stats.RTT = rtt
+	stats.Samples++
+	stats.RTTHistogram.observe(rtt)
+}
+
+func (m *heartbeatMonitor) Stats() HeartbeatStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	stats := m.stats
+	stats.RTTHistogram = stats.RTTHistogram.copy()
+	stats.JitterHistogram = stats.JitterHistogram.copy()
+	return stats
+}
+
+// Add the headline figures to a forwarder's attributes, for the
+// connection status
+func (m *heartbeatMonitor) addAttrs(attrs map[string]interface{}) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.stats.Samples > 0 {
+		attrs["rtt"] = m.stats.SmoothedRTT.Round(time.Microsecond)
+		attrs["jitter"] = m.stats.Jitter.Round(time.Microsecond)
+	}
+	if m.stats.Missed > 0 {
+		attrs["missed-heartbeats"] = m.stats.Missed
+	}
+}
@@ -0,0 +1,99 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Send a heartbeat, and have it echoed after rtt
+func heartbeatRoundTrip(m *heartbeatMonitor, clock *testClock, rtt time.Duration) {
+	stamp := m.sent()
+	clock.Advance(rtt)
+	m.echoed(stamp)
+}
+
+func TestHeartbeatMonitor(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000, 0)}
+	m := newHeartbeatMonitor(clock.Now)
+
+	attrs := map[string]interface{}{}
+	m.addAttrs(attrs)
+	require.Empty(t, attrs)
+	require.Equal(t, uint64(0), m.Stats().Samples)
+
+	// The first sample sets the smoothed RTT, but there is no
+	// jitter until there are two
+	heartbeatRoundTrip(m, clock, 10*time.Millisecond)
+	stats := m.Stats()
+	require.Equal(t, 10*time.Millisecond, stats.RTT)
+	require.Equal(t, 10*time.Millisecond, stats.SmoothedRTT)
+	require.Equal(t, time.Duration(0), stats.Jitter)
+	require.Equal(t, uint64(1), stats.Samples)
+	require.Equal(t, uint64(1), stats.RTTHistogram.Count)
+	require.Equal(t, []uint64{0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0}, stats.RTTHistogram.Counts)
+	require.Equal(t, uint64(0), stats.JitterHistogram.Count)
+
+	clock.Advance(time.Second)
+	heartbeatRoundTrip(m, clock, 18*time.Millisecond)
+	stats = m.Stats()
+	require.Equal(t, 18*time.Millisecond, stats.RTT)
+	require.Equal(t, 11*time.Millisecond, stats.SmoothedRTT) // 10 + (18-10)/8
+	require.Equal(t, 500*time.Microsecond, stats.Jitter)     // 0 + (8-0)/16
+	require.Equal(t, []uint64{0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0}, stats.JitterHistogram.Counts)
+
+	clock.Advance(time.Second)
+	heartbeatRoundTrip(m, clock, 2*time.Millisecond)
+	stats = m.Stats()
+	require.Equal(t, 2*time.Millisecond, stats.RTT)
+	require.Equal(t, 9875*time.Microsecond, stats.SmoothedRTT) // 11 + (2-11)/8
+	require.Equal(t, 1468750*time.Nanosecond, stats.Jitter)    // 0.5 + (16-0.5)/16
+	require.Equal(t, uint64(3), stats.Samples)
+	require.Equal(t, uint64(3), stats.RTTHistogram.Count)
+	require.Equal(t, []uint64{0, 0, 1, 0, 1, 1, 0, 0, 0, 0, 0, 0}, stats.RTTHistogram.Counts)
+	require.InDelta(t, 0.030, stats.RTTHistogram.Sum, 1e-9)
+	require.Equal(t, uint64(2), stats.JitterHistogram.Count)
+	require.Equal(t, []uint64{0, 0, 0, 0, 1, 1, 0, 0, 0, 0, 0, 0}, stats.JitterHistogram.Counts)
+	require.Equal(t, uint64(0), stats.Missed)
+
+	// A heartbeat which is not echoed before the next is sent is
+	// missed, and its late echo ignored
+	clock.Advance(time.Second)
+	missed := m.sent()
+	clock.Advance(time.Second)
+	stamp := m.sent()
+	clock.Advance(5 * time.Millisecond)
+	m.echoed(missed)
+	m.echoed(0)
+	stats = m.Stats()
+	require.Equal(t, uint64(1), stats.Missed)
+	require.Equal(t, uint64(3), stats.Samples)
+	m.echoed(stamp)
+	m.echoed(stamp) // a duplicate
+	stats = m.Stats()
+	require.Equal(t, 5*time.Millisecond, stats.RTT)
+	require.Equal(t, uint64(4), stats.Samples)
+
+	// An RTT beyond the last bucket is only in the count and sum
+	clock.Advance(time.Second)
+	heartbeatRoundTrip(m, clock, 5*time.Second)
+	stats = m.Stats()
+	require.Equal(t, uint64(5), stats.RTTHistogram.Count)
+	var inBuckets uint64
+	for _, count := range stats.RTTHistogram.Counts {
+		inBuckets += count
+	}
+	require.Equal(t, uint64(4), inBuckets)
+
+	// The histograms reported are copies
+	stats.RTTHistogram.Counts[0] = 100
+	require.Equal(t, uint64(0), m.Stats().RTTHistogram.Counts[0])
+
+	m.addAttrs(attrs)
+	require.Equal(t, map[string]interface{}{
+		"rtt":               m.Stats().SmoothedRTT.Round(time.Microsecond),
+		"jitter":            m.Stats().Jitter.Round(time.Microsecond),
+		"missed-heartbeats": uint64(1),
+	}, attrs)
+}
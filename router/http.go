@@ -1,6 +1,7 @@
 package router
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -53,4 +54,151 @@ func (router *NetworkRouter) HandleHTTP(muxRouter *mux.Router) {
 		w.WriteHeader(204)
 	})
 
+	// Replacing the network password across a running network is done
+	// in two steps: first add the new one as a secondary password on
+	// every peer, then make it the primary one everywhere.
+	muxRouter.Methods("POST").Path("/passwords").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Sprint("unable to parse form: ", err), http.StatusBadRequest)
+			return
+		}
+		password, secondaries, err := parsePasswords(r.FormValue("password"), r.Form["secondary"])
+		if err == nil {
+			err = router.SetPasswords(password, secondaries)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprint("unable to set passwords: ", err.Error()), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Network password changed; accepting %d secondary passwords on incoming connections", len(secondaries))
+
+		w.WriteHeader(204)
+	})
+
+	muxRouter.Methods("GET").Path("/link-routes").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if router.linkRouting == nil {
+			http.Error(w, "link-quality routing is not enabled", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(router.LinkRoutes()); err != nil {
+			common.Log.Warningln("[link-routes]:", err.Error())
+		}
+	})
+
+	muxRouter.Methods("GET").Path("/multicast-groups").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if router.multicast == nil {
+			http.Error(w, "multicast snooping is not enabled", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(router.MulticastGroups()); err != nil {
+			common.Log.Warningln("[multicast-groups]:", err.Error())
+		}
+	})
+
+	muxRouter.Methods("GET").Path("/capture").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter, duration, maxPackets, err := ParseCaptureRequest(r)
+		if err != nil {
+			http.Error(w, fmt.Sprint("unable to parse capture request: ", err.Error()), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+		if err := router.Capture(w, filter, duration, maxPackets, r.Context().Done()); err != nil {
+			common.Log.Warningln("[capture]:", err.Error())
+		}
+	})
+
+	// The segment containers with the given addresses are attached
+	// in, which is the default segment 0 unless segments are enabled
+	muxRouter.Methods("GET").Path("/segment").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ips, err := parseSegmentAddrs(r.URL.Query()["ip"])
+		if err != nil {
+			http.Error(w, fmt.Sprint("unable to parse addresses: ", err.Error()), http.StatusBadRequest)
+			return
+		}
+		segment, err := router.SegmentOf(ips)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, segment)
+	})
+
+	muxRouter.Methods("POST").Path("/trace").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dstMAC, dstIP, segment, timeout, err := ParseTraceRequest(r)
+		if err != nil {
+			http.Error(w, fmt.Sprint("unable to parse trace request: ", err.Error()), http.StatusBadRequest)
+			return
+		}
+		result, err := router.Trace(dstMAC, dstIP, segment, timeout, r.Context().Done())
+		if err != nil {
+			http.Error(w, fmt.Sprint("unable to trace: ", err.Error()), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			common.Log.Warningln("[trace]:", err.Error())
+		}
+	})
+
+	if osw, ok := router.Overlay.(*OverlaySwitch); ok {
+		if fastdp, ok := osw.overlays["fastdp"].(fastDatapathOverlay); ok {
+			fastdp.HandleHTTP(muxRouter)
+		}
+
+		muxRouter.Methods("GET").Path("/overlay-policy").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(osw.Policy()); err != nil {
+				common.Log.Warningln("[overlay-policy]:", err.Error())
+			}
+		})
+
+		muxRouter.Methods("POST").Path("/overlay-policy").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			policy, err := ParseOverlayPolicy(r.FormValue("order"), r.FormValue("rules"))
+			if err == nil {
+				err = osw.SetPolicy(policy)
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprint("unable to set overlay policy: ", err.Error()), http.StatusBadRequest)
+				return
+			}
+
+			w.WriteHeader(204)
+		})
+
+		muxRouter.Methods("GET").Path("/encryption-policy").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(osw.EncryptionPolicy()); err != nil {
+				common.Log.Warningln("[encryption-policy]:", err.Error())
+			}
+		})
+
+		muxRouter.Methods("POST").Path("/encryption-policy").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			policy, err := ParseEncryptionPolicy(r.FormValue("rules"))
+			if err == nil {
+				err = osw.SetEncryptionPolicy(policy)
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprint("unable to set encryption policy: ", err.Error()), http.StatusBadRequest)
+				return
+			}
+
+			w.WriteHeader(204)
+		})
+	}
+}
+
+func parsePasswords(password string, secondaries []string) ([]byte, [][]byte, error) {
+	if password == "" {
+		return nil, nil, fmt.Errorf("no password given")
+	}
+	var secondaryPasswords [][]byte
+	for _, secondary := range secondaries {
+		if secondary == "" {
+			return nil, nil, fmt.Errorf("empty secondary password")
+		}
+		secondaryPasswords = append(secondaryPasswords, []byte(secondary))
+	}
+	return []byte(password), secondaryPasswords, nil
 }
@@ -0,0 +1,426 @@
+package router
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Link-quality routing chooses unicast routes by the cost of the
+// links along them, rather than by topology alone.  Each
+// participating peer derives the cost of its links from the RTT and
+// loss of heartbeats, and gossips those costs.  Routes are the
+// cheapest paths whose intermediate peers all participate; where
+// there is no such path, the topology-based route from mesh is used.
+
+const (
+	LinkRoutingGossipChannel = "linkcosts"
+
+	linkCostInterval = 30 * time.Second
+	// Peers re-advertise their costs at this interval even if they
+	// have not changed, and we forget the costs of peers which stop
+	// doing so.
+	linkCostRefresh = 2 * time.Minute
+	linkCostMaxAge  = 3 * linkCostRefresh
+
+	// Costs are in microseconds of RTT.  Each hop costs a little, so
+	// that paths with more hops are only chosen when they are
+	// appreciably faster.
+	linkHopCost = 1000
+	// A cost is only re-advertised when it changes by more than
+	// 1/linkCostChangeDivisor, to avoid churning routes.
+	linkCostChangeDivisor = 4
+	// How much a heartbeat loss rate of 1 multiplies a link's cost by
+	linkLossFactor = 10
+)
+
+// The costs of the links from one peer to those it is connected to
+type linkCosts struct {
+	Version uint64
+	Costs   map[mesh.PeerName]uint32
+}
+
+type LinkRouting struct {
+	router      *NetworkRouter
+	gossip      mesh.Gossip
+	changedChan chan struct{}
+
+	sync.Mutex
+	costs    map[mesh.PeerName]linkCosts // by peer, including ourself
+	received map[mesh.PeerName]time.Time
+	links    map[mesh.PeerName]*linkMeasurement
+	routes   map[mesh.PeerName]linkRoute
+}
+
+// What we know about one of our own links
+type linkMeasurement struct {
+	samples uint64
+	missed  uint64
+	loss    float64 // smoothed over successive intervals
+}
+
+type linkRoute struct {
+	path []mesh.PeerName // from the next hop to the destination
+	cost uint32
+}
+
+// EnableLinkRouting makes the router choose unicast routes by link
+// quality.  It must be called before the router is started.
+func (router *NetworkRouter) EnableLinkRouting() error {
+	lr := &LinkRouting{
+		router:      router,
+		changedChan: make(chan struct{}, 1),
+		costs:       make(map[mesh.PeerName]linkCosts),
+		received:    make(map[mesh.PeerName]time.Time),
+		links:       make(map[mesh.PeerName]*linkMeasurement),
+		routes:      make(map[mesh.PeerName]linkRoute),
+	}
+
+	gossip, err := router.NewGossip(LinkRoutingGossipChannel, lr)
+	if err != nil {
+		return err
+	}
+	lr.gossip = gossip
+
+	router.Routes.OnChange(lr.changed)
+	router.Peers.OnGC(func(peer *mesh.Peer) { lr.forget(peer.Name) })
+	router.linkRouting = lr
+	go lr.run()
+	return nil
+}
+
+func (lr *LinkRouting) changed() {
+	select {
+	case lr.changedChan <- struct{}{}:
+	default:
+	}
+}
+
+func (lr *LinkRouting) run() {
+	ticker := time.NewTicker(linkCostInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			lr.measure()
+		case <-lr.changedChan:
+			lr.measure()
+		}
+	}
+}
+
+// Measure the costs of our links, advertising them if they have
+// changed appreciably, and recompute routes.
+func (lr *LinkRouting) measure() {
+	ourName := lr.router.Ourself.Name
+	costs := make(map[mesh.PeerName]uint32)
+
+	measured := make(map[mesh.PeerName]*HeartbeatStats)
+	for _, conn := range localConnections(lr.router) {
+		// Links are only advertised once heartbeats have
+		// measured them, which also shows they work
+		if stats := connectionHeartbeatStats(conn); stats != nil && stats.Samples > 0 {
+			measured[conn.Remote().Name] = stats
+		}
+	}
+
+	lr.Lock()
+	links := make(map[mesh.PeerName]*linkMeasurement)
+	for name, stats := range measured {
+		link := lr.links[name]
+		if link == nil {
+			link = &linkMeasurement{}
+		}
+		links[name] = link
+		costs[name] = link.cost(stats)
+	}
+	lr.links = links
+
+	ours, found := lr.costs[ourName]
+	if found && !costsChanged(ours.Costs, costs) && time.Since(lr.received[ourName]) < linkCostRefresh {
+		lr.Unlock()
+		lr.recomputeRoutes()
+		return
+	}
+	ours = linkCosts{Version: uint64(time.Now().UnixNano()), Costs: costs}
+	if old, found := lr.costs[ourName]; found && ours.Version <= old.Version {
+		ours.Version = old.Version + 1
+	}
+	lr.costs[ourName] = ours
+	lr.received[ourName] = time.Now()
+	lr.Unlock()
+
+	lr.gossip.GossipBroadcast(linkCostsGossip{ourName: ours})
+	lr.recomputeRoutes()
+}
+
+// The heartbeat statistics of the overlay a connection is using
+func connectionHeartbeatStats(conn *mesh.LocalConnection) *HeartbeatStats {
+	reporter, ok := conn.OverlayConn.(heartbeatReporter)
+	if !ok {
+		return nil
+	}
+	name, _ := conn.OverlayConn.Attrs()["name"].(string)
+	if stats, found := reporter.HeartbeatStats()[name]; found {
+		return &stats
+	}
+	return nil
+}
+
+func (link *linkMeasurement) cost(stats *HeartbeatStats) uint32 {
+	samples := stats.Samples - link.samples
+	missed := stats.Missed - link.missed
+	link.samples, link.missed = stats.Samples, stats.Missed
+	if samples+missed > 0 {
+		loss := float64(missed) / float64(samples+missed)
+		link.loss += (loss - link.loss) / 4
+	}
+
+	rtt := float64(stats.SmoothedRTT / time.Microsecond)
+	return linkHopCost + uint32(rtt*(1+linkLossFactor*link.loss))
+}
+
+func costsChanged(old, new map[mesh.PeerName]uint32) bool {
+	if len(old) != len(new) {
+		return true
+	}
+	for name, cost := range new {
+		oldCost, found := old[name]
+		if !found {
+			return true
+		}
+		diff := int64(cost) - int64(oldCost)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > int64(oldCost)/linkCostChangeDivisor {
+			return true
+		}
+	}
+	return false
+}
+
+func (lr *LinkRouting) forget(name mesh.PeerName) {
+	lr.Lock()
+	delete(lr.costs, name)
+	delete(lr.received, name)
+	lr.Unlock()
+	lr.recomputeRoutes()
+}
+
+// Compute the cheapest paths from us to every peer, through
+// participating peers, and invalidate the overlay's routes if any
+// next hops have changed.
+func (lr *LinkRouting) recomputeRoutes() {
+	ourName := lr.router.Ourself.Name
+
+	lr.Lock()
+	for name, t := range lr.received {
+		if name != ourName && time.Since(t) > linkCostMaxAge {
+			delete(lr.costs, name)
+			delete(lr.received, name)
+		}
+	}
+
+	routes := cheapestPaths(ourName, lr.costs)
+	changed := len(routes) != len(lr.routes)
+	for name, route := range routes {
+		if old, found := lr.routes[name]; !found || old.path[0] != route.path[0] {
+			changed = true
+		}
+	}
+	lr.routes = routes
+	lr.Unlock()
+
+	if changed {
+		lr.router.Overlay.(NetworkOverlay).InvalidateRoutes()
+	}
+}
+
+// Dijkstra's algorithm, only expanding from peers which have
+// advertised costs.  The cost of a link is the mean of what its ends
+// advertise.  Ties are broken by peer name, so that the peers along a
+// path agree on it.
+func cheapestPaths(source mesh.PeerName, costs map[mesh.PeerName]linkCosts) map[mesh.PeerName]linkRoute {
+	linkCost := func(from, to mesh.PeerName) uint32 {
+		cost := costs[from].Costs[to]
+		if reverse, found := costs[to].Costs[from]; found {
+			cost = uint32((uint64(cost) + uint64(reverse)) / 2)
+		}
+		return cost
+	}
+
+	dist := map[mesh.PeerName]uint64{source: 0}
+	prev := make(map[mesh.PeerName]mesh.PeerName)
+	done := make(map[mesh.PeerName]bool)
+
+	for {
+		var (
+			current mesh.PeerName
+			best    uint64
+			found   bool
+		)
+		for name, d := range dist {
+			if !done[name] && (!found || d < best || (d == best && name < current)) {
+				current, best, found = name, d, true
+			}
+		}
+		if !found {
+			break
+		}
+		done[current] = true
+
+		for to := range costs[current].Costs {
+			d := best + uint64(linkCost(current, to))
+			if old, seen := dist[to]; !seen || d < old || (d == old && current < prev[to]) {
+				dist[to] = d
+				prev[to] = current
+			}
+		}
+	}
+
+	routes := make(map[mesh.PeerName]linkRoute)
+	for name, d := range dist {
+		if name == source {
+			continue
+		}
+		var path []mesh.PeerName
+		for hop := name; hop != source; hop = prev[hop] {
+			path = append([]mesh.PeerName{hop}, path...)
+		}
+		routes[name] = linkRoute{path: path, cost: uint32(d)}
+	}
+	return routes
+}
+
+// The next hop towards the destination, if there is a route to it
+func (lr *LinkRouting) unicast(dst mesh.PeerName) (mesh.PeerName, bool) {
+	lr.Lock()
+	defer lr.Unlock()
+	route, found := lr.routes[dst]
+	if !found {
+		return mesh.UnknownPeerName, false
+	}
+	return route.path[0], true
+}
+
+// Status
+
+type LinkRouteStatus struct {
+	Destination string
+	NickName    string
+	Path        []string // peer names, starting with the next hop
+	Cost        uint32
+	Topology    string // the next hop of the topology-based route
+}
+
+func (lr *LinkRouting) Status() []LinkRouteStatus {
+	lr.Lock()
+	routes := make(map[mesh.PeerName]linkRoute, len(lr.routes))
+	for name, route := range lr.routes {
+		routes[name] = route
+	}
+	lr.Unlock()
+
+	describe := func(name mesh.PeerName) string {
+		if peer := lr.router.Peers.Fetch(name); peer != nil {
+			return peer.String()
+		}
+		return name.String()
+	}
+
+	var slice []LinkRouteStatus
+	for name, route := range routes {
+		status := LinkRouteStatus{Destination: name.String(), Cost: route.cost}
+		if peer := lr.router.Peers.Fetch(name); peer != nil {
+			status.NickName = peer.NickName
+		}
+		for _, hop := range route.path {
+			status.Path = append(status.Path, describe(hop))
+		}
+		if hop, found := lr.router.Routes.Unicast(name); found {
+			status.Topology = describe(hop)
+		}
+		slice = append(slice, status)
+	}
+	sort.Slice(slice, func(i, j int) bool { return slice[i].Destination < slice[j].Destination })
+	return slice
+}
+
+// Gossip
+
+type linkCostsGossip map[mesh.PeerName]linkCosts
+
+func (g linkCostsGossip) Merge(other mesh.GossipData) mesh.GossipData {
+	merged := make(linkCostsGossip, len(g))
+	for name, costs := range g {
+		merged[name] = costs
+	}
+	for name, costs := range other.(linkCostsGossip) {
+		if existing, found := merged[name]; !found || costs.Version > existing.Version {
+			merged[name] = costs
+		}
+	}
+	return merged
+}
+
+func (g linkCostsGossip) Encode() [][]byte {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(map[mesh.PeerName]linkCosts(g)); err != nil {
+		panic(err)
+	}
+	return [][]byte{buf.Bytes()}
+}
+
+func (lr *LinkRouting) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	return nil
+}
+
+func (lr *LinkRouting) OnGossipBroadcast(sender mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	return lr.OnGossip(msg)
+}
+
+func (lr *LinkRouting) Gossip() mesh.GossipData {
+	lr.Lock()
+	defer lr.Unlock()
+	g := make(linkCostsGossip, len(lr.costs))
+	for name, costs := range lr.costs {
+		g[name] = costs
+	}
+	return g
+}
+
+// OnGossip merges the received costs, returning those which are new
+func (lr *LinkRouting) OnGossip(msg []byte) (mesh.GossipData, error) {
+	var received map[mesh.PeerName]linkCosts
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&received); err != nil {
+		return nil, err
+	}
+
+	ourName := lr.router.Ourself.Name
+	delta := make(linkCostsGossip)
+	lr.Lock()
+	for name, costs := range received {
+		if name == ourName {
+			// Left over from before we restarted; ours
+			// supersede it
+			continue
+		}
+		if existing, found := lr.costs[name]; !found || costs.Version > existing.Version {
+			lr.costs[name] = costs
+			lr.received[name] = time.Now()
+			delta[name] = costs
+		}
+	}
+	lr.Unlock()
+
+	if len(delta) == 0 {
+		return nil, nil
+	}
+	lr.recomputeRoutes()
+	return delta, nil
+}
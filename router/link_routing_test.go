@@ -0,0 +1,131 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestCheapestPaths(t *testing.T) {
+	const (
+		a mesh.PeerName = iota + 1
+		b
+		c
+		d
+		s // the source, named after the others
+	)
+	type links map[mesh.PeerName]map[mesh.PeerName]uint32
+	type route struct {
+		path []mesh.PeerName
+		cost uint32
+	}
+	for _, tc := range []struct {
+		name   string
+		source mesh.PeerName
+		links  links
+		routes map[mesh.PeerName]route
+	}{
+		{
+			name:   "no costs",
+			source: s,
+			routes: map[mesh.PeerName]route{},
+		},
+		{
+			name:   "direct",
+			source: s,
+			links:  links{s: {a: 10, b: 20}, a: {s: 10}, b: {s: 20}},
+			routes: map[mesh.PeerName]route{a: {[]mesh.PeerName{a}, 10}, b: {[]mesh.PeerName{b}, 20}},
+		},
+		{
+			name:   "two cheap hops beat one dear one",
+			source: s,
+			links:  links{s: {a: 100, b: 10}, a: {s: 100, b: 10}, b: {s: 10, a: 10}},
+			routes: map[mesh.PeerName]route{a: {[]mesh.PeerName{b, a}, 20}, b: {[]mesh.PeerName{b}, 10}},
+		},
+		{
+			name:   "equal paths go by the lower named peer",
+			source: s,
+			links:  links{s: {a: 10, b: 10}, a: {s: 10, c: 10}, b: {s: 10, c: 10}, c: {a: 10, b: 10}},
+			routes: map[mesh.PeerName]route{
+				a: {[]mesh.PeerName{a}, 10},
+				b: {[]mesh.PeerName{b}, 10},
+				c: {[]mesh.PeerName{a, c}, 20},
+			},
+		},
+		{
+			name:   "equal paths go by the lower named peer, further along",
+			source: s,
+			links: links{
+				s: {b: 10, a: 20},
+				a: {s: 20, c: 10},
+				b: {s: 10, d: 20},
+				c: {a: 10, d: 10},
+				d: {b: 20, c: 10},
+			},
+			// s-b-d and s-a-c-d both cost 30; d's predecessor is
+			// the lower named of b and c
+			routes: map[mesh.PeerName]route{
+				a: {[]mesh.PeerName{a}, 20},
+				b: {[]mesh.PeerName{b}, 10},
+				c: {[]mesh.PeerName{a, c}, 30},
+				d: {[]mesh.PeerName{b, d}, 30},
+			},
+		},
+		{
+			name:   "asymmetric costs are averaged",
+			source: s,
+			links:  links{s: {a: 10, b: 40}, a: {s: 30, b: 10}, b: {s: 40, a: 50}},
+			// s-a is 20; a-b is 30
+			routes: map[mesh.PeerName]route{a: {[]mesh.PeerName{a}, 20}, b: {[]mesh.PeerName{b}, 40}},
+		},
+		{
+			name:   "a cost advertised by one end only",
+			source: s,
+			links:  links{s: {a: 10}},
+			routes: map[mesh.PeerName]route{a: {[]mesh.PeerName{a}, 10}},
+		},
+		{
+			name:   "a link only the far end advertises is not used",
+			source: s,
+			links:  links{a: {s: 10}},
+			routes: map[mesh.PeerName]route{},
+		},
+		{
+			name:   "peers which have not advertised costs are not passed through",
+			source: s,
+			links:  links{s: {a: 10, b: 100}, b: {s: 100, c: 10}},
+			routes: map[mesh.PeerName]route{
+				a: {[]mesh.PeerName{a}, 10},
+				b: {[]mesh.PeerName{b}, 100},
+				c: {[]mesh.PeerName{b, c}, 110},
+			},
+		},
+		{
+			name:   "unreachable peers have no route",
+			source: s,
+			links:  links{s: {a: 10}, a: {s: 10}, c: {d: 10}, d: {c: 10}},
+			routes: map[mesh.PeerName]route{a: {[]mesh.PeerName{a}, 10}},
+		},
+		{
+			name:   "the source may have the lowest name",
+			source: a,
+			links:  links{a: {c: 10, d: 10}, c: {a: 10, b: 10}, d: {a: 10, b: 10}, b: {c: 10, d: 10}},
+			routes: map[mesh.PeerName]route{
+				b: {[]mesh.PeerName{c, b}, 20},
+				c: {[]mesh.PeerName{c}, 10},
+				d: {[]mesh.PeerName{d}, 10},
+			},
+		},
+	} {
+		costs := make(map[mesh.PeerName]linkCosts)
+		for from, to := range tc.links {
+			costs[from] = linkCosts{Version: 1, Costs: to}
+		}
+		routes := make(map[mesh.PeerName]route)
+		for name, r := range cheapestPaths(tc.source, costs) {
+			routes[name] = route{r.path, r.cost}
+		}
+		require.Equal(t, tc.routes, routes, tc.name)
+	}
+}
@@ -21,6 +21,17 @@ type MacCache struct {
 	onExpiry    func(net.HardwareAddr, *mesh.Peer)
 }
 
+// Entries are keyed by segment as well as MAC, so that the same MAC
+// may be at different peers in different segments, and a MAC learnt
+// in one segment is unknown in the others.
+func cacheKey(mac net.HardwareAddr, segment Segment) uint64 {
+	return uint64(segment)<<48 | macint(mac)
+}
+
+func keySegment(key uint64) Segment {
+	return Segment(key >> 48)
+}
+
 func NewMacCache(maxAge time.Duration, onExpiry func(net.HardwareAddr, *mesh.Peer)) *MacCache {
 	cache := &MacCache{
 		table:    make(map[uint64]*MacCacheEntry),
@@ -30,8 +41,8 @@ func NewMacCache(maxAge time.Duration, onExpiry func(net.HardwareAddr, *mesh.Pee
 	return cache
 }
 
-func (cache *MacCache) add(mac net.HardwareAddr, peer *mesh.Peer, force bool) (bool, *mesh.Peer) {
-	key := macint(mac)
+func (cache *MacCache) add(mac net.HardwareAddr, segment Segment, peer *mesh.Peer, force bool) (bool, *mesh.Peer) {
+	key := cacheKey(mac, segment)
 	now := time.Now()
 
 	cache.RLock()
@@ -66,16 +77,16 @@ func (cache *MacCache) add(mac net.HardwareAddr, peer *mesh.Peer, force bool) (b
 	return false, nil
 }
 
-func (cache *MacCache) Add(mac net.HardwareAddr, peer *mesh.Peer) (bool, *mesh.Peer) {
-	return cache.add(mac, peer, false)
+func (cache *MacCache) Add(mac net.HardwareAddr, segment Segment, peer *mesh.Peer) (bool, *mesh.Peer) {
+	return cache.add(mac, segment, peer, false)
 }
 
-func (cache *MacCache) AddForced(mac net.HardwareAddr, peer *mesh.Peer) (bool, *mesh.Peer) {
-	return cache.add(mac, peer, true)
+func (cache *MacCache) AddForced(mac net.HardwareAddr, segment Segment, peer *mesh.Peer) (bool, *mesh.Peer) {
+	return cache.add(mac, segment, peer, true)
 }
 
-func (cache *MacCache) Lookup(mac net.HardwareAddr) *mesh.Peer {
-	key := macint(mac)
+func (cache *MacCache) Lookup(mac net.HardwareAddr, segment Segment) *mesh.Peer {
+	key := cacheKey(mac, segment)
 	cache.RLock()
 	defer cache.RUnlock()
 	entry, found := cache.table[key]
@@ -123,6 +134,7 @@ func macint(mac net.HardwareAddr) (r uint64) {
 	return
 }
 
+// The MAC of a key; any segment in the top bits is ignored
 func intmac(key uint64) (r net.HardwareAddr) {
 	r = make([]byte, 6)
 	for i := 5; i >= 0; i-- {
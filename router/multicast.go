@@ -0,0 +1,618 @@
+package router
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/weaveworks/mesh"
+)
+
+// Multicast snooping sends multicast frames only to the peers with
+// members of the group, rather than broadcasting them.  Each
+// participating peer learns which groups its containers are members
+// of from the IGMP and MLD reports they send, querying them
+// periodically so that they keep reporting, and gossips the groups.
+// Multicast frames are then forwarded to each interested peer
+// directly, rather than along the broadcast tree.
+//
+// Groups are told apart by the MAC addresses they map to, which
+// several groups can share, so a peer gets the frames for any group
+// sharing a MAC address with one it is interested in.  Link-local
+// groups, such as those used by IPv6 neighbour discovery and
+// multicast DNS, are always broadcast, as are groups sharing their
+// MAC addresses.
+//
+// Older hosts send their reports to the group they are about, so all
+// frames which local containers send to snooped group MACs pass
+// through the router, and the fast datapath creates no flows for
+// them.
+
+const (
+	MulticastGossipChannel = "multicast"
+
+	// The RFC 3376 and RFC 3810 defaults
+	multicastQueryInterval = 125 * time.Second
+	multicastResponseTime  = 10 * time.Second
+	multicastMemberTimeout = 2*multicastQueryInterval + multicastResponseTime
+	multicastRobustness    = 2
+)
+
+// IGMPv3 and MLDv2 reports, and IGMPv2 leaves and MLDv1 dones, go to
+// these well-known groups, rather than the groups they are about.
+// IGMPv1 and v2 and MLDv1 reports go to the group itself.
+var multicastReportMACs = map[MAC]struct{}{
+	{0x01, 0x00, 0x5e, 0x00, 0x00, 0x16}: {}, // 224.0.0.22, IGMPv3 reports
+	{0x01, 0x00, 0x5e, 0x00, 0x00, 0x02}: {}, // 224.0.0.2, IGMPv2 leaves
+	{0x33, 0x33, 0x00, 0x00, 0x00, 0x16}: {}, // ff02::16, MLDv2 reports
+	{0x33, 0x33, 0x00, 0x00, 0x00, 0x02}: {}, // ff02::2, MLDv1 dones
+}
+
+// The groups with members at one peer
+type multicastGroups struct {
+	Version uint64
+	Groups  []string // IP addresses, sorted
+}
+
+type MulticastSnooping struct {
+	router  *NetworkRouter
+	gossip  mesh.Gossip
+	querier MAC // the source of our queries
+
+	sync.Mutex
+	members    map[string]map[MAC]time.Time      // local members by group, and when they last reported
+	groups     map[mesh.PeerName]multicastGroups // by peer, including ourself
+	interested map[MAC][]mesh.PeerName           // remote peers with members, by group MAC
+}
+
+// EnableMulticastSnooping makes the router forward multicast only to
+// the peers with members of the group.  It must be enabled on all
+// peers, and called before the router is started.
+func (router *NetworkRouter) EnableMulticastSnooping() error {
+	ms := &MulticastSnooping{
+		router:     router,
+		members:    make(map[string]map[MAC]time.Time),
+		groups:     make(map[mesh.PeerName]multicastGroups),
+		interested: make(map[MAC][]mesh.PeerName),
+	}
+	if _, err := rand.Read(ms.querier[:]); err != nil {
+		return err
+	}
+	// unicast, locally administered
+	ms.querier[0] = ms.querier[0]&^0x01 | 0x02
+
+	gossip, err := router.NewGossip(MulticastGossipChannel, ms)
+	if err != nil {
+		return err
+	}
+	ms.gossip = gossip
+	// Peers which participate need to be known as such even
+	// before they have any members
+	ms.groups[router.Ourself.Name] = multicastGroups{Version: uint64(time.Now().UnixNano())}
+
+	router.Peers.OnGC(func(peer *mesh.Peer) { ms.forget(peer.Name) })
+	router.multicast = ms
+	go ms.run()
+	return nil
+}
+
+func (ms *MulticastSnooping) run() {
+	// Hosts report the groups they are already members of in
+	// response to a query, so ask straight away in case weave
+	// was restarted.
+	ms.query()
+	queryTicker := time.NewTicker(multicastQueryInterval)
+	defer queryTicker.Stop()
+	expireTicker := time.NewTicker(multicastResponseTime)
+	defer expireTicker.Stop()
+	for {
+		select {
+		case <-queryTicker.C:
+			ms.query()
+		case <-expireTicker.C:
+			ms.expire()
+		}
+	}
+}
+
+// The MAC address which frames to a multicast group are sent to
+func multicastGroupMAC(group net.IP) MAC {
+	if ip4 := group.To4(); ip4 != nil {
+		return MAC{0x01, 0x00, 0x5e, ip4[1] & 0x7f, ip4[2], ip4[3]}
+	}
+	return MAC{0x33, 0x33, group[12], group[13], group[14], group[15]}
+}
+
+// Is the MAC address that of groups which are snooped?  The IPv4
+// link-local groups, 224.0.0.x, share MAC addresses with others
+// such as 239.128.0.x, and the IPv6 ones with well-known groups of
+// all scopes, which are therefore broadcast too, as are the IPv6
+// solicited-node groups.
+func isSnoopedMulticast(mac MAC) bool {
+	switch {
+	case mac[0] == 0x01 && mac[1] == 0x00 && mac[2] == 0x5e:
+		return mac[3]&0x80 == 0 && !(mac[3] == 0 && mac[4] == 0)
+	case mac[0] == 0x33 && mac[1] == 0x33:
+		return !(mac[2] == 0 && mac[3] == 0 && mac[4] == 0) && mac[2] != 0xff
+	}
+	return false
+}
+
+// Snooping
+
+// multicastSnoopFlowOp passes reports to the snooping.
+type multicastSnoopFlowOp struct {
+	inspectingFlowOp
+	ms *MulticastSnooping
+}
+
+func (op multicastSnoopFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	op.ms.snoop(frame)
+}
+
+// Add a multicastSnoopFlowOp to the FlowOp for a locally captured
+// packet, if it might be a report: one to a well-known report group,
+// or to a snooped group, from an older host.
+func (ms *MulticastSnooping) snoopPacket(key PacketKey, fop FlowOp) FlowOp {
+	if _, found := multicastReportMACs[key.DstMAC]; !found && !isSnoopedMulticast(key.DstMAC) {
+		return fop
+	}
+	mfop := NewMultiFlowOp(false, multicastSnoopFlowOp{ms: ms})
+	if fop != nil {
+		mfop.Add(fop)
+	}
+	return mfop
+}
+
+// The change in membership that a group record of an IGMPv3 or MLDv2
+// report, which share record types, means: 1 for a join, -1 for a
+// leave, 0 for neither.  Source filtering is ignored, so any
+// interest in a group counts as membership.
+func multicastRecordChange(recordType uint8, sources int) int {
+	switch recordType {
+	case 2, 4: // MODE_IS_EXCLUDE, CHANGE_TO_EXCLUDE_MODE
+		return 1
+	case 1, 3: // MODE_IS_INCLUDE, CHANGE_TO_INCLUDE_MODE
+		if sources == 0 {
+			return -1
+		}
+		return 1
+	case 5: // ALLOW_NEW_SOURCES
+		return 1
+	}
+	return 0
+}
+
+func (ms *MulticastSnooping) snoop(frame []byte) {
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	eth, ok := packet.LinkLayer().(*layers.Ethernet)
+	if !ok {
+		return
+	}
+	var host MAC
+	copy(host[:], eth.SrcMAC)
+
+	var joined, left []net.IP
+	record := func(group net.IP, change int) {
+		switch change {
+		case 1:
+			joined = append(joined, group)
+		case -1:
+			left = append(left, group)
+		}
+	}
+	for _, layer := range packet.Layers() {
+		switch report := layer.(type) {
+		case *layers.IGMP:
+			if report.Type == layers.IGMPMembershipReportV3 {
+				for _, r := range report.GroupRecords {
+					record(r.MulticastAddress, multicastRecordChange(uint8(r.Type), len(r.SourceAddresses)))
+				}
+			}
+		case *layers.IGMPv1or2:
+			switch report.Type {
+			case layers.IGMPMembershipReportV1, layers.IGMPMembershipReportV2:
+				record(report.GroupAddress, 1)
+			case layers.IGMPLeaveGroup:
+				record(report.GroupAddress, -1)
+			}
+		case *layers.MLDv2MulticastListenerReportMessage:
+			for _, r := range report.MulticastAddressRecords {
+				record(r.MulticastAddress, multicastRecordChange(uint8(r.RecordType), len(r.SourceAddresses)))
+			}
+		case *layers.MLDv1MulticastListenerReportMessage:
+			record(report.MulticastAddress, 1)
+		case *layers.MLDv1MulticastListenerDoneMessage:
+			record(report.MulticastAddress, -1)
+		}
+	}
+	if len(joined) > 0 || len(left) > 0 {
+		ms.update(host, joined, left)
+	}
+}
+
+// Record that a local host has joined and left groups
+func (ms *MulticastSnooping) update(host MAC, joined, left []net.IP) {
+	now := time.Now()
+	ms.Lock()
+	for _, group := range joined {
+		if !group.IsMulticast() || !isSnoopedMulticast(multicastGroupMAC(group)) {
+			continue
+		}
+		members := ms.members[group.String()]
+		if members == nil {
+			members = make(map[MAC]time.Time)
+			ms.members[group.String()] = members
+		}
+		if _, found := members[host]; !found {
+			log.Debugln("Multicast group", group, "joined by", host)
+		}
+		members[host] = now
+	}
+	for _, group := range left {
+		if members, found := ms.members[group.String()]; found {
+			delete(members, host)
+			if len(members) == 0 {
+				delete(ms.members, group.String())
+			}
+			log.Debugln("Multicast group", group, "left by", host)
+		}
+	}
+	ms.Unlock()
+	ms.advertise()
+}
+
+// Forget the local members which have stopped reporting
+func (ms *MulticastSnooping) expire() {
+	ms.Lock()
+	for group, members := range ms.members {
+		for host, t := range members {
+			if time.Since(t) > multicastMemberTimeout {
+				delete(members, host)
+			}
+		}
+		if len(members) == 0 {
+			delete(ms.members, group)
+		}
+	}
+	ms.Unlock()
+	ms.advertise()
+}
+
+// Gossip the groups with local members, if they have changed
+func (ms *MulticastSnooping) advertise() {
+	ourName := ms.router.Ourself.Name
+	ms.Lock()
+	groups := make([]string, 0, len(ms.members))
+	for group := range ms.members {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	ours := ms.groups[ourName]
+	if len(groups) == len(ours.Groups) && (len(groups) == 0 || reflect.DeepEqual(groups, ours.Groups)) {
+		ms.Unlock()
+		return
+	}
+	version := uint64(time.Now().UnixNano())
+	if version <= ours.Version {
+		version = ours.Version + 1
+	}
+	ours = multicastGroups{Version: version, Groups: groups}
+	ms.groups[ourName] = ours
+	ms.Unlock()
+
+	ms.gossip.GossipBroadcast(multicastGroupsGossip{ourName: ours})
+}
+
+// Queries
+
+// Send IGMPv3 and MLDv2 general queries to the local bridge
+func (ms *MulticastSnooping) query() {
+	dec := NewEthernetDecoder()
+	for _, frame := range [][]byte{igmpQuery(ms.querier), mldQuery(ms.querier)} {
+		dec.DecodeLayers(frame)
+		if fop := ms.router.InjectorConsumer.InjectPacket(dec.PacketKey()); fop != nil {
+			fop.Process(frame, dec, true)
+		}
+	}
+}
+
+func internetChecksum(data []byte, sum uint32) uint16 {
+	for ; len(data) > 1; data = data[2:] {
+		sum += uint32(binary.BigEndian.Uint16(data))
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// An IGMPv3 general query, from 0.0.0.0 as queriers with no address
+// of their own use.  The IP header carries the router alert option.
+func igmpQuery(src MAC) []byte {
+	frame := make([]byte, 14+24+12)
+	copy(frame[0:], []byte{0x01, 0x00, 0x5e, 0x00, 0x00, 0x01})
+	copy(frame[6:], src[:])
+	binary.BigEndian.PutUint16(frame[12:], uint16(layers.EthernetTypeIPv4))
+
+	ip := frame[14 : 14+24]
+	ip[0] = 0x46 // version 4, 6 words of header
+	ip[1] = 0xc0 // internetwork control
+	binary.BigEndian.PutUint16(ip[2:], 24+12)
+	ip[8] = 1 // TTL
+	ip[9] = byte(layers.IPProtocolIGMP)
+	copy(ip[16:], net.IPv4allsys.To4())
+	copy(ip[20:], []byte{0x94, 0x04, 0x00, 0x00}) // router alert
+	binary.BigEndian.PutUint16(ip[10:], internetChecksum(ip, 0))
+
+	igmp := frame[14+24:]
+	igmp[0] = byte(layers.IGMPMembershipQuery)
+	igmp[1] = byte(multicastResponseTime / (time.Second / 10))
+	igmp[8] = multicastRobustness
+	igmp[9] = byte(multicastQueryInterval / time.Second)
+	binary.BigEndian.PutUint16(igmp[2:], internetChecksum(igmp, 0))
+	return frame
+}
+
+// An MLDv2 general query, from the link-local address derived from
+// the MAC address, since hosts ignore queries from any other.
+func mldQuery(src MAC) []byte {
+	frame := make([]byte, 14+40+8+28)
+	copy(frame[0:], []byte{0x33, 0x33, 0x00, 0x00, 0x00, 0x01})
+	copy(frame[6:], src[:])
+	binary.BigEndian.PutUint16(frame[12:], uint16(layers.EthernetTypeIPv6))
+
+	ip := frame[14 : 14+40]
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], 8+28)
+	ip[6] = byte(layers.IPProtocolIPv6HopByHop)
+	ip[7] = 1 // hop limit
+	srcIP := ip[8:24]
+	copy(srcIP, []byte{0xfe, 0x80})
+	copy(srcIP[8:], []byte{src[0] ^ 0x02, src[1], src[2], 0xff, 0xfe, src[3], src[4], src[5]})
+	dstIP := ip[24:40]
+	copy(dstIP, net.IPv6linklocalallnodes)
+
+	hopByHop := frame[14+40 : 14+40+8]
+	hopByHop[0] = byte(layers.IPProtocolICMPv6)
+	copy(hopByHop[2:], []byte{0x05, 0x02, 0x00, 0x00}) // router alert: MLD
+	copy(hopByHop[6:], []byte{0x01, 0x00})             // PadN
+
+	mld := frame[14+40+8:]
+	mld[0] = byte(layers.ICMPv6TypeMLDv1MulticastListenerQueryMessage)
+	binary.BigEndian.PutUint16(mld[4:], uint16(multicastResponseTime/time.Millisecond))
+	mld[24] = multicastRobustness
+	mld[25] = byte(multicastQueryInterval / time.Second)
+	var pseudoHeader []byte
+	pseudoHeader = append(pseudoHeader, srcIP...)
+	pseudoHeader = append(pseudoHeader, dstIP...)
+	pseudoHeader = append(pseudoHeader, 0, 0, 0, byte(len(mld)), 0, 0, 0, byte(layers.IPProtocolICMPv6))
+	var sum uint32
+	for i := 0; i < len(pseudoHeader); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pseudoHeader[i:]))
+	}
+	binary.BigEndian.PutUint16(mld[2:], internetChecksum(mld, sum))
+	return frame
+}
+
+// Forwarding
+
+// Forward a multicast frame directly to each of the peers with
+// members of its group.
+func (ms *MulticastSnooping) relay(srcPeer *mesh.Peer, key PacketKey) FlowOp {
+	ms.Lock()
+	names := ms.interested[key.DstMAC]
+	ms.Unlock()
+	if len(names) == 0 {
+		return DiscardingFlowOp{}
+	}
+
+	op := NewMultiFlowOp(true)
+	for _, name := range names {
+		if peer := ms.router.Peers.Fetch(name); peer != nil && peer != srcPeer {
+			op.Add(ms.router.relay(ForwardPacketKey{
+				PacketKey: key,
+				SrcPeer:   srcPeer,
+				DstPeer:   peer}))
+		}
+	}
+	return op
+}
+
+// Was a forwarded multicast frame sent directly to us, rather than
+// along the broadcast tree, so that we should not relay it further?
+func (ms *MulticastSnooping) sentDirectly(key ForwardPacketKey) bool {
+	if !isSnoopedMulticast(key.DstMAC) {
+		return false
+	}
+	ms.Lock()
+	defer ms.Unlock()
+	_, found := ms.groups[key.SrcPeer.Name]
+	return found
+}
+
+func (ms *MulticastSnooping) forget(name mesh.PeerName) {
+	ms.Lock()
+	delete(ms.groups, name)
+	ms.Unlock()
+	ms.recompute()
+}
+
+// Work out which peers are interested in each group MAC, and
+// invalidate the overlay's routes if that has changed.
+func (ms *MulticastSnooping) recompute() {
+	ourName := ms.router.Ourself.Name
+	ms.Lock()
+	interested := make(map[MAC][]mesh.PeerName)
+	for name, groups := range ms.groups {
+		if name == ourName {
+			continue
+		}
+		macs := make(map[MAC]struct{})
+		for _, group := range groups.Groups {
+			if ip := net.ParseIP(group); ip != nil {
+				macs[multicastGroupMAC(ip)] = struct{}{}
+			}
+		}
+		for mac := range macs {
+			interested[mac] = append(interested[mac], name)
+		}
+	}
+	for _, names := range interested {
+		sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	}
+	changed := !reflect.DeepEqual(interested, ms.interested)
+	ms.interested = interested
+	ms.Unlock()
+
+	if changed {
+		ms.router.Overlay.(NetworkOverlay).InvalidateRoutes()
+	}
+}
+
+// Status
+
+type MulticastGroupStatus struct {
+	Group   string
+	Members []string // MAC addresses of local members
+	Peers   []string // remote peers with members
+}
+
+func (ms *MulticastSnooping) Status() []MulticastGroupStatus {
+	ourName := ms.router.Ourself.Name
+	statuses := make(map[string]*MulticastGroupStatus)
+	status := func(group string) *MulticastGroupStatus {
+		if statuses[group] == nil {
+			statuses[group] = &MulticastGroupStatus{Group: group}
+		}
+		return statuses[group]
+	}
+
+	ms.Lock()
+	for group, members := range ms.members {
+		s := status(group)
+		for host := range members {
+			s.Members = append(s.Members, host.String())
+		}
+		sort.Strings(s.Members)
+	}
+	groups := make(map[mesh.PeerName][]string, len(ms.groups))
+	for name, g := range ms.groups {
+		if name != ourName {
+			groups[name] = g.Groups
+		}
+	}
+	ms.Unlock()
+
+	for name, gs := range groups {
+		description := name.String()
+		if peer := ms.router.Peers.Fetch(name); peer != nil {
+			description = peer.String()
+		}
+		for _, group := range gs {
+			s := status(group)
+			s.Peers = append(s.Peers, description)
+		}
+	}
+
+	var slice []MulticastGroupStatus
+	for _, s := range statuses {
+		sort.Strings(s.Peers)
+		slice = append(slice, *s)
+	}
+	sort.Slice(slice, func(i, j int) bool { return slice[i].Group < slice[j].Group })
+	return slice
+}
+
+// Gossip
+
+type multicastGroupsGossip map[mesh.PeerName]multicastGroups
+
+func (g multicastGroupsGossip) Merge(other mesh.GossipData) mesh.GossipData {
+	merged := make(multicastGroupsGossip, len(g))
+	for name, groups := range g {
+		merged[name] = groups
+	}
+	for name, groups := range other.(multicastGroupsGossip) {
+		if existing, found := merged[name]; !found || groups.Version > existing.Version {
+			merged[name] = groups
+		}
+	}
+	return merged
+}
+
+func (g multicastGroupsGossip) Encode() [][]byte {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(map[mesh.PeerName]multicastGroups(g)); err != nil {
+		panic(err)
+	}
+	return [][]byte{buf.Bytes()}
+}
+
+func (ms *MulticastSnooping) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	return nil
+}
+
+func (ms *MulticastSnooping) OnGossipBroadcast(sender mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	return ms.OnGossip(msg)
+}
+
+func (ms *MulticastSnooping) Gossip() mesh.GossipData {
+	ms.Lock()
+	defer ms.Unlock()
+	g := make(multicastGroupsGossip, len(ms.groups))
+	for name, groups := range ms.groups {
+		g[name] = groups
+	}
+	return g
+}
+
+// OnGossip merges the received groups, returning those which are new
+func (ms *MulticastSnooping) OnGossip(msg []byte) (mesh.GossipData, error) {
+	var received map[mesh.PeerName]multicastGroups
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&received); err != nil {
+		return nil, err
+	}
+
+	ourName := ms.router.Ourself.Name
+	delta := make(multicastGroupsGossip)
+	ms.Lock()
+	for name, groups := range received {
+		if name == ourName {
+			// Left over from before we restarted; ours
+			// supersede it
+			continue
+		}
+		if existing, found := ms.groups[name]; !found || groups.Version > existing.Version {
+			ms.groups[name] = groups
+			delta[name] = groups
+		}
+	}
+	ms.Unlock()
+
+	if len(delta) == 0 {
+		return nil, nil
+	}
+	ms.recompute()
+	return delta, nil
+}
+
+// MulticastGroups describes the groups with members, or returns nil
+// if multicast snooping is not enabled.
+func (router *NetworkRouter) MulticastGroups() []MulticastGroupStatus {
+	if router.multicast == nil {
+		return nil
+	}
+	return router.multicast.Status()
+}
@@ -0,0 +1,271 @@
+package router
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+type testGossip struct {
+	broadcasts []mesh.GossipData
+}
+
+func (g *testGossip) GossipUnicast(mesh.PeerName, []byte) error { return nil }
+
+func (g *testGossip) GossipBroadcast(update mesh.GossipData) {
+	g.broadcasts = append(g.broadcasts, update)
+}
+
+func (g *testGossip) GossipNeighbourSubset(mesh.GossipData) {}
+
+func testMulticastSnooping(t *testing.T) (*MulticastSnooping, *testGossip) {
+	meshRouter, err := mesh.NewRouter(mesh.Config{}, mesh.PeerName(0x000000000001), "host1", NullNetworkOverlay{}, log)
+	require.NoError(t, err)
+	gossip := &testGossip{}
+	ms := &MulticastSnooping{
+		router:     &NetworkRouter{Router: meshRouter},
+		gossip:     gossip,
+		members:    make(map[string]map[MAC]time.Time),
+		groups:     make(map[mesh.PeerName]multicastGroups),
+		interested: make(map[MAC][]mesh.PeerName),
+	}
+	return ms, gossip
+}
+
+// The groups with local members, and the members of each
+func (ms *MulticastSnooping) testMembers() map[string][]MAC {
+	members := make(map[string][]MAC)
+	for group, hosts := range ms.members {
+		for host := range hosts {
+			members[group] = append(members[group], host)
+		}
+	}
+	return members
+}
+
+func testIGMPFrame(t *testing.T, src MAC, dstIP net.IP, igmp []byte) []byte {
+	dst := multicastGroupMAC(dstIP)
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{SrcMAC: src[:], DstMAC: dst[:], EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, TTL: 1, Protocol: layers.IPProtocolIGMP, SrcIP: net.IPv4(10, 32, 0, 1), DstIP: dstIP},
+		gopacket.Payload(igmp)))
+	return buf.Bytes()
+}
+
+func testMLDFrame(t *testing.T, src MAC, dstIP net.IP, icmpType uint8, body []byte) []byte {
+	dst := multicastGroupMAC(dstIP)
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{SrcMAC: src[:], DstMAC: dst[:], EthernetType: layers.EthernetTypeIPv6},
+		&layers.IPv6{Version: 6, HopLimit: 1, NextHeader: layers.IPProtocolICMPv6, SrcIP: net.ParseIP("fe80::1"), DstIP: dstIP},
+		&layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(icmpType, 0)},
+		gopacket.Payload(body)))
+	return buf.Bytes()
+}
+
+// An IGMPv1 or v2 message about a group
+func igmpV1or2(msgType layers.IGMPType, group net.IP) []byte {
+	msg := make([]byte, 8)
+	msg[0] = byte(msgType)
+	copy(msg[4:], group.To4())
+	return msg
+}
+
+type testGroupRecord struct {
+	recordType uint8
+	group      net.IP
+	sources    []net.IP
+}
+
+// An IGMPv3 report, or the body of an MLDv2 one, which share a layout
+func groupRecordReport(records []testGroupRecord, v6 bool) []byte {
+	var msg []byte
+	if !v6 {
+		msg = append(msg, byte(layers.IGMPMembershipReportV3), 0, 0, 0)
+	}
+	msg = append(msg, 0, 0, 0, byte(len(records)))
+	for _, r := range records {
+		msg = append(msg, r.recordType, 0, 0, byte(len(r.sources)))
+		addr := []byte(r.group.To4())
+		if v6 {
+			addr = r.group.To16()
+		}
+		msg = append(msg, addr...)
+		for _, source := range r.sources {
+			if v6 {
+				msg = append(msg, source.To16()...)
+			} else {
+				msg = append(msg, source.To4()...)
+			}
+		}
+	}
+	return msg
+}
+
+// The body of an MLDv1 message about a group
+func mldV1(group net.IP) []byte {
+	msg := make([]byte, 20)
+	binary.BigEndian.PutUint16(msg, 10000)
+	copy(msg[4:], group.To16())
+	return msg
+}
+
+func TestMulticastSnoopPacket(t *testing.T) {
+	ms, _ := testMulticastSnooping(t)
+	host := MAC{0x02, 0, 0, 0, 0, 1}
+	for _, tc := range []struct {
+		name  string
+		dst   MAC
+		snoop bool
+	}{
+		{name: "IGMPv3 reports", dst: MAC{0x01, 0x00, 0x5e, 0x00, 0x00, 0x16}, snoop: true},
+		{name: "IGMPv2 leaves", dst: MAC{0x01, 0x00, 0x5e, 0x00, 0x00, 0x02}, snoop: true},
+		{name: "MLDv2 reports", dst: MAC{0x33, 0x33, 0x00, 0x00, 0x00, 0x16}, snoop: true},
+		{name: "MLDv1 dones", dst: MAC{0x33, 0x33, 0x00, 0x00, 0x00, 0x02}, snoop: true},
+		{name: "IPv4 group", dst: multicastGroupMAC(net.ParseIP("239.1.2.3")), snoop: true},
+		{name: "IPv6 group", dst: multicastGroupMAC(net.ParseIP("ff05::1:3")), snoop: true},
+		{name: "IPv4 link-local group", dst: multicastGroupMAC(net.ParseIP("224.0.0.251"))},
+		{name: "IPv6 solicited-node group", dst: multicastGroupMAC(net.ParseIP("ff02::1:ff00:1"))},
+		{name: "broadcast", dst: MAC{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{name: "unicast", dst: MAC{0x02, 0, 0, 0, 0, 2}},
+	} {
+		fop := DiscardingFlowOp{}
+		result := ms.snoopPacket(PacketKey{SrcMAC: host, DstMAC: tc.dst}, fop)
+		if !tc.snoop {
+			require.Equal(t, FlowOp(fop), result, tc.name)
+			continue
+		}
+		ops := FlattenFlowOp(result)
+		require.Len(t, ops, 2, tc.name)
+		require.IsType(t, multicastSnoopFlowOp{}, ops[0], tc.name)
+		require.Equal(t, FlowOp(fop), ops[1], tc.name)
+	}
+}
+
+func TestMulticastSnoop(t *testing.T) {
+	var (
+		host1 = MAC{0x02, 0, 0, 0, 0, 1}
+		host2 = MAC{0x02, 0, 0, 0, 0, 2}
+
+		group4a = net.ParseIP("239.1.2.3")
+		group4b = net.ParseIP("239.1.2.4")
+		group6a = net.ParseIP("ff05::1:3")
+		group6b = net.ParseIP("ff05::1:4")
+
+		igmpv3Reports = net.ParseIP("224.0.0.22")
+		allRouters4   = net.ParseIP("224.0.0.2")
+		mldv2Reports  = net.ParseIP("ff02::16")
+		allRouters6   = net.ParseIP("ff02::2")
+	)
+	ms, gossip := testMulticastSnooping(t)
+	for _, tc := range []struct {
+		name    string
+		frame   []byte
+		members map[string][]MAC
+	}{
+		{
+			name:    "IGMPv2 report, sent to the group",
+			frame:   testIGMPFrame(t, host1, group4a, igmpV1or2(layers.IGMPMembershipReportV2, group4a)),
+			members: map[string][]MAC{"239.1.2.3": {host1}},
+		},
+		{
+			name:    "IGMPv1 report, sent to the group",
+			frame:   testIGMPFrame(t, host2, group4a, igmpV1or2(layers.IGMPMembershipReportV1, group4a)),
+			members: map[string][]MAC{"239.1.2.3": {host1, host2}},
+		},
+		{
+			name:    "IGMPv2 leave",
+			frame:   testIGMPFrame(t, host1, allRouters4, igmpV1or2(layers.IGMPLeaveGroup, group4a)),
+			members: map[string][]MAC{"239.1.2.3": {host2}},
+		},
+		{
+			name: "IGMPv3 report",
+			frame: testIGMPFrame(t, host1, igmpv3Reports, groupRecordReport([]testGroupRecord{
+				{recordType: 4, group: group4b}, // CHANGE_TO_EXCLUDE_MODE, no sources
+				{recordType: 3, group: group4a}, // CHANGE_TO_INCLUDE_MODE, no sources
+				{recordType: 6, group: net.ParseIP("239.1.2.5"), sources: []net.IP{net.ParseIP("10.0.0.1")}}, // BLOCK_OLD_SOURCES
+			}, false)),
+			members: map[string][]MAC{"239.1.2.3": {host2}, "239.1.2.4": {host1}},
+		},
+		{
+			name: "IGMPv3 leave",
+			frame: testIGMPFrame(t, host2, igmpv3Reports, groupRecordReport([]testGroupRecord{
+				{recordType: 3, group: group4a},
+			}, false)),
+			members: map[string][]MAC{"239.1.2.4": {host1}},
+		},
+		{
+			name:    "MLDv1 report, sent to the group",
+			frame:   testMLDFrame(t, host1, group6a, uint8(layers.ICMPv6TypeMLDv1MulticastListenerReportMessage), mldV1(group6a)),
+			members: map[string][]MAC{"239.1.2.4": {host1}, "ff05::1:3": {host1}},
+		},
+		{
+			name:    "MLDv1 done",
+			frame:   testMLDFrame(t, host1, allRouters6, uint8(layers.ICMPv6TypeMLDv1MulticastListenerDoneMessage), mldV1(group6a)),
+			members: map[string][]MAC{"239.1.2.4": {host1}},
+		},
+		{
+			name: "MLDv2 report",
+			frame: testMLDFrame(t, host2, mldv2Reports, uint8(layers.ICMPv6TypeMLDv2MulticastListenerReportMessageV2), groupRecordReport([]testGroupRecord{
+				{recordType: 2, group: group6b},                                            // MODE_IS_EXCLUDE
+				{recordType: 1, group: group6a, sources: []net.IP{net.ParseIP("fd00::1")}}, // MODE_IS_INCLUDE, with a source
+			}, true)),
+			members: map[string][]MAC{"239.1.2.4": {host1}, "ff05::1:3": {host2}, "ff05::1:4": {host2}},
+		},
+		{
+			name:    "not a report",
+			frame:   testIGMPFrame(t, host1, group4b, gopacket.Payload("hello")),
+			members: map[string][]MAC{"239.1.2.4": {host1}, "ff05::1:3": {host2}, "ff05::1:4": {host2}},
+		},
+	} {
+		ms.snoop(tc.frame)
+		require.Equal(t, len(tc.members), len(ms.members), tc.name)
+		members := ms.testMembers()
+		for group, hosts := range tc.members {
+			require.ElementsMatch(t, hosts, members[group], "%s: %s", tc.name, group)
+		}
+	}
+
+	// Each change to the set of groups with members was gossiped
+	require.Len(t, gossip.broadcasts, 6)
+	ours := gossip.broadcasts[len(gossip.broadcasts)-1].(multicastGroupsGossip)[ms.router.Ourself.Name]
+	require.Equal(t, []string{"239.1.2.4", "ff05::1:3", "ff05::1:4"}, ours.Groups)
+}
+
+func TestMulticastUpdate(t *testing.T) {
+	var (
+		host1 = MAC{0x02, 0, 0, 0, 0, 1}
+		host2 = MAC{0x02, 0, 0, 0, 0, 2}
+		group = net.ParseIP("239.1.2.3")
+	)
+	ms, gossip := testMulticastSnooping(t)
+
+	// Groups which are not snooped are ignored
+	ms.update(host1, []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("224.0.0.251"), net.ParseIP("ff02::fb")}, nil)
+	require.Empty(t, ms.members)
+	require.Empty(t, gossip.broadcasts)
+
+	ms.update(host1, []net.IP{group}, nil)
+	ms.update(host2, []net.IP{group}, nil)
+	require.Len(t, ms.members["239.1.2.3"], 2)
+	require.Len(t, gossip.broadcasts, 1)
+
+	// Leaving a group a host is not a member of changes nothing
+	ms.update(host1, nil, []net.IP{net.ParseIP("239.1.2.4")})
+	require.Len(t, ms.members, 1)
+
+	// The group goes when its last member leaves
+	ms.update(host1, nil, []net.IP{group})
+	require.Len(t, ms.members["239.1.2.3"], 1)
+	ms.update(host2, nil, []net.IP{group})
+	require.Empty(t, ms.members)
+	require.Len(t, gossip.broadcasts, 2)
+	require.Empty(t, gossip.broadcasts[1].(multicastGroupsGossip)[ms.router.Ourself.Name].Groups)
+}
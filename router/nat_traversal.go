@@ -0,0 +1,740 @@
+package router
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// NAT traversal lets two peers which cannot make a TCP connection to
+// each other, typically because both are behind NAT, exchange frames
+// directly over UDP rather than through a peer they are both
+// connected to.  A peer asks the next hop on its route to a peer it is
+// not connected to for an introduction.  If that rendezvous peer is
+// connected to both, it tells each of them the address it sees the
+// other's sleeve traffic coming from.  Both then send sleeve
+// heartbeats to those addresses, which opens up their NATs, and
+// follow the remote address as sleeve does when it changes.
+//
+// The resulting "direct link" is a sleeve forwarder whose control
+// messages travel by gossip, and it is used for unicast frames to
+// that peer; broadcasts still follow the topology.  Only peers which
+// advertise the NATTraversal connection feature take part, and direct
+// links are subject to the overlay and encryption policies as
+// connections are.
+//
+// If the mesh is encrypted, so are direct links.  The peers agree a
+// key with an X25519 exchange relayed by gossip, which the peers
+// relaying it could tamper with, so as in mesh's own handshake the key
+// is derived from the network password as well, and each side proves
+// it knows the password with an HMAC over the exchange.  With peer
+// certificates, each side also presents credentials for it, so that
+// knowing the password is not enough to impersonate a peer.
+
+const (
+	NATTraversalGossipChannel = "nat-traversal"
+
+	natTraversalFeature = "NATTraversal"
+
+	natRequestInterval = 30 * time.Second
+	// How long to wait for the other peer to answer our hello
+	natHelloTimeout = HeartbeatTimeout
+	// After a failed attempt, how long to wait before trying the
+	// peer again
+	natRetryInterval = 5 * time.Minute
+)
+
+// Kinds of NAT traversal message
+const (
+	natRequest   = iota // please introduce me to Peer
+	natIntroduce        // Peer is at Addr, and you are at YourAddr
+	natHello            // from the initiator, to set up a direct link
+	natHelloAck         // the answer to a hello
+	natControl          // a control message for a direct link
+)
+
+type natMessage struct {
+	Kind      byte
+	Peer      mesh.PeerName
+	Addr      string
+	YourAddr  string
+	ConnUID   uint64
+	PublicKey []byte
+	Features  map[string]string
+	Tag       byte
+	Msg       []byte
+	// Proof of knowledge of the password, and credentials from the
+	// authenticator, for the key exchange in a hello or its answer
+	Proof       []byte
+	Credentials string
+}
+
+type NATTraversal struct {
+	router  *NetworkRouter
+	osw     *OverlaySwitch
+	sleeve  *SleeveOverlay
+	gossip  mesh.Gossip
+	encrypt bool
+
+	sync.RWMutex
+	links  map[mesh.PeerName]*directLink
+	failed map[mesh.PeerName]time.Time
+}
+
+type directLink struct {
+	remotePeer *mesh.Peer
+	via        mesh.PeerName // the rendezvous peer
+	outbound   bool          // we initiated it
+	remoteAddr *net.UDPAddr  // as the rendezvous peer sees it
+	connUID    uint64
+	started    time.Time
+
+	// Until the hello is answered, on the initiating side
+	publicKey, privateKey *[32]byte
+
+	fwd         *sleeveForwarder // nil until both sides have said hello
+	established bool
+	stopped     bool
+}
+
+// EnableNATTraversal makes the router take part in NAT traversal,
+// both as a rendezvous peer and to set up direct links itself.  It
+// requires the sleeve overlay, and must be called before the router
+// is started.
+func (router *NetworkRouter) EnableNATTraversal() error {
+	osw, _ := router.Overlay.(*OverlaySwitch)
+	var sleeve *SleeveOverlay
+	if osw != nil {
+		sleeve, _ = osw.overlays["sleeve"].(*SleeveOverlay)
+	}
+	if sleeve == nil {
+		return fmt.Errorf("NAT traversal requires the sleeve overlay")
+	}
+
+	password, _ := router.Passwords()
+	nt := &NATTraversal{
+		router:  router,
+		osw:     osw,
+		sleeve:  sleeve,
+		encrypt: password != nil,
+		links:   make(map[mesh.PeerName]*directLink),
+		failed:  make(map[mesh.PeerName]time.Time),
+	}
+	gossip, err := router.NewGossip(NATTraversalGossipChannel, nt)
+	if err != nil {
+		return err
+	}
+	nt.gossip = gossip
+	sleeve.natTraversal = true
+	osw.onPolicyChange = nt.applyPolicies
+	router.Peers.OnGC(func(peer *mesh.Peer) { nt.forget(peer.Name) })
+	router.natTraversal = nt
+	go nt.run()
+	return nil
+}
+
+func (nt *NATTraversal) run() {
+	for range time.Tick(natRequestInterval) {
+		nt.prune()
+		nt.requestIntroductions()
+	}
+}
+
+func (nt *NATTraversal) send(dst mesh.PeerName, msg natMessage) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+	return nt.gossip.GossipUnicast(dst, buf.Bytes())
+}
+
+func (nt *NATTraversal) connected(name mesh.PeerName) bool {
+	_, found := nt.router.Ourself.ConnectionTo(name)
+	return found
+}
+
+// Ask for an introduction to each peer we have neither a connection
+// nor a direct link to.  The request goes to the next hop towards the
+// peer, which is the peer most likely to be connected to it.
+func (nt *NATTraversal) requestIntroductions() {
+	ourName := nt.router.Ourself.Name
+	now := time.Now()
+	for _, desc := range nt.router.Peers.Descriptions() {
+		name := desc.Name
+		if name == ourName || nt.connected(name) {
+			continue
+		}
+		nt.RLock()
+		_, linked := nt.links[name]
+		failedAt, failed := nt.failed[name]
+		nt.RUnlock()
+		if linked || (failed && now.Sub(failedAt) < natRetryInterval) {
+			continue
+		}
+		via, found := nt.router.Routes.Unicast(name)
+		if !found || via == name || !nt.sleeve.natCapable(via) {
+			continue
+		}
+		if err := nt.send(via, natMessage{Kind: natRequest, Peer: name}); err != nil {
+			log.Debugf("NAT traversal: unable to request introduction to %s from %s: %s", name, via, err)
+		}
+	}
+}
+
+// Stop links to peers we now have connections to, and hellos which
+// went unanswered.
+func (nt *NATTraversal) prune() {
+	now := time.Now()
+	var pending, links []*directLink
+	nt.RLock()
+	for _, link := range nt.links {
+		if link.fwd == nil {
+			pending = append(pending, link)
+		}
+		links = append(links, link)
+	}
+	nt.RUnlock()
+	for _, link := range pending {
+		if now.Sub(link.started) > natHelloTimeout {
+			nt.remove(link, fmt.Errorf("hello not answered"))
+		}
+	}
+	for _, link := range links {
+		if nt.connected(link.remotePeer.Name) {
+			nt.remove(link, nil)
+		}
+	}
+}
+
+func (nt *NATTraversal) forget(name mesh.PeerName) {
+	nt.Lock()
+	link := nt.links[name]
+	delete(nt.failed, name)
+	nt.Unlock()
+	if link != nil {
+		nt.remove(link, nil)
+	}
+}
+
+// Remove a link, stopping its forwarder.  If the link failed, the
+// peer is not tried again for a while.
+func (nt *NATTraversal) remove(link *directLink, err error) {
+	name := link.remotePeer.Name
+	nt.Lock()
+	if link.stopped {
+		nt.Unlock()
+		return
+	}
+	link.stopped = true
+	fwd, wasEstablished := link.fwd, link.established
+	if nt.links[name] == link {
+		delete(nt.links, name)
+	}
+	if err != nil {
+		nt.failed[name] = time.Now()
+	}
+	nt.Unlock()
+
+	if err != nil {
+		log.Infof("NAT traversal: direct link to %s failed: %s", link.remotePeer, err)
+	} else if wasEstablished {
+		log.Infof("NAT traversal: closed direct link to %s", link.remotePeer)
+	}
+	if fwd != nil {
+		fwd.Stop()
+	}
+	if wasEstablished {
+		nt.router.Overlay.(NetworkOverlay).InvalidateRoutes()
+	}
+}
+
+// Stop the links which the overlay or encryption policy no longer
+// allows.
+func (nt *NATTraversal) applyPolicies() {
+	var links []*directLink
+	nt.RLock()
+	for _, link := range nt.links {
+		if link.fwd != nil {
+			links = append(links, link)
+		}
+	}
+	nt.RUnlock()
+	for _, link := range links {
+		if err := nt.osw.checkDirectLink(link.remotePeer, link.remoteAddr.IP, nt.encrypt); err != nil {
+			nt.remove(link, err)
+		}
+	}
+}
+
+// The forwarder for an established direct link to the peer, or nil
+func (nt *NATTraversal) forwarder(name mesh.PeerName) OverlayForwarder {
+	nt.RLock()
+	defer nt.RUnlock()
+	if link := nt.links[name]; link != nil && link.established {
+		return link.fwd
+	}
+	return nil
+}
+
+// The rendezvous side
+
+// Is the peer connected to us, and does it take part in NAT
+// traversal?
+func (sleeve *SleeveOverlay) natCapable(name mesh.PeerName) bool {
+	_, found := sleeve.natAddr(name)
+	return found
+}
+
+// The address the peer's sleeve traffic reaches us from, if it takes
+// part in NAT traversal and its sleeve forwarder is established
+func (sleeve *SleeveOverlay) natAddr(name mesh.PeerName) (*net.UDPAddr, bool) {
+	fwd := sleeve.lookupForwarder(name)
+	if fwd == nil || !fwd.natTraversal {
+		return nil, false
+	}
+	select {
+	case <-fwd.establishedChan:
+	default:
+		return nil, false
+	}
+	fwd.lock.RLock()
+	defer fwd.lock.RUnlock()
+	return fwd.remoteAddr, fwd.remoteAddr != nil
+}
+
+func (nt *NATTraversal) introduce(requester, target mesh.PeerName) error {
+	requesterAddr, found := nt.sleeve.natAddr(requester)
+	if !found || !nt.connected(requester) {
+		return nil
+	}
+	targetAddr, found := nt.sleeve.natAddr(target)
+	if !found || !nt.connected(target) {
+		return nil
+	}
+	log.Debugf("NAT traversal: introducing %s at %s to %s at %s", requester, requesterAddr, target, targetAddr)
+	if err := nt.send(requester, natMessage{Kind: natIntroduce, Peer: target, Addr: targetAddr.String(), YourAddr: requesterAddr.String()}); err != nil {
+		return err
+	}
+	return nt.send(target, natMessage{Kind: natIntroduce, Peer: requester, Addr: requesterAddr.String(), YourAddr: targetAddr.String()})
+}
+
+// The peers being introduced
+
+// Both peers are introduced to each other; the one with the lower
+// name initiates the direct link.
+func (nt *NATTraversal) introduced(via mesh.PeerName, msg natMessage) error {
+	if msg.Peer >= nt.router.Ourself.Name || nt.connected(msg.Peer) {
+		return nil
+	}
+	peer := nt.router.Peers.Fetch(msg.Peer)
+	if peer == nil {
+		return nil
+	}
+	remoteAddr, err := net.ResolveUDPAddr("udp4", msg.Addr)
+	if err != nil {
+		return err
+	}
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	var uid [8]byte
+	if _, err := rand.Read(uid[:]); err != nil {
+		return err
+	}
+
+	link := &directLink{
+		remotePeer: peer,
+		via:        via,
+		outbound:   true,
+		remoteAddr: remoteAddr,
+		connUID:    binary.LittleEndian.Uint64(uid[:]),
+		started:    time.Now(),
+		publicKey:  publicKey,
+		privateKey: privateKey,
+	}
+	nt.Lock()
+	if _, found := nt.links[msg.Peer]; found {
+		// Introduced by more than one peer, or again
+		nt.Unlock()
+		return nil
+	}
+	nt.links[msg.Peer] = link
+	nt.Unlock()
+
+	log.Infof("NAT traversal: introduced to %s at %s by %s", peer, remoteAddr, via)
+	hello := natMessage{
+		Kind:      natHello,
+		Peer:      via,
+		Addr:      msg.YourAddr,
+		ConnUID:   link.connUID,
+		PublicKey: publicKey[:],
+		Features:  nt.features(),
+	}
+	password, _ := nt.router.Passwords()
+	transcript := natTranscript(natHello, nt.router.Ourself.Name, msg.Peer, link.connUID, publicKey[:], nil)
+	if err := nt.sign(&hello, password, transcript); err != nil {
+		nt.remove(link, err)
+		return err
+	}
+	return nt.send(msg.Peer, hello)
+}
+
+func (nt *NATTraversal) features() map[string]string {
+	features := make(map[string]string)
+	nt.sleeve.AddFeaturesTo(features)
+	return features
+}
+
+func (nt *NATTraversal) hello(sender mesh.PeerName, msg natMessage) error {
+	if nt.connected(sender) {
+		return nil
+	}
+	peer := nt.router.Peers.Fetch(sender)
+	if peer == nil {
+		return nil
+	}
+	remoteAddr, err := net.ResolveUDPAddr("udp4", msg.Addr)
+	if err != nil {
+		return err
+	}
+	password, err := nt.verify(sender, msg, natTranscript(natHello, sender, nt.router.Ourself.Name, msg.ConnUID, msg.PublicKey, nil))
+	if err != nil {
+		return err
+	}
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	sessionKey, err := nt.sessionKey(msg.PublicKey, privateKey, password)
+	if err != nil {
+		return err
+	}
+
+	link := &directLink{
+		remotePeer: peer,
+		via:        msg.Peer,
+		remoteAddr: remoteAddr,
+		connUID:    msg.ConnUID,
+		started:    time.Now(),
+	}
+	// The initiator may have started again, e.g. after
+	// restarting, so this hello replaces any link we had.
+	nt.Lock()
+	old := nt.links[sender]
+	nt.links[sender] = link
+	nt.Unlock()
+	if old != nil {
+		nt.remove(old, nil)
+	}
+
+	if err := nt.prepare(link, sessionKey, msg.Features); err != nil {
+		nt.remove(link, err)
+		return err
+	}
+
+	ack := natMessage{Kind: natHelloAck, ConnUID: link.connUID, PublicKey: publicKey[:], Features: nt.features()}
+	transcript := natTranscript(natHelloAck, sender, nt.router.Ourself.Name, msg.ConnUID, msg.PublicKey, publicKey[:])
+	if err := nt.sign(&ack, password, transcript); err != nil {
+		nt.remove(link, err)
+		return err
+	}
+	if err := nt.send(sender, ack); err != nil {
+		nt.remove(link, err)
+		return err
+	}
+	link.fwd.Confirm()
+	return nil
+}
+
+func (nt *NATTraversal) helloAck(sender mesh.PeerName, msg natMessage) error {
+	nt.Lock()
+	link := nt.links[sender]
+	if link == nil || !link.outbound || link.fwd != nil || link.connUID != msg.ConnUID {
+		nt.Unlock()
+		return nil
+	}
+	publicKey, privateKey := link.publicKey, link.privateKey
+	link.privateKey = nil
+	nt.Unlock()
+
+	transcript := natTranscript(natHelloAck, nt.router.Ourself.Name, sender, msg.ConnUID, publicKey[:], msg.PublicKey)
+	password, err := nt.verify(sender, msg, transcript)
+	var sessionKey *[32]byte
+	if err == nil {
+		sessionKey, err = nt.sessionKey(msg.PublicKey, privateKey, password)
+	}
+	if err == nil {
+		err = nt.prepare(link, sessionKey, msg.Features)
+	}
+	if err != nil {
+		nt.remove(link, err)
+		return err
+	}
+	link.fwd.Confirm()
+	return nil
+}
+
+// What the proofs and credentials in a hello (without the responder's
+// public key) and its answer are for.
+func natTranscript(kind byte, initiator, responder mesh.PeerName, connUID uint64, initiatorKey, responderKey []byte) []byte {
+	buf := bytes.NewBufferString("weave NAT traversal")
+	buf.WriteByte(kind)
+	binary.Write(buf, binary.BigEndian, []uint64{uint64(initiator), uint64(responder), connUID})
+	buf.Write(initiatorKey)
+	buf.Write(responderKey)
+	return buf.Bytes()
+}
+
+func natProof(password, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
+
+// Add our proof and credentials to a message
+func (nt *NATTraversal) sign(msg *natMessage, password, transcript []byte) error {
+	if !nt.encrypt {
+		return nil
+	}
+	msg.Proof = natProof(password, transcript)
+	if nt.router.Authenticator != nil {
+		credentials, err := nt.router.Authenticator.Credentials(transcript)
+		if err != nil {
+			return err
+		}
+		msg.Credentials = credentials
+	}
+	return nil
+}
+
+// Check the proof and credentials in a message from the sender,
+// returning the password the proof is for.  As with connections, any
+// of the secondary passwords will do.
+func (nt *NATTraversal) verify(sender mesh.PeerName, msg natMessage, transcript []byte) ([]byte, error) {
+	if !nt.encrypt {
+		if msg.Proof != nil {
+			return nil, fmt.Errorf("peer requires encryption, but we have no password")
+		}
+		return nil, nil
+	}
+	if nt.router.Authenticator != nil {
+		name, err := nt.router.Authenticator.Authenticate(msg.Credentials, transcript)
+		if err != nil {
+			return nil, err
+		}
+		if name != sender {
+			return nil, fmt.Errorf("credentials are for %s, not the sender", name)
+		}
+	}
+	password, secondaries := nt.router.Passwords()
+	for _, candidate := range append([][]byte{password}, secondaries...) {
+		if hmac.Equal(msg.Proof, natProof(candidate, transcript)) {
+			return candidate, nil
+		}
+	}
+	return nil, fmt.Errorf("key exchange not signed with a password we know")
+}
+
+// The session key is derived from the password as well as the shared
+// key, in the same way as mesh's, so that only peers knowing it can
+// agree on the key.
+func (nt *NATTraversal) sessionKey(remotePublicKey []byte, privateKey *[32]byte, password []byte) (*[32]byte, error) {
+	if !nt.encrypt {
+		return nil, nil
+	}
+	if len(remotePublicKey) != 32 {
+		return nil, fmt.Errorf("bad public key from peer")
+	}
+	var remoteKey, sharedKey [32]byte
+	copy(remoteKey[:], remotePublicKey)
+	box.Precompute(&sharedKey, &remoteKey, privateKey)
+	sessionKey := sha256.Sum256(append(sharedKey[:], password...))
+	return &sessionKey, nil
+}
+
+// Create the sleeve forwarder for a link, if the policies allow it.
+// Both sides know the other's address, and so both send heartbeats
+// straight away.
+func (nt *NATTraversal) prepare(link *directLink, sessionKey *[32]byte, features map[string]string) error {
+	name := link.remotePeer.Name
+	connUID := link.connUID
+	if err := nt.osw.checkDirectLink(link.remotePeer, link.remoteAddr.IP, sessionKey != nil); err != nil {
+		return err
+	}
+	conn, err := nt.sleeve.PrepareConnection(mesh.OverlayConnectionParams{
+		RemotePeer: link.remotePeer,
+		LocalAddr:  &net.TCPAddr{},
+		RemoteAddr: &net.TCPAddr{IP: link.remoteAddr.IP, Port: link.remoteAddr.Port},
+		Outbound:   link.outbound,
+		ConnUID:    connUID,
+		SessionKey: sessionKey,
+		SendControlMessage: func(tag byte, msg []byte) error {
+			return nt.send(name, natMessage{Kind: natControl, ConnUID: connUID, Tag: tag, Msg: msg})
+		},
+		Features: features,
+	})
+	if err != nil {
+		return err
+	}
+	fwd := conn.(*sleeveForwarder)
+	if !link.outbound {
+		fwd.setRemoteAddr(link.remoteAddr)
+	}
+
+	nt.Lock()
+	if link.stopped {
+		nt.Unlock()
+		fwd.Stop()
+		return fmt.Errorf("direct link to %s stopped while being set up", link.remotePeer)
+	}
+	link.fwd = fwd
+	nt.Unlock()
+	go nt.monitor(link)
+	return nil
+}
+
+func (nt *NATTraversal) monitor(link *directLink) {
+	select {
+	case <-link.fwd.EstablishedChannel():
+	case err := <-link.fwd.ErrorChannel():
+		if err == nil {
+			err = fmt.Errorf("no heartbeats received")
+		}
+		nt.remove(link, err)
+		return
+	}
+
+	nt.Lock()
+	stopped := link.stopped
+	link.established = !stopped
+	nt.Unlock()
+	if stopped {
+		return
+	}
+	log.Infof("NAT traversal: established direct link to %s", link.remotePeer)
+	nt.router.Overlay.(NetworkOverlay).InvalidateRoutes()
+
+	// The error is nil when the link was stopped
+	nt.remove(link, <-link.fwd.ErrorChannel())
+}
+
+func (nt *NATTraversal) controlMessage(sender mesh.PeerName, msg natMessage) {
+	nt.RLock()
+	link := nt.links[sender]
+	nt.RUnlock()
+	if link != nil && link.fwd != nil && link.connUID == msg.ConnUID {
+		link.fwd.ControlMessage(msg.Tag, msg.Msg)
+	}
+}
+
+// Gossip methods - only unicast is used
+
+func (nt *NATTraversal) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	var m natMessage
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&m); err != nil {
+		return err
+	}
+	var err error
+	switch m.Kind {
+	case natRequest:
+		err = nt.introduce(sender, m.Peer)
+	case natIntroduce:
+		err = nt.introduced(sender, m)
+	case natHello:
+		err = nt.hello(sender, m)
+	case natHelloAck:
+		err = nt.helloAck(sender, m)
+	case natControl:
+		nt.controlMessage(sender, m)
+	}
+	if err != nil {
+		// Not the fault of the connection the gossip came over
+		log.Warningf("NAT traversal: error handling message from %s: %s", sender, err)
+	}
+	return nil
+}
+
+func (nt *NATTraversal) OnGossipBroadcast(sender mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	return nil, nil
+}
+
+func (nt *NATTraversal) Gossip() mesh.GossipData {
+	return nil
+}
+
+func (nt *NATTraversal) OnGossip(msg []byte) (mesh.GossipData, error) {
+	return nil, nil
+}
+
+// Status
+
+type DirectLinkStatus struct {
+	Peer     string
+	NickName string
+	Via      string // the rendezvous peer
+	Address  string
+	Outbound bool
+	State    string // "pending" or "established"
+	Attrs    map[string]interface{}
+}
+
+// DirectLinks describes the direct links set up by NAT traversal, or
+// returns nil if it is not enabled.
+func (router *NetworkRouter) DirectLinks() []DirectLinkStatus {
+	nt := router.natTraversal
+	if nt == nil {
+		return nil
+	}
+
+	var links []*directLink
+	nt.RLock()
+	for _, link := range nt.links {
+		links = append(links, link)
+	}
+	nt.RUnlock()
+
+	statuses := []DirectLinkStatus{}
+	for _, link := range links {
+		status := DirectLinkStatus{
+			Peer:     link.remotePeer.Name.String(),
+			NickName: link.remotePeer.NickName,
+			Via:      link.via.String(),
+			Address:  link.remoteAddr.String(),
+			Outbound: link.outbound,
+			State:    "pending",
+		}
+		if via := router.Peers.Fetch(link.via); via != nil {
+			status.Via = via.String()
+		}
+		nt.RLock()
+		fwd, established := link.fwd, link.established
+		nt.RUnlock()
+		if fwd != nil {
+			// The address follows the other peer's NAT
+			fwd.lock.RLock()
+			if fwd.remoteAddr != nil {
+				status.Address = fwd.remoteAddr.String()
+			}
+			fwd.lock.RUnlock()
+			status.Attrs = fwd.Attrs()
+		}
+		if established {
+			status.State = "established"
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Peer < statuses[j].Peer })
+	return statuses
+}
@@ -0,0 +1,197 @@
+package router
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Credentials are the peer name and a hash of it with the transcript
+type testNATAuthenticator struct {
+	name mesh.PeerName
+}
+
+func (auth testNATAuthenticator) Credentials(transcript []byte) (string, error) {
+	return auth.name.String() + " " + testNATCredentialsHash(auth.name, transcript), nil
+}
+
+func (auth testNATAuthenticator) Authenticate(credentials string, transcript []byte) (mesh.PeerName, error) {
+	fields := strings.Fields(credentials)
+	if len(fields) != 2 {
+		return mesh.UnknownPeerName, fmt.Errorf("bad credentials")
+	}
+	name, err := mesh.PeerNameFromString(fields[0])
+	if err != nil {
+		return mesh.UnknownPeerName, err
+	}
+	if fields[1] != testNATCredentialsHash(name, transcript) {
+		return mesh.UnknownPeerName, fmt.Errorf("credentials not for this transcript")
+	}
+	return name, nil
+}
+
+func testNATCredentialsHash(name mesh.PeerName, transcript []byte) string {
+	sum := sha256.Sum256(append([]byte(name.String()), transcript...))
+	return hex.EncodeToString(sum[:])
+}
+
+func testNATTraversal(auth mesh.PeerAuthenticator, password string, secondaries ...string) *NATTraversal {
+	config := mesh.Config{Authenticator: auth}
+	if password != "" {
+		config.Password = []byte(password)
+	}
+	for _, secondary := range secondaries {
+		config.SecondaryPasswords = append(config.SecondaryPasswords, []byte(secondary))
+	}
+	return &NATTraversal{
+		router:  &NetworkRouter{Router: &mesh.Router{Config: config}},
+		encrypt: password != "",
+	}
+}
+
+// Run the key exchange of a hello and its answer between the
+// initiator and responder, with tamper applied to each message on
+// the way, and return the session keys each side arrives at.
+func testNATKeyExchange(t *testing.T, initiator, responder *NATTraversal, initiatorName, responderName mesh.PeerName, tamper func(*natMessage)) (*[32]byte, *[32]byte, error) {
+	const connUID = 42
+	initiatorPublic, initiatorPrivate, err := box.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	responderPublic, responderPrivate, err := box.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	password, _ := initiator.router.Passwords()
+	hello := natMessage{Kind: natHello, ConnUID: connUID, PublicKey: initiatorPublic[:]}
+	require.NoError(t, initiator.sign(&hello, password, natTranscript(natHello, initiatorName, responderName, connUID, initiatorPublic[:], nil)))
+	tamper(&hello)
+	password, err = responder.verify(initiatorName, hello, natTranscript(natHello, initiatorName, responderName, connUID, hello.PublicKey, nil))
+	if err != nil {
+		return nil, nil, err
+	}
+	responderKey, err := responder.sessionKey(hello.PublicKey, responderPrivate, password)
+	require.NoError(t, err)
+
+	ack := natMessage{Kind: natHelloAck, ConnUID: connUID, PublicKey: responderPublic[:]}
+	require.NoError(t, responder.sign(&ack, password, natTranscript(natHelloAck, initiatorName, responderName, connUID, hello.PublicKey, responderPublic[:])))
+	tamper(&ack)
+	password, err = initiator.verify(responderName, ack, natTranscript(natHelloAck, initiatorName, responderName, connUID, initiatorPublic[:], ack.PublicKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	initiatorKey, err := initiator.sessionKey(ack.PublicKey, initiatorPrivate, password)
+	require.NoError(t, err)
+	return initiatorKey, responderKey, nil
+}
+
+func TestNATKeyExchange(t *testing.T) {
+	const (
+		initiatorName = mesh.PeerName(0x0a0000000001)
+		responderName = mesh.PeerName(0x0a0000000002)
+	)
+	mitmPublic, _, err := box.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	noTamper := func(*natMessage) {}
+	replaceKey := func(msg *natMessage) { msg.PublicKey = mitmPublic[:] }
+
+	for _, tc := range []struct {
+		name                 string
+		initiator, responder *NATTraversal
+		tamper               func(*natMessage)
+		encrypted            bool
+		err                  bool
+	}{
+		{
+			name:      "plain",
+			initiator: testNATTraversal(nil, ""),
+			responder: testNATTraversal(nil, ""),
+			tamper:    noTamper,
+		},
+		{
+			name:      "same password",
+			initiator: testNATTraversal(nil, "secret"),
+			responder: testNATTraversal(nil, "secret"),
+			tamper:    noTamper,
+			encrypted: true,
+		},
+		{
+			name:      "initiator's password is the responder's secondary",
+			initiator: testNATTraversal(nil, "old"),
+			responder: testNATTraversal(nil, "new", "old"),
+			tamper:    noTamper,
+			encrypted: true,
+		},
+		{
+			name:      "responder's password is the initiator's secondary",
+			initiator: testNATTraversal(nil, "new", "old"),
+			responder: testNATTraversal(nil, "old", "new"),
+			tamper:    noTamper,
+			encrypted: true,
+		},
+		{
+			name:      "different passwords",
+			initiator: testNATTraversal(nil, "secret"),
+			responder: testNATTraversal(nil, "other"),
+			tamper:    noTamper,
+			err:       true,
+		},
+		{
+			name:      "only the initiator encrypts",
+			initiator: testNATTraversal(nil, "secret"),
+			responder: testNATTraversal(nil, ""),
+			tamper:    noTamper,
+			err:       true,
+		},
+		{
+			name:      "only the responder encrypts",
+			initiator: testNATTraversal(nil, ""),
+			responder: testNATTraversal(nil, "secret"),
+			tamper:    noTamper,
+			err:       true,
+		},
+		{
+			name:      "public key replaced in transit",
+			initiator: testNATTraversal(nil, "secret"),
+			responder: testNATTraversal(nil, "secret"),
+			tamper:    replaceKey,
+			err:       true,
+		},
+		{
+			name:      "authenticated",
+			initiator: testNATTraversal(testNATAuthenticator{initiatorName}, "secret"),
+			responder: testNATTraversal(testNATAuthenticator{responderName}, "secret"),
+			tamper:    noTamper,
+			encrypted: true,
+		},
+		{
+			name:      "credentials for another peer",
+			initiator: testNATTraversal(testNATAuthenticator{mesh.PeerName(0x0a0000000003)}, "secret"),
+			responder: testNATTraversal(testNATAuthenticator{responderName}, "secret"),
+			tamper:    noTamper,
+			err:       true,
+		},
+		{
+			name:      "credentials stripped in transit",
+			initiator: testNATTraversal(testNATAuthenticator{initiatorName}, "secret"),
+			responder: testNATTraversal(testNATAuthenticator{responderName}, "secret"),
+			tamper:    func(msg *natMessage) { msg.Credentials = "" },
+			err:       true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			initiatorKey, responderKey, err := testNATKeyExchange(t, tc.initiator, tc.responder, initiatorName, responderName, tc.tamper)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, initiatorKey, responderKey)
+			require.Equal(t, tc.encrypted, initiatorKey != nil)
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package router
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"math"
 	"net"
@@ -51,6 +53,25 @@ type NetworkRouter struct {
 	weavenet.BridgeConfig
 	Macs *MacCache
 	db   db.DB
+
+	// nil unless link-quality routing is enabled
+	linkRouting *LinkRouting
+	// nil unless multicast snooping is enabled
+	multicast *MulticastSnooping
+	// nil unless ARP suppression is enabled
+	arp *ARPSuppression
+	// nil unless broadcasts are rate-limited
+	broadcastLimiter *broadcastLimiter
+	// nil unless NAT traversal is enabled
+	natTraversal *NATTraversal
+	// nil unless segments are enabled
+	segments *Segments
+
+	captures captureSet
+	tracer   *packetTracer
+	// identifies the passwords given at launch, which runtime
+	// changes are persisted against
+	launchPasswordsHash []byte
 }
 
 func NewNetworkRouter(config mesh.Config, networkConfig NetworkConfig, bridgeConfig weavenet.BridgeConfig, name mesh.PeerName, nickName string, overlay NetworkOverlay, db db.DB) (*NetworkRouter, error) {
@@ -73,6 +94,12 @@ func NewNetworkRouter(config mesh.Config, networkConfig NetworkConfig, bridgeCon
 			log.Debugln("Expired MAC", mac, "at", peer)
 		})
 	router.Peers.OnGC(func(peer *mesh.Peer) { router.Macs.Delete(peer) })
+	if router.tracer, err = newPacketTracer(router); err != nil {
+		return nil, err
+	}
+	if err := router.restorePasswords(config.Password, config.SecondaryPasswords); err != nil {
+		return nil, err
+	}
 	return router, nil
 }
 
@@ -86,11 +113,39 @@ func (router *NetworkRouter) Start() {
 }
 
 func (router *NetworkRouter) handleCapturedPacket(key PacketKey) FlowOp {
+	// Only Trace injects probes.  Frames from the bridge which
+	// claim to be probes are dropped, so that containers cannot
+	// make peers send trace reports.
+	if isTraceMAC(key.SrcMAC) {
+		return DiscardingFlowOp{}
+	}
+	return router.handleLocalPacket(key, false)
+}
+
+// Handle a frame from the local bridge, or a probe injected by Trace
+func (router *NetworkRouter) handleLocalPacket(key PacketKey, probe bool) FlowOp {
+	fop := router.forwardCapturedPacket(key)
+	if router.multicast != nil {
+		fop = router.multicast.snoopPacket(key, fop)
+	}
+	if router.arp != nil {
+		fop = router.arp.inspectPacket(key, true, fop)
+	}
+	if probe {
+		fop = router.tracePacket(ForwardPacketKey{PacketKey: key, SrcPeer: router.Ourself.Peer}, true, fop)
+	}
+	if router.captures.active() {
+		fop = router.capturePacket(key, router.Macs.Lookup(net.HardwareAddr(key.DstMAC[:]), key.Segment), fop)
+	}
+	return fop
+}
+
+func (router *NetworkRouter) forwardCapturedPacket(key PacketKey) FlowOp {
 	router.PacketLogging.LogPacket("Captured", key)
 	srcMac := net.HardwareAddr(key.SrcMAC[:])
 	dstMac := net.HardwareAddr(key.DstMAC[:])
 
-	switch newSrcMac, conflictPeer := router.Macs.Add(srcMac, router.Ourself.Peer); {
+	switch newSrcMac, conflictPeer := router.Macs.Add(srcMac, key.Segment, router.Ourself.Peer); {
 	case newSrcMac:
 		log.Debugln("Discovered local MAC", srcMac)
 	case conflictPeer != nil:
@@ -107,7 +162,7 @@ func (router *NetworkRouter) handleCapturedPacket(key PacketKey) FlowOp {
 		return DiscardingFlowOp{}
 	}
 
-	switch dstPeer := router.Macs.Lookup(dstMac); dstPeer {
+	switch dstPeer := router.Macs.Lookup(dstMac, key.Segment); dstPeer {
 	case router.Ourself.Peer:
 		// The packet is destined for a local MAC.  The bridge
 		// won't normally send us such packets, and if it does
@@ -116,10 +171,14 @@ func (router *NetworkRouter) handleCapturedPacket(key PacketKey) FlowOp {
 		// avoid warnings if we try to forward it.
 		return DiscardingFlowOp{}
 	case nil:
+		if router.multicast != nil && isSnoopedMulticast(key.DstMAC) {
+			router.PacketLogging.LogPacket("Multicasting", key)
+			return router.limitBroadcast(key, router.Ourself.Peer, router.multicast.relay(router.Ourself.Peer, key))
+		}
 		// If we don't know which peer corresponds to the dest
 		// MAC, broadcast it.
 		router.PacketLogging.LogPacket("Broadcasting", key)
-		return router.relayBroadcast(router.Ourself.Peer, key)
+		return router.limitBroadcast(key, router.Ourself.Peer, router.relayBroadcast(router.Ourself.Peer, key))
 	default:
 		router.PacketLogging.LogPacket("Forwarding", key)
 		return router.relay(ForwardPacketKey{
@@ -130,6 +189,20 @@ func (router *NetworkRouter) handleCapturedPacket(key PacketKey) FlowOp {
 }
 
 func (router *NetworkRouter) handleForwardedPacket(key ForwardPacketKey) FlowOp {
+	fop := router.deliverForwardedPacket(key)
+	if router.arp != nil {
+		fop = router.arp.inspectPacket(key.PacketKey, false, fop)
+	}
+	if isTraceMAC(key.SrcMAC) {
+		fop = router.tracePacket(key, false, fop)
+	}
+	if router.captures.active() {
+		fop = router.capturePacket(key.PacketKey, key.SrcPeer, fop)
+	}
+	return fop
+}
+
+func (router *NetworkRouter) deliverForwardedPacket(key ForwardPacketKey) FlowOp {
 	srcMac := net.HardwareAddr(key.SrcMAC[:])
 	dstMac := net.HardwareAddr(key.DstMAC[:])
 
@@ -147,7 +220,7 @@ func (router *NetworkRouter) handleForwardedPacket(key ForwardPacketKey) FlowOp
 	// (because the DstPeer on a forwarded broadcast packet is
 	// always set to the peer being forwarded to)
 
-	switch newSrcMac, conflictPeer := router.Macs.AddForced(srcMac, key.SrcPeer); {
+	switch newSrcMac, conflictPeer := router.Macs.AddForced(srcMac, key.Segment, key.SrcPeer); {
 	case newSrcMac:
 		log.Print("Discovered remote MAC ", srcMac, " at ", key.SrcPeer)
 	case conflictPeer != nil:
@@ -159,45 +232,89 @@ func (router *NetworkRouter) handleForwardedPacket(key ForwardPacketKey) FlowOp
 
 	router.PacketLogging.LogForwardPacket("Injecting", key)
 	injectFop := router.InjectorConsumer.InjectPacket(key.PacketKey)
-	dstPeer := router.Macs.Lookup(dstMac)
+	dstPeer := router.Macs.Lookup(dstMac, key.Segment)
 	if dstPeer == router.Ourself.Peer {
 		return injectFop
 	}
+	if router.multicast != nil && router.multicast.sentDirectly(key) {
+		return router.limitBroadcast(key.PacketKey, key.SrcPeer, injectFop)
+	}
 
 	router.PacketLogging.LogForwardPacket("Relaying broadcast", key)
 	relayFop := router.relayBroadcast(key.SrcPeer, key.PacketKey)
 	switch {
 	case injectFop == nil:
-		return relayFop
+		return router.limitBroadcast(key.PacketKey, key.SrcPeer, relayFop)
 	case relayFop == nil:
-		return injectFop
+		return router.limitBroadcast(key.PacketKey, key.SrcPeer, injectFop)
 	default:
 		mfop := NewMultiFlowOp(false)
 		mfop.Add(injectFop)
 		mfop.Add(relayFop)
-		return mfop
+		return router.limitBroadcast(key.PacketKey, key.SrcPeer, mfop)
+	}
+}
+
+// Apply the broadcast limits, if any, to a frame from srcPeer which
+// is being broadcast
+func (router *NetworkRouter) limitBroadcast(key PacketKey, srcPeer *mesh.Peer, fop FlowOp) FlowOp {
+	if router.broadcastLimiter == nil {
+		return fop
 	}
+	return router.broadcastLimiter.limit(key, srcPeer, fop)
 }
 
 // Routing
 
 func (router *NetworkRouter) relay(key ForwardPacketKey) FlowOp {
-	relayPeerName, found := router.Routes.Unicast(key.DstPeer.Name)
+	fwd, _, err := router.nextHop(key.DstPeer)
+	if err != nil {
+		log.Println("Unable to relay packet:", err)
+		return DiscardingFlowOp{}
+	}
+	return fwd.Forward(key)
+}
+
+// The forwarder which carries unicast frames towards dstPeer, and the
+// peer it carries them to.
+func (router *NetworkRouter) nextHop(dstPeer *mesh.Peer) (OverlayForwarder, mesh.PeerName, error) {
+	if router.natTraversal != nil {
+		if fwd := router.natTraversal.forwarder(dstPeer.Name); fwd != nil {
+			return fwd, dstPeer.Name, nil
+		}
+	}
+
+	if router.linkRouting != nil {
+		if relayPeerName, found := router.linkRouting.unicast(dstPeer.Name); found {
+			if conn, found := router.Ourself.ConnectionTo(relayPeerName); found {
+				return conn.(*mesh.LocalConnection).OverlayConn.(OverlayForwarder), relayPeerName, nil
+			}
+		}
+	}
+
+	relayPeerName, found := router.Routes.Unicast(dstPeer.Name)
 	if !found {
 		// Not necessarily an error as there could be a race with the
 		// dst disappearing whilst the frame is in flight
-		log.Println("Received packet for unknown destination:", key.DstPeer)
-		return DiscardingFlowOp{}
+		return nil, relayPeerName, fmt.Errorf("unknown destination %s", dstPeer)
 	}
 
 	conn, found := router.Ourself.ConnectionTo(relayPeerName)
 	if !found {
 		// Again, could just be a race, not necessarily an error
-		log.Println("Unable to find connection to relay peer", relayPeerName)
-		return DiscardingFlowOp{}
+		return nil, relayPeerName, fmt.Errorf("no connection to relay peer %s", relayPeerName)
 	}
 
-	return conn.(*mesh.LocalConnection).OverlayConn.(OverlayForwarder).Forward(key)
+	return conn.(*mesh.LocalConnection).OverlayConn.(OverlayForwarder), relayPeerName, nil
+}
+
+// LinkRoutes describes the routes chosen by link-quality routing, or
+// returns nil if it is not enabled.
+func (router *NetworkRouter) LinkRoutes() []LinkRouteStatus {
+	if router.linkRouting == nil {
+		return nil
+	}
+	return router.linkRouting.Status()
 }
 
 func (router *NetworkRouter) relayBroadcast(srcPeer *mesh.Peer, key PacketKey) FlowOp {
@@ -228,6 +345,49 @@ func (router *NetworkRouter) persistPeers() {
 	}
 }
 
+// Persisting the passwords set at runtime, so that a restart doesn't
+// revert them.  They are only restored while the peer is launched with
+// the same passwords as when they were set, since otherwise the
+// operator has changed them since.
+const passwordsIdent = "passwords"
+
+type persistedPasswords struct {
+	LaunchHash  []byte // of the passwords the peer was launched with
+	Password    []byte
+	Secondaries [][]byte
+}
+
+func hashPasswords(password []byte, secondaries [][]byte) []byte {
+	h := sha256.New()
+	for _, p := range append([][]byte{password}, secondaries...) {
+		fmt.Fprintf(h, "%d:%s", len(p), p)
+	}
+	return h.Sum(nil)
+}
+
+func (router *NetworkRouter) restorePasswords(password []byte, secondaries [][]byte) error {
+	router.launchPasswordsHash = hashPasswords(password, secondaries)
+	var persisted persistedPasswords
+	found, err := router.db.Load(passwordsIdent, &persisted)
+	if err != nil || !found || !bytes.Equal(persisted.LaunchHash, router.launchPasswordsHash) {
+		return err
+	}
+	log.Printf("Using the network passwords set at runtime; accepting %d secondary passwords on incoming connections", len(persisted.Secondaries))
+	return router.Router.SetPasswords(persisted.Password, persisted.Secondaries)
+}
+
+// SetPasswords changes the network passwords, and persists them.
+func (router *NetworkRouter) SetPasswords(password []byte, secondaries [][]byte) error {
+	if err := router.Router.SetPasswords(password, secondaries); err != nil {
+		return err
+	}
+	return router.db.Save(passwordsIdent, persistedPasswords{
+		LaunchHash:  router.launchPasswordsHash,
+		Password:    password,
+		Secondaries: secondaries,
+	})
+}
+
 func (router *NetworkRouter) InitiateConnections(peers []string, replace bool) []error {
 	errors := router.ConnectionMaker.InitiateConnections(peers, replace)
 	router.persistPeers()
@@ -11,6 +11,29 @@ type NetworkRouterStatus struct {
 	Interface    string
 	CaptureStats map[string]int
 	MACs         []MACStatus
+	Traffic      []PeerTrafficStatus
+	Heartbeats   []PeerHeartbeatStatus
+	LinkRoutes   []LinkRouteStatus
+	Refused      []RefusedConnection
+	Multicast    []MulticastGroupStatus
+	ARP          *ARPSuppressionStatus
+	Broadcasts   *BroadcastLimitStatus
+	DirectLinks  []DirectLinkStatus
+	Segments     *SegmentsStatus
+}
+
+type PeerTrafficStatus struct {
+	Peer     string
+	NickName string
+	Overlay  string
+	TrafficStats
+}
+
+type PeerHeartbeatStatus struct {
+	Peer     string
+	NickName string
+	Overlay  string
+	HeartbeatStats
 }
 
 type MACStatus struct {
@@ -18,6 +41,7 @@ type MACStatus struct {
 	Name     string
 	NickName string
 	LastSeen time.Time
+	Segment  Segment
 }
 
 func NewNetworkRouterStatus(router *NetworkRouter) *NetworkRouterStatus {
@@ -25,7 +49,23 @@ func NewNetworkRouterStatus(router *NetworkRouter) *NetworkRouterStatus {
 		mesh.NewStatus(router.Router),
 		router.InjectorConsumer.String(),
 		router.InjectorConsumer.Stats(),
-		NewMACStatusSlice(router.Macs)}
+		NewMACStatusSlice(router.Macs),
+		NewPeerTrafficStatusSlice(router),
+		NewPeerHeartbeatStatusSlice(router),
+		router.LinkRoutes(),
+		refusedConnections(router),
+		router.MulticastGroups(),
+		router.ARPSuppression(),
+		router.BroadcastLimits(),
+		router.DirectLinks(),
+		router.Segments()}
+}
+
+func refusedConnections(router *NetworkRouter) []RefusedConnection {
+	if osw, ok := router.Overlay.(*OverlaySwitch); ok {
+		return osw.RefusedConnections()
+	}
+	return nil
 }
 
 func NewMACStatusSlice(cache *MacCache) []MACStatus {
@@ -38,8 +78,63 @@ func NewMACStatusSlice(cache *MacCache) []MACStatus {
 			intmac(key).String(),
 			entry.peer.Name.String(),
 			entry.peer.NickName,
-			entry.lastSeen})
+			entry.lastSeen,
+			keySegment(key)})
+	}
+
+	return slice
+}
+
+func NewPeerTrafficStatusSlice(router *NetworkRouter) []PeerTrafficStatus {
+	var slice []PeerTrafficStatus
+	for _, conn := range localConnections(router) {
+		reporter, ok := conn.OverlayConn.(trafficReporter)
+		if !ok {
+			continue
+		}
+		for overlay, stats := range reporter.Traffic() {
+			slice = append(slice, PeerTrafficStatus{
+				conn.Remote().Name.String(),
+				conn.Remote().NickName,
+				overlay,
+				stats})
+		}
+	}
+
+	return slice
+}
+
+func NewPeerHeartbeatStatusSlice(router *NetworkRouter) []PeerHeartbeatStatus {
+	var slice []PeerHeartbeatStatus
+	for _, conn := range localConnections(router) {
+		reporter, ok := conn.OverlayConn.(heartbeatReporter)
+		if !ok {
+			continue
+		}
+		for overlay, stats := range reporter.HeartbeatStats() {
+			slice = append(slice, PeerHeartbeatStatus{
+				conn.Remote().Name.String(),
+				conn.Remote().NickName,
+				overlay,
+				stats})
+		}
 	}
 
 	return slice
 }
+
+// The connections to all the peers we know about
+func localConnections(router *NetworkRouter) []*mesh.LocalConnection {
+	var names []mesh.PeerName
+	for _, desc := range router.Peers.Descriptions() {
+		if !desc.Self {
+			names = append(names, desc.Name)
+		}
+	}
+
+	var conns []*mesh.LocalConnection
+	for _, conn := range router.Ourself.ConnectionsTo(names) {
+		conns = append(conns, conn.(*mesh.LocalConnection))
+	}
+	return conns
+}
@@ -0,0 +1,212 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/weaveworks/mesh"
+)
+
+// OverlayPolicy lets the operator choose between the overlays which
+// a connection has in common: a global order of preference, and
+// rules which pin or forbid overlays for particular peers or remote
+// addresses.
+
+type OverlayPolicy struct {
+	// Most preferred first; overlays not mentioned come afterwards,
+	// in the order negotiated with the peer.
+	Order []string      `json:"order,omitempty"`
+	Rules []OverlayRule `json:"rules,omitempty"`
+}
+
+const (
+	OverlayRulePin    = "pin"
+	OverlayRuleForbid = "forbid"
+)
+
+// An OverlayRule applies to connections to a peer, identified by
+// name or nickname, or to connections whose remote address is in a
+// CIDR.  Its textual form is <action>=<overlay>[,<overlay>...]@<peer or cidr>,
+// e.g. "pin=sleeve@192.168.48.0/24" or "forbid=fastdp@host1"
+type OverlayRule struct {
+	Action   string   `json:"action"`
+	Overlays []string `json:"overlays"`
+	Match    string   `json:"match"`
+
+	cidr *net.IPNet
+}
+
+func ParseOverlayRule(s string) (OverlayRule, error) {
+	var rule OverlayRule
+	at := strings.LastIndex(s, "@")
+	eq := strings.Index(s, "=")
+	if at < 0 || eq < 0 || eq > at {
+		return rule, fmt.Errorf("invalid overlay rule %q: expected <action>=<overlays>@<peer or cidr>", s)
+	}
+	rule.Action = s[:eq]
+	rule.Overlays = strings.Split(s[eq+1:at], ",")
+	rule.Match = s[at+1:]
+	return rule, rule.validate()
+}
+
+func (rule *OverlayRule) validate() error {
+	switch rule.Action {
+	case OverlayRulePin, OverlayRuleForbid:
+	default:
+		return fmt.Errorf("invalid overlay rule action %q", rule.Action)
+	}
+	if len(rule.Overlays) == 0 || rule.Overlays[0] == "" {
+		return fmt.Errorf("overlay rule %s has no overlays", rule)
+	}
+	if rule.Match == "" {
+		return fmt.Errorf("overlay rule %s has nothing to match", rule)
+	}
+	rule.cidr = nil
+	if _, cidr, err := net.ParseCIDR(rule.Match); err == nil {
+		rule.cidr = cidr
+	}
+	return nil
+}
+
+func (rule OverlayRule) String() string {
+	return fmt.Sprintf("%s=%s@%s", rule.Action, strings.Join(rule.Overlays, ","), rule.Match)
+}
+
+func (rule *OverlayRule) matches(peer *mesh.Peer, ip net.IP) bool {
+	if rule.cidr != nil {
+		return ip != nil && rule.cidr.Contains(ip)
+	}
+	return rule.Match == peer.Name.String() || rule.Match == peer.NickName
+}
+
+// ParseOverlayPolicy parses a comma-separated overlay order, and a
+// whitespace-separated list of rules.
+func ParseOverlayPolicy(order, rules string) (OverlayPolicy, error) {
+	var policy OverlayPolicy
+	for _, name := range strings.Split(order, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			policy.Order = append(policy.Order, name)
+		}
+	}
+	for _, s := range strings.Fields(rules) {
+		rule, err := ParseOverlayRule(s)
+		if err != nil {
+			return policy, err
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return policy, nil
+}
+
+// Validate checks the policy, including that it only names overlays
+// which are known.
+func (policy *OverlayPolicy) Validate(known map[string]NetworkOverlay) error {
+	check := func(name string) error {
+		if _, found := known[name]; !found {
+			return fmt.Errorf("unknown overlay %q", name)
+		}
+		return nil
+	}
+	for _, name := range policy.Order {
+		if err := check(name); err != nil {
+			return err
+		}
+	}
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if err := rule.validate(); err != nil {
+			return err
+		}
+		for _, name := range rule.Overlays {
+			if err := check(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// The outcome of applying the policy to a particular connection
+type connectionPolicy struct {
+	order  []string
+	pinned []string // if non-nil, only these overlays may be used
+	forbid []string
+}
+
+func (policy *OverlayPolicy) forConnection(peer *mesh.Peer, ip net.IP) connectionPolicy {
+	cp := connectionPolicy{order: policy.Order}
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if !rule.matches(peer, ip) {
+			continue
+		}
+		switch rule.Action {
+		case OverlayRulePin:
+			cp.pinned = append(cp.pinned, rule.Overlays...)
+		case OverlayRuleForbid:
+			cp.forbid = append(cp.forbid, rule.Overlays...)
+		}
+	}
+	return cp
+}
+
+func (cp connectionPolicy) allows(name string) bool {
+	if cp.pinned != nil && !contains(cp.pinned, name) {
+		return false
+	}
+	return !contains(cp.forbid, name)
+}
+
+// Order the indices of the named overlays by preference.  Pinned
+// overlays come first, then those in the global order, then the rest
+// in their original order.
+func (cp connectionPolicy) preferenceOrder(names []string) []int {
+	rank := func(name string) int {
+		for i, n := range cp.pinned {
+			if n == name {
+				return i
+			}
+		}
+		for i, n := range cp.order {
+			if n == name {
+				return len(cp.pinned) + i
+			}
+		}
+		return len(cp.pinned) + len(cp.order)
+	}
+	indices := make([]int, len(names))
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.SliceStable(indices, func(i, j int) bool {
+		return rank(names[indices[i]]) < rank(names[indices[j]])
+	})
+	return indices
+}
+
+// A description of the policy as applied to a connection, for status
+// reports
+func (cp connectionPolicy) String() string {
+	var parts []string
+	if cp.pinned != nil {
+		parts = append(parts, "pinned:"+strings.Join(cp.pinned, ","))
+	}
+	if len(cp.forbid) > 0 {
+		parts = append(parts, "forbidden:"+strings.Join(cp.forbid, ","))
+	}
+	if len(parts) == 0 && len(cp.order) > 0 {
+		parts = append(parts, "order:"+strings.Join(cp.order, ","))
+	}
+	return strings.Join(parts, " ")
+}
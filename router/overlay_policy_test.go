@@ -0,0 +1,167 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestParseOverlayRule(t *testing.T) {
+	for _, tc := range []struct {
+		rule     string
+		action   string
+		overlays []string
+		match    string
+		cidr     bool
+		err      bool
+	}{
+		{rule: "pin=sleeve@192.168.48.0/24", action: OverlayRulePin, overlays: []string{"sleeve"}, match: "192.168.48.0/24", cidr: true},
+		{rule: "forbid=fastdp@host1", action: OverlayRuleForbid, overlays: []string{"fastdp"}, match: "host1"},
+		{rule: "forbid=fastdp,tcp@0.0.0.0/0", action: OverlayRuleForbid, overlays: []string{"fastdp", "tcp"}, match: "0.0.0.0/0", cidr: true},
+		{rule: "pin=sleeve", err: true},
+		{rule: "sleeve@host1", err: true},
+		{rule: "prefer=sleeve@host1", err: true},
+		{rule: "pin=@host1", err: true},
+		{rule: "pin=sleeve@", err: true},
+		{rule: "pin@host1=sleeve", err: true},
+		{rule: "", err: true},
+	} {
+		rule, err := ParseOverlayRule(tc.rule)
+		if tc.err {
+			require.Error(t, err, tc.rule)
+			continue
+		}
+		require.NoError(t, err, tc.rule)
+		require.Equal(t, tc.action, rule.Action, tc.rule)
+		require.Equal(t, tc.overlays, rule.Overlays, tc.rule)
+		require.Equal(t, tc.match, rule.Match, tc.rule)
+		require.Equal(t, tc.cidr, rule.cidr != nil, tc.rule)
+		require.Equal(t, tc.rule, rule.String())
+	}
+}
+
+func TestOverlayPolicyValidate(t *testing.T) {
+	known := map[string]NetworkOverlay{"fastdp": nil, "sleeve": nil}
+	for _, tc := range []struct {
+		order, rules string
+		err          bool
+	}{
+		{order: "", rules: ""},
+		{order: "sleeve,fastdp", rules: "pin=sleeve@host1 forbid=fastdp@10.0.0.0/8"},
+		{order: " sleeve , fastdp ", rules: ""},
+		{order: "sleeve,tcp", err: true},
+		{rules: "pin=sleeve,tcp@host1", err: true},
+	} {
+		policy, err := ParseOverlayPolicy(tc.order, tc.rules)
+		require.NoError(t, err, "%s %s", tc.order, tc.rules)
+		err = policy.Validate(known)
+		if tc.err {
+			require.Error(t, err, "%s %s", tc.order, tc.rules)
+		} else {
+			require.NoError(t, err, "%s %s", tc.order, tc.rules)
+		}
+	}
+}
+
+func TestOverlayPolicyForConnection(t *testing.T) {
+	names := []string{"fastdp", "sleeve", "tcp"}
+	peer := testPeer(mesh.PeerName(0x000000000001), "host1")
+	for _, tc := range []struct {
+		name       string
+		order      string
+		rules      string
+		ip         string
+		allowed    []string
+		preference []string
+		str        string
+	}{
+		{
+			name:       "no policy",
+			ip:         "10.0.0.1",
+			allowed:    names,
+			preference: names,
+		},
+		{
+			name:       "order",
+			order:      "tcp,sleeve",
+			ip:         "10.0.0.1",
+			allowed:    names,
+			preference: []string{"tcp", "sleeve", "fastdp"},
+			str:        "order:tcp,sleeve",
+		},
+		{
+			name:       "pin by nickname",
+			order:      "tcp",
+			rules:      "pin=sleeve@host1",
+			ip:         "10.0.0.1",
+			allowed:    []string{"sleeve"},
+			preference: []string{"sleeve", "tcp", "fastdp"},
+			str:        "pinned:sleeve",
+		},
+		{
+			name:       "pin several by cidr",
+			rules:      "pin=tcp,sleeve@10.0.0.0/8",
+			ip:         "10.0.0.1",
+			allowed:    []string{"sleeve", "tcp"},
+			preference: []string{"tcp", "sleeve", "fastdp"},
+			str:        "pinned:tcp,sleeve",
+		},
+		{
+			name:       "pin for another address",
+			rules:      "pin=sleeve@192.168.0.0/16",
+			ip:         "10.0.0.1",
+			allowed:    names,
+			preference: names,
+		},
+		{
+			name:       "pin with no address",
+			rules:      "pin=sleeve@0.0.0.0/0",
+			allowed:    names,
+			preference: names,
+		},
+		{
+			name:       "forbid by name",
+			rules:      "forbid=fastdp@00:00:00:00:00:01",
+			ip:         "10.0.0.1",
+			allowed:    []string{"sleeve", "tcp"},
+			preference: names,
+			str:        "forbidden:fastdp",
+		},
+		{
+			name:       "forbid beats pin",
+			rules:      "pin=sleeve,tcp@host1 forbid=sleeve@10.0.0.0/8",
+			ip:         "10.0.0.1",
+			allowed:    []string{"tcp"},
+			preference: []string{"sleeve", "tcp", "fastdp"},
+			str:        "pinned:sleeve,tcp forbidden:sleeve",
+		},
+		{
+			name:       "rules for another peer",
+			rules:      "pin=sleeve@host2 forbid=fastdp@00:00:00:00:00:02",
+			ip:         "10.0.0.1",
+			allowed:    names,
+			preference: names,
+		},
+	} {
+		policy, err := ParseOverlayPolicy(tc.order, tc.rules)
+		require.NoError(t, err, tc.name)
+		cp := policy.forConnection(peer, net.ParseIP(tc.ip))
+
+		var allowed []string
+		for _, name := range names {
+			if cp.allows(name) {
+				allowed = append(allowed, name)
+			}
+		}
+		require.Equal(t, tc.allowed, allowed, tc.name)
+
+		var preference []string
+		for _, i := range cp.preferenceOrder(names) {
+			preference = append(preference, names[i])
+		}
+		require.Equal(t, tc.preference, preference, tc.name)
+		require.Equal(t, tc.str, cp.String(), tc.name)
+	}
+}
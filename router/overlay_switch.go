@@ -2,6 +2,7 @@ package router
 
 import (
 	"fmt"
+	"net"
 	"strings"
 	"sync"
 
@@ -12,16 +13,33 @@ import (
 // subsidiary overlays.  First, it passes a list of supported overlays
 // in the connection features, and uses that to determine which
 // overlays are in common.  Then it tries those common overlays, and
-// uses the best one that seems to be working.
+// uses the best one that seems to be working.  Which is best, and
+// which overlays may be used at all, is subject to the OverlayPolicy.
+// Connections which the EncryptionPolicy does not allow are refused.
 
 type OverlaySwitch struct {
 	overlays      map[string]NetworkOverlay
 	overlayNames  []string
 	compatOverlay NetworkOverlay
+
+	lock             sync.Mutex
+	policy           OverlayPolicy
+	encryptionPolicy EncryptionPolicy
+	refused          []RefusedConnection
+	connections      map[*overlaySwitchForwarder]struct{}
+	compatConns      map[*compatForwarder]struct{}
+
+	// called after either policy changes, for connections which
+	// are not made through the switch
+	onPolicyChange func()
 }
 
 func NewOverlaySwitch() *OverlaySwitch {
-	return &OverlaySwitch{overlays: make(map[string]NetworkOverlay)}
+	return &OverlaySwitch{
+		overlays:    make(map[string]NetworkOverlay),
+		connections: make(map[*overlaySwitchForwarder]struct{}),
+		compatConns: make(map[*compatForwarder]struct{}),
+	}
 }
 
 func (osw *OverlaySwitch) Add(name string, overlay NetworkOverlay) {
@@ -38,8 +56,76 @@ func (osw *OverlaySwitch) SetCompatOverlay(overlay NetworkOverlay) {
 	osw.compatOverlay = overlay
 }
 
+// SetPolicy replaces the overlay policy.  It takes effect
+// immediately for the choice between overlays on existing
+// connections, and stops any overlays which it now forbids; overlays
+// which it now allows are only used on new connections.
+func (osw *OverlaySwitch) SetPolicy(policy OverlayPolicy) error {
+	if err := policy.Validate(osw.overlays); err != nil {
+		return err
+	}
+
+	osw.lock.Lock()
+	osw.policy = policy
+	connections := make([]*overlaySwitchForwarder, 0, len(osw.connections))
+	for fwd := range osw.connections {
+		connections = append(connections, fwd)
+	}
+	osw.lock.Unlock()
+
+	for _, fwd := range connections {
+		fwd.applyPolicy(policy.forConnection(fwd.remotePeer, fwd.remoteIP))
+	}
+	if osw.onPolicyChange != nil {
+		osw.onPolicyChange()
+	}
+	return nil
+}
+
+func (osw *OverlaySwitch) Policy() OverlayPolicy {
+	osw.lock.Lock()
+	defer osw.lock.Unlock()
+	return osw.policy
+}
+
+func (osw *OverlaySwitch) connectionPolicy(peer *mesh.Peer, ip net.IP) connectionPolicy {
+	osw.lock.Lock()
+	defer osw.lock.Unlock()
+	return osw.policy.forConnection(peer, ip)
+}
+
+// Check a sleeve link to a peer which does not go through
+// PrepareConnection, such as a NAT traversal direct link, against
+// both policies.
+func (osw *OverlaySwitch) checkDirectLink(peer *mesh.Peer, ip net.IP, encrypted bool) error {
+	osw.lock.Lock()
+	defer osw.lock.Unlock()
+	if err := osw.encryptionPolicy.check(peer, ip, encrypted); err != nil {
+		return err
+	}
+	if policy := osw.policy.forConnection(peer, ip); !policy.allows("sleeve") {
+		return fmt.Errorf("sleeve is not allowed by the overlay policy (%s)", policy)
+	}
+	return nil
+}
+
+func (osw *OverlaySwitch) addConnection(fwd *overlaySwitchForwarder) {
+	osw.lock.Lock()
+	defer osw.lock.Unlock()
+	osw.connections[fwd] = struct{}{}
+}
+
+func (osw *OverlaySwitch) removeConnection(fwd *overlaySwitchForwarder) {
+	osw.lock.Lock()
+	defer osw.lock.Unlock()
+	delete(osw.connections, fwd)
+}
+
 func (osw *OverlaySwitch) AddFeaturesTo(features map[string]string) {
 	features["Overlays"] = strings.Join(osw.overlayNames, " ")
+	for _, overlay := range osw.overlays {
+		overlay.AddFeaturesTo(features)
+	}
 }
 
 func (osw *OverlaySwitch) Diagnostics() interface{} {
@@ -126,7 +212,10 @@ func (osw *OverlaySwitch) commonOverlays(params mesh.OverlayConnectionParams) ([
 }
 
 type overlaySwitchForwarder struct {
+	osw        *OverlaySwitch
 	remotePeer *mesh.Peer
+	remoteIP   net.IP
+	encrypted  bool
 
 	lock sync.Mutex
 
@@ -136,6 +225,11 @@ type overlaySwitchForwarder struct {
 	// the subsidiary forwarders
 	forwarders []subForwarder
 
+	// the policy for this connection, and the resulting indices of
+	// the forwarders in order of preference
+	policy     connectionPolicy
+	preference []int
+
 	// closed to tell the main goroutine to stop
 	stopChan chan<- struct{}
 
@@ -158,6 +252,13 @@ type subForwarder struct {
 
 	// set to true to skip this forwarder in chooseBest()
 	onHold bool
+
+	// the overlay policy does not allow this forwarder
+	forbidden bool
+
+	// the forwarder has found that the path to the peer does not
+	// carry frames as big as the bridge MTU
+	lowMTU bool
 }
 
 // An event from a subsidiary forwarder
@@ -173,11 +274,25 @@ type subForwarderEvent struct {
 
 	// event to indicate if forwarder is in healthy state to be considered for best forwarded
 	healthy *bool
+
+	// event to indicate if the path carries frames as big as the
+	// bridge MTU
+	mtuOK *bool
+}
+
+// Forwarders which discover the path MTU report whether it is enough
+// for the bridge MTU.
+type mtuReporter interface {
+	MTUChannel() <-chan bool
 }
 
 func (osw *OverlaySwitch) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	if err := osw.checkEncryptionPolicy(params); err != nil {
+		return nil, err
+	}
+
 	if _, present := params.Features["Overlays"]; !present && osw.compatOverlay != nil {
-		return osw.compatOverlay.PrepareConnection(params)
+		return osw.prepareCompatConnection(params)
 	}
 
 	overlays, err := osw.commonOverlays(params)
@@ -185,6 +300,23 @@ func (osw *OverlaySwitch) PrepareConnection(params mesh.OverlayConnectionParams)
 		return nil, err
 	}
 
+	var remoteIP net.IP
+	if params.RemoteAddr != nil {
+		remoteIP = params.RemoteAddr.IP
+	}
+	policy := osw.connectionPolicy(params.RemotePeer, remoteIP)
+	names := make([]string, len(overlays))
+	allowed := 0
+	for i, overlay := range overlays {
+		names[i] = overlay.name
+		if policy.allows(overlay.name) {
+			allowed++
+		}
+	}
+	if allowed == 0 {
+		return nil, fmt.Errorf("no overlays in common with peer are allowed by the overlay policy (%s)", policy)
+	}
+
 	// channel to carry events from the subforwarder monitors to
 	// the main goroutine
 	eventsChan := make(chan subForwarderEvent)
@@ -193,10 +325,15 @@ func (osw *OverlaySwitch) PrepareConnection(params mesh.OverlayConnectionParams)
 	stopChan := make(chan struct{})
 
 	fwd := &overlaySwitchForwarder{
+		osw:        osw,
 		remotePeer: params.RemotePeer,
+		remoteIP:   remoteIP,
+		encrypted:  params.SessionKey != nil,
 
 		best:       -1,
 		forwarders: make([]subForwarder, len(overlays)),
+		policy:     policy,
+		preference: policy.preferenceOrder(names),
 		stopChan:   stopChan,
 
 		establishedChan: make(chan struct{}),
@@ -215,6 +352,18 @@ func (osw *OverlaySwitch) PrepareConnection(params mesh.OverlayConnectionParams)
 			return origSendControlMessage(mesh.ProtocolOverlayControlMsg, xmsg)
 		}
 
+		if !policy.allows(overlay.name) {
+			log.Infof("Not using %s for connection to %s(%s): forbidden by overlay policy",
+				overlay.name,
+				params.RemotePeer.Name,
+				params.RemotePeer.NickName)
+			fwd.forwarders[i] = subForwarder{
+				overlayName: overlay.name,
+				forbidden:   true,
+			}
+			continue
+		}
+
 		subConn, err := overlay.PrepareConnection(params)
 		if err != nil {
 			log.Infof("Unable to use %s for connection to %s(%s): %s",
@@ -240,12 +389,17 @@ func (osw *OverlaySwitch) PrepareConnection(params mesh.OverlayConnectionParams)
 	}
 
 	fwd.chooseBest()
+	osw.addConnection(fwd)
 	go fwd.run(eventsChan, stopChan)
 	return fwd, nil
 }
 
 func monitorForwarder(index int, eventsChan chan<- subForwarderEvent, stopChan <-chan struct{}, fwd OverlayForwarder) {
 	establishedChan := fwd.EstablishedChannel()
+	var mtuChan <-chan bool
+	if reporter, ok := fwd.(mtuReporter); ok {
+		mtuChan = reporter.MTUChannel()
+	}
 loop:
 	for {
 		e := subForwarderEvent{index: index}
@@ -258,6 +412,9 @@ loop:
 		case healthy := <-fwd.HealthChannel():
 			e.healthy = &healthy
 
+		case mtuOK := <-mtuChan:
+			e.mtuOK = &mtuOK
+
 		case err := <-fwd.ErrorChannel():
 			e.err = err
 
@@ -294,6 +451,8 @@ loop:
 				fwd.error(e.index, e.err)
 			case e.healthy != nil:
 				fwd.healthCheck(e.index, *e.healthy)
+			case e.mtuOK != nil:
+				fwd.mtuCheck(e.index, *e.mtuOK)
 			}
 		}
 	}
@@ -347,6 +506,43 @@ func (fwd *overlaySwitchForwarder) healthCheck(index int, healthy bool) {
 	}
 }
 
+func (fwd *overlaySwitchForwarder) mtuCheck(index int, ok bool) {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	subFwd := &fwd.forwarders[index]
+	if subFwd.lowMTU == !ok {
+		return
+	}
+	subFwd.lowMTU = !ok
+	if ok {
+		log.Info(fwd.logPrefix(), subFwd.overlayName, " path MTU is enough for the bridge MTU")
+	} else {
+		log.Warning(fwd.logPrefix(), subFwd.overlayName, " path MTU is below the bridge MTU; preferring other overlays")
+	}
+	fwd.chooseBest()
+}
+
+func (fwd *overlaySwitchForwarder) applyPolicy(policy connectionPolicy) {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	names := make([]string, len(fwd.forwarders))
+	for i := range fwd.forwarders {
+		subFwd := &fwd.forwarders[i]
+		names[i] = subFwd.overlayName
+		if subFwd.fwd != nil && !policy.allows(subFwd.overlayName) {
+			log.Info(fwd.logPrefix(), "stopping ", subFwd.overlayName, ": forbidden by overlay policy")
+			subFwd.fwd = nil
+			subFwd.forbidden = true
+			close(subFwd.stopChan)
+		}
+	}
+	fwd.policy = policy
+	fwd.preference = policy.preferenceOrder(names)
+	fwd.chooseBest()
+}
+
 func (fwd *overlaySwitchForwarder) stopFrom(index int) {
 	for index < len(fwd.forwarders) {
 		subFwd := &fwd.forwarders[index]
@@ -360,37 +556,48 @@ func (fwd *overlaySwitchForwarder) stopFrom(index int) {
 
 func (fwd *overlaySwitchForwarder) chooseBest() {
 	// the most preferred established forwarder is the best
-	// otherwise, the most preferred working forwarder is the best
+	// otherwise, the most preferred working forwarder is the best.
+	// Either way, forwarders whose path MTU is below the bridge
+	// MTU are only used if there is nothing else, since they drop
+	// big frames.
 	bestEstablished := -1
 	bestWorking := -1
+	bestLowMTUEstablished := -1
+	bestLowMTUWorking := -1
 
-	for i := range fwd.forwarders {
+	for _, i := range fwd.preference {
 		subFwd := &fwd.forwarders[i]
 		if subFwd.fwd == nil || subFwd.onHold {
 			continue
 		}
 
-		if bestWorking < 0 {
-			bestWorking = i
+		working, established := &bestWorking, &bestEstablished
+		if subFwd.lowMTU {
+			working, established = &bestLowMTUWorking, &bestLowMTUEstablished
 		}
 
-		if bestEstablished < 0 && subFwd.established {
-			bestEstablished = i
+		if *working < 0 {
+			*working = i
+		}
+
+		if *established < 0 && subFwd.established {
+			*established = i
 		}
 	}
 
 	best := bestEstablished
+	for _, candidate := range []int{bestLowMTUEstablished, bestWorking, bestLowMTUWorking} {
+		if best < 0 {
+			best = candidate
+		}
+	}
 	if best < 0 {
-		if bestWorking < 0 {
-			select {
-			case fwd.errorChan <- fmt.Errorf("no working forwarders to %s", fwd.remotePeer):
-			default:
-			}
-
-			return
+		select {
+		case fwd.errorChan <- fmt.Errorf("no working forwarders to %s", fwd.remotePeer):
+		default:
 		}
 
-		best = bestWorking
+		return
 	}
 
 	if fwd.best != best {
@@ -419,7 +626,12 @@ func (fwd *overlaySwitchForwarder) Forward(pk ForwardPacketKey) FlowOp {
 	fwd.lock.Lock()
 
 	if fwd.best >= 0 {
-		for i := fwd.best; i < len(fwd.forwarders); i++ {
+		// try the best forwarder, and then the less preferred ones
+		pos := 0
+		for pos < len(fwd.preference) && fwd.preference[pos] != fwd.best {
+			pos++
+		}
+		for _, i := range fwd.preference[pos:] {
 			best := fwd.forwarders[i].fwd
 			if best != nil {
 				fwd.lock.Unlock()
@@ -449,6 +661,7 @@ func (fwd *overlaySwitchForwarder) HealthChannel() <-chan bool {
 }
 
 func (fwd *overlaySwitchForwarder) Stop() {
+	fwd.osw.removeConnection(fwd)
 	fwd.lock.Lock()
 	defer fwd.lock.Unlock()
 	fwd.stopFrom(0)
@@ -464,6 +677,52 @@ func (fwd *overlaySwitchForwarder) ControlMessage(tag byte, msg []byte) {
 	}
 }
 
+// Traffic reports the traffic of each subsidiary forwarder which is
+// still running.
+func (fwd *overlaySwitchForwarder) Traffic() map[string]TrafficStats {
+	var reporters []trafficReporter
+
+	fwd.lock.Lock()
+	for _, subFwd := range fwd.forwarders {
+		if reporter, ok := subFwd.fwd.(trafficReporter); ok {
+			reporters = append(reporters, reporter)
+		}
+	}
+	fwd.lock.Unlock()
+
+	traffic := make(map[string]TrafficStats)
+	for _, reporter := range reporters {
+		for name, stats := range reporter.Traffic() {
+			total := traffic[name]
+			total.Add(stats)
+			traffic[name] = total
+		}
+	}
+	return traffic
+}
+
+// HeartbeatStats reports the heartbeat statistics of each subsidiary
+// forwarder which is still running.
+func (fwd *overlaySwitchForwarder) HeartbeatStats() map[string]HeartbeatStats {
+	var reporters []heartbeatReporter
+
+	fwd.lock.Lock()
+	for _, subFwd := range fwd.forwarders {
+		if reporter, ok := subFwd.fwd.(heartbeatReporter); ok {
+			reporters = append(reporters, reporter)
+		}
+	}
+	fwd.lock.Unlock()
+
+	stats := make(map[string]HeartbeatStats)
+	for _, reporter := range reporters {
+		for name, s := range reporter.HeartbeatStats() {
+			stats[name] = s
+		}
+	}
+	return stats
+}
+
 func (fwd *overlaySwitchForwarder) Attrs() map[string]interface{} {
 	var best OverlayForwarder
 
@@ -471,11 +730,97 @@ func (fwd *overlaySwitchForwarder) Attrs() map[string]interface{} {
 	if fwd.best >= 0 {
 		best = fwd.forwarders[fwd.best].fwd
 	}
+	policy := fwd.policy.String()
 	fwd.lock.Unlock()
 
-	if best != nil {
-		return best.Attrs()
+	if best == nil {
+		return nil
+	}
+
+	attrs := make(map[string]interface{})
+	for k, v := range best.Attrs() {
+		attrs[k] = v
+	}
+	if policy != "" {
+		attrs["policy"] = policy
+	}
+	return attrs
+}
+
+// A connection on the compat overlay, to a peer which does not
+// support the switch.  It is tracked, and its errors relayed, so that
+// a change to the encryption policy can close it.
+type compatForwarder struct {
+	OverlayForwarder
+	osw        *OverlaySwitch
+	remotePeer *mesh.Peer
+	remoteIP   net.IP
+	encrypted  bool
+
+	errorChan chan error
+	stopChan  chan struct{}
+}
+
+func (osw *OverlaySwitch) prepareCompatConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	conn, err := osw.compatOverlay.PrepareConnection(params)
+	if err != nil {
+		return nil, err
+	}
+	fwd := &compatForwarder{
+		OverlayForwarder: conn.(OverlayForwarder),
+		osw:              osw,
+		remotePeer:       params.RemotePeer,
+		encrypted:        params.SessionKey != nil,
+		errorChan:        make(chan error, 1),
+		stopChan:         make(chan struct{}),
+	}
+	if params.RemoteAddr != nil {
+		fwd.remoteIP = params.RemoteAddr.IP
+	}
+	osw.lock.Lock()
+	osw.compatConns[fwd] = struct{}{}
+	osw.lock.Unlock()
+	go fwd.relayErrors()
+	return fwd, nil
+}
+
+func (fwd *compatForwarder) relayErrors() {
+	select {
+	case err := <-fwd.OverlayForwarder.ErrorChannel():
+		fwd.fail(err)
+	case <-fwd.stopChan:
+	}
+}
+
+func (fwd *compatForwarder) fail(err error) {
+	select {
+	case fwd.errorChan <- err:
+	default:
 	}
+}
+
+func (fwd *compatForwarder) ErrorChannel() <-chan error {
+	return fwd.errorChan
+}
 
+func (fwd *compatForwarder) Stop() {
+	fwd.osw.lock.Lock()
+	delete(fwd.osw.compatConns, fwd)
+	fwd.osw.lock.Unlock()
+	close(fwd.stopChan)
+	fwd.OverlayForwarder.Stop()
+}
+
+func (fwd *compatForwarder) Traffic() map[string]TrafficStats {
+	if reporter, ok := fwd.OverlayForwarder.(trafficReporter); ok {
+		return reporter.Traffic()
+	}
+	return nil
+}
+
+func (fwd *compatForwarder) HeartbeatStats() map[string]HeartbeatStats {
+	if reporter, ok := fwd.OverlayForwarder.(heartbeatReporter); ok {
+		return reporter.HeartbeatStats()
+	}
 	return nil
 }
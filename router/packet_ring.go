@@ -0,0 +1,298 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// PacketRing captures packets through AF_PACKET sockets with
+// TPACKET_V3 memory-mapped rings, avoiding libpcap's copying and
+// per-packet system calls.  The kernel hands over a block of packets
+// at a time, when the block fills up or after packetRingBlockTimeout.
+// With fanout, several sockets share the packets of the interface,
+// spread by flow hash so that the frames of a flow stay in order, each
+// consumed by a goroutine of its own.
+type PacketRing struct {
+	NonDiscardingFlowOp
+
+	iface   *net.Interface
+	bufSz   int
+	fanout  int
+	writeFd int // bound to the interface, for injecting packets
+
+	mutex   sync.Mutex
+	readFds []int
+	// The kernel resets its counters when they are read, so the
+	// totals are kept here
+	received  uint64
+	dropped   uint64
+	freezes   uint64
+	truncated uint64 // updated atomically
+}
+
+const (
+	packetRingBlockSize = 1 << 20
+	// in milliseconds; the most latency the ring adds
+	packetRingBlockTimeout = 1
+	// sizeof(struct tpacket3_hdr), aligned to TPACKET_ALIGNMENT,
+	// which the struct sockaddr_ll of each packet follows
+	tpacket3HdrLen = 48
+)
+
+// Fanout groups are identified per network namespace, so the rings
+// of each interface need their own
+var packetRingFanoutID = uint32(os.Getpid())
+
+func NewPacketRing(iface *net.Interface, bufSz int, fanout int) (InjectorConsumer, error) {
+	// A protocol of zero receives nothing
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("packet ring: creating socket: %s", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Ifindex: iface.Index}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("packet ring: binding to %s: %s", iface.Name, err)
+	}
+	if fanout < 1 {
+		fanout = 1
+	}
+	return &PacketRing{iface: iface, bufSz: bufSz, fanout: fanout, writeFd: fd}, nil
+}
+
+func (r *PacketRing) StartConsumingPackets(consumer Consumer) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.readFds != nil {
+		return fmt.Errorf("PacketRing already has a Consumer")
+	}
+
+	// The capture buffer is shared out between the rings
+	blocks := r.bufSz / packetRingBlockSize / r.fanout
+	if blocks < 1 {
+		blocks = 1
+	}
+	fanoutID := uint16(atomic.AddUint32(&packetRingFanoutID, 1))
+
+	var fds []int
+	var rings [][]byte
+	for i := 0; i < r.fanout; i++ {
+		fd, ring, err := r.openRing(blocks, fanoutID)
+		if err != nil {
+			for i, fd := range fds {
+				unix.Munmap(rings[i])
+				unix.Close(fd)
+			}
+			return err
+		}
+		fds = append(fds, fd)
+		rings = append(rings, ring)
+	}
+
+	r.readFds = fds
+	for i, fd := range fds {
+		go r.sniff(fd, rings[i], blocks, consumer)
+	}
+	return nil
+}
+
+func (r *PacketRing) openRing(blocks int, fanoutID uint16) (int, []byte, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return -1, nil, fmt.Errorf("packet ring: creating socket: %s", err)
+	}
+	ring, err := r.setupRing(fd, blocks, fanoutID)
+	if err != nil {
+		unix.Close(fd)
+		return -1, nil, err
+	}
+	return fd, ring, nil
+}
+
+func (r *PacketRing) setupRing(fd int, blocks int, fanoutID uint16) ([]byte, error) {
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return nil, fmt.Errorf("packet ring: setting TPACKET_V3: %s", err)
+	}
+	// Like the "inbound" filter on pcap handles.  Older kernels
+	// lack this, so outgoing packets are also skipped in sniff.
+	unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_IGNORE_OUTGOING, 1)
+
+	frameSize := unix.Getpagesize()
+	req := unix.TpacketReq3{
+		Block_size:     packetRingBlockSize,
+		Block_nr:       uint32(blocks),
+		Frame_size:     uint32(frameSize),
+		Frame_nr:       uint32(blocks * packetRingBlockSize / frameSize),
+		Retire_blk_tov: packetRingBlockTimeout,
+	}
+	if err := unix.SetsockoptTpacketReq3(fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &req); err != nil {
+		return nil, fmt.Errorf("packet ring: setting up ring: %s", err)
+	}
+	ring, err := unix.Mmap(fd, 0, blocks*packetRingBlockSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("packet ring: mapping ring: %s", err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: r.iface.Index}); err != nil {
+		unix.Munmap(ring)
+		return nil, fmt.Errorf("packet ring: binding to %s: %s", r.iface.Name, err)
+	}
+	if r.fanout > 1 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_FANOUT, int(fanoutID)|unix.PACKET_FANOUT_HASH<<16); err != nil {
+			unix.Munmap(ring)
+			return nil, fmt.Errorf("packet ring: joining fanout group: %s", err)
+		}
+	}
+	return ring, nil
+}
+
+// Convert to network byte order, for sockaddr_ll
+func htons(v uint16) uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return nl.NativeEndian().Uint16(b)
+}
+
+// Offsets in struct tpacket_block_desc, and struct tpacket3_hdr
+const (
+	tpBlockStatus   = 8
+	tpBlockNumPkts  = 12
+	tpBlockFirstPkt = 16
+	tpPktNextOffset = 0
+	tpPktSnaplen    = 12
+	tpPktLen        = 16
+	tpPktStatus     = 20
+	tpPktMac        = 24
+	tpPktVlanTCI    = 32
+	tpPktVlanTPID   = 36
+	tpPktSllPkttype = tpacket3HdrLen + 10
+	vlanTagSize     = 4
+	defaultVlanTPID = 0x8100
+)
+
+func (r *PacketRing) sniff(fd int, ring []byte, blocks int, consumer Consumer) {
+	dec := NewEthernetDecoder()
+	pollFds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN | unix.POLLERR}}
+
+	for i := 0; ; i = (i + 1) % blocks {
+		block := ring[i*packetRingBlockSize : (i+1)*packetRingBlockSize]
+		status := (*uint32)(unsafe.Pointer(&block[tpBlockStatus]))
+		for atomic.LoadUint32(status)&unix.TP_STATUS_USER == 0 {
+			if _, err := unix.Poll(pollFds, -1); err != nil && err != unix.EINTR {
+				checkFatal(err)
+			}
+		}
+
+		r.handleBlock(block, dec, consumer)
+	}
+}
+
+// Handle the packets of a block which the kernel has handed over, then
+// give it back
+func (r *PacketRing) handleBlock(block []byte, dec *EthernetDecoder, consumer Consumer) {
+	order := nl.NativeEndian()
+	numPkts := int(order.Uint32(block[tpBlockNumPkts:]))
+	offset := int(order.Uint32(block[tpBlockFirstPkt:]))
+	for n := 0; n < numPkts; n++ {
+		hdr := block[offset:]
+		if hdr[tpPktSllPkttype] != unix.PACKET_OUTGOING {
+			r.handlePacket(hdr, dec, consumer)
+		}
+		offset += int(order.Uint32(hdr[tpPktNextOffset:]))
+	}
+
+	status := (*uint32)(unsafe.Pointer(&block[tpBlockStatus]))
+	atomic.StoreUint32(status, unix.TP_STATUS_KERNEL)
+}
+
+func (r *PacketRing) handlePacket(hdr []byte, dec *EthernetDecoder, consumer Consumer) {
+	order := nl.NativeEndian()
+	pktStatus := order.Uint32(hdr[tpPktStatus:])
+	mac := int(order.Uint16(hdr[tpPktMac:]))
+	snaplen := int(order.Uint32(hdr[tpPktSnaplen:]))
+	if snaplen != int(order.Uint32(hdr[tpPktLen:])) {
+		// Too big for a block, so truncated
+		atomic.AddUint64(&r.truncated, 1)
+		return
+	}
+	pkt := hdr[mac : mac+snaplen]
+
+	// The kernel strips VLAN tags which the device offloaded, so
+	// put them back, as libpcap does
+	if pktStatus&unix.TP_STATUS_VLAN_VALID != 0 && len(pkt) >= 12 {
+		tpid := uint16(defaultVlanTPID)
+		if pktStatus&unix.TP_STATUS_VLAN_TPID_VALID != 0 {
+			tpid = order.Uint16(hdr[tpPktVlanTPID:])
+		}
+		tagged := make([]byte, len(pkt)+vlanTagSize)
+		copy(tagged, pkt[:12])
+		binary.BigEndian.PutUint16(tagged[12:], tpid)
+		binary.BigEndian.PutUint16(tagged[14:], uint16(order.Uint32(hdr[tpPktVlanTCI:])))
+		copy(tagged[12+vlanTagSize:], pkt[12:])
+		pkt = tagged
+	}
+
+	dec.DecodeLayers(pkt)
+	if len(dec.decoded) == 0 {
+		return
+	}
+
+	if fop := consumer(dec.PacketKey()); !fop.Discards() {
+		// We are handing over the frame to forwarders, so we
+		// need to make a copy of it, as the ring is reused
+		pktCopy := make([]byte, len(pkt))
+		copy(pktCopy, pkt)
+		fop.Process(pktCopy, dec, false)
+	}
+}
+
+func (r *PacketRing) Interface() *net.Interface {
+	return r.iface
+}
+
+func (r *PacketRing) String() string {
+	return fmt.Sprint(r.iface.Name, " (via packet ring)")
+}
+
+func (r *PacketRing) InjectPacket(PacketKey) FlowOp {
+	return r
+}
+
+// Writes to a socket are atomic, so no locking is needed
+func (r *PacketRing) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	_, err := unix.Write(r.writeFd, frame)
+	checkWarn(err)
+}
+
+func (r *PacketRing) Stats() map[string]int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.readFds == nil {
+		return nil
+	}
+	for _, fd := range r.readFds {
+		stats, err := unix.GetsockoptTpacketStatsV3(fd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
+		if err != nil {
+			return nil
+		}
+		// tp_packets includes the drops
+		r.received += uint64(stats.Packets - stats.Drops)
+		r.dropped += uint64(stats.Drops)
+		r.freezes += uint64(stats.Freeze_q_cnt)
+	}
+
+	return map[string]int{
+		"PacketsReceived":  int(r.received),
+		"PacketsDropped":   int(r.dropped),
+		"PacketsTruncated": int(atomic.LoadUint64(&r.truncated)),
+		"RingFreezes":      int(r.freezes),
+	}
+}
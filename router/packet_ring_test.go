@@ -0,0 +1,162 @@
+package router
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// A packet as the kernel puts it in a block of the ring
+type testRingPacket struct {
+	frame   []byte
+	length  int // of the packet before truncation, if it was
+	status  uint32
+	vlanTCI uint32
+	tpid    uint16
+	pkttype byte
+}
+
+// Where the frame follows the struct tpacket3_hdr and struct
+// sockaddr_ll, as for TPACKET_ALIGN(TPACKET3_HDRLEN)
+const testRingMac = 80
+
+// A block which the kernel has handed over, holding the packets.  The
+// offsets are those the kernel would use, aligned to 16 bytes.
+func testRingBlock(pkts ...testRingPacket) []byte {
+	order := nl.NativeEndian()
+	block := make([]byte, 1<<16)
+	order.PutUint32(block[tpBlockStatus:], unix.TP_STATUS_USER)
+	order.PutUint32(block[tpBlockNumPkts:], uint32(len(pkts)))
+	offset := 48 // after struct tpacket_block_desc
+	order.PutUint32(block[tpBlockFirstPkt:], uint32(offset))
+	for i, pkt := range pkts {
+		hdr := block[offset:]
+		length := pkt.length
+		if length == 0 {
+			length = len(pkt.frame)
+		}
+		order.PutUint32(hdr[tpPktSnaplen:], uint32(len(pkt.frame)))
+		order.PutUint32(hdr[tpPktLen:], uint32(length))
+		order.PutUint32(hdr[tpPktStatus:], pkt.status)
+		order.PutUint16(hdr[tpPktMac:], testRingMac)
+		order.PutUint32(hdr[tpPktVlanTCI:], pkt.vlanTCI)
+		order.PutUint16(hdr[tpPktVlanTPID:], pkt.tpid)
+		hdr[tpPktSllPkttype] = pkt.pkttype
+		copy(hdr[testRingMac:], pkt.frame)
+		next := (testRingMac + len(pkt.frame) + 15) &^ 15
+		if i == len(pkts)-1 {
+			next = 0
+		}
+		order.PutUint32(hdr[tpPktNextOffset:], uint32(next))
+		offset += next
+	}
+	return block
+}
+
+// retainingFlowOp keeps the frames it is given, without copying them
+type retainingFlowOp struct {
+	NonDiscardingFlowOp
+	frames *[][]byte
+}
+
+func (op retainingFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	*op.frames = append(*op.frames, frame)
+}
+
+// Frames with the given VLAN tag put back after the MACs
+func testTaggedFrame(frame []byte, tpid, tci uint16) []byte {
+	tagged := append([]byte(nil), frame[:12]...)
+	tagged = append(tagged, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(tagged[12:], tpid)
+	binary.BigEndian.PutUint16(tagged[14:], tci)
+	return append(tagged, frame[12:]...)
+}
+
+func TestPacketRingBlock(t *testing.T) {
+	frames := [][]byte{testIPv6Frame(t, 10), testIPv6Frame(t, 100), testIPv6Frame(t, 1000)}
+	discarded := testIPv6Frame(t, 20)
+	copy(discarded[6:12], []byte{0x02, 0, 0, 0, 0, 3})
+
+	block := testRingBlock(
+		testRingPacket{frame: frames[0], pkttype: unix.PACKET_HOST},
+		testRingPacket{frame: testIPv6Frame(t, 30), pkttype: unix.PACKET_OUTGOING},
+		testRingPacket{frame: frames[1], pkttype: unix.PACKET_BROADCAST},
+		testRingPacket{frame: testIPv6Frame(t, 40)[:60], length: 94},
+		testRingPacket{frame: []byte{1, 2, 3, 4}},
+		testRingPacket{frame: discarded},
+		testRingPacket{frame: frames[2], status: unix.TP_STATUS_VLAN_VALID, vlanTCI: 0x0123},
+		testRingPacket{frame: frames[0], status: unix.TP_STATUS_VLAN_VALID | unix.TP_STATUS_VLAN_TPID_VALID, vlanTCI: 0x0456, tpid: 0x88a8},
+	)
+
+	r := &PacketRing{}
+	var keys []PacketKey
+	var got [][]byte
+	r.handleBlock(block, NewEthernetDecoder(), func(key PacketKey) FlowOp {
+		keys = append(keys, key)
+		if key.SrcMAC == (MAC{0x02, 0, 0, 0, 0, 3}) {
+			return DiscardingFlowOp{}
+		}
+		return retainingFlowOp{frames: &got}
+	})
+
+	// Outgoing, truncated and undecodable packets are skipped; the
+	// VLAN tags the kernel took out are put back
+	require.Len(t, keys, 5)
+	require.Equal(t, PacketKey{SrcMAC: testSrcMAC, DstMAC: testDstMAC}, keys[0])
+	require.Equal(t, [][]byte{
+		frames[0],
+		frames[1],
+		testTaggedFrame(frames[2], defaultVlanTPID, 0x0123),
+		testTaggedFrame(frames[0], 0x88a8, 0x0456),
+	}, got)
+	require.Equal(t, uint64(1), atomic.LoadUint64(&r.truncated))
+
+	// The block is given back to the kernel, and what the
+	// consumer got doesn't change when the kernel reuses it
+	require.Equal(t, uint32(unix.TP_STATUS_KERNEL), nl.NativeEndian().Uint32(block[tpBlockStatus:]))
+	for i := range block {
+		block[i] = 0xff
+	}
+	require.Equal(t, frames[0], got[0])
+	require.Equal(t, frames[1], got[1])
+
+	// An empty block, as when the block timeout expires
+	block = testRingBlock()
+	r.handleBlock(block, NewEthernetDecoder(), func(key PacketKey) FlowOp {
+		require.FailNow(t, "consumer called for an empty block")
+		return nil
+	})
+	require.Equal(t, uint32(unix.TP_STATUS_KERNEL), nl.NativeEndian().Uint32(block[tpBlockStatus:]))
+}
+
+// The offsets of the fields we read match the kernel's structs
+func TestPacketRingOffsets(t *testing.T) {
+	var desc unix.TpacketBlockDesc
+	var bd unix.TpacketHdrV1
+	var hdr unix.Tpacket3Hdr
+	var sll unix.RawSockaddrLinklayer
+	for _, test := range []struct {
+		name           string
+		offset, kernel uintptr
+	}{
+		{"block_status", tpBlockStatus, unsafe.Offsetof(desc.Hdr) + unsafe.Offsetof(bd.Block_status)},
+		{"num_pkts", tpBlockNumPkts, unsafe.Offsetof(desc.Hdr) + unsafe.Offsetof(bd.Num_pkts)},
+		{"offset_to_first_pkt", tpBlockFirstPkt, unsafe.Offsetof(desc.Hdr) + unsafe.Offsetof(bd.Offset_to_first_pkt)},
+		{"tp_next_offset", tpPktNextOffset, unsafe.Offsetof(hdr.Next_offset)},
+		{"tp_snaplen", tpPktSnaplen, unsafe.Offsetof(hdr.Snaplen)},
+		{"tp_len", tpPktLen, unsafe.Offsetof(hdr.Len)},
+		{"tp_status", tpPktStatus, unsafe.Offsetof(hdr.Status)},
+		{"tp_mac", tpPktMac, unsafe.Offsetof(hdr.Mac)},
+		{"tp_vlan_tci", tpPktVlanTCI, unsafe.Offsetof(hdr.Hv1) + unsafe.Offsetof(hdr.Hv1.Vlan_tci)},
+		{"tp_vlan_tpid", tpPktVlanTPID, unsafe.Offsetof(hdr.Hv1) + unsafe.Offsetof(hdr.Hv1.Vlan_tpid)},
+		{"sll_pkttype", tpPktSllPkttype, (unsafe.Sizeof(hdr)+15)&^15 + unsafe.Offsetof(sll.Pkttype)},
+	} {
+		require.Equal(t, test.kernel, test.offset, test.name)
+	}
+	require.True(t, tpacket3HdrLen+unix.SizeofSockaddrLinklayer <= testRingMac)
+}
@@ -0,0 +1,340 @@
+package router
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Certificate-based peer authentication.  Each peer presents a
+// certificate, signed by a CA which all peers trust and with its peer
+// name as the subject common name, in the mesh protocol intro, and
+// proves that it holds the corresponding private key.  Certificates
+// can be revoked with a CRL issued by the CA; the CRL file is re-read
+// when it changes, and connections to peers with revoked certificates
+// are closed.
+
+const crlCheckInterval = time.Minute
+
+type PeerCertConfig struct {
+	CertFile string // PEM certificate, optionally followed by intermediates
+	KeyFile  string
+	CAFile   string // PEM certificates of the trusted CAs
+	CRLFile  string // PEM or DER CRL; optional
+}
+
+func (config PeerCertConfig) Enabled() bool {
+	return config.CertFile != "" || config.KeyFile != "" || config.CAFile != ""
+}
+
+// CertAuthenticator implements mesh.PeerAuthenticator
+type CertAuthenticator struct {
+	sync.Mutex
+	chain      [][]byte
+	key        crypto.Signer
+	name       mesh.PeerName
+	roots      *x509.CertPool
+	cas        []*x509.Certificate
+	crlFile    string
+	crlModTime time.Time
+	revoked    map[string]struct{} // serial numbers
+	// the certificates each peer authenticated with, when there is
+	// a CRL to check them against
+	peerSerials map[mesh.PeerName]peerCertSerials
+}
+
+// The serial numbers of the certificates a peer authenticated with
+type peerCertSerials struct {
+	serials []string
+	at      time.Time
+}
+
+type peerCredentials struct {
+	Certificates [][]byte // DER, leaf first
+	Signature    []byte
+}
+
+func NewCertAuthenticator(config PeerCertConfig) (*CertAuthenticator, error) {
+	if config.CertFile == "" || config.KeyFile == "" || config.CAFile == "" {
+		return nil, fmt.Errorf("peer certificate authentication requires a certificate, key and CA")
+	}
+	keyPair, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keyPair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", keyPair.PrivateKey)
+	}
+	leaf, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	name, err := mesh.PeerNameFromString(leaf.Subject.CommonName)
+	if err != nil {
+		return nil, fmt.Errorf("certificate common name is not a peer name: %s", err)
+	}
+
+	caPEM, err := ioutil.ReadFile(config.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	auth := &CertAuthenticator{
+		chain:       keyPair.Certificate,
+		key:         key,
+		name:        name,
+		roots:       x509.NewCertPool(),
+		crlFile:     config.CRLFile,
+		revoked:     make(map[string]struct{}),
+		peerSerials: make(map[mesh.PeerName]peerCertSerials),
+	}
+	for block, rest := pem.Decode(caPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		auth.roots.AddCert(ca)
+		auth.cas = append(auth.cas, ca)
+	}
+	if len(auth.cas) == 0 {
+		return nil, fmt.Errorf("no CA certificates found in %s", config.CAFile)
+	}
+
+	if _, err := leaf.Verify(auth.verifyOptions(keyPair.Certificate[1:])); err != nil {
+		return nil, fmt.Errorf("our certificate: %s", err)
+	}
+	if _, err := auth.reloadCRL(); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// The peer name our certificate is for
+func (auth *CertAuthenticator) Name() mesh.PeerName {
+	return auth.name
+}
+
+func (auth *CertAuthenticator) verifyOptions(intermediates [][]byte) x509.VerifyOptions {
+	opts := x509.VerifyOptions{
+		Roots:         auth.roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, der := range intermediates {
+		if cert, err := x509.ParseCertificate(der); err == nil {
+			opts.Intermediates.AddCert(cert)
+		}
+	}
+	return opts
+}
+
+func (auth *CertAuthenticator) Credentials(transcript []byte) (string, error) {
+	var signature []byte
+	var err error
+	if _, ok := auth.key.Public().(ed25519.PublicKey); ok {
+		signature, err = auth.key.Sign(rand.Reader, transcript, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(transcript)
+		signature, err = auth.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+	credentials, err := json.Marshal(peerCredentials{Certificates: auth.chain, Signature: signature})
+	return string(credentials), err
+}
+
+func (auth *CertAuthenticator) Authenticate(credentials string, transcript []byte) (mesh.PeerName, error) {
+	var creds peerCredentials
+	if err := json.Unmarshal([]byte(credentials), &creds); err != nil {
+		return mesh.UnknownPeerName, err
+	}
+	if len(creds.Certificates) == 0 {
+		return mesh.UnknownPeerName, fmt.Errorf("peer presented no certificate")
+	}
+	cert, err := x509.ParseCertificate(creds.Certificates[0])
+	if err != nil {
+		return mesh.UnknownPeerName, err
+	}
+	chains, err := cert.Verify(auth.verifyOptions(creds.Certificates[1:]))
+	if err != nil {
+		return mesh.UnknownPeerName, fmt.Errorf("peer certificate %q: %s", cert.Subject.CommonName, err)
+	}
+	algorithm, err := signatureAlgorithm(cert.PublicKey)
+	if err != nil {
+		return mesh.UnknownPeerName, err
+	}
+	if err := cert.CheckSignature(algorithm, transcript, creds.Signature); err != nil {
+		return mesh.UnknownPeerName, fmt.Errorf("peer certificate %q: invalid proof of possession: %s", cert.Subject.CommonName, err)
+	}
+	name, err := mesh.PeerNameFromString(cert.Subject.CommonName)
+	if err != nil {
+		return mesh.UnknownPeerName, fmt.Errorf("peer certificate common name is not a peer name: %s", err)
+	}
+
+	auth.Lock()
+	defer auth.Unlock()
+	var serials []string
+	for _, chain := range chains {
+		for _, c := range chain {
+			serial := c.SerialNumber.String()
+			if _, found := auth.revoked[serial]; found {
+				return mesh.UnknownPeerName, fmt.Errorf("peer certificate %q: certificate with serial number %s has been revoked", cert.Subject.CommonName, serial)
+			}
+			serials = append(serials, serial)
+		}
+	}
+	if auth.crlFile != "" {
+		auth.peerSerials[name] = peerCertSerials{serials: serials, at: time.Now()}
+	}
+	return name, nil
+}
+
+func signatureAlgorithm(publicKey interface{}) (x509.SignatureAlgorithm, error) {
+	switch publicKey.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA, nil
+	case *ecdsa.PublicKey:
+		return x509.ECDSAWithSHA256, nil
+	case ed25519.PublicKey:
+		return x509.PureEd25519, nil
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported public key type %T", publicKey)
+}
+
+// Re-read the CRL if it has changed, returning whether it had.  The
+// CRL must be signed by one of the CAs.
+func (auth *CertAuthenticator) reloadCRL() (bool, error) {
+	if auth.crlFile == "" {
+		return false, nil
+	}
+	info, err := os.Stat(auth.crlFile)
+	if err != nil {
+		return false, err
+	}
+	auth.Lock()
+	unchanged := info.ModTime().Equal(auth.crlModTime)
+	auth.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	crlBytes, err := ioutil.ReadFile(auth.crlFile)
+	if err != nil {
+		return false, err
+	}
+	crl, err := x509.ParseCRL(crlBytes)
+	if err != nil {
+		return false, err
+	}
+	signed := false
+	for _, ca := range auth.cas {
+		if ca.CheckCRLSignature(crl) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return false, fmt.Errorf("CRL %s is not signed by any of our CAs", auth.crlFile)
+	}
+	revoked := make(map[string]struct{}, len(crl.TBSCertList.RevokedCertificates))
+	for _, rc := range crl.TBSCertList.RevokedCertificates {
+		revoked[rc.SerialNumber.String()] = struct{}{}
+	}
+
+	auth.Lock()
+	defer auth.Unlock()
+	auth.crlModTime = info.ModTime()
+	auth.revoked = revoked
+	return true, nil
+}
+
+// The peers whose certificates we are keeping
+func (auth *CertAuthenticator) authenticatedPeers() []mesh.PeerName {
+	auth.Lock()
+	defer auth.Unlock()
+	peers := make([]mesh.PeerName, 0, len(auth.peerSerials))
+	for name := range auth.peerSerials {
+		peers = append(peers, name)
+	}
+	return peers
+}
+
+// Forget the certificates of the peers which are not connected, other
+// than those which authenticated after the given time, whose
+// connections may not have been added yet.
+func (auth *CertAuthenticator) forgetPeers(connected map[mesh.PeerName]bool, after time.Time) {
+	auth.Lock()
+	defer auth.Unlock()
+	for name, ps := range auth.peerSerials {
+		if !connected[name] && ps.at.Before(after) {
+			delete(auth.peerSerials, name)
+		}
+	}
+}
+
+// The peers which authenticated with certificates that have since
+// been revoked
+func (auth *CertAuthenticator) revokedPeers() []mesh.PeerName {
+	auth.Lock()
+	defer auth.Unlock()
+	var peers []mesh.PeerName
+	for name, ps := range auth.peerSerials {
+		for _, serial := range ps.serials {
+			if _, found := auth.revoked[serial]; found {
+				peers = append(peers, name)
+				break
+			}
+		}
+	}
+	return peers
+}
+
+// Periodically re-read the CRL, and close the connections to peers
+// whose certificates it revokes.
+func (router *NetworkRouter) WatchRevocations(auth *CertAuthenticator) {
+	if auth.crlFile == "" {
+		return
+	}
+	go func() {
+		for now := range time.Tick(crlCheckInterval) {
+			connected := make(map[mesh.PeerName]bool)
+			for _, conn := range router.Ourself.ConnectionsTo(auth.authenticatedPeers()) {
+				connected[conn.Remote().Name] = true
+			}
+			auth.forgetPeers(connected, now.Add(-crlCheckInterval))
+
+			changed, err := auth.reloadCRL()
+			if err != nil {
+				log.Warningln("Unable to reload CRL:", err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+			log.Infoln("Reloaded CRL", auth.crlFile)
+			for _, conn := range router.Ourself.ConnectionsTo(auth.revokedPeers()) {
+				if lc, ok := conn.(*mesh.LocalConnection); ok {
+					lc.Shutdown(fmt.Errorf("peer certificate has been revoked"))
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,199 @@
+package router
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+// Issue a certificate for the given common name, returning it with
+// its key
+func (ca *testCA) issue(t *testing.T, commonName string) ([]byte, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return der, key
+}
+
+func writeTestPEM(t *testing.T, filename, blockType string, der []byte) {
+	require.NoError(t, ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+}
+
+// Write a CRL revoking the given certificates
+func (ca *testCA) writeCRL(t *testing.T, filename string, revoked ...[]byte) {
+	var entries []pkix.RevokedCertificate
+	for _, der := range revoked {
+		cert, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		entries = append(entries, pkix.RevokedCertificate{SerialNumber: cert.SerialNumber, RevocationTime: time.Now()})
+	}
+	crl, err := ca.cert.CreateCRL(rand.Reader, ca.key, entries, time.Now(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	writeTestPEM(t, filename, "X509 CRL", crl)
+	// Make sure the change is noticed, however coarse the mtime
+	modTime := time.Now().Add(time.Duration(len(revoked)) * time.Second)
+	require.NoError(t, os.Chtimes(filename, modTime, modTime))
+}
+
+// An authenticator for a peer with a certificate issued by ca
+func testCertAuthenticator(t *testing.T, dir string, ca *testCA, name mesh.PeerName, crlFile string) (*CertAuthenticator, []byte) {
+	der, key := ca.issue(t, name.String())
+	config := PeerCertConfig{
+		CertFile: filepath.Join(dir, name.String()+".pem"),
+		KeyFile:  filepath.Join(dir, name.String()+"-key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CRLFile:  crlFile,
+	}
+	writeTestPEM(t, config.CertFile, "CERTIFICATE", der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	writeTestPEM(t, config.KeyFile, "EC PRIVATE KEY", keyDER)
+	auth, err := NewCertAuthenticator(config)
+	require.NoError(t, err)
+	require.Equal(t, name, auth.Name())
+	return auth, der
+}
+
+// Credentials for any certificate, signing the transcript with key
+func testCredentials(t *testing.T, der []byte, key crypto.Signer, transcript []byte) string {
+	auth := &CertAuthenticator{chain: [][]byte{der}, key: key}
+	credentials, err := auth.Credentials(transcript)
+	require.NoError(t, err)
+	return credentials
+}
+
+func TestCertAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peer-certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "weave CA")
+	writeTestPEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.cert.Raw)
+	crlFile := filepath.Join(dir, "crl.pem")
+	ca.writeCRL(t, crlFile)
+
+	nameA, _ := mesh.PeerNameFromString("00:00:00:00:00:0a")
+	nameB, _ := mesh.PeerNameFromString("00:00:00:00:00:0b")
+	authA, _ := testCertAuthenticator(t, dir, ca, nameA, crlFile)
+	authB, derB := testCertAuthenticator(t, dir, ca, nameB, crlFile)
+	transcript := []byte("transcript")
+
+	credentials, err := authB.Credentials(transcript)
+	require.NoError(t, err)
+	name, err := authA.Authenticate(credentials, transcript)
+	require.NoError(t, err)
+	require.Equal(t, nameB, name)
+
+	// A certificate from another CA
+	otherCA := newTestCA(t, "other CA")
+	der, key := otherCA.issue(t, nameB.String())
+	_, err = authA.Authenticate(testCredentials(t, der, key, transcript), transcript)
+	require.Error(t, err)
+
+	// A common name which isn't a peer name
+	der, key = ca.issue(t, "host1")
+	_, err = authA.Authenticate(testCredentials(t, der, key, transcript), transcript)
+	require.Error(t, err)
+
+	// A signature of another transcript, or by another key
+	_, err = authA.Authenticate(credentials, []byte("another transcript"))
+	require.Error(t, err)
+	_, otherKey := ca.issue(t, nameB.String())
+	_, err = authA.Authenticate(testCredentials(t, derB, otherKey, transcript), transcript)
+	require.Error(t, err)
+
+	// No certificate, or not even credentials
+	_, err = authA.Authenticate(`{"Certificates":[]}`, transcript)
+	require.Error(t, err)
+	_, err = authA.Authenticate("not json", transcript)
+	require.Error(t, err)
+
+	// Revoking B's certificate picks out the peer, and stops it
+	// authenticating again
+	require.Empty(t, authA.revokedPeers())
+	ca.writeCRL(t, crlFile, derB)
+	changed, err := authA.reloadCRL()
+	require.NoError(t, err)
+	require.True(t, changed)
+	changed, err = authA.reloadCRL()
+	require.NoError(t, err)
+	require.False(t, changed)
+	require.Equal(t, []mesh.PeerName{nameB}, authA.revokedPeers())
+	_, err = authA.Authenticate(credentials, transcript)
+	require.Error(t, err)
+
+	// A CRL signed by another CA is refused
+	otherCA.writeCRL(t, crlFile, derB, derB)
+	_, err = authA.reloadCRL()
+	require.Error(t, err)
+}
+
+func TestCertAuthenticatorForgetPeers(t *testing.T) {
+	nameA, _ := mesh.PeerNameFromString("00:00:00:00:00:0a")
+	nameB, _ := mesh.PeerNameFromString("00:00:00:00:00:0b")
+	nameC, _ := mesh.PeerNameFromString("00:00:00:00:00:0c")
+	now := time.Now()
+	auth := &CertAuthenticator{
+		revoked: map[string]struct{}{"2": {}},
+		peerSerials: map[mesh.PeerName]peerCertSerials{
+			nameA: {serials: []string{"2", "1"}, at: now.Add(-time.Hour)},
+			nameB: {serials: []string{"3", "1"}, at: now.Add(-time.Hour)},
+			nameC: {serials: []string{"4", "1"}, at: now},
+		},
+	}
+	require.ElementsMatch(t, []mesh.PeerName{nameA, nameB, nameC}, auth.authenticatedPeers())
+	require.Equal(t, []mesh.PeerName{nameA}, auth.revokedPeers())
+
+	// Only connected peers, and those which have only just
+	// authenticated, are kept
+	auth.forgetPeers(map[mesh.PeerName]bool{nameB: true}, now.Add(-time.Minute))
+	require.ElementsMatch(t, []mesh.PeerName{nameB, nameC}, auth.authenticatedPeers())
+	require.Empty(t, auth.revokedPeers())
+}
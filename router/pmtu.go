@@ -0,0 +1,73 @@
+package router
+
+import (
+	"time"
+)
+
+// The smallest path MTU searched for.  A path which does not carry
+// frames of this size is treated as broken.
+const pmtuFloor = 552
+
+// A binary search for the path MTU of a connection, shared by the
+// overlays which probe for it.  The overlay sends probe frames of the
+// candidate size, which the remote peer acknowledges, and reports
+// whether each candidate got through.  The ceiling is probed first,
+// as it usually does get through; if it does not, the floor is probed
+// before the search narrows down between the two, so that a path
+// which does not even carry the floor is noticed rather than assumed
+// to carry it.
+type pmtuSearch struct {
+	floor       int
+	highestGood int // 0 until some size has got through
+	lowestBad   int
+	candidate   int // the size being probed; 0 when not searching
+	probesSent  uint
+}
+
+// Start a search for a path MTU between floor and ceiling.
+func (s *pmtuSearch) start(floor, ceiling int) {
+	*s = pmtuSearch{floor: floor, lowestBad: ceiling + 1, candidate: ceiling}
+}
+
+func (s *pmtuSearch) searching() bool {
+	return s.candidate != 0
+}
+
+// The timeout for the next probe of the candidate.
+func (s *pmtuSearch) probeTimeout() time.Duration {
+	timeout := MTUVerifyTimeout << s.probesSent
+	s.probesSent++
+	return timeout
+}
+
+// Whether the candidate should be probed again, rather than taken to
+// have failed.
+func (s *pmtuSearch) retry() bool {
+	return s.probesSent < MTUVerifyAttempts
+}
+
+// Record whether the candidate got through, and move on to the next
+// one, if there is one to probe.
+func (s *pmtuSearch) update(ok bool) {
+	if ok {
+		s.highestGood = s.candidate
+	} else {
+		s.lowestBad = s.candidate
+	}
+	s.probesSent = 0
+
+	switch {
+	case s.highestGood == 0 && s.floor < s.lowestBad && s.candidate != s.floor:
+		s.candidate = s.floor
+	case s.highestGood != 0 && s.highestGood+1 < s.lowestBad:
+		s.candidate = (s.highestGood + s.lowestBad) / 2
+	default:
+		s.candidate = 0
+	}
+}
+
+// The path MTU found by a finished search, or 0 if nothing got
+// through.
+func (s *pmtuSearch) result() int {
+	return s.highestGood
+}
@@ -0,0 +1,102 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Run a search over a path which carries frames up to pathMTU,
+// returning the result and the candidates probed
+func runPMTUSearch(floor, ceiling, pathMTU int) (int, []int) {
+	var s pmtuSearch
+	var probed []int
+	for s.start(floor, ceiling); s.searching(); {
+		probed = append(probed, s.candidate)
+		if s.candidate > pathMTU {
+			// every probe goes unanswered
+			for s.retry() {
+				s.probeTimeout()
+			}
+			s.update(false)
+		} else {
+			s.probeTimeout()
+			s.update(true)
+		}
+	}
+	return s.result(), probed
+}
+
+func TestPMTUSearch(t *testing.T) {
+	for _, tc := range []struct {
+		name                    string
+		floor, ceiling, pathMTU int
+		result                  int
+		probed                  []int
+	}{
+		{
+			name:  "the ceiling gets through",
+			floor: 552, ceiling: 1376, pathMTU: 1500,
+			result: 1376,
+			probed: []int{1376},
+		},
+		{
+			name:  "the floor is probed before searching",
+			floor: 552, ceiling: 1376, pathMTU: 1000,
+			result: 1000,
+			probed: []int{1376, 552, 964, 1170, 1067, 1015, 989, 1002, 995, 998, 1000, 1001},
+		},
+		{
+			name:  "just below the ceiling",
+			floor: 552, ceiling: 1376, pathMTU: 1375,
+			result: 1375,
+			probed: []int{1376, 552, 964, 1170, 1273, 1324, 1350, 1363, 1369, 1372, 1374, 1375},
+		},
+		{
+			name:  "only the floor gets through",
+			floor: 552, ceiling: 554, pathMTU: 552,
+			result: 552,
+			probed: []int{554, 552, 553},
+		},
+		{
+			name:  "not even the floor gets through",
+			floor: 552, ceiling: 1376, pathMTU: 500,
+			result: 0,
+			probed: []int{1376, 552},
+		},
+		{
+			name:  "a ceiling below the floor",
+			floor: 552, ceiling: 500, pathMTU: 1500,
+			result: 500,
+			probed: []int{500},
+		},
+		{
+			name:  "a ceiling below the floor which does not get through",
+			floor: 552, ceiling: 500, pathMTU: 400,
+			result: 0,
+			probed: []int{500},
+		},
+	} {
+		result, probed := runPMTUSearch(tc.floor, tc.ceiling, tc.pathMTU)
+		require.Equal(t, tc.result, result, tc.name)
+		require.Equal(t, tc.probed, probed, tc.name)
+	}
+}
+
+func TestPMTUSearchProbes(t *testing.T) {
+	var s pmtuSearch
+	s.start(552, 1376)
+
+	// Each probe of a candidate waits twice as long as the last
+	for i := uint(0); i < MTUVerifyAttempts; i++ {
+		require.True(t, s.retry())
+		require.Equal(t, MTUVerifyTimeout<<i, s.probeTimeout())
+	}
+	require.False(t, s.retry())
+
+	// And the next candidate starts again
+	s.update(false)
+	require.Equal(t, 552, s.candidate)
+	require.True(t, s.retry())
+	require.Equal(t, MTUVerifyTimeout, s.probeTimeout())
+}
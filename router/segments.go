@@ -0,0 +1,181 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Segments split one weave network into isolated layer 2 segments,
+// so that the containers of different tenants cannot exchange frames,
+// not even broadcasts.  A container is in the segment of the most
+// specific rule whose CIDR contains its addresses, or the default
+// segment 0 if none does.  The rules must be the same on all peers.
+//
+// Each segment is a VLAN on the weave bridge, with the segment as its
+// VLAN ID; the default segment is the bridge's default VLAN 1.  A
+// container's port is put into the VLAN of its segment when it is
+// attached, so the bridge keeps containers in different segments on
+// the same host apart, and tags the frames they send to the router
+// with their segment.  The tag travels inside the frame over every
+// overlay, and the bridge at the other end only delivers the frame to
+// containers in its segment.  The router just keys the MAC cache by
+// segment, so that a MAC is found in the segment it was learnt in.
+
+const (
+	MaxSegment = 4094 // the largest VLAN ID; 4095 is reserved
+
+	// VLAN 1 is the bridge's default, which carries the default
+	// segment untagged
+	minSegment = 2
+
+	segmentTPID    = 0x8100 // 802.1Q
+	segmentTagSize = 4
+)
+
+type Segment uint16
+
+type SegmentRule struct {
+	Subnet  *net.IPNet
+	Segment Segment
+}
+
+// ParseSegmentRule parses a rule of the form <CIDR>=<segment>
+func ParseSegmentRule(s string) (SegmentRule, error) {
+	var rule SegmentRule
+	eq := strings.LastIndex(s, "=")
+	if eq < 0 {
+		return rule, fmt.Errorf("invalid segment rule %q: expected <CIDR>=<segment>", s)
+	}
+	_, subnet, err := net.ParseCIDR(s[:eq])
+	if err != nil {
+		return rule, fmt.Errorf("invalid CIDR in segment rule %q: %s", s, err)
+	}
+	id, err := strconv.ParseUint(s[eq+1:], 10, 16)
+	if err != nil || id < minSegment || id > MaxSegment {
+		return rule, fmt.Errorf("invalid segment in segment rule %q: must be from %d to %d", s, minSegment, MaxSegment)
+	}
+	rule.Subnet = subnet
+	rule.Segment = Segment(id)
+	return rule, nil
+}
+
+func (rule SegmentRule) String() string {
+	return fmt.Sprintf("%s=%d", rule.Subnet, rule.Segment)
+}
+
+type Segments struct {
+	rules []SegmentRule // most specific first
+}
+
+type SegmentsStatus struct {
+	Rules []string
+}
+
+// NewSegments orders the rules so that the most specific one
+// containing an address decides its segment.
+func NewSegments(rules []SegmentRule) *Segments {
+	seg := &Segments{rules: append([]SegmentRule(nil), rules...)}
+	sort.SliceStable(seg.rules, func(i, j int) bool {
+		a, _ := seg.rules[i].Subnet.Mask.Size()
+		b, _ := seg.rules[j].Subnet.Mask.Size()
+		return a > b
+	})
+	return seg
+}
+
+// The segments which have VLANs on the bridge
+func (seg *Segments) VLANs() []uint16 {
+	var vlans []uint16
+	seen := make(map[Segment]bool)
+	for _, rule := range seg.rules {
+		if !seen[rule.Segment] {
+			seen[rule.Segment] = true
+			vlans = append(vlans, uint16(rule.Segment))
+		}
+	}
+	return vlans
+}
+
+func (seg *Segments) segmentOf(ip net.IP) Segment {
+	for _, rule := range seg.rules {
+		if rule.Subnet.Contains(ip) {
+			return rule.Segment
+		}
+	}
+	return 0
+}
+
+// EnableSegments puts containers into the segments given by the
+// rules when they are attached.  It must be called before the router
+// is started.
+func (router *NetworkRouter) EnableSegments(segments *Segments) {
+	router.segments = segments
+}
+
+// The segment of an address, which is always the default segment
+// unless segments are enabled
+func (router *NetworkRouter) segmentOf(ip net.IP) Segment {
+	if router.segments == nil {
+		return 0
+	}
+	return router.segments.segmentOf(ip)
+}
+
+// SegmentOf finds the segment of a container with the given
+// addresses, which must all be in the same one.
+func (router *NetworkRouter) SegmentOf(ips []net.IP) (Segment, error) {
+	if len(ips) == 0 {
+		return 0, nil
+	}
+	segment := router.segmentOf(ips[0])
+	for _, ip := range ips[1:] {
+		if other := router.segmentOf(ip); other != segment {
+			return 0, fmt.Errorf("%s is in segment %d, but %s is in segment %d", ips[0], segment, ip, other)
+		}
+	}
+	return segment, nil
+}
+
+// Addresses to find the segment of may be given with a prefix
+// length, as they are to attach
+func parseSegmentAddrs(addrs []string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, addr := range addrs {
+		ip, _, err := net.ParseCIDR(addr)
+		if err != nil {
+			if ip = net.ParseIP(addr); ip == nil {
+				return nil, fmt.Errorf("invalid address %q", addr)
+			}
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// Push an 802.1Q tag carrying the segment onto a frame
+func pushSegmentTag(frame []byte, segment Segment) []byte {
+	tagged := make([]byte, len(frame)+segmentTagSize)
+	copy(tagged, frame[:12])
+	binary.BigEndian.PutUint16(tagged[12:], segmentTPID)
+	binary.BigEndian.PutUint16(tagged[14:], uint16(segment))
+	copy(tagged[12+segmentTagSize:], frame[12:])
+	return tagged
+}
+
+// Segments describes the segment rules, or returns nil if segments
+// are not enabled.
+func (router *NetworkRouter) Segments() *SegmentsStatus {
+	seg := router.segments
+	if seg == nil {
+		return nil
+	}
+	status := &SegmentsStatus{}
+	for _, rule := range seg.rules {
+		status.Rules = append(status.Rules, rule.String())
+	}
+	return status
+}
@@ -0,0 +1,227 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/go-odp/odp"
+)
+
+func TestParseSegmentRule(t *testing.T) {
+	for _, tc := range []struct {
+		rule    string
+		subnet  string
+		segment Segment
+		ok      bool
+	}{
+		{rule: "10.2.2.0/24=5", subnet: "10.2.2.0/24", segment: 5, ok: true},
+		{rule: "10.2.2.7/24=5", subnet: "10.2.2.0/24", segment: 5, ok: true},
+		{rule: "10.2.2.7/32=2", subnet: "10.2.2.7/32", segment: 2, ok: true},
+		{rule: "fd00:2::/64=4094", subnet: "fd00:2::/64", segment: MaxSegment, ok: true},
+		{rule: "10.2.2.0/24"},
+		{rule: "10.2.2.0=5"},
+		{rule: "10.2.2.0/33=5"},
+		{rule: "10.2.2.0/24="},
+		{rule: "10.2.2.0/24=0"},
+		{rule: "10.2.2.0/24=1"}, // the bridge's default VLAN
+		{rule: "10.2.2.0/24=4095"},
+		{rule: "10.2.2.0/24=65541"},
+		{rule: "10.2.2.0/24=-5"},
+		{rule: "10.2.2.0/24=five"},
+	} {
+		rule, err := ParseSegmentRule(tc.rule)
+		if !tc.ok {
+			require.Error(t, err, tc.rule)
+			continue
+		}
+		require.NoError(t, err, tc.rule)
+		require.Equal(t, tc.subnet, rule.Subnet.String(), tc.rule)
+		require.Equal(t, tc.segment, rule.Segment, tc.rule)
+	}
+}
+
+func TestSegmentOf(t *testing.T) {
+	var rules []SegmentRule
+	for _, s := range []string{"10.2.0.0/16=5", "10.2.2.0/24=6", "fd00:2::/64=6", "10.3.0.0/16=5"} {
+		rule, err := ParseSegmentRule(s)
+		require.NoError(t, err)
+		rules = append(rules, rule)
+	}
+	segments := NewSegments(rules)
+	require.Equal(t, []uint16{6, 5}, segments.VLANs())
+
+	ip := net.ParseIP
+	router := &NetworkRouter{}
+	segment, err := router.SegmentOf([]net.IP{ip("10.2.2.1")})
+	require.NoError(t, err)
+	require.Equal(t, Segment(0), segment, "segments not enabled")
+
+	router.EnableSegments(segments)
+	for _, tc := range []struct {
+		ips     []net.IP
+		segment Segment
+		ok      bool
+	}{
+		{ips: nil, segment: 0, ok: true},
+		{ips: []net.IP{ip("10.1.0.1")}, segment: 0, ok: true},
+		{ips: []net.IP{ip("10.2.1.1")}, segment: 5, ok: true},
+		{ips: []net.IP{ip("10.2.2.1")}, segment: 6, ok: true}, // the most specific rule
+		{ips: []net.IP{ip("10.2.2.1"), ip("fd00:2::1")}, segment: 6, ok: true},
+		{ips: []net.IP{ip("10.2.1.1"), ip("10.3.0.1")}, segment: 5, ok: true},
+		{ips: []net.IP{ip("10.2.1.1"), ip("10.2.2.1")}},
+		{ips: []net.IP{ip("10.2.2.1"), ip("10.1.0.1")}},
+		{ips: []net.IP{ip("10.1.0.1"), ip("fd00:2::1")}},
+	} {
+		segment, err := router.SegmentOf(tc.ips)
+		if !tc.ok {
+			require.Error(t, err, "%v", tc.ips)
+			continue
+		}
+		require.NoError(t, err, "%v", tc.ips)
+		require.Equal(t, tc.segment, segment, "%v", tc.ips)
+	}
+
+	ips, err := parseSegmentAddrs([]string{"10.2.2.1/24", "fd00:2::1"})
+	require.NoError(t, err)
+	require.Equal(t, []net.IP{ip("10.2.2.1"), ip("fd00:2::1")}, ips)
+	_, err = parseSegmentAddrs([]string{"10.2.2"})
+	require.Error(t, err)
+}
+
+// The decoder sees through the tag of a frame in a segment
+func TestSegmentTag(t *testing.T) {
+	arpFrame := testBroadcastFrame(t, testSrcMAC, &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   testSrcMAC[:],
+		SourceProtAddress: []byte{10, 0, 0, 1},
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    []byte{10, 0, 0, 2},
+	})
+	ipFrame := testBroadcastFrame(t, testSrcMAC, &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    []byte{10, 0, 0, 1},
+		DstIP:    []byte{10, 255, 255, 255},
+	})
+
+	for _, tc := range []struct {
+		name      string
+		frame     []byte
+		etherType layers.EthernetType
+		ipv4      bool
+		ipv6      bool
+	}{
+		{name: "ARP", frame: arpFrame, etherType: layers.EthernetTypeARP},
+		{name: "IPv4", frame: ipFrame, etherType: layers.EthernetTypeIPv4, ipv4: true},
+		{name: "IPv6", frame: testIPv6Frame(t, 100), etherType: layers.EthernetTypeIPv6, ipv6: true},
+	} {
+		untagged := NewEthernetDecoder()
+		untagged.DecodeLayers(tc.frame)
+		require.Equal(t, Segment(0), untagged.PacketKey().Segment, tc.name)
+		require.Equal(t, 0, untagged.tagSize(), tc.name)
+
+		for _, segment := range []Segment{minSegment, 100, MaxSegment} {
+			frame := pushSegmentTag(tc.frame, segment)
+			require.Len(t, frame, len(tc.frame)+segmentTagSize, tc.name)
+			require.Equal(t, layers.EthernetTypeDot1Q, frameEthertype(frame), tc.name)
+
+			dec := NewEthernetDecoder()
+			dec.DecodeLayers(frame)
+			key := dec.PacketKey()
+			require.Equal(t, segment, key.Segment, tc.name)
+			require.Equal(t, testSrcMAC, key.SrcMAC, tc.name)
+			require.Equal(t, segmentTagSize, dec.tagSize(), tc.name)
+			require.Equal(t, tc.etherType, dec.etherType(), tc.name)
+			require.Equal(t, untagged.linkPayload(), dec.linkPayload(), tc.name)
+			require.Equal(t, tc.ipv4, dec.isIPv4(), tc.name)
+			require.Equal(t, tc.ipv6, dec.isIPv6(), tc.name)
+			require.Equal(t, tc.etherType, dec.untaggedEth().EthernetType, tc.name)
+
+			// Frames made from it get the tag back
+			require.Equal(t, frame, dec.retag(tc.frame), tc.name)
+		}
+	}
+
+	// A truncated tag is not mistaken for a segment
+	frame := pushSegmentTag(ipFrame, 5)[:14+segmentTagSize-1]
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(frame)
+	require.Equal(t, Segment(0), dec.PacketKey().Segment)
+	require.False(t, dec.hasIP())
+}
+
+// ICMP errors go back to the sender in its segment
+func TestSegmentICMPFragNeeded(t *testing.T) {
+	frame := pushSegmentTag(testIPv6Frame(t, 1400), 7)
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(frame)
+	icmp, err := dec.makeICMPFragNeeded(1280)
+	require.NoError(t, err)
+
+	reply := NewEthernetDecoder()
+	reply.DecodeLayers(icmp)
+	require.Equal(t, Segment(7), reply.PacketKey().Segment)
+	require.Equal(t, testSrcMAC, reply.PacketKey().DstMAC)
+	require.True(t, reply.isIPv6())
+	require.Equal(t, testSrcIP6, reply.IP6.DstIP)
+}
+
+// ARP suppression only learns a binding in the segment of the address
+func TestSegmentARPBindings(t *testing.T) {
+	rule, err := ParseSegmentRule("10.2.2.0/24=6")
+	require.NoError(t, err)
+	router := &NetworkRouter{}
+	router.EnableSegments(NewSegments([]SegmentRule{rule}))
+	arp := &ARPSuppression{router: router, bindings: make(map[[4]byte]MAC)}
+
+	announce := func(ip []byte, segment Segment) {
+		frame := testBroadcastFrame(t, testSrcMAC, &layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPReply,
+			SourceHwAddress:   testSrcMAC[:],
+			SourceProtAddress: ip,
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    ip,
+		})
+		if segment != 0 {
+			frame = pushSegmentTag(frame, segment)
+		}
+		dec := NewEthernetDecoder()
+		dec.DecodeLayers(frame)
+		require.False(t, arp.inspect(dec, false, dec.PacketKey().Segment))
+	}
+
+	announce([]byte{10, 2, 2, 1}, 6)
+	announce([]byte{10, 2, 2, 2}, 0)
+	announce([]byte{10, 2, 1, 1}, 0)
+	announce([]byte{10, 2, 1, 2}, 6)
+	require.Equal(t, map[[4]byte]MAC{{10, 2, 2, 1}: testSrcMAC, {10, 2, 1, 1}: testSrcMAC}, arp.bindings)
+}
+
+// Fast datapath flows for frames in a segment match its VLAN, as the
+// kernel only matches untagged frames against flows without one
+func TestSegmentODPFlowKeys(t *testing.T) {
+	for _, segment := range []Segment{0, 5} {
+		flow := odp.NewFlowSpec()
+		for _, fop := range FlattenFlowOp(odpEthernetFlowKey(PacketKey{SrcMAC: testSrcMAC, DstMAC: testDstMAC, Segment: segment})) {
+			fop.(odpFlowKeyFlowOp).updateFlowSpec(&flow)
+		}
+		vlan, tagged := flow.FlowKeys[odp.OVS_KEY_ATTR_VLAN].(odp.VlanFlowKey)
+		require.Equal(t, segment != 0, tagged)
+		require.Equal(t, PacketKey{SrcMAC: testSrcMAC, DstMAC: testDstMAC, Segment: segment}, flowKeysToPacketKey(flow.FlowKeys))
+		if tagged {
+			vid, _ := vlan.VlanID()
+			require.Equal(t, uint16(segment), vid)
+		}
+	}
+}
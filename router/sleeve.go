@@ -11,7 +11,9 @@ import (
 	"io"
 	"net"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -54,6 +56,7 @@ const (
 	FragTestInterval  = 5 * time.Minute
 	MTUVerifyAttempts = 8
 	MTUVerifyTimeout  = 10 * time.Millisecond // doubled with each attempt
+	HeartbeatEchoSize = EthernetOverhead + 17
 
 	ProtocolConnectionEstablished = mesh.ProtocolReserved1
 	ProtocolFragmentationReceived = mesh.ProtocolReserved2
@@ -74,6 +77,10 @@ type SleeveOverlay struct {
 
 	lock       sync.Mutex
 	forwarders map[mesh.PeerName]*sleeveForwarder
+
+	// Set before connections are made, if NAT traversal is
+	// enabled
+	natTraversal bool
 }
 
 func NewSleeveOverlay(host string, localPort int) NetworkOverlay {
@@ -132,8 +139,14 @@ func (*SleeveOverlay) InvalidateShortIDs() {
 	// no cached information, so nothing to do
 }
 
-func (*SleeveOverlay) AddFeaturesTo(map[string]string) {
-	// No features to be provided, to facilitate compatibility
+func (sleeve *SleeveOverlay) AddFeaturesTo(features map[string]string) {
+	// Only optional features, which older peers ignore, to
+	// facilitate compatibility
+	features[heartbeatEchoFeature] = "1"
+	features[sleeveCiphersFeature] = strings.Join(sleeveCipherPreference(), ",")
+	if sleeve.natTraversal {
+		features[natTraversalFeature] = "1"
+	}
 }
 
 func (*SleeveOverlay) Diagnostics() interface{} {
@@ -246,6 +259,7 @@ func (sleeve *SleeveOverlay) handleFrame(sender *net.UDPAddr, fwd *sleeveForward
 		return
 	}
 
+	fwd.traffic.countRx(frame)
 	sleeve.sendToConsumer(srcPeer, dstPeer, frame, dec)
 }
 
@@ -283,24 +297,38 @@ func (sleeve *SleeveOverlay) send(msg []byte, raddr *net.UDPAddr) error {
 }
 
 type sleeveCrypto struct {
-	Dec   Decryptor
-	Enc   Encryptor
-	EncDF Encryptor
+	Dec    Decryptor
+	Enc    Encryptor
+	EncDF  Encryptor
+	Cipher string // empty if not encrypted
 }
 
-func newSleeveCrypto(name []byte, sessionKey *[32]byte, outbound bool) sleeveCrypto {
-	if sessionKey == nil {
+func newSleeveCrypto(name []byte, sessionKey *[32]byte, outbound bool, suite string) (sleeveCrypto, error) {
+	switch {
+	case sessionKey == nil:
 		return sleeveCrypto{
 			Dec:   NewNonDecryptor(),
 			Enc:   NewNonEncryptor(name),
 			EncDF: NewNonEncryptor(name),
-		}
+		}, nil
+	case suite == CipherNaCl:
+		return sleeveCrypto{
+			Dec:    NewNaClDecryptor(sessionKey, outbound),
+			Enc:    NewNaClEncryptor(name, sessionKey, outbound, false),
+			EncDF:  NewNaClEncryptor(name, sessionKey, outbound, true),
+			Cipher: suite,
+		}, nil
 	}
-	return sleeveCrypto{
-		Dec:   NewNaClDecryptor(sessionKey, outbound),
-		Enc:   NewNaClEncryptor(name, sessionKey, outbound, false),
-		EncDF: NewNaClEncryptor(name, sessionKey, outbound, true),
+	aead, err := newSleeveAEAD(suite, sessionKey)
+	if err != nil {
+		return sleeveCrypto{}, err
 	}
+	return sleeveCrypto{
+		Dec:    NewAEADDecryptor(aead, outbound),
+		Enc:    NewAEADEncryptor(name, aead, outbound, false),
+		EncDF:  NewAEADEncryptor(name, aead, outbound, true),
+		Cipher: suite,
+	}, nil
 }
 
 func (crypto sleeveCrypto) Overhead() int {
@@ -314,6 +342,7 @@ type sleeveForwarder struct {
 	remotePeerBin  []byte
 	sendControlMsg func(byte, []byte) error
 	connUID        uint64
+	natTraversal   bool // the remote peer takes part in NAT traversal
 
 	// Channels to communicate with the aggregator goroutine
 	aggregatorChan   chan<- aggregatorFrame
@@ -337,6 +366,9 @@ type sleeveForwarder struct {
 	mtu       int // the mtu for this link on the overlay network
 	stackFrag bool
 
+	traffic    *trafficCounters
+	heartbeats *heartbeatMonitor
+
 	// State only used within the forwarder goroutine
 	crypto     sleeveCrypto
 	senderDF   *udpSenderDF
@@ -352,12 +384,10 @@ type sleeveForwarder struct {
 	heartbeatTimeout  *time.Timer
 	fragTestTicker    *time.Ticker
 	ackedHeartbeat    bool
+	heartbeatEcho     bool // the remote peer echoes heartbeats
 
 	mtuTestTimeout *time.Timer
-	mtuTestsSent   uint
-	mtuHighestGood int
-	mtuLowestBad   int
-	mtuCandidate   int
+	mtuSearch      pmtuSearch
 }
 
 type aggregatorFrame struct {
@@ -391,7 +421,11 @@ func (sleeve *SleeveOverlay) PrepareConnection(params mesh.OverlayConnectionPara
 		remoteAddr = makeUDPAddr(params.RemoteAddr)
 	}
 
-	crypto := newSleeveCrypto(sleeve.localPeer.NameByte, params.SessionKey, params.Outbound)
+	suite := chooseSleeveCipher(params.Outbound, sleeveCipherPreference(), params.Features[sleeveCiphersFeature])
+	crypto, err := newSleeveCrypto(sleeve.localPeer.NameByte, params.SessionKey, params.Outbound, suite)
+	if err != nil {
+		return nil, err
+	}
 
 	fwd := &sleeveForwarder{
 		sleeve:           sleeve,
@@ -399,6 +433,7 @@ func (sleeve *SleeveOverlay) PrepareConnection(params mesh.OverlayConnectionPara
 		remotePeerBin:    params.RemotePeer.NameByte,
 		sendControlMsg:   params.SendControlMessage,
 		connUID:          params.ConnUID,
+		natTraversal:     params.Features[natTraversalFeature] != "",
 		aggregatorChan:   aggChan,
 		aggregatorDFChan: aggDFChan,
 		specialChan:      specialChan,
@@ -408,6 +443,9 @@ func (sleeve *SleeveOverlay) PrepareConnection(params mesh.OverlayConnectionPara
 		establishedChan:  make(chan struct{}),
 		errorChan:        make(chan error, 1),
 		remoteAddr:       remoteAddr,
+		traffic:          &trafficCounters{},
+		heartbeats:       newHeartbeatMonitor(time.Now),
+		heartbeatEcho:    params.Features[heartbeatEchoFeature] != "",
 		mtu:              DefaultMTU,
 		crypto:           crypto,
 		maxPayload:       DefaultMTU - UDPOverhead,
@@ -475,6 +513,9 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 
 	srcName := f.key.SrcPeer.NameByte
 	dstName := f.key.DstPeer.NameByte
+	// The MTU is for IP packets, which leave room for the tag of
+	// a frame in a segment
+	tagSize := dec.tagSize()
 
 	// We could use non-blocking channel sends here, i.e. drop frames
 	// on the floor when the forwarder is busy. This would allow our
@@ -486,7 +527,11 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 	// drop will likely get re-transmitted we end up paying that cost
 	// multiple times. So it's better to drop things at the beginning
 	// of our pipeline.
-	if dec.DF() {
+	// IPv6 packets are always DF.  But a packet no bigger than the
+	// IPv6 minimum MTU must get through the overlay even if our MTU
+	// is smaller than that, so those are treated like non-DF IPv4
+	// packets below (cf. RFC 2473 section 7.1).
+	if dec.DF() && !(dec.isIPv6() && !frameTooBig(frame, IPv6MinMTU+tagSize)) {
 		if !frameTooBig(frame, mtu) {
 			fwd.aggregate(fwd.aggregatorDFChan, srcName, dstName, frame)
 			return
@@ -498,12 +543,13 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 		// non-broadcast frames can be broadcast, if the
 		// destination MAC was not in our MAC cache.
 		if broadcast {
-			log.Print(fwd.logPrefix(), "dropping too big DF broadcast frame: len ", len(frame), " (", dec.IP.SrcIP, " -> ", dec.IP.DstIP, "): MTU=", mtu)
+			srcIP, dstIP := dec.ipAddrs()
+			log.Print(fwd.logPrefix(), "dropping too big DF broadcast frame: len ", len(frame), " (", srcIP, " -> ", dstIP, "): MTU=", mtu)
 			return
 		}
 
 		// Send an ICMP back to where the frame came from
-		fragNeededPacket, err := dec.makeICMPFragNeeded(mtu)
+		fragNeededPacket, err := dec.makeICMPFragNeeded(mtu - tagSize)
 		if err != nil {
 			log.Print(fwd.logPrefix(), err)
 			return
@@ -511,13 +557,15 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 
 		dec.DecodeLayers(fragNeededPacket)
 
-		// The frag-needed packet does not have DF set, so the
-		// potential recursion here is bounded.
+		// The frag-needed packet is either an IPv4 packet
+		// without DF set, or an IPv6 packet no bigger than the
+		// IPv6 minimum MTU, so the potential recursion here is
+		// bounded.
 		fwd.sleeve.sendToConsumer(f.key.DstPeer, f.key.SrcPeer, fragNeededPacket, dec)
 		return
 	}
 
-	if stackFrag || len(dec.decoded) < 2 {
+	if stackFrag || !dec.hasIP() {
 		fwd.aggregate(fwd.aggregatorChan, srcName, dstName, frame)
 		return
 	}
@@ -532,15 +580,20 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 	// We can't trust the stack to fragment, we have IP, and we
 	// have a frame that's too big for the MTU, so we have to
 	// fragment it ourself.
-	checkWarn(fragment(dec.Eth, dec.IP, mtu,
-		func(segFrame []byte) {
-			fwd.aggregate(fwd.aggregatorDFChan, srcName, dstName, segFrame)
-		}))
+	forward := func(segFrame []byte) {
+		fwd.aggregate(fwd.aggregatorDFChan, srcName, dstName, dec.retag(segFrame))
+	}
+	if dec.isIPv6() {
+		checkWarn(fragmentIPv6(dec.untaggedEth(), dec.IP6, mtu-tagSize, forward))
+	} else {
+		checkWarn(fragment(dec.untaggedEth(), dec.IP, mtu-tagSize, forward))
+	}
 }
 
 func (fwd *sleeveForwarder) aggregate(ch chan<- aggregatorFrame, src []byte, dst []byte, frame []byte) {
 	select {
 	case ch <- aggregatorFrame{src, dst, frame}:
+		fwd.traffic.countTx(frame)
 	case <-fwd.finishedChan:
 	}
 }
@@ -597,6 +650,62 @@ func fragment(eth layers.Ethernet, ip layers.IPv4, mtu int, forward func([]byte)
 	return nil
 }
 
+// Identification values for the IPv6 fragments we generate.  These
+// only need to be unique for a given source and destination over the
+// reassembly timeout, so a global counter is more than sufficient.
+var ipv6FragmentID uint32
+
+// Fragment an IPv6 packet, by inserting a fragment extension header
+// (RFC 8200 section 4.5).  Only the IPv6 header itself is treated as
+// the unfragmentable part, so packets with hop-by-hop options are
+// refused.
+func fragmentIPv6(eth layers.Ethernet, ip layers.IPv6, mtu int, forward func([]byte)) error {
+	const headerSize = 40
+	const fragHeaderSize = 8
+	if ip.HopByHop != nil {
+		return fmt.Errorf("unable to fragment IPv6 packet with hop-by-hop options (%v -> %v)", ip.SrcIP, ip.DstIP)
+	}
+
+	maxSegmentSize := (mtu - headerSize - fragHeaderSize) &^ 7
+	if maxSegmentSize <= 0 {
+		return fmt.Errorf("MTU %d too small to fragment IPv6 packet", mtu)
+	}
+
+	opts := gopacket.SerializeOptions{
+		FixLengths:       false,
+		ComputeChecksums: true}
+	payload := ip.BaseLayer.Payload
+	id := atomic.AddUint32(&ipv6FragmentID, 1)
+	nextHeader := ip.NextHeader
+	ip.NextHeader = layers.IPProtocolIPv6Fragment
+	eth.Length = 0
+	for offset := 0; offset < len(payload); offset += maxSegmentSize {
+		end := offset + maxSegmentSize
+		more := uint16(1)
+		if end >= len(payload) {
+			end = len(payload)
+			more = 0
+		}
+
+		segment := make([]byte, fragHeaderSize+end-offset)
+		segment[0] = byte(nextHeader)
+		binary.BigEndian.PutUint16(segment[2:], uint16(offset)|more)
+		binary.BigEndian.PutUint32(segment[4:], id)
+		copy(segment[fragHeaderSize:], payload[offset:end])
+		ip.Length = uint16(len(segment))
+
+		buf := gopacket.NewSerializeBuffer()
+		segPayload := gopacket.Payload(segment)
+		err := gopacket.SerializeLayers(buf, opts, &eth, &ip, &segPayload)
+		if err != nil {
+			return err
+		}
+
+		forward(buf.Bytes())
+	}
+	return nil
+}
+
 func frameTooBig(frame []byte, mtu int) bool {
 	// We capture/forward complete ethernet frames. Therefore the
 	// frame length includes the ethernet header. However, MTUs
@@ -615,7 +724,20 @@ func (fwd *sleeveForwarder) ControlMessage(tag byte, msg []byte) {
 }
 
 func (fwd *sleeveForwarder) Attrs() map[string]interface{} {
-	return map[string]interface{}{"name": "sleeve", "mtu": fwd.mtu}
+	attrs := map[string]interface{}{"name": "sleeve", "mtu": fwd.mtu}
+	if fwd.crypto.Cipher != "" {
+		attrs["cipher"] = fwd.crypto.Cipher
+	}
+	fwd.heartbeats.addAttrs(attrs)
+	return attrs
+}
+
+func (fwd *sleeveForwarder) HeartbeatStats() map[string]HeartbeatStats {
+	return map[string]HeartbeatStats{"sleeve": fwd.heartbeats.Stats()}
+}
+
+func (fwd *sleeveForwarder) Traffic() map[string]TrafficStats {
+	return map[string]TrafficStats{"sleeve": fwd.traffic.stats()}
 }
 
 func (fwd *sleeveForwarder) Stop() {
@@ -765,6 +887,9 @@ func (fwd *sleeveForwarder) handleSpecialFrame(special specialFrame) error {
 	case EthernetOverhead + 8:
 		return fwd.handleHeartbeat(special)
 
+	case HeartbeatEchoSize:
+		return fwd.handleHeartbeatEcho(special)
+
 	case FragTestSize:
 		return fwd.handleFragTest(special.frame)
 
@@ -823,11 +948,48 @@ func (fwd *sleeveForwarder) sendHeartbeat() error {
 	// ticker because the interval is not constant.
 	fwd.heartbeatTimer = setTimer(fwd.heartbeatTimer, fwd.heartbeatInterval)
 
+	// Once the connection is established, have the heartbeats
+	// echoed if the peer is able to, so we can measure the RTT.
+	if fwd.heartbeatEcho && fwd.heartbeatInterval == SlowHeartbeat {
+		return fwd.sendSpecial(fwd.crypto.EncDF, fwd.senderDF, fwd.heartbeatEchoFrame(heartbeatEchoRequest, fwd.heartbeats.sent()))
+	}
+
 	buf := make([]byte, EthernetOverhead+8)
 	binary.BigEndian.PutUint64(buf[EthernetOverhead:], fwd.connUID)
 	return fwd.sendSpecial(fwd.crypto.EncDF, fwd.senderDF, buf)
 }
 
+// A heartbeat echo frame extends the heartbeat with the kind of echo
+// frame, and the stamp to identify the heartbeat by.
+func (fwd *sleeveForwarder) heartbeatEchoFrame(kind byte, stamp uint64) []byte {
+	buf := make([]byte, HeartbeatEchoSize)
+	binary.BigEndian.PutUint64(buf[EthernetOverhead:], fwd.connUID)
+	buf[EthernetOverhead+8] = kind
+	binary.BigEndian.PutUint64(buf[EthernetOverhead+9:], stamp)
+	return buf
+}
+
+func (fwd *sleeveForwarder) handleHeartbeatEcho(special specialFrame) error {
+	uid := binary.BigEndian.Uint64(special.frame[EthernetOverhead:])
+	if uid != fwd.connUID {
+		return nil
+	}
+
+	stamp := binary.BigEndian.Uint64(special.frame[EthernetOverhead+9:])
+	switch special.frame[EthernetOverhead+8] {
+	case heartbeatEchoRequest:
+		if err := fwd.handleHeartbeat(special); err != nil {
+			return err
+		}
+		return fwd.sendSpecial(fwd.crypto.EncDF, fwd.senderDF, fwd.heartbeatEchoFrame(heartbeatEchoReply, stamp))
+
+	case heartbeatEchoReply:
+		fwd.heartbeats.echoed(stamp)
+	}
+
+	return nil
+}
+
 func (fwd *sleeveForwarder) handleHeartbeat(special specialFrame) error {
 	uid := binary.BigEndian.Uint64(special.frame[EthernetOverhead:])
 	if uid != fwd.connUID {
@@ -921,14 +1083,11 @@ func (fwd *sleeveForwarder) handleFragTestAck() error {
 func (fwd *sleeveForwarder) processSendError(err error) error {
 	if mtbe, ok := err.(msgTooBigError); ok {
 		mtu := mtbe.underlayPMTU - fwd.overheadDF
-		if fwd.mtuCandidate != 0 && mtu >= fwd.mtuCandidate {
+		if fwd.mtuSearch.searching() && mtu >= fwd.mtuSearch.candidate {
 			return nil
 		}
 
-		fwd.mtuHighestGood = 552
-		fwd.mtuLowestBad = mtu + 1
-		fwd.mtuCandidate = mtu
-		fwd.mtuTestsSent = 0
+		fwd.mtuSearch.start(pmtuFloor, mtu)
 		fwd.maxPayload = mtbe.underlayPMTU - UDPOverhead
 		fwd.mtu = mtu
 		return fwd.sendMTUTest()
@@ -938,15 +1097,14 @@ func (fwd *sleeveForwarder) processSendError(err error) error {
 }
 
 func (fwd *sleeveForwarder) sendMTUTest() error {
-	log.Debug(fwd.logPrefix(), "sendMTUTest: mtu candidate ", fwd.mtuCandidate)
+	log.Debug(fwd.logPrefix(), "sendMTUTest: mtu candidate ", fwd.mtuSearch.candidate)
 
-	err := fwd.sendSpecial(fwd.crypto.EncDF, fwd.senderDF, make([]byte, fwd.mtuCandidate+EthernetOverhead))
+	err := fwd.sendSpecial(fwd.crypto.EncDF, fwd.senderDF, make([]byte, fwd.mtuSearch.candidate+EthernetOverhead))
 	if err != nil {
 		return err
 	}
 
-	fwd.mtuTestTimeout = setTimer(fwd.mtuTestTimeout, MTUVerifyTimeout<<fwd.mtuTestsSent)
-	fwd.mtuTestsSent++
+	fwd.mtuTestTimeout = setTimer(fwd.mtuTestTimeout, fwd.mtuSearch.probeTimeout())
 	return nil
 }
 
@@ -964,45 +1122,44 @@ func (fwd *sleeveForwarder) handleMTUTestAck(msg []byte) error {
 
 	mtu := int(binary.BigEndian.Uint16(msg))
 	log.Debug(fwd.logPrefix(), "handleMTUTestAck: for mtu candidate ", mtu)
-	if mtu != fwd.mtuCandidate {
+	if !fwd.mtuSearch.searching() || mtu != fwd.mtuSearch.candidate {
 		return nil
 	}
 
-	fwd.mtuHighestGood = mtu
+	fwd.mtuSearch.update(true)
 	return fwd.searchMTU()
 }
 
 func (fwd *sleeveForwarder) handleMTUTestFailure() error {
-	if fwd.mtuTestsSent < MTUVerifyAttempts {
+	if fwd.mtuSearch.retry() {
 		return fwd.sendMTUTest()
 	}
 
 	log.Debug(fwd.logPrefix(), "handleMTUTestFailure")
-	fwd.mtuLowestBad = fwd.mtuCandidate
+	fwd.mtuSearch.update(false)
 	return fwd.searchMTU()
 }
 
 func (fwd *sleeveForwarder) searchMTU() error {
-	log.Debug(fwd.logPrefix(), "searchMTU: ", fwd.mtuHighestGood, fwd.mtuLowestBad)
+	log.Debug(fwd.logPrefix(), "searchMTU: ", fwd.mtuSearch.highestGood, fwd.mtuSearch.lowestBad)
 
-	if fwd.mtuHighestGood+1 >= fwd.mtuLowestBad {
-		mtu := fwd.mtuHighestGood
-		log.Print(fwd.logPrefix(), "Effective MTU verified at ", mtu)
-
-		if fwd.mtuTestTimeout != nil {
-			fwd.mtuTestTimeout.Stop()
-			fwd.mtuTestTimeout = nil
-		}
+	if fwd.mtuSearch.searching() {
+		return fwd.sendMTUTest()
+	}
 
-		fwd.mtuCandidate = 0
-		fwd.maxPayload = mtu + fwd.overheadDF - UDPOverhead
-		fwd.mtu = mtu
-		return nil
+	if fwd.mtuTestTimeout != nil {
+		fwd.mtuTestTimeout.Stop()
+		fwd.mtuTestTimeout = nil
 	}
 
-	fwd.mtuCandidate = (fwd.mtuHighestGood + fwd.mtuLowestBad) / 2
-	fwd.mtuTestsSent = 0
-	return fwd.sendMTUTest()
+	mtu := fwd.mtuSearch.result()
+	if mtu == 0 {
+		return fmt.Errorf("path MTU below %d; no MTU test frames got through", pmtuFloor)
+	}
+	log.Print(fwd.logPrefix(), "Effective MTU verified at ", mtu)
+	fwd.maxPayload = mtu + fwd.overheadDF - UDPOverhead
+	fwd.mtu = mtu
+	return nil
 }
 
 type udpSenderDF struct {
@@ -0,0 +1,100 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFragmentIPv6(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		payloadLen int
+		mtu        int
+		fragments  int
+	}{
+		{name: "several fragments", payloadLen: 3000, mtu: 1280, fragments: 3},
+		{name: "a partial last fragment", payloadLen: 1300, mtu: 1280, fragments: 2},
+		{name: "an MTU which is not a multiple of 8", payloadLen: 2000, mtu: 1283, fragments: 2},
+	} {
+		frame := testIPv6Frame(t, tc.payloadLen)
+		dec := NewEthernetDecoder()
+		dec.DecodeLayers(frame)
+		require.True(t, dec.isIPv6(), tc.name)
+		original := append([]byte(nil), dec.IP6.Payload...)
+
+		var frames [][]byte
+		require.NoError(t, fragmentIPv6(dec.Eth, dec.IP6, tc.mtu, func(frame []byte) {
+			frames = append(frames, frame)
+		}), tc.name)
+		require.Len(t, frames, tc.fragments, tc.name)
+
+		var reassembled []byte
+		var id uint32
+		for i, frame := range frames {
+			require.False(t, frameTooBig(frame, tc.mtu), tc.name)
+
+			packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+			eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+			require.Equal(t, dec.Eth.SrcMAC, eth.SrcMAC, tc.name)
+			require.Equal(t, dec.Eth.DstMAC, eth.DstMAC, tc.name)
+
+			ip := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+			require.True(t, testSrcIP6.Equal(ip.SrcIP), tc.name)
+			require.True(t, testDstIP6.Equal(ip.DstIP), tc.name)
+			require.Equal(t, dec.IP6.TrafficClass, ip.TrafficClass, tc.name)
+			require.Equal(t, dec.IP6.HopLimit, ip.HopLimit, tc.name)
+			require.Equal(t, layers.IPProtocolIPv6Fragment, ip.NextHeader, tc.name)
+			require.Equal(t, int(ip.Length), len(ip.Payload), tc.name)
+
+			frag := packet.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment)
+			require.Equal(t, layers.IPProtocolUDP, frag.NextHeader, tc.name)
+			require.Equal(t, len(reassembled), int(frag.FragmentOffset)*8, tc.name)
+			if i == 0 {
+				id = frag.Identification
+			}
+			require.Equal(t, id, frag.Identification, tc.name)
+
+			last := i == len(frames)-1
+			require.Equal(t, !last, frag.MoreFragments, tc.name)
+			if !last {
+				require.Equal(t, 0, len(frag.Payload)%8, tc.name)
+			}
+			reassembled = append(reassembled, frag.Payload...)
+		}
+		require.Equal(t, original, reassembled, tc.name)
+	}
+
+	// Each packet gets its own identification
+	frame := testIPv6Frame(t, 2000)
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(frame)
+	var ids []uint32
+	for i := 0; i < 2; i++ {
+		require.NoError(t, fragmentIPv6(dec.Eth, dec.IP6, 1280, func(frame []byte) {
+			packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+			ids = append(ids, packet.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment).Identification)
+		}))
+	}
+	require.Len(t, ids, 4)
+	require.Equal(t, ids[0], ids[1])
+	require.NotEqual(t, ids[1], ids[2])
+	require.Equal(t, ids[2], ids[3])
+}
+
+func TestFragmentIPv6Refused(t *testing.T) {
+	frame := testIPv6Frame(t, 2000)
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(frame)
+	forward := func([]byte) { t.Fatal("unexpected fragment") }
+
+	// No room for any payload alongside the headers
+	require.Error(t, fragmentIPv6(dec.Eth, dec.IP6, 40+8+7, forward))
+
+	// Hop-by-hop options would have to be repeated in each fragment
+	ip := dec.IP6
+	ip.HopByHop = &layers.IPv6HopByHop{}
+	require.Error(t, fragmentIPv6(dec.Eth, ip, 1280, forward))
+}
@@ -0,0 +1,329 @@
+package router
+
+// A minimal eBPF toolkit for the tc datapath: an assembler for the
+// instructions its programs use, and wrappers for the bpf(2) commands
+// which load programs and manage hash maps.  The programs are simple
+// and generated at run time, so this avoids depending on a compiler
+// toolchain or an eBPF library.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Instruction classes, sizes, modes and operations, from linux/bpf.h
+const (
+	bpfLD    = 0x00
+	bpfLDX   = 0x01
+	bpfST    = 0x02
+	bpfSTX   = 0x03
+	bpfALU   = 0x04
+	bpfJMP   = 0x05
+	bpfALU64 = 0x07
+
+	bpfW  = 0x00
+	bpfH  = 0x08
+	bpfB  = 0x10
+	bpfDW = 0x18
+
+	bpfIMM  = 0x00
+	bpfMEM  = 0x60
+	bpfXADD = 0xc0
+
+	bpfK = 0x00
+	bpfX = 0x08
+
+	bpfADD  = 0x00
+	bpfAND  = 0x50
+	bpfMOV  = 0xb0
+	bpfEND  = 0xd0
+	bpfToBE = 0x08
+
+	bpfJEQ  = 0x10
+	bpfJNE  = 0x50
+	bpfCALL = 0x80
+	bpfEXIT = 0x90
+)
+
+// Registers
+const (
+	bpfR0 = iota
+	bpfR1
+	bpfR2
+	bpfR3
+	bpfR4
+	bpfR5
+	bpfR6
+	bpfR7
+	bpfR8
+	bpfR9
+	bpfFP // the read-only frame pointer
+)
+
+// Helper functions, from linux/bpf.h
+const (
+	bpfFuncMapLookupElem   = 1
+	bpfFuncSkbStoreBytes   = 9
+	bpfFuncCloneRedirect   = 13
+	bpfFuncSkbVlanPop      = 19
+	bpfFuncSkbGetTunnelKey = 20
+	bpfFuncSkbSetTunnelKey = 21
+	bpfFuncRedirect        = 23
+	bpfFuncSkbLoadBytes    = 26
+	bpfFuncSkbChangeHead   = 43
+)
+
+// The tc action returned by direct-action programs to drop a frame
+const tcActShot = 2
+
+type bpfInsn struct {
+	code     uint8
+	dst, src uint8
+	off      int16
+	imm      int32
+	jump     string // the label jumped to, if any
+}
+
+func bpfMov64Reg(dst, src uint8) bpfInsn {
+	return bpfInsn{code: bpfALU64 | bpfMOV | bpfX, dst: dst, src: src}
+}
+
+func bpfMov64Imm(dst uint8, imm int32) bpfInsn {
+	return bpfInsn{code: bpfALU64 | bpfMOV | bpfK, dst: dst, imm: imm}
+}
+
+func bpfAdd64Imm(dst uint8, imm int32) bpfInsn {
+	return bpfInsn{code: bpfALU64 | bpfADD | bpfK, dst: dst, imm: imm}
+}
+
+func bpfAnd64Imm(dst uint8, imm int32) bpfInsn {
+	return bpfInsn{code: bpfALU64 | bpfAND | bpfK, dst: dst, imm: imm}
+}
+
+// Convert the low 32 or 16 bits of a register to network byte order
+func bpfToBE32(dst uint8) bpfInsn {
+	return bpfInsn{code: bpfALU | bpfEND | bpfToBE, dst: dst, imm: 32}
+}
+
+func bpfToBE16(dst uint8) bpfInsn {
+	return bpfInsn{code: bpfALU | bpfEND | bpfToBE, dst: dst, imm: 16}
+}
+
+func bpfLdxMem(size uint8, dst, src uint8, off int16) bpfInsn {
+	return bpfInsn{code: bpfLDX | size | bpfMEM, dst: dst, src: src, off: off}
+}
+
+func bpfStxMem(size uint8, dst, src uint8, off int16) bpfInsn {
+	return bpfInsn{code: bpfSTX | size | bpfMEM, dst: dst, src: src, off: off}
+}
+
+func bpfStMem(size uint8, dst uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{code: bpfST | size | bpfMEM, dst: dst, off: off, imm: imm}
+}
+
+// Atomically add a register to a 64-bit word in memory
+func bpfXAdd64(dst, src uint8, off int16) bpfInsn {
+	return bpfInsn{code: bpfSTX | bpfDW | bpfXADD, dst: dst, src: src, off: off}
+}
+
+func bpfJmpImm(op uint8, dst uint8, imm int32, label string) bpfInsn {
+	return bpfInsn{code: bpfJMP | op | bpfK, dst: dst, imm: imm, jump: label}
+}
+
+func bpfCall(fn int32) bpfInsn {
+	return bpfInsn{code: bpfJMP | bpfCALL, imm: fn}
+}
+
+func bpfExit() bpfInsn {
+	return bpfInsn{code: bpfJMP | bpfEXIT}
+}
+
+// Load the file descriptor of a map, which the kernel turns into a
+// pointer to it.  This takes two instruction slots.
+func bpfLdMapFd(dst uint8, fd int) []bpfInsn {
+	return []bpfInsn{
+		{code: bpfLD | bpfDW | bpfIMM, dst: dst, src: unix.BPF_PSEUDO_MAP_FD, imm: int32(fd)},
+		{},
+	}
+}
+
+// bpfAssembler accumulates a program, resolving jumps to labels.
+type bpfAssembler struct {
+	insns  []bpfInsn
+	labels map[string]int
+}
+
+func newBPFAssembler() *bpfAssembler {
+	return &bpfAssembler{labels: make(map[string]int)}
+}
+
+func (asm *bpfAssembler) emit(insns ...bpfInsn) {
+	asm.insns = append(asm.insns, insns...)
+}
+
+// Label the next instruction
+func (asm *bpfAssembler) label(name string) {
+	asm.labels[name] = len(asm.insns)
+}
+
+func (asm *bpfAssembler) assemble() ([]byte, error) {
+	order := nl.NativeEndian()
+	code := make([]byte, 8*len(asm.insns))
+	for pc, insn := range asm.insns {
+		if insn.jump != "" {
+			target, found := asm.labels[insn.jump]
+			if !found {
+				return nil, fmt.Errorf("eBPF jump to unknown label %q", insn.jump)
+			}
+			insn.off = int16(target - pc - 1)
+		}
+		b := code[8*pc:]
+		b[0] = insn.code
+		// The register fields are bitfields, so their order
+		// follows the byte order
+		if order == binary.BigEndian {
+			b[1] = insn.dst<<4 | insn.src
+		} else {
+			b[1] = insn.src<<4 | insn.dst
+		}
+		order.PutUint16(b[2:], uint16(insn.off))
+		order.PutUint32(b[4:], uint32(insn.imm))
+	}
+	return code, nil
+}
+
+func bpfSyscall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return int(r), errno
+	}
+	return int(r), nil
+}
+
+// bpfMap is a hash map shared between the programs and userspace.
+type bpfMap struct {
+	fd        int
+	keySize   int
+	valueSize int
+}
+
+func newBPFHashMap(keySize, valueSize, maxEntries int) (*bpfMap, error) {
+	attr := struct {
+		mapType    uint32
+		keySize    uint32
+		valueSize  uint32
+		maxEntries uint32
+		mapFlags   uint32
+	}{unix.BPF_MAP_TYPE_HASH, uint32(keySize), uint32(valueSize), uint32(maxEntries), 0}
+	fd, err := bpfSyscall(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return nil, fmt.Errorf("creating eBPF map: %s", err)
+	}
+	return &bpfMap{fd: fd, keySize: keySize, valueSize: valueSize}, nil
+}
+
+type bpfMapElemAttr struct {
+	mapFd uint32
+	_     uint32
+	key   uint64
+	value uint64 // or the next key
+	flags uint64
+}
+
+func (m *bpfMap) elem(cmd int, key, value []byte, flags uint64) error {
+	attr := bpfMapElemAttr{mapFd: uint32(m.fd), key: uint64(uintptr(unsafe.Pointer(&key[0]))), flags: flags}
+	if value != nil {
+		attr.value = uint64(uintptr(unsafe.Pointer(&value[0])))
+	}
+	_, err := bpfSyscall(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+func (m *bpfMap) lookup(key []byte) ([]byte, error) {
+	value := make([]byte, m.valueSize)
+	if err := m.elem(unix.BPF_MAP_LOOKUP_ELEM, key, value, 0); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (m *bpfMap) update(key, value []byte) error {
+	return m.elem(unix.BPF_MAP_UPDATE_ELEM, key, value, unix.BPF_ANY)
+}
+
+func (m *bpfMap) delete(key []byte) error {
+	return m.elem(unix.BPF_MAP_DELETE_ELEM, key, nil, 0)
+}
+
+// Call f with each key in the map.  Entries deleted meanwhile may be
+// skipped or repeated, as the kernel makes no promises about that.
+func (m *bpfMap) iterate(f func(key []byte)) error {
+	key := make([]byte, m.keySize)
+	next := make([]byte, m.keySize)
+	// An absent key starts the iteration
+	attr := bpfMapElemAttr{mapFd: uint32(m.fd), value: uint64(uintptr(unsafe.Pointer(&next[0])))}
+	for {
+		_, err := bpfSyscall(unix.BPF_MAP_GET_NEXT_KEY, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		if err == unix.ENOENT {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		copy(key, next)
+		attr.key = uint64(uintptr(unsafe.Pointer(&key[0])))
+		f(append([]byte(nil), key...))
+	}
+}
+
+func (m *bpfMap) close() error {
+	return unix.Close(m.fd)
+}
+
+// Load a sched_cls program, returning its file descriptor.  If the
+// verifier rejects it, it is loaded again to get the verifier's log
+// for the error.
+func loadBPFProgram(code []byte) (int, error) {
+	fd, err := loadBPFProgramWithLog(code, nil)
+	if err == nil {
+		return fd, nil
+	}
+	logBuf := make([]byte, 1024*1024)
+	if _, err2 := loadBPFProgramWithLog(code, logBuf); err2 != nil {
+		if n := bytes.IndexByte(logBuf, 0); n > 0 {
+			return -1, fmt.Errorf("loading eBPF program: %s\n%s", err, strings.TrimRight(string(logBuf[:n]), "\n"))
+		}
+	}
+	return -1, fmt.Errorf("loading eBPF program: %s", err)
+}
+
+func loadBPFProgramWithLog(code []byte, logBuf []byte) (int, error) {
+	license := []byte("GPL\x00")
+	attr := struct {
+		progType    uint32
+		insnCnt     uint32
+		insns       uint64
+		license     uint64
+		logLevel    uint32
+		logSize     uint32
+		logBuf      uint64
+		kernVersion uint32
+		progFlags   uint32
+	}{
+		progType: unix.BPF_PROG_TYPE_SCHED_CLS,
+		insnCnt:  uint32(len(code) / 8),
+		insns:    uint64(uintptr(unsafe.Pointer(&code[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	if logBuf != nil {
+		attr.logLevel = 1
+		attr.logSize = uint32(len(logBuf))
+		attr.logBuf = uint64(uintptr(unsafe.Pointer(&logBuf[0])))
+	}
+	return bpfSyscall(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
@@ -0,0 +1,127 @@
+package router
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Decode an assembled instruction, for comparison
+func decodeBPFInsn(b []byte) bpfInsn {
+	order := nl.NativeEndian()
+	insn := bpfInsn{
+		code: b[0],
+		off:  int16(order.Uint16(b[2:])),
+		imm:  int32(order.Uint32(b[4:])),
+	}
+	if order == binary.BigEndian {
+		insn.dst, insn.src = b[1]>>4, b[1]&0xf
+	} else {
+		insn.dst, insn.src = b[1]&0xf, b[1]>>4
+	}
+	return insn
+}
+
+func TestBPFAssemble(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		build func(asm *bpfAssembler)
+		want  []bpfInsn
+	}{
+		{
+			name: "registers",
+			build: func(asm *bpfAssembler) {
+				asm.emit(bpfMov64Reg(bpfR6, bpfR1), bpfLdxMem(bpfW, bpfR2, bpfR6, -4))
+			},
+			want: []bpfInsn{
+				{code: bpfALU64 | bpfMOV | bpfX, dst: bpfR6, src: bpfR1},
+				{code: bpfLDX | bpfW | bpfMEM, dst: bpfR2, src: bpfR6, off: -4},
+			},
+		},
+		{
+			name: "forward jump",
+			build: func(asm *bpfAssembler) {
+				asm.emit(bpfJmpImm(bpfJEQ, bpfR0, 0, "out"), bpfMov64Imm(bpfR0, 1), bpfMov64Imm(bpfR0, 2))
+				asm.label("out")
+				asm.emit(bpfExit())
+			},
+			want: []bpfInsn{
+				{code: bpfJMP | bpfJEQ | bpfK, dst: bpfR0, off: 2},
+				{code: bpfALU64 | bpfMOV | bpfK, dst: bpfR0, imm: 1},
+				{code: bpfALU64 | bpfMOV | bpfK, dst: bpfR0, imm: 2},
+				{code: bpfJMP | bpfEXIT},
+			},
+		},
+		{
+			name: "backward jump and next instruction",
+			build: func(asm *bpfAssembler) {
+				asm.label("top")
+				asm.emit(bpfAdd64Imm(bpfR1, 1), bpfJmpImm(bpfJNE, bpfR1, 3, "next"))
+				asm.label("next")
+				asm.emit(bpfJmpImm(bpfJNE, bpfR1, 4, "top"))
+			},
+			want: []bpfInsn{
+				{code: bpfALU64 | bpfADD | bpfK, dst: bpfR1, imm: 1},
+				{code: bpfJMP | bpfJNE | bpfK, dst: bpfR1, imm: 3, off: 0},
+				{code: bpfJMP | bpfJNE | bpfK, dst: bpfR1, imm: 4, off: -3},
+			},
+		},
+		{
+			name: "masking and byte order",
+			build: func(asm *bpfAssembler) {
+				asm.emit(bpfAnd64Imm(bpfR1, 0xfff), bpfToBE16(bpfR1), bpfToBE32(bpfR2))
+			},
+			want: []bpfInsn{
+				{code: bpfALU64 | bpfAND | bpfK, dst: bpfR1, imm: 0xfff},
+				{code: bpfALU | bpfEND | bpfToBE, dst: bpfR1, imm: 16},
+				{code: bpfALU | bpfEND | bpfToBE, dst: bpfR2, imm: 32},
+			},
+		},
+	} {
+		asm := newBPFAssembler()
+		test.build(asm)
+		code, err := asm.assemble()
+		require.NoError(t, err, test.name)
+		require.Len(t, code, 8*len(test.want), test.name)
+		for i, want := range test.want {
+			require.Equal(t, want, decodeBPFInsn(code[8*i:]), "%s: instruction %d", test.name, i)
+		}
+	}
+}
+
+// The kernel's struct bpf_insn has the dst_reg bitfield first, so on
+// little-endian hosts it is the low nibble
+func TestBPFRegisterNibbles(t *testing.T) {
+	asm := newBPFAssembler()
+	asm.emit(bpfMov64Reg(bpfR6, bpfR1))
+	code, err := asm.assemble()
+	require.NoError(t, err)
+	if nl.NativeEndian() == binary.BigEndian {
+		require.Equal(t, byte(0x61), code[1])
+	} else {
+		require.Equal(t, byte(0x16), code[1])
+	}
+}
+
+func TestBPFAssembleUnknownLabel(t *testing.T) {
+	asm := newBPFAssembler()
+	asm.emit(bpfJmpImm(bpfJEQ, bpfR0, 0, "nowhere"), bpfExit())
+	_, err := asm.assemble()
+	require.Error(t, err)
+}
+
+func TestBPFLdMapFd(t *testing.T) {
+	asm := newBPFAssembler()
+	asm.emit(bpfLdMapFd(bpfR1, 42)...)
+	asm.emit(bpfExit())
+	code, err := asm.assemble()
+	require.NoError(t, err)
+	require.Len(t, code, 3*8)
+	require.Equal(t, bpfInsn{code: bpfLD | bpfDW | bpfIMM, dst: bpfR1, src: unix.BPF_PSEUDO_MAP_FD, imm: 42}, decodeBPFInsn(code))
+	// The second slot holds the upper half of the immediate
+	require.Equal(t, bpfInsn{}, decodeBPFInsn(code[8:]))
+	require.Equal(t, bpfInsn{code: bpfJMP | bpfEXIT}, decodeBPFInsn(code[16:]))
+}
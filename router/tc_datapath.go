@@ -0,0 +1,1345 @@
+package router
+
+// The tc datapath does what the fast datapath does, without Open
+// vSwitch: frames are forwarded between the weave bridge and other
+// peers by eBPF programs which tc runs on the router's veth and on a
+// flow-based VXLAN device.  The programs look frames up in a hash map
+// of flows, keyed by MACs, the VLAN of a frame in a segment, and, for
+// frames from VXLAN, the tunnel they arrived on.  A hit is handled
+// entirely in the kernel.  A miss is sent to a veth which the router
+// captures from, and handled by the router as usual; the resulting
+// FlowOp is then turned into a flow where possible, in the same way as
+// for ODP flows.
+//
+// VXLAN frames are the same as the fast datapath's, so peers using
+// either can talk to each other.  There is no encryption or path MTU
+// discovery, so encrypted connections use sleeve.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/weaveworks/mesh"
+	"golang.org/x/sys/unix"
+
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+const (
+	// The VNI in the keys of flows for frames from the bridge.
+	// Real VNIs only have 24 bits.
+	tcLocalVNI = 0xffffffff
+
+	tcMaxFlows   = 65536
+	tcMaxActions = 16
+
+	// Flow keys: the destination and source MACs, the VNI, the
+	// remote IP address the frame was tunnelled from, and the
+	// segment, padded to a multiple of 4 bytes
+	tcFlowKeySize = 24
+
+	// Flow values: packet and byte counters, the number of
+	// actions, and the actions themselves
+	tcFlowPackets   = 0
+	tcFlowBytes     = 8
+	tcFlowCount     = 16
+	tcFlowActions   = 24
+	tcFlowValueSize = tcFlowActions + tcMaxActions*tcActionSize
+
+	// Actions: the ifindex and flags for bpf_clone_redirect, and
+	// the tunnel to set first, if the remote IP is not zero
+	tcActionIfindex = 0
+	tcActionFlags   = 4
+	tcActionVNI     = 8
+	tcActionRemote  = 12
+	tcActionSize    = 16
+
+	// Frames from VXLAN which miss are given a header which says
+	// which tunnel they arrived on: zero MACs, this ethertype (for
+	// local experiments), then the VNI and remote IP.  The kernel
+	// has taken the tag of a frame in a segment out of it by then,
+	// so the header carries the segment too, and the tag is
+	// removed, rather than being put back in the wrong place by
+	// the capture.
+	tcMissEtherType  = 0x88b6
+	tcMissHeaderSize = EthernetOverhead + 10
+
+	vxlanHeaderSize = 8
+
+	// struct bpf_tunnel_key, up to tunnel_label, which older
+	// kernels lack
+	bpfTunnelKeySize = 24
+
+	// __sk_buff fields
+	skbLenOffset         = 0
+	skbProtocolOffset    = 16
+	skbVlanPresentOffset = 20
+	skbVlanTCIOffset     = 24
+)
+
+// Stack layout of the programs, as offsets from the frame pointer
+const (
+	tcStackKey        = -24
+	tcStackKeyVNI     = tcStackKey + 12
+	tcStackKeyRemote  = tcStackKey + 16
+	tcStackKeySegment = tcStackKey + 20
+	tcStackTunnel     = -48 // the tunnel key a frame arrived with
+	tcStackSetTunnel  = -72 // the tunnel key a frame is sent with
+	tcStackMiss       = -90 // the miss header after the MACs
+)
+
+type TCDatapath struct {
+	iface      *net.Interface
+	inject     InjectorConsumer // injects frames into the bridge
+	miss       InjectorConsumer // captures frames which miss the flows
+	conn       *net.UDPConn     // for sending VXLAN frames from userspace
+	vxlanPort  int
+	flows      *bpfMap
+	ifindexes  struct{ pcap, vxlan int }
+	stopTicker chan struct{}
+
+	lock             sync.Mutex
+	deleteFlowsCount uint64
+	missCount        uint64
+	consumer         Consumer
+	localPeer        *mesh.Peer
+	peers            *mesh.Peers
+	overlayConsumer  OverlayConsumer
+
+	// MACs which frames have come from, at the bridge or
+	// injected into it.  Unicast frames to other MACs might be
+	// for a MAC we don't know about yet, so get no flows.
+	macs     map[MAC]struct{}
+	seenMACs map[MAC]struct{}
+
+	forwarders     map[mesh.PeerName]*tcForwarder
+	forwardersByIP map[[4]byte]*tcForwarder
+
+	// The traffic counted by current flows, gathered for status
+	// reports
+	flowTraffic     map[*tcForwarder]TrafficStats
+	flowTrafficTime time.Time
+}
+
+// NewTCDatapath sets up the tc datapath on the devices created by
+// the tc bridge type.  Frames are injected into the bridge through
+// inject, and frames which miss the flows are captured through miss.
+func NewTCDatapath(inject, miss InjectorConsumer, port int) (*TCDatapath, error) {
+	tc := &TCDatapath{
+		iface:          inject.Interface(),
+		inject:         inject,
+		miss:           miss,
+		vxlanPort:      port + 1, // as for fast datapath
+		stopTicker:     make(chan struct{}),
+		macs:           make(map[MAC]struct{}),
+		seenMACs:       make(map[MAC]struct{}),
+		forwarders:     make(map[mesh.PeerName]*tcForwarder),
+		forwardersByIP: make(map[[4]byte]*tcForwarder),
+	}
+
+	links := make(map[string]netlink.Link)
+	for _, name := range []string{weavenet.BridgeIfName, weavenet.PcapIfName, weavenet.TCIfName, weavenet.TCVxlanIfName} {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("tc datapath: finding %s: %s", name, err)
+		}
+		links[name] = link
+	}
+	tc.ifindexes.pcap = links[weavenet.PcapIfName].Attrs().Index
+	tc.ifindexes.vxlan = links[weavenet.TCVxlanIfName].Attrs().Index
+	missIfindex := links[weavenet.TCIfName].Attrs().Index
+
+	var err error
+	if tc.flows, err = newBPFHashMap(tcFlowKeySize, tcFlowValueSize, tcMaxFlows); err != nil {
+		return nil, err
+	}
+
+	success := false
+	defer func() {
+		if !success {
+			tc.flows.close()
+		}
+	}()
+
+	// Frames leaving the bridge for the router, and frames
+	// arriving over VXLAN
+	if err := tc.attachProgram(links[weavenet.BridgeIfName], netlink.HANDLE_MIN_EGRESS, false, missIfindex); err != nil {
+		return nil, err
+	}
+	if err := tc.attachProgram(links[weavenet.TCVxlanIfName], netlink.HANDLE_MIN_INGRESS, true, missIfindex); err != nil {
+		return nil, err
+	}
+
+	if tc.conn, err = net.ListenUDP("udp4", &net.UDPAddr{}); err != nil {
+		return nil, err
+	}
+
+	success = true
+	go tc.run()
+	return tc, nil
+}
+
+func (tc *TCDatapath) attachProgram(link netlink.Link, parent uint32, fromVxlan bool, missIfindex int) error {
+	code, err := tcProgram(tc.flows, fromVxlan, missIfindex)
+	if err != nil {
+		return err
+	}
+	fd, err := loadBPFProgram(code)
+	if err != nil {
+		return err
+	}
+	// The filter holds its own reference to the program
+	defer unix.Close(fd)
+
+	// Replace the filters of a previous run
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return err
+	}
+	for _, filter := range filters {
+		if err := netlink.FilterDel(filter); err != nil {
+			return fmt.Errorf("deleting tc filter on %s: %s", link.Attrs().Name, err)
+		}
+	}
+
+	filter := &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    parent,
+			Handle:    1,
+			Priority:  1,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Fd:           fd,
+		Name:         "weave",
+		DirectAction: true,
+	}
+	if err := netlink.FilterAdd(filter); err != nil {
+		return fmt.Errorf("adding tc filter on %s: %s", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// Generate the program which forwards frames from the bridge, or
+// from VXLAN.  It looks up the frame's flow, counts it, and then
+// performs each action with bpf_clone_redirect, setting the tunnel
+// first if the action has one.  A frame without a flow is redirected
+// to the miss veth, after the miss header if it came from VXLAN.
+func tcProgram(flows *bpfMap, fromVxlan bool, missIfindex int) ([]byte, error) {
+	asm := newBPFAssembler()
+	asm.emit(
+		bpfMov64Reg(bpfR6, bpfR1),
+		bpfStMem(bpfDW, bpfFP, tcStackKey, 0),
+		bpfStMem(bpfDW, bpfFP, tcStackKey+8, 0),
+		bpfStMem(bpfDW, bpfFP, tcStackKey+16, 0),
+	)
+	if !fromVxlan {
+		// Frames from containers must not pass for missed
+		// frames from VXLAN
+		missProtocol := nl.NativeEndian().Uint16([]byte{tcMissEtherType >> 8, tcMissEtherType & 0xff})
+		asm.emit(
+			bpfLdxMem(bpfW, bpfR1, bpfR6, skbProtocolOffset),
+			bpfJmpImm(bpfJEQ, bpfR1, int32(missProtocol), "drop"),
+		)
+	}
+
+	// The flow key starts with the MACs
+	asm.emit(
+		bpfMov64Reg(bpfR1, bpfR6),
+		bpfMov64Imm(bpfR2, 0),
+		bpfMov64Reg(bpfR3, bpfFP),
+		bpfAdd64Imm(bpfR3, tcStackKey),
+		bpfMov64Imm(bpfR4, 12),
+		bpfCall(bpfFuncSkbLoadBytes),
+		bpfJmpImm(bpfJNE, bpfR0, 0, "drop"),
+	)
+	if fromVxlan {
+		asm.emit(
+			bpfMov64Reg(bpfR1, bpfR6),
+			bpfMov64Reg(bpfR2, bpfFP),
+			bpfAdd64Imm(bpfR2, tcStackTunnel),
+			bpfMov64Imm(bpfR3, bpfTunnelKeySize),
+			bpfMov64Imm(bpfR4, 0),
+			bpfCall(bpfFuncSkbGetTunnelKey),
+			bpfJmpImm(bpfJNE, bpfR0, 0, "drop"),
+			bpfLdxMem(bpfW, bpfR1, bpfFP, tcStackTunnel), // tunnel_id
+			bpfStxMem(bpfW, bpfFP, bpfR1, tcStackKeyVNI),
+			bpfLdxMem(bpfW, bpfR1, bpfFP, tcStackTunnel+4), // remote_ipv4
+			bpfStxMem(bpfW, bpfFP, bpfR1, tcStackKeyRemote),
+		)
+	} else {
+		asm.emit(bpfStMem(bpfW, bpfFP, tcStackKeyVNI, -1)) // tcLocalVNI
+	}
+	asm.emit(
+		bpfLdxMem(bpfW, bpfR1, bpfR6, skbVlanPresentOffset),
+		bpfJmpImm(bpfJEQ, bpfR1, 0, "lookup"),
+		bpfLdxMem(bpfW, bpfR1, bpfR6, skbVlanTCIOffset),
+		bpfAnd64Imm(bpfR1, 0xfff),
+		bpfStxMem(bpfH, bpfFP, bpfR1, tcStackKeySegment),
+	)
+
+	asm.label("lookup")
+	asm.emit(bpfLdMapFd(bpfR1, flows.fd)...)
+	asm.emit(
+		bpfMov64Reg(bpfR2, bpfFP),
+		bpfAdd64Imm(bpfR2, tcStackKey),
+		bpfCall(bpfFuncMapLookupElem),
+		bpfJmpImm(bpfJEQ, bpfR0, 0, "miss"),
+		bpfMov64Reg(bpfR7, bpfR0),
+		bpfMov64Imm(bpfR1, 1),
+		bpfXAdd64(bpfR7, bpfR1, tcFlowPackets),
+		bpfLdxMem(bpfW, bpfR1, bpfR6, skbLenOffset),
+		bpfXAdd64(bpfR7, bpfR1, tcFlowBytes),
+		bpfLdxMem(bpfW, bpfR8, bpfR7, tcFlowCount),
+	)
+
+	// There are no loops in eBPF, so the actions are unrolled
+	for i := 0; i < tcMaxActions; i++ {
+		action := int16(tcFlowActions + i*tcActionSize)
+		redirect := fmt.Sprint("redirect", i)
+		next := fmt.Sprint("action", i+1)
+		asm.emit(
+			bpfJmpImm(bpfJEQ, bpfR8, int32(i), "drop"),
+			bpfLdxMem(bpfW, bpfR1, bpfR7, action+tcActionRemote),
+			bpfJmpImm(bpfJEQ, bpfR1, 0, redirect),
+			bpfStMem(bpfDW, bpfFP, tcStackSetTunnel, 0),
+			bpfStMem(bpfDW, bpfFP, tcStackSetTunnel+8, 0),
+			bpfStMem(bpfDW, bpfFP, tcStackSetTunnel+16, 0),
+			bpfStxMem(bpfW, bpfFP, bpfR1, tcStackSetTunnel+4),
+			bpfLdxMem(bpfW, bpfR1, bpfR7, action+tcActionVNI),
+			bpfStxMem(bpfW, bpfFP, bpfR1, tcStackSetTunnel),
+			bpfStMem(bpfB, bpfFP, tcStackSetTunnel+21, 64), // tunnel_ttl
+			bpfMov64Reg(bpfR1, bpfR6),
+			bpfMov64Reg(bpfR2, bpfFP),
+			bpfAdd64Imm(bpfR2, tcStackSetTunnel),
+			bpfMov64Imm(bpfR3, bpfTunnelKeySize),
+			bpfMov64Imm(bpfR4, 0),
+			bpfCall(bpfFuncSkbSetTunnelKey),
+			bpfJmpImm(bpfJNE, bpfR0, 0, next),
+		)
+		asm.label(redirect)
+		asm.emit(
+			bpfMov64Reg(bpfR1, bpfR6),
+			bpfLdxMem(bpfW, bpfR2, bpfR7, action+tcActionIfindex),
+			bpfLdxMem(bpfW, bpfR3, bpfR7, action+tcActionFlags),
+			bpfCall(bpfFuncCloneRedirect),
+		)
+		asm.label(next)
+	}
+
+	// The actions sent clones, so the frame itself is done with
+	asm.label("drop")
+	asm.emit(
+		bpfMov64Imm(bpfR0, tcActShot),
+		bpfExit(),
+	)
+
+	asm.label("miss")
+	if fromVxlan {
+		asm.emit(
+			bpfStMem(bpfH, bpfFP, tcStackMiss+10, 0),
+			bpfLdxMem(bpfW, bpfR1, bpfR6, skbVlanPresentOffset),
+			bpfJmpImm(bpfJEQ, bpfR1, 0, "untagged"),
+			bpfLdxMem(bpfW, bpfR1, bpfR6, skbVlanTCIOffset),
+			bpfAnd64Imm(bpfR1, 0xfff),
+			bpfToBE16(bpfR1),
+			bpfStxMem(bpfH, bpfFP, bpfR1, tcStackMiss+10),
+			bpfMov64Reg(bpfR1, bpfR6),
+			bpfCall(bpfFuncSkbVlanPop),
+			bpfJmpImm(bpfJNE, bpfR0, 0, "drop"),
+		)
+		asm.label("untagged")
+		asm.emit(
+			bpfMov64Reg(bpfR1, bpfR6),
+			bpfMov64Imm(bpfR2, tcMissHeaderSize),
+			bpfMov64Imm(bpfR3, 0),
+			bpfCall(bpfFuncSkbChangeHead),
+			bpfJmpImm(bpfJNE, bpfR0, 0, "drop"),
+			bpfStMem(bpfB, bpfFP, tcStackMiss, tcMissEtherType>>8),
+			bpfStMem(bpfB, bpfFP, tcStackMiss+1, tcMissEtherType&0xff),
+			bpfLdxMem(bpfW, bpfR1, bpfFP, tcStackTunnel),
+			bpfToBE32(bpfR1),
+			bpfStxMem(bpfW, bpfFP, bpfR1, tcStackMiss+2),
+			bpfLdxMem(bpfW, bpfR1, bpfFP, tcStackTunnel+4),
+			bpfToBE32(bpfR1),
+			bpfStxMem(bpfW, bpfFP, bpfR1, tcStackMiss+6),
+			bpfMov64Reg(bpfR1, bpfR6),
+			bpfMov64Imm(bpfR2, 12),
+			bpfMov64Reg(bpfR3, bpfFP),
+			bpfAdd64Imm(bpfR3, tcStackMiss),
+			bpfMov64Imm(bpfR4, tcMissHeaderSize-12),
+			bpfMov64Imm(bpfR5, 0),
+			bpfCall(bpfFuncSkbStoreBytes),
+			bpfJmpImm(bpfJNE, bpfR0, 0, "drop"),
+		)
+	}
+	asm.emit(
+		bpfMov64Imm(bpfR1, int32(missIfindex)),
+		bpfMov64Imm(bpfR2, 0),
+		bpfCall(bpfFuncRedirect),
+		bpfExit(),
+	)
+	return asm.assemble()
+}
+
+type tcFlowKey struct {
+	dstMAC  MAC
+	srcMAC  MAC
+	vni     uint32
+	remote  [4]byte // zero for frames from the bridge
+	segment Segment
+}
+
+// Flow keys and values are in host byte order, as the programs see
+// them; the remote IP is too, as in struct bpf_tunnel_key.
+func (key tcFlowKey) bytes() []byte {
+	order := nl.NativeEndian()
+	b := make([]byte, tcFlowKeySize)
+	copy(b, key.dstMAC[:])
+	copy(b[6:], key.srcMAC[:])
+	order.PutUint32(b[12:], key.vni)
+	order.PutUint32(b[16:], binary.BigEndian.Uint32(key.remote[:]))
+	order.PutUint16(b[20:], uint16(key.segment))
+	return b
+}
+
+func parseTCFlowKey(b []byte) (key tcFlowKey) {
+	order := nl.NativeEndian()
+	copy(key.dstMAC[:], b)
+	copy(key.srcMAC[:], b[6:])
+	key.vni = order.Uint32(b[12:])
+	binary.BigEndian.PutUint32(key.remote[:], order.Uint32(b[16:]))
+	key.segment = Segment(order.Uint16(b[20:]))
+	return
+}
+
+func (key tcFlowKey) fromBridge() bool {
+	return key.vni == tcLocalVNI
+}
+
+func (key tcFlowKey) String() string {
+	s := fmt.Sprintf("%s->%s", key.srcMAC, key.dstMAC)
+	if key.segment != 0 {
+		s += fmt.Sprintf(" segment %d", key.segment)
+	}
+	if key.fromBridge() {
+		return s
+	}
+	return fmt.Sprintf("%s vni %d from %s", s, key.vni, net.IP(key.remote[:]))
+}
+
+type tcAction struct {
+	ifindex int
+	vni     uint32
+	remote  [4]byte // zero for delivery to the bridge
+}
+
+func (action tcAction) String() string {
+	if action.remote == ([4]byte{}) {
+		return fmt.Sprintf("redirect %d", action.ifindex)
+	}
+	return fmt.Sprintf("tunnel vni %d to %s", action.vni, net.IP(action.remote[:]))
+}
+
+type tcFlow struct {
+	packets uint64
+	bytes   uint64
+	actions []tcAction
+}
+
+func (flow *tcFlow) bytesValue() []byte {
+	order := nl.NativeEndian()
+	b := make([]byte, tcFlowValueSize)
+	order.PutUint64(b[tcFlowPackets:], flow.packets)
+	order.PutUint64(b[tcFlowBytes:], flow.bytes)
+	order.PutUint32(b[tcFlowCount:], uint32(len(flow.actions)))
+	for i, action := range flow.actions {
+		a := b[tcFlowActions+i*tcActionSize:]
+		order.PutUint32(a[tcActionIfindex:], uint32(action.ifindex))
+		order.PutUint32(a[tcActionVNI:], action.vni)
+		order.PutUint32(a[tcActionRemote:], binary.BigEndian.Uint32(action.remote[:]))
+	}
+	return b
+}
+
+func parseTCFlow(b []byte) *tcFlow {
+	order := nl.NativeEndian()
+	flow := &tcFlow{
+		packets: order.Uint64(b[tcFlowPackets:]),
+		bytes:   order.Uint64(b[tcFlowBytes:]),
+	}
+	count := int(order.Uint32(b[tcFlowCount:]))
+	for i := 0; i < count && i < tcMaxActions; i++ {
+		a := b[tcFlowActions+i*tcActionSize:]
+		action := tcAction{
+			ifindex: int(order.Uint32(a[tcActionIfindex:])),
+			vni:     order.Uint32(a[tcActionVNI:]),
+		}
+		binary.BigEndian.PutUint32(action.remote[:], order.Uint32(a[tcActionRemote:]))
+		flow.actions = append(flow.actions, action)
+	}
+	return flow
+}
+
+func (tc *TCDatapath) Close() error {
+	close(tc.stopTicker)
+	tc.conn.Close()
+	return tc.flows.close()
+}
+
+// Injector/consumer bits
+
+type tcDatapathInjectorConsumer struct {
+	*TCDatapath
+}
+
+func (tc *TCDatapath) InjectorConsumer() InjectorConsumer {
+	return tcDatapathInjectorConsumer{tc}
+}
+
+func (tc tcDatapathInjectorConsumer) Interface() *net.Interface {
+	return tc.iface
+}
+
+func (tc tcDatapathInjectorConsumer) String() string {
+	return fmt.Sprint(tc.iface.Name, " (via tc)")
+}
+
+func (tc tcDatapathInjectorConsumer) Stats() map[string]int {
+	stats := tc.miss.Stats()
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	stats["FlowMisses"] = int(tc.missCount)
+	return stats
+}
+
+func (tc tcDatapathInjectorConsumer) StartConsumingPackets(consumer Consumer) error {
+	tc.lock.Lock()
+	if tc.consumer != nil {
+		tc.lock.Unlock()
+		return fmt.Errorf("TCDatapath already has a Consumer")
+	}
+	tc.consumer = consumer
+	tc.lock.Unlock()
+
+	return tc.miss.StartConsumingPackets(func(key PacketKey) FlowOp {
+		return tcMissFlowOp{tc: tc.TCDatapath, key: key}
+	})
+}
+
+func (tc tcDatapathInjectorConsumer) InjectPacket(key PacketKey) FlowOp {
+	tc.lock.Lock()
+	tc.learnMAC(key.SrcMAC)
+	tc.lock.Unlock()
+	return tcActionFlowOp{tc: tc.TCDatapath, action: tcAction{ifindex: tc.ifindexes.pcap}}
+}
+
+// Called with the lock held
+func (tc *TCDatapath) learnMAC(mac MAC) {
+	tc.macs[mac] = struct{}{}
+	tc.seenMACs[mac] = struct{}{}
+}
+
+// Whether frames to a MAC can have flows.  Called with the lock held.
+func (tc *TCDatapath) knownDst(mac MAC) bool {
+	if mac[0]&1 != 0 {
+		return true // a real broadcast or multicast
+	}
+	_, found := tc.macs[mac]
+	return found
+}
+
+// tcMissFlowOp handles a frame captured from the miss veth
+type tcMissFlowOp struct {
+	NonDiscardingFlowOp
+	tc  *TCDatapath
+	key PacketKey
+}
+
+func (op tcMissFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	tc := op.tc
+	tc.lock.Lock()
+	tc.missCount++
+	tc.lock.Unlock()
+
+	if isTCVxlanMiss(dec) {
+		tc.handleVxlanMiss(frame, dec)
+	} else {
+		tc.handleBridgeMiss(op.key, frame, dec)
+	}
+}
+
+// The miss header has a real ethertype, unlike the special frames
+// of fast datapath, which IsSpecial looks for
+func isTCVxlanMiss(dec *EthernetDecoder) bool {
+	return dec.Eth.EthernetType == layers.EthernetType(tcMissEtherType) &&
+		bytes.Equal(zeroMAC, dec.Eth.SrcMAC) && bytes.Equal(zeroMAC, dec.Eth.DstMAC)
+}
+
+func (tc *TCDatapath) handleBridgeMiss(key PacketKey, frame []byte, dec *EthernetDecoder) {
+	tc.lock.Lock()
+	consumer := tc.consumer
+	deleteFlowsCount := tc.deleteFlowsCount
+	tc.learnMAC(key.SrcMAC)
+	tc.lock.Unlock()
+
+	tc.send(tcFlowKey{dstMAC: key.DstMAC, srcMAC: key.SrcMAC, vni: tcLocalVNI, segment: key.Segment},
+		consumer(key), frame, dec, deleteFlowsCount)
+}
+
+// The decoder is the capturing goroutine's own, as the miss capture
+// may run several of them.  It is reused for the inner frame.
+func (tc *TCDatapath) handleVxlanMiss(frame []byte, dec *EthernetDecoder) {
+	if len(frame) < tcMissHeaderSize+EthernetOverhead {
+		return
+	}
+	var key tcFlowKey
+	key.vni = binary.BigEndian.Uint32(frame[EthernetOverhead:])
+	copy(key.remote[:], frame[EthernetOverhead+4:EthernetOverhead+8])
+	key.segment = Segment(binary.BigEndian.Uint16(frame[EthernetOverhead+8:]))
+	frame = frame[tcMissHeaderSize:]
+	if key.segment != 0 {
+		frame = pushSegmentTag(frame, key.segment)
+	}
+
+	dec.DecodeLayers(frame)
+	if len(dec.decoded) == 0 {
+		return
+	}
+	pk := dec.PacketKey()
+	key.dstMAC, key.srcMAC = pk.DstMAC, pk.SrcMAC
+
+	tc.lock.Lock()
+	overlayConsumer := tc.overlayConsumer
+	deleteFlowsCount := tc.deleteFlowsCount
+	tc.countRxTraffic(key.remote, frame)
+	tc.lock.Unlock()
+	if overlayConsumer == nil {
+		// StartConsumingPackets wasn't called yet
+		return
+	}
+
+	srcPeer, dstPeer := tc.extractPeers(key.vni)
+	if srcPeer == nil || dstPeer == nil {
+		return
+	}
+
+	if dec.IsSpecial() {
+		tc.lock.Lock()
+		fwd := tc.forwarders[srcPeer.Name]
+		tc.lock.Unlock()
+		if fwd != nil {
+			fwd.handleSpecial(frame, &net.UDPAddr{IP: net.IP(key.remote[:]), Port: tc.vxlanPort})
+		}
+		return
+	}
+
+	fop := overlayConsumer(ForwardPacketKey{SrcPeer: srcPeer, DstPeer: dstPeer, PacketKey: pk})
+	tc.send(key, fop, frame, dec, deleteFlowsCount)
+}
+
+func (tc *TCDatapath) extractPeers(vni uint32) (*mesh.Peer, *mesh.Peer) {
+	tc.lock.Lock()
+	peers := tc.peers
+	tc.lock.Unlock()
+	srcPeer := peers.FetchByShortID(mesh.PeerShortID(vni & 0xfff))
+	dstPeer := peers.FetchByShortID(mesh.PeerShortID((vni >> 12) & 0xfff))
+	return srcPeer, dstPeer
+}
+
+// Send a frame, and create a flow for frames like it if possible.
+// The frame is sent in userspace by the FlowOp itself, including the
+// tcActionFlowOps the flow is made of.
+func (tc *TCDatapath) send(key tcFlowKey, fop FlowOp, frame []byte, dec *EthernetDecoder, deleteFlowsCount uint64) {
+	if fop == nil {
+		return
+	}
+
+	var actions []tcAction
+	createFlow := true
+	for _, xfop := range FlattenFlowOp(fop) {
+		switch fop := xfop.(type) {
+		case tcActionFlowOp:
+			actions = append(actions, fop.action)
+		case vetoFlowCreationFlowOp:
+			createFlow = false
+		default:
+			// A foreign FlowOp (e.g. a sleeve forwarding
+			// FlowOp) must see similar frames too
+			if !xfop.Discards() {
+				createFlow = false
+			}
+		}
+	}
+
+	fop.Process(frame, dec, false)
+
+	if !createFlow || len(actions) > tcMaxActions {
+		return
+	}
+	if tc.isHairpinFlow(key, actions) {
+		log.Warning("Vetoed installation of hairpin flow ", key)
+		return
+	}
+
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	// As for fast datapath, a flow created on the basis of stale
+	// information must not be installed.  Unicast frames to
+	// unknown MACs are broadcast, but must not get a flow to do
+	// so, or it would outlive our learning the MAC.
+	if deleteFlowsCount != tc.deleteFlowsCount || !tc.knownDst(key.dstMAC) {
+		return
+	}
+	log.Debug("Creating tc flow ", key, " ", actions)
+	checkWarn(tc.flows.update(key.bytes(), (&tcFlow{actions: actions}).bytesValue()))
+}
+
+// A flow is a hairpin if it sends frames from the bridge back into
+// it, or sends frames back down the tunnel they arrived on, or its
+// reverse.
+func (tc *TCDatapath) isHairpinFlow(key tcFlowKey, actions []tcAction) bool {
+	for _, action := range actions {
+		if action.remote == ([4]byte{}) {
+			if key.fromBridge() {
+				return true
+			}
+		} else if !key.fromBridge() && action.remote == key.remote &&
+			(action.vni == key.vni || action.vni == (key.vni&0xfff)<<12|key.vni>>12) {
+			return true
+		}
+	}
+	return false
+}
+
+// tcActionFlowOp is an action of a flow.  Processing it performs the
+// action in userspace.
+type tcActionFlowOp struct {
+	NonDiscardingFlowOp
+	tc     *TCDatapath
+	action tcAction
+}
+
+func (op tcActionFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	tc := op.tc
+	if op.action.remote == ([4]byte{}) {
+		tc.inject.InjectPacket(dec.PacketKey()).Process(frame, dec, broadcast)
+		return
+	}
+
+	buf := make([]byte, vxlanHeaderSize+len(frame))
+	buf[0] = 0x08 // the VNI is valid
+	binary.BigEndian.PutUint32(buf[4:], op.action.vni<<8)
+	copy(buf[vxlanHeaderSize:], frame)
+	remote := &net.UDPAddr{IP: net.IP(op.action.remote[:]), Port: tc.vxlanPort}
+	if _, err := tc.conn.WriteToUDP(buf, remote); err != nil {
+		log.Warning("tc datapath: sending to ", remote, ": ", err)
+		return
+	}
+
+	tc.lock.Lock()
+	if fwd := tc.forwardersByIP[op.action.remote]; fwd != nil {
+		fwd.traffic.count(true, 1, uint64(len(frame)))
+	}
+	tc.lock.Unlock()
+}
+
+// Called with the lock held
+func (tc *TCDatapath) countRxTraffic(remote [4]byte, frame []byte) {
+	if fwd := tc.forwardersByIP[remote]; fwd != nil {
+		fwd.traffic.count(false, 1, uint64(len(frame)))
+	}
+}
+
+// Overlay bits
+
+type tcDatapathOverlay struct {
+	*TCDatapath
+}
+
+func (tc *TCDatapath) Overlay() NetworkOverlay {
+	return tcDatapathOverlay{tc}
+}
+
+func (tc tcDatapathOverlay) InvalidateRoutes() {
+	log.Debug("InvalidateRoutes")
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	checkWarn(tc.deleteFlows())
+}
+
+func (tc tcDatapathOverlay) InvalidateShortIDs() {
+	log.Debug("InvalidateShortIDs")
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	checkWarn(tc.deleteFlows())
+}
+
+func (tc tcDatapathOverlay) Stop() {
+	// Nothing to do; the programs and their flows are replaced
+	// when the router next starts.
+}
+
+func (tc tcDatapathOverlay) AddFeaturesTo(features map[string]string) {
+	// Fast datapath support itself is indicated through
+	// OverlaySwitch.  Path MTU discovery and IPsec are not
+	// supported, so are not advertised.
+	features[heartbeatEchoFeature] = "1"
+}
+
+type TCStatus struct {
+	Flows []TCFlowStatus
+}
+
+type TCFlowStatus struct {
+	Key     string
+	Actions []string
+	Packets uint64
+	Bytes   uint64
+}
+
+func (tc tcDatapathOverlay) Diagnostics() interface{} {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	status := TCStatus{Flows: []TCFlowStatus{}}
+	checkWarn(tc.flows.iterate(func(k []byte) {
+		value, err := tc.flows.lookup(k)
+		if err != nil {
+			return
+		}
+		flow := parseTCFlow(value)
+		flowStatus := TCFlowStatus{
+			Key:     parseTCFlowKey(k).String(),
+			Actions: make([]string, 0, len(flow.actions)),
+			Packets: flow.packets,
+			Bytes:   flow.bytes,
+		}
+		for _, action := range flow.actions {
+			flowStatus.Actions = append(flowStatus.Actions, action.String())
+		}
+		status.Flows = append(status.Flows, flowStatus)
+	}))
+	return status
+}
+
+func (s TCStatus) Metrics() interface{} {
+	var m FastDPMetrics
+	m.Flows = len(s.Flows)
+	for _, flow := range s.Flows {
+		m.TotalPackets += flow.Packets
+		m.TotalBytes += flow.Bytes
+	}
+	return &m
+}
+
+func (tc tcDatapathOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *mesh.Peers, consumer OverlayConsumer) error {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	if tc.overlayConsumer != nil {
+		return fmt.Errorf("TCDatapath already has an OverlayConsumer")
+	}
+
+	tc.localPeer = localPeer
+	tc.peers = peers
+	tc.overlayConsumer = consumer
+	return nil
+}
+
+type tcForwarder struct {
+	tc             *TCDatapath
+	remotePeer     *mesh.Peer
+	sendControlMsg func(byte, []byte) error
+	connUID        uint64
+
+	// Traffic sent or received in userspace, and counted by flows
+	// which have since been cleared or deleted.  Guarded by the
+	// tc lock.
+	traffic TrafficStats
+
+	heartbeats    *heartbeatMonitor
+	heartbeatEcho bool // the remote peer echoes heartbeats
+
+	lock              sync.RWMutex
+	confirmed         bool
+	remoteAddr        *net.UDPAddr
+	heartbeatInterval time.Duration
+	heartbeatTimer    *time.Timer // for sending
+	heartbeatTimeout  *time.Timer // for receiving
+	ackedHeartbeat    bool
+	stopChan          chan struct{}
+	stopped           bool
+	healthy           bool
+	established       bool
+	establishedChan   chan struct{}
+	errorChan         chan error
+	healthChan        chan bool
+}
+
+func (tc tcDatapathOverlay) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	if params.SessionKey != nil {
+		return nil, fmt.Errorf("the tc datapath does not support encryption")
+	}
+
+	remoteAddr := makeUDPAddr(params.RemoteAddr)
+	// There is only the one VXLAN device, so the remote peer must
+	// use the same VXLAN port as we do
+	if params.Outbound && remoteAddr.Port+1 != tc.vxlanPort {
+		return nil, fmt.Errorf("the tc datapath requires peers to use port %d", tc.vxlanPort-1)
+	}
+	remoteAddr.Port = tc.vxlanPort
+
+	return &tcForwarder{
+		tc:             tc.TCDatapath,
+		remotePeer:     params.RemotePeer,
+		sendControlMsg: params.SendControlMessage,
+		connUID:        params.ConnUID,
+		heartbeats:     newHeartbeatMonitor(time.Now),
+		heartbeatEcho:  params.Features[heartbeatEchoFeature] != "",
+		healthy:        true,
+
+		remoteAddr:        remoteAddr,
+		heartbeatInterval: FastHeartbeat,
+		stopChan:          make(chan struct{}),
+
+		establishedChan: make(chan struct{}),
+		errorChan:       make(chan error, 1),
+		healthChan:      make(chan bool),
+	}, nil
+}
+
+func (fwd *tcForwarder) logPrefix() string {
+	return fmt.Sprintf("tc ->[%s|%s]: ", fwd.remoteAddr, fwd.remotePeer)
+}
+
+func (fwd *tcForwarder) Confirm() {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	if fwd.confirmed {
+		log.Fatal(fwd.logPrefix(), "already confirmed")
+	}
+
+	log.Debug(fwd.logPrefix(), "confirmed")
+	fwd.tc.addForwarder(fwd)
+	fwd.tc.setForwarderIP(fwd, fwd.remoteAddr.IP)
+	fwd.confirmed = true
+
+	// have the goroutine send a heartbeat straight away
+	fwd.heartbeatTimer = time.NewTimer(0)
+	fwd.heartbeatTimeout = time.NewTimer(HeartbeatTimeout)
+	go fwd.doHeartbeats()
+}
+
+func (fwd *tcForwarder) EstablishedChannel() <-chan struct{} {
+	return fwd.establishedChan
+}
+
+func (fwd *tcForwarder) ErrorChannel() <-chan error {
+	return fwd.errorChan
+}
+
+func (fwd *tcForwarder) HealthChannel() <-chan bool {
+	return fwd.healthChan
+}
+
+func (fwd *tcForwarder) doHeartbeats() {
+	for {
+		select {
+		case <-fwd.heartbeatTimer.C:
+			log.Debug(fwd.logPrefix(), "sending Heartbeat to peer")
+			fwd.sendHeartbeat()
+			fwd.lock.RLock()
+			fwd.heartbeatTimer.Reset(fwd.heartbeatInterval)
+			fwd.lock.RUnlock()
+
+		case <-fwd.heartbeatTimeout.C:
+			log.Debug(fwd.logPrefix(), "missed Heartbeat from peer, marking tc forwarder as un-healthy")
+			fwd.healthChan <- false
+
+			fwd.lock.Lock()
+			if fwd.heartbeatInterval != SlowHeartbeat {
+				fwd.heartbeatInterval = SlowHeartbeat
+				fwd.heartbeatTimer.Reset(fwd.heartbeatInterval)
+			}
+			fwd.healthy = false
+			fwd.lock.Unlock()
+
+		case <-fwd.stopChan:
+			return
+		}
+	}
+}
+
+// Handle an error which leads to notifying the listener and
+// termination of the forwarder.  Called with the lock held.
+func (fwd *tcForwarder) handleError(err error) {
+	if err == nil {
+		return
+	}
+
+	select {
+	case fwd.errorChan <- err:
+	default:
+	}
+
+	// stop the heartbeat goroutine
+	if !fwd.stopped {
+		fwd.stopped = true
+		close(fwd.stopChan)
+	}
+}
+
+// Heartbeats are the same as the fast datapath's, padded to the MTU.
+func (fwd *tcForwarder) sendHeartbeat() {
+	fwd.lock.RLock()
+	buf := make([]byte, EthernetOverhead+fwd.tc.iface.MTU)
+	binary.BigEndian.PutUint64(buf[EthernetOverhead:], fwd.connUID)
+	binary.BigEndian.PutUint16(buf[EthernetOverhead+8:], uint16(len(buf)))
+	if fwd.heartbeatEcho && fwd.established {
+		buf[EthernetOverhead+10] = heartbeatEchoRequest
+		binary.BigEndian.PutUint64(buf[EthernetOverhead+11:], fwd.heartbeats.sent())
+	}
+	fwd.lock.RUnlock()
+
+	fwd.sendSpecial(buf)
+}
+
+func (fwd *tcForwarder) sendSpecial(buf []byte) {
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(buf)
+	fwd.tc.lock.Lock()
+	localPeer := fwd.tc.localPeer
+	fwd.tc.lock.Unlock()
+	pk := ForwardPacketKey{
+		PacketKey: dec.PacketKey(),
+		SrcPeer:   localPeer,
+		DstPeer:   fwd.remotePeer,
+	}
+
+	if fop := fwd.Forward(pk); fop != nil {
+		fop.Process(buf, dec, false)
+	}
+}
+
+func (fwd *tcForwarder) handleSpecial(frame []byte, sender *net.UDPAddr) {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	if len(frame) < EthernetOverhead+10 ||
+		binary.BigEndian.Uint64(frame[EthernetOverhead:]) != fwd.connUID ||
+		uint16(len(frame)) != binary.BigEndian.Uint16(frame[EthernetOverhead+8:]) {
+		return
+	}
+
+	if len(frame) >= EthernetOverhead+heartbeatMinSize {
+		stamp := binary.BigEndian.Uint64(frame[EthernetOverhead+11:])
+		switch frame[EthernetOverhead+10] {
+		case heartbeatEchoReply:
+			fwd.heartbeats.echoed(stamp)
+			return
+
+		case heartbeatEchoRequest:
+			// Forward needs the lock, so send the echo
+			// asynchronously
+			reply := make([]byte, len(frame))
+			copy(reply, frame)
+			reply[EthernetOverhead+10] = heartbeatEchoReply
+			go fwd.sendSpecial(reply)
+		}
+	}
+
+	if !udpAddrsEqual(fwd.remoteAddr, sender) {
+		log.Info(fwd.logPrefix(), "Peer IP address changed to ", sender)
+		fwd.remoteAddr = sender
+		fwd.tc.setForwarderIP(fwd, sender.IP)
+	}
+
+	if !fwd.ackedHeartbeat {
+		fwd.ackedHeartbeat = true
+		log.Debug(fwd.logPrefix(), "Ack Heartbeat from peer")
+		fwd.handleError(fwd.sendControlMsg(FastDatapathHeartbeatAck, nil))
+	}
+
+	// we can receive a heartbeat before Confirm() has set up
+	// heartbeatTimeout
+	if fwd.heartbeatTimeout != nil {
+		fwd.heartbeatTimeout.Reset(HeartbeatTimeout)
+		if !fwd.healthy {
+			log.Debug(fwd.logPrefix(), "got Heartbeat from peer, marking tc forwarder as healthy")
+			fwd.healthy = true
+			fwd.healthChan <- true
+		}
+	}
+}
+
+func (fwd *tcForwarder) ControlMessage(tag byte, msg []byte) {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	switch tag {
+	case FastDatapathHeartbeatAck:
+		if !fwd.established {
+			close(fwd.establishedChan)
+			fwd.established = true
+		}
+		if fwd.heartbeatInterval != SlowHeartbeat {
+			fwd.heartbeatInterval = SlowHeartbeat
+			if fwd.heartbeatTimer != nil {
+				fwd.heartbeatTimer.Reset(fwd.heartbeatInterval)
+			}
+		}
+
+	default:
+		log.Info(fwd.logPrefix(), "Ignoring unknown control message: ", tag)
+	}
+}
+
+// The name is the fast datapath's, since the two are interchangeable
+// from the remote peer's point of view.
+func (fwd *tcForwarder) Attrs() map[string]interface{} {
+	attrs := map[string]interface{}{"name": "fastdp", "datapath": "tc", "mtu": fwd.tc.iface.MTU}
+	fwd.heartbeats.addAttrs(attrs)
+	return attrs
+}
+
+func (fwd *tcForwarder) HeartbeatStats() map[string]HeartbeatStats {
+	return map[string]HeartbeatStats{"fastdp": fwd.heartbeats.Stats()}
+}
+
+func (fwd *tcForwarder) Traffic() map[string]TrafficStats {
+	return map[string]TrafficStats{"fastdp": fwd.tc.forwarderTraffic(fwd)}
+}
+
+func (fwd *tcForwarder) Forward(key ForwardPacketKey) FlowOp {
+	if !key.SrcPeer.HasShortID || !key.DstPeer.HasShortID {
+		return nil
+	}
+
+	fwd.lock.RLock()
+	defer fwd.lock.RUnlock()
+
+	remoteIP, err := ipv4Bytes(fwd.remoteAddr.IP)
+	if err != nil {
+		log.Error(err)
+		return DiscardingFlowOp{}
+	}
+
+	tunnelID := tunnelIDFor(key)
+	return tcActionFlowOp{
+		tc: fwd.tc,
+		action: tcAction{
+			ifindex: fwd.tc.ifindexes.vxlan,
+			vni:     uint32(binary.BigEndian.Uint64(tunnelID[:])),
+			remote:  remoteIP,
+		},
+	}
+}
+
+func (fwd *tcForwarder) Stop() {
+	// The flows to the remote peer are deleted when the routes
+	// change
+	fwd.tc.removeForwarder(fwd)
+
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+	fwd.sendControlMsg = func(byte, []byte) error { return nil }
+
+	// stop the heartbeat goroutine
+	if !fwd.stopped {
+		fwd.stopped = true
+		close(fwd.stopChan)
+	}
+}
+
+func (tc *TCDatapath) addForwarder(fwd *tcForwarder) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	tc.forwarders[fwd.remotePeer.Name] = fwd
+}
+
+func (tc *TCDatapath) removeForwarder(fwd *tcForwarder) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	if tc.forwarders[fwd.remotePeer.Name] == fwd {
+		delete(tc.forwarders, fwd.remotePeer.Name)
+	}
+	for ip, f := range tc.forwardersByIP {
+		if f == fwd {
+			delete(tc.forwardersByIP, ip)
+		}
+	}
+}
+
+// Called with the forwarder's lock held
+func (tc *TCDatapath) setForwarderIP(fwd *tcForwarder, ip net.IP) {
+	remoteIP, err := ipv4Bytes(ip)
+	if err != nil {
+		return
+	}
+
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	for ip, f := range tc.forwardersByIP {
+		if f == fwd {
+			delete(tc.forwardersByIP, ip)
+		}
+	}
+	tc.forwardersByIP[remoteIP] = fwd
+}
+
+// Call f for each forwarder that traffic matching the flow passes
+// through.  Called with the lock held.
+func (tc *TCDatapath) flowForwarders(key tcFlowKey, flow *tcFlow, f func(fwd *tcForwarder, tx bool)) {
+	if !key.fromBridge() {
+		if fwd := tc.forwardersByIP[key.remote]; fwd != nil {
+			f(fwd, false)
+		}
+	}
+	for _, action := range flow.actions {
+		if fwd := tc.forwardersByIP[action.remote]; fwd != nil {
+			f(fwd, true)
+		}
+	}
+}
+
+// Add the traffic counted by a flow which is about to be cleared or
+// deleted to the forwarders' totals.  Called with the lock held.
+func (tc *TCDatapath) harvestFlowTraffic(key tcFlowKey, flow *tcFlow) {
+	tc.flowForwarders(key, flow, func(fwd *tcForwarder, tx bool) {
+		fwd.traffic.count(tx, flow.packets, flow.bytes)
+	})
+	tc.flowTrafficTime = time.Time{}
+}
+
+func (tc *TCDatapath) forwarderTraffic(fwd *tcForwarder) TrafficStats {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	if time.Since(tc.flowTrafficTime) > flowTrafficMaxAge {
+		flowTraffic := make(map[*tcForwarder]TrafficStats)
+		checkWarn(tc.eachFlow(func(key tcFlowKey, flow *tcFlow) {
+			tc.flowForwarders(key, flow, func(fwd *tcForwarder, tx bool) {
+				stats := flowTraffic[fwd]
+				stats.count(tx, flow.packets, flow.bytes)
+				flowTraffic[fwd] = stats
+			})
+		}))
+		tc.flowTraffic = flowTraffic
+		tc.flowTrafficTime = time.Now()
+	}
+
+	stats := fwd.traffic
+	stats.Add(tc.flowTraffic[fwd])
+	return stats
+}
+
+// Call f with each flow.  The keys are gathered first, so f may
+// delete or update flows.
+func (tc *TCDatapath) eachFlow(f func(key tcFlowKey, flow *tcFlow)) error {
+	var keys [][]byte
+	if err := tc.flows.iterate(func(k []byte) { keys = append(keys, k) }); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if value, err := tc.flows.lookup(k); err == nil {
+			f(parseTCFlowKey(k), parseTCFlow(value))
+		}
+	}
+	return nil
+}
+
+// Called with the lock held
+func (tc *TCDatapath) deleteFlows() error {
+	tc.deleteFlowsCount++
+	return tc.eachFlow(func(key tcFlowKey, flow *tcFlow) {
+		tc.harvestFlowTraffic(key, flow)
+		if err := tc.flows.delete(key.bytes()); err != nil && err != unix.ENOENT {
+			log.Warn(err)
+		}
+	})
+}
+
+func (tc *TCDatapath) run() {
+	expireMACs := time.NewTicker(10 * time.Minute)
+	expireFlows := time.NewTicker(5 * time.Minute)
+	defer expireMACs.Stop()
+	defer expireFlows.Stop()
+
+	for {
+		select {
+		case <-expireMACs.C:
+			tc.expireMACs()
+
+		case <-expireFlows.C:
+			tc.expireFlows()
+
+		case <-tc.stopTicker:
+			return
+		}
+	}
+}
+
+func (tc *TCDatapath) expireMACs() {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	for mac := range tc.macs {
+		if _, present := tc.seenMACs[mac]; !present {
+			delete(tc.macs, mac)
+		}
+	}
+	tc.seenMACs = make(map[MAC]struct{})
+}
+
+// Delete the flows which have not been used since the last time, and
+// clear the counters of the others.  The router needs to know which
+// flows are active in order to maintain its MAC->peer table, so the
+// consumers are told about those, as for fast datapath.
+func (tc *TCDatapath) expireFlows() {
+	var touch []tcFlowKey
+
+	tc.lock.Lock()
+	checkWarn(tc.eachFlow(func(key tcFlowKey, flow *tcFlow) {
+		tc.harvestFlowTraffic(key, flow)
+		var err error
+		if flow.packets == 0 {
+			log.Debug("Expiring tc flow ", key)
+			err = tc.flows.delete(key.bytes())
+		} else {
+			touch = append(touch, key)
+			err = tc.flows.update(key.bytes(), (&tcFlow{actions: flow.actions}).bytesValue())
+		}
+		if err != nil && err != unix.ENOENT {
+			log.Warn(err)
+		}
+	}))
+	consumer, overlayConsumer := tc.consumer, tc.overlayConsumer
+	for _, key := range touch {
+		if key.fromBridge() {
+			tc.learnMAC(key.srcMAC)
+		}
+	}
+	tc.lock.Unlock()
+
+	for _, key := range touch {
+		pk := PacketKey{SrcMAC: key.srcMAC, DstMAC: key.dstMAC}
+		if key.fromBridge() {
+			if consumer != nil {
+				consumer(pk)
+			}
+		} else if overlayConsumer != nil {
+			if srcPeer, dstPeer := tc.extractPeers(key.vni); srcPeer != nil && dstPeer != nil {
+				overlayConsumer(ForwardPacketKey{SrcPeer: srcPeer, DstPeer: dstPeer, PacketKey: pk})
+			}
+		}
+	}
+}
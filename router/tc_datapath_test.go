@@ -0,0 +1,162 @@
+package router
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestTCFlowKeyRoundTrip(t *testing.T) {
+	for _, key := range []tcFlowKey{
+		{},
+		{dstMAC: MAC{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, srcMAC: MAC{2, 1, 2, 3, 4, 5}, vni: tcLocalVNI},
+		{dstMAC: MAC{2, 9, 8, 7, 6, 5}, srcMAC: MAC{2, 1, 2, 3, 4, 5}, vni: 0x123456, remote: [4]byte{10, 0, 0, 1}},
+		{dstMAC: MAC{2, 9, 8, 7, 6, 5}, srcMAC: MAC{2, 1, 2, 3, 4, 5}, vni: 0x123456, remote: [4]byte{10, 0, 0, 1}, segment: MaxSegment},
+	} {
+		b := key.bytes()
+		require.Len(t, b, tcFlowKeySize)
+		require.Equal(t, key, parseTCFlowKey(b))
+	}
+}
+
+func TestTCFlowRoundTrip(t *testing.T) {
+	maxActions := make([]tcAction, tcMaxActions)
+	for i := range maxActions {
+		maxActions[i] = tcAction{vni: uint32(i + 1), remote: [4]byte{10, 0, 0, byte(i + 1)}}
+	}
+	for _, flow := range []*tcFlow{
+		{},
+		{packets: 1, bytes: 1 << 40, actions: []tcAction{{ifindex: 7}}},
+		{packets: 3, bytes: 300, actions: []tcAction{{ifindex: 7}, {vni: 0x001002, remote: [4]byte{192, 168, 1, 2}}}},
+		{actions: maxActions},
+	} {
+		b := flow.bytesValue()
+		require.Len(t, b, tcFlowValueSize)
+		require.Equal(t, flow, parseTCFlow(b))
+	}
+}
+
+func TestTCIsHairpinFlow(t *testing.T) {
+	var (
+		remote      = [4]byte{10, 0, 0, 1}
+		otherRemote = [4]byte{10, 0, 0, 2}
+		bridge      = tcAction{ifindex: 3}
+		fromBridge  = tcFlowKey{vni: tcLocalVNI}
+		fromTunnel  = tcFlowKey{vni: 0x001002, remote: remote}
+	)
+	tc := &TCDatapath{}
+	for _, test := range []struct {
+		name    string
+		key     tcFlowKey
+		actions []tcAction
+		hairpin bool
+	}{
+		{"bridge to bridge", fromBridge, []tcAction{bridge}, true},
+		{"bridge to tunnel", fromBridge, []tcAction{{vni: 0x001002, remote: remote}}, false},
+		{"tunnel to bridge", fromTunnel, []tcAction{bridge}, false},
+		{"back down the same tunnel", fromTunnel, []tcAction{{vni: 0x001002, remote: remote}}, true},
+		{"back down the reverse tunnel", fromTunnel, []tcAction{{vni: 0x002001, remote: remote}}, true},
+		{"to another peer at the same address", fromTunnel, []tcAction{{vni: 0x001003, remote: remote}}, false},
+		{"to another address", fromTunnel, []tcAction{{vni: 0x001002, remote: otherRemote}}, false},
+		{"one hairpin among several", fromBridge, []tcAction{{vni: 0x001002, remote: remote}, bridge}, true},
+		{"no actions", fromBridge, nil, false},
+	} {
+		require.Equal(t, test.hairpin, tc.isHairpinFlow(test.key, test.actions), test.name)
+	}
+}
+
+// A frame from VXLAN which missed the flows, as the eBPF program
+// hands it to the router
+func testTCMissFrame(vni uint32, remote [4]byte, segment Segment, inner []byte) []byte {
+	frame := make([]byte, tcMissHeaderSize, tcMissHeaderSize+len(inner))
+	binary.BigEndian.PutUint16(frame[12:], tcMissEtherType)
+	binary.BigEndian.PutUint32(frame[EthernetOverhead:], vni)
+	copy(frame[EthernetOverhead+4:], remote[:])
+	binary.BigEndian.PutUint16(frame[EthernetOverhead+8:], uint16(segment))
+	return append(frame, inner...)
+}
+
+func TestTCIsVxlanMiss(t *testing.T) {
+	inner := testIPv6Frame(t, 10)
+	miss := testTCMissFrame(0x001002, [4]byte{10, 0, 0, 1}, 0, inner)
+	withMACs := append([]byte(nil), miss...)
+	copy(withMACs, inner[:12])
+	special := make([]byte, EthernetOverhead+10) // as fast datapath's
+
+	for _, test := range []struct {
+		name  string
+		frame []byte
+		miss  bool
+	}{
+		{"vxlan miss", miss, true},
+		{"bridge miss", inner, false},
+		{"miss ethertype with MACs", withMACs, false},
+		{"special frame", special, false},
+	} {
+		dec := NewEthernetDecoder()
+		dec.DecodeLayers(test.frame)
+		require.Equal(t, test.miss, isTCVxlanMiss(dec), test.name)
+	}
+}
+
+// decoderFlowOp checks that the decoder it is given has decoded the
+// frame it is given
+type decoderFlowOp struct {
+	NonDiscardingFlowOp
+	t      *testing.T
+	frames chan *EthernetDecoder
+}
+
+func (op decoderFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	require.Equal(op.t, net.HardwareAddr(frame[6:12]), dec.Eth.SrcMAC)
+	op.frames <- dec
+}
+
+// Each goroutine capturing misses decodes the frames inside VXLAN
+// misses with its own decoder
+func TestTCVxlanMissDecoder(t *testing.T) {
+	routerA := testMeshRouter(t, mesh.PeerName(0x000000000001))
+	routerB := testMeshRouter(t, mesh.PeerName(0x000000000002), routerA)
+	peerA := routerB.Peers.Fetch(routerA.Ourself.Name)
+	vni := uint32(peerA.ShortID) | uint32(routerB.Ourself.ShortID)<<12
+
+	const goroutines, frames = 4, 100
+	fop := decoderFlowOp{t: t, frames: make(chan *EthernetDecoder, goroutines*frames)}
+	tc := &TCDatapath{
+		peers:           routerB.Peers,
+		overlayConsumer: func(ForwardPacketKey) FlowOp { return fop },
+	}
+
+	var wg sync.WaitGroup
+	decs := make(map[*EthernetDecoder]bool)
+	for i := 0; i < goroutines; i++ {
+		inner := testIPv6Frame(t, 10+i)
+		inner[11] = byte(i)
+		miss := testTCMissFrame(vni, [4]byte{10, 0, 0, 1}, 0, inner)
+		dec := NewEthernetDecoder()
+		decs[dec] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < frames; j++ {
+				// As the packet capture does
+				dec.DecodeLayers(miss)
+				tcMissFlowOp{tc: tc}.Process(miss, dec, false)
+			}
+		}()
+	}
+	wg.Wait()
+	close(fop.frames)
+
+	count := 0
+	for dec := range fop.frames {
+		require.True(t, decs[dec])
+		count++
+	}
+	require.Equal(t, goroutines*frames, count)
+	require.Equal(t, uint64(goroutines*frames), tc.missCount)
+}
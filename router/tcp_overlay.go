@@ -0,0 +1,307 @@
+// This contains the Overlay implementation which carries frames in
+// control messages over the mesh TCP connection itself.
+//
+// It is intended as a last resort, for peers between which only TCP
+// is allowed, so that they have working, if slow, connectivity rather
+// than none.  Frames suffer TCP's head-of-line blocking and
+// retransmission, and share the connection with gossip, so it should
+// always be the least preferred overlay.  Encryption, if enabled,
+// comes from the mesh connection.
+
+package router
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/weaveworks/mesh"
+)
+
+const (
+	// frames waiting to be sent on a connection; beyond this they
+	// are dropped, as a congested link would
+	tcpOverlayQueueLength = 256
+)
+
+type TCPOverlay struct {
+	// These fields are set in StartConsumingPackets, and not
+	// subsequently modified
+	localPeer *mesh.Peer
+	consumer  OverlayConsumer
+	peers     *mesh.Peers
+
+	lock sync.Mutex
+}
+
+func NewTCPOverlay() *TCPOverlay {
+	return &TCPOverlay{}
+}
+
+func (tcp *TCPOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *mesh.Peers, consumer OverlayConsumer) error {
+	tcp.lock.Lock()
+	defer tcp.lock.Unlock()
+
+	if tcp.localPeer != nil {
+		return fmt.Errorf("StartConsumingPackets already called")
+	}
+
+	tcp.localPeer = localPeer
+	tcp.consumer = consumer
+	tcp.peers = peers
+	return nil
+}
+
+func (*TCPOverlay) InvalidateRoutes() {
+	// no cached information, so nothing to do
+}
+
+func (*TCPOverlay) InvalidateShortIDs() {
+	// no cached information, so nothing to do
+}
+
+func (*TCPOverlay) AddFeaturesTo(features map[string]string) {
+	// Nothing needed.  Being in the Overlays feature is enough.
+}
+
+func (*TCPOverlay) Diagnostics() interface{} {
+	return nil
+}
+
+func (*TCPOverlay) Stop() {
+	// Nothing to do; the forwarders are stopped with their
+	// connections.
+}
+
+func (tcp *TCPOverlay) started() (OverlayConsumer, *mesh.Peers) {
+	tcp.lock.Lock()
+	defer tcp.lock.Unlock()
+	return tcp.consumer, tcp.peers
+}
+
+type tcpOverlayForwarder struct {
+	tcp        *TCPOverlay
+	remotePeer *mesh.Peer
+	encrypted  bool
+	traffic    *trafficCounters
+	sendChan   chan []byte
+	dec        *EthernetDecoder // only used on the connection's receiving goroutine
+
+	lock            sync.Mutex
+	sendControlMsg  func(byte, []byte) error
+	confirmed       bool
+	established     bool
+	stopped         bool
+	stopChan        chan struct{}
+	establishedChan chan struct{}
+	errorChan       chan error
+	healthChan      chan bool
+}
+
+func (tcp *TCPOverlay) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	return &tcpOverlayForwarder{
+		tcp:            tcp,
+		remotePeer:     params.RemotePeer,
+		encrypted:      params.SessionKey != nil,
+		traffic:        &trafficCounters{},
+		sendChan:       make(chan []byte, tcpOverlayQueueLength),
+		dec:            NewEthernetDecoder(),
+		sendControlMsg: params.SendControlMessage,
+
+		stopChan:        make(chan struct{}),
+		establishedChan: make(chan struct{}),
+		errorChan:       make(chan error, 1),
+		// never signalled: if the TCP connection fails, so does
+		// the mesh connection
+		healthChan: make(chan bool),
+	}, nil
+}
+
+func (fwd *tcpOverlayForwarder) logPrefix() string {
+	return fmt.Sprintf("tcp ->[%s]: ", fwd.remotePeer)
+}
+
+const (
+	// Sent on Confirm, to say that we are ready to receive frames
+	TCPOverlayHello = iota
+	// A frame, preceded by the names of its source and
+	// destination peers
+	TCPOverlayFrame
+)
+
+const tcpOverlayHeaderSize = NameSize + NameSize
+
+func (fwd *tcpOverlayForwarder) Confirm() {
+	fwd.lock.Lock()
+	if fwd.confirmed {
+		log.Fatal(fwd.logPrefix(), "already confirmed")
+	}
+
+	log.Debug(fwd.logPrefix(), "confirmed")
+	fwd.confirmed = true
+	sendControlMsg := fwd.sendControlMsg
+	fwd.lock.Unlock() // unlock before calling send() which may block
+
+	if err := sendControlMsg(TCPOverlayHello, nil); err != nil {
+		fwd.lock.Lock()
+		fwd.handleError(err)
+		fwd.lock.Unlock()
+		return
+	}
+	go fwd.sendFrames()
+}
+
+func (fwd *tcpOverlayForwarder) EstablishedChannel() <-chan struct{} {
+	return fwd.establishedChan
+}
+
+func (fwd *tcpOverlayForwarder) ErrorChannel() <-chan error {
+	return fwd.errorChan
+}
+
+func (fwd *tcpOverlayForwarder) HealthChannel() <-chan bool {
+	return fwd.healthChan
+}
+
+// Handle an error which leads to notifying the listener and
+// termination of the forwarder.  Called with the lock held.
+func (fwd *tcpOverlayForwarder) handleError(err error) {
+	if err == nil {
+		return
+	}
+
+	select {
+	case fwd.errorChan <- err:
+	default:
+	}
+
+	if !fwd.stopped {
+		fwd.stopped = true
+		close(fwd.stopChan)
+	}
+}
+
+// Frames are sent from a goroutine of their own, so that a slow
+// connection holds up neither the capture of packets nor the other
+// overlays.
+func (fwd *tcpOverlayForwarder) sendFrames() {
+	for {
+		select {
+		case msg := <-fwd.sendChan:
+			fwd.lock.Lock()
+			sendControlMsg := fwd.sendControlMsg
+			fwd.lock.Unlock()
+			if err := sendControlMsg(TCPOverlayFrame, msg); err != nil {
+				fwd.lock.Lock()
+				fwd.handleError(err)
+				fwd.lock.Unlock()
+				return
+			}
+			fwd.traffic.countTx(msg[tcpOverlayHeaderSize:])
+
+		case <-fwd.stopChan:
+			return
+		}
+	}
+}
+
+func (fwd *tcpOverlayForwarder) ControlMessage(tag byte, msg []byte) {
+	switch tag {
+	case TCPOverlayHello:
+		fwd.lock.Lock()
+		defer fwd.lock.Unlock()
+		if !fwd.established && !fwd.stopped {
+			log.Debug(fwd.logPrefix(), "established")
+			fwd.established = true
+			close(fwd.establishedChan)
+		}
+	case TCPOverlayFrame:
+		fwd.receiveFrame(msg)
+	default:
+		log.Info(fwd.logPrefix(), "Ignoring unknown control message: ", tag)
+	}
+}
+
+func (fwd *tcpOverlayForwarder) receiveFrame(msg []byte) {
+	if len(msg) < tcpOverlayHeaderSize {
+		log.Print(fwd.logPrefix(), "ignoring too short frame message")
+		return
+	}
+	consumer, peers := fwd.tcp.started()
+	if consumer == nil {
+		// Consume wasn't called yet
+		return
+	}
+
+	frame := msg[tcpOverlayHeaderSize:]
+	fwd.dec.DecodeLayers(frame)
+	if len(fwd.dec.decoded) == 0 {
+		return
+	}
+
+	srcPeer := peers.Fetch(mesh.PeerNameFromBin(msg[:NameSize]))
+	dstPeer := peers.Fetch(mesh.PeerNameFromBin(msg[NameSize:tcpOverlayHeaderSize]))
+	if srcPeer == nil || dstPeer == nil {
+		return
+	}
+
+	fwd.traffic.countRx(frame)
+	if fop := consumer(ForwardPacketKey{
+		SrcPeer:   srcPeer,
+		DstPeer:   dstPeer,
+		PacketKey: fwd.dec.PacketKey(),
+	}); fop != nil {
+		fop.Process(frame, fwd.dec, false)
+	}
+}
+
+// There is no "mtu" attribute: frames of any size fit in a TCP stream.
+func (fwd *tcpOverlayForwarder) Attrs() map[string]interface{} {
+	attrs := map[string]interface{}{"name": "tcp"}
+	if fwd.encrypted {
+		attrs["encrypted"] = true
+	}
+	return attrs
+}
+
+func (fwd *tcpOverlayForwarder) Traffic() map[string]TrafficStats {
+	return map[string]TrafficStats{"tcp": fwd.traffic.stats()}
+}
+
+func (fwd *tcpOverlayForwarder) Forward(key ForwardPacketKey) FlowOp {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+	if !fwd.established || fwd.stopped {
+		return nil
+	}
+	return tcpOverlayFlowOp{fwd: fwd, key: key}
+}
+
+type tcpOverlayFlowOp struct {
+	NonDiscardingFlowOp
+	fwd *tcpOverlayForwarder
+	key ForwardPacketKey
+}
+
+func (op tcpOverlayFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	msg := make([]byte, tcpOverlayHeaderSize+len(frame))
+	copy(msg, op.key.SrcPeer.NameByte)
+	copy(msg[NameSize:], op.key.DstPeer.NameByte)
+	copy(msg[tcpOverlayHeaderSize:], frame)
+	select {
+	case op.fwd.sendChan <- msg:
+	default:
+		log.Debug(op.fwd.logPrefix(), "send queue full; dropping frame")
+	}
+}
+
+func (fwd *tcpOverlayForwarder) Stop() {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+	fwd.sendControlMsg = func(byte, []byte) error { return nil }
+
+	// stop the sending goroutine
+	if !fwd.stopped {
+		fwd.stopped = true
+		close(fwd.stopChan)
+	}
+}
@@ -0,0 +1,128 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+// recordingFlowOp keeps the frames it is asked to process
+type recordingFlowOp struct {
+	NonDiscardingFlowOp
+	frames chan []byte
+}
+
+func (fop recordingFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	fop.frames <- append([]byte(nil), frame...)
+}
+
+// A mesh router for the given peer name, which also knows of the
+// peers of the others
+func testMeshRouter(t *testing.T, name mesh.PeerName, others ...*mesh.Router) *mesh.Router {
+	router, err := mesh.NewRouter(mesh.Config{}, name, name.String(), nil, log)
+	require.NoError(t, err)
+	for _, other := range others {
+		for _, update := range other.Gossip().Encode() {
+			_, err := router.OnGossip(update)
+			require.NoError(t, err)
+		}
+	}
+	return router
+}
+
+func TestTCPOverlayFrames(t *testing.T) {
+	routerA := testMeshRouter(t, mesh.PeerName(0x000000000001))
+	routerB := testMeshRouter(t, mesh.PeerName(0x000000000002), routerA)
+	peerA := routerB.Peers.Fetch(routerA.Ourself.Name)
+	require.NotNil(t, peerA)
+	peerB := routerB.Peers.Fetch(routerB.Ourself.Name)
+
+	// Received frames, and the keys they were forwarded with
+	received := recordingFlowOp{frames: make(chan []byte, 1)}
+	keys := make(chan ForwardPacketKey, 1)
+	tcpA, tcpB := NewTCPOverlay(), NewTCPOverlay()
+	require.NoError(t, tcpA.StartConsumingPackets(routerA.Ourself.Peer, routerA.Peers, func(ForwardPacketKey) FlowOp { return nil }))
+	require.NoError(t, tcpB.StartConsumingPackets(routerB.Ourself.Peer, routerB.Peers, func(key ForwardPacketKey) FlowOp {
+		keys <- key
+		return received
+	}))
+
+	// Wire the forwarders at either end of a connection to each
+	// other, keeping the messages A sends
+	var fwdA, fwdB mesh.OverlayConnection
+	sent := make(chan []byte, 1)
+	conn, err := tcpA.PrepareConnection(mesh.OverlayConnectionParams{
+		RemotePeer: peerB,
+		SendControlMessage: func(tag byte, msg []byte) error {
+			if tag == TCPOverlayFrame {
+				sent <- msg
+			}
+			fwdB.ControlMessage(tag, msg)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	fwdA = conn
+	conn, err = tcpB.PrepareConnection(mesh.OverlayConnectionParams{
+		RemotePeer: peerA,
+		SendControlMessage: func(tag byte, msg []byte) error {
+			fwdA.ControlMessage(tag, msg)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	fwdB = conn
+	defer fwdA.Stop()
+	defer fwdB.Stop()
+
+	// Nothing is forwarded until the remote end has confirmed
+	key := ForwardPacketKey{SrcPeer: peerA, DstPeer: peerB}
+	require.Nil(t, fwdA.(OverlayForwarder).Forward(key))
+	fwdA.Confirm()
+	fwdB.Confirm()
+	<-fwdA.EstablishedChannel()
+	<-fwdB.EstablishedChannel()
+
+	frame := testBroadcastFrame(t, testSrcMAC, &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    []byte{10, 0, 0, 1},
+		DstIP:    []byte{10, 255, 255, 255},
+	})
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(frame)
+	key.PacketKey = dec.PacketKey()
+	fop := fwdA.(OverlayForwarder).Forward(key)
+	require.NotNil(t, fop)
+	fop.Process(frame, dec, true)
+
+	// The message carries the names of the source and destination
+	// peers ahead of the frame
+	msg := <-sent
+	require.Len(t, msg, tcpOverlayHeaderSize+len(frame))
+	require.Equal(t, peerA.NameByte, msg[:NameSize])
+	require.Equal(t, peerB.NameByte, msg[NameSize:tcpOverlayHeaderSize])
+
+	require.Equal(t, frame, <-received.frames)
+	require.Equal(t, key, <-keys)
+
+	rx := fwdB.(*tcpOverlayForwarder).Traffic()["tcp"]
+	require.Equal(t, uint64(1), rx.RxPackets)
+	require.Equal(t, uint64(len(frame)), rx.RxBytes)
+
+	// Messages too short for the header, and from unknown peers,
+	// are dropped
+	fwdB.ControlMessage(TCPOverlayFrame, msg[:tcpOverlayHeaderSize-1])
+	unknown := append([]byte(nil), msg...)
+	copy(unknown, make([]byte, NameSize))
+	fwdB.ControlMessage(TCPOverlayFrame, unknown)
+	require.Empty(t, received.frames)
+	require.Equal(t, uint64(1), fwdB.(*tcpOverlayForwarder).Traffic()["tcp"].RxPackets)
+
+	// Nor is anything forwarded once stopped
+	fwdA.Stop()
+	require.Nil(t, fwdA.(OverlayForwarder).Forward(key))
+}
@@ -0,0 +1,371 @@
+package router
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/weaveworks/mesh"
+)
+
+// Packet traces show how each peer on the way handles a frame to a
+// destination MAC, to find where frames are being lost.  The peer
+// starting the trace sends a probe frame as though it had been
+// captured from the bridge, and every peer which handles the probe,
+// including that one, reports what it did with it by gossip unicast
+// to the peer which started the trace.
+//
+// Probes come from a random source MAC with a prefix reserved for
+// them, so that no flows match them when they reach the fast
+// datapath, and carry an experimental EtherType which nothing on the
+// destination bridge will act on.  The FlowOp which reports on a
+// probe is an inspectingFlowOp, so each hop sees every probe.  Frames
+// captured from the bridge with a source MAC in the probe prefix are
+// dropped, so only the router itself can start a trace.
+
+const (
+	TraceGossipChannel = "trace"
+
+	DefaultTraceTimeout = 2 * time.Second
+	MaxTraceTimeout     = 30 * time.Second
+
+	traceEtherType = layers.EthernetType(0x88b5) // IEEE local experimental
+	traceMinFrame  = 60
+)
+
+// Locally administered, and unlikely to be in use
+var traceMACPrefix = [3]byte{0x0a, 0x77, 0x74}
+
+var traceMagic = [4]byte{'W', 'V', 'T', 'R'}
+
+// The probe payload is the magic, the number of hops the probe has
+// taken, the name of the peer which started the trace and the trace
+// ID.
+const (
+	traceHopOffset    = len(traceMagic)
+	traceOriginOffset = traceHopOffset + 1
+	traceIDOffset     = traceOriginOffset + NameSize
+	tracePayloadSize  = traceIDOffset + 8
+)
+
+// What a peer did with a probe
+const (
+	TraceForwarded = "forwarded" // sent on towards the peer with the destination MAC
+	TraceBroadcast = "broadcast" // destination MAC unknown, so broadcast
+	TraceRelayed   = "relayed"   // passed on towards the destination peer
+	TraceInjected  = "injected"  // delivered to the local bridge
+	TraceDiscarded = "discarded"
+)
+
+type TraceHop struct {
+	Hop      int // how many peers handled the probe before this one
+	Peer     string
+	NickName string
+	Action   string
+	To       string `json:",omitempty"` // the peer with the destination MAC
+	Overlay  string `json:",omitempty"` // of the connection the probe was sent on
+	Via      string `json:",omitempty"` // the peer the probe was sent to
+	Detail   string `json:",omitempty"`
+}
+
+type TraceResult struct {
+	ID      string
+	SrcMAC  string
+	DstMAC  string
+	DstIP   string  `json:",omitempty"`
+	Segment Segment `json:",omitempty"`
+	Hops    []TraceHop
+}
+
+type traceReport struct {
+	ID  uint64
+	Hop TraceHop
+}
+
+type packetTracer struct {
+	router *NetworkRouter
+	gossip mesh.Gossip
+
+	sync.Mutex
+	traces map[uint64]*TraceResult // in progress, by ID
+}
+
+func newPacketTracer(router *NetworkRouter) (*packetTracer, error) {
+	tracer := &packetTracer{router: router, traces: make(map[uint64]*TraceResult)}
+	gossip, err := router.NewGossip(TraceGossipChannel, tracer)
+	if err != nil {
+		return nil, err
+	}
+	tracer.gossip = gossip
+	return tracer, nil
+}
+
+func isTraceMAC(mac MAC) bool {
+	return mac[0] == traceMACPrefix[0] && mac[1] == traceMACPrefix[1] && mac[2] == traceMACPrefix[2]
+}
+
+// Trace sends a probe to the destination MAC, and returns the reports
+// of the peers which handled it within the timeout.  If only the
+// destination IP address is given, its MAC is found from the ARP
+// packets seen by ARP suppression.  With segments enabled, the probe
+// is sent in the segment given, or if that is the default segment, in
+// the segment of the destination IP.
+func (router *NetworkRouter) Trace(dstMAC net.HardwareAddr, dstIP net.IP, segment Segment, timeout time.Duration, stop <-chan struct{}) (*TraceResult, error) {
+	if dstMAC == nil {
+		mac, found := router.traceMACFor(dstIP)
+		if !found {
+			return nil, fmt.Errorf("MAC of %s is unknown; give the destination MAC", dstIP)
+		}
+		dstMAC = net.HardwareAddr(mac[:])
+	}
+
+	var random [8]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint64(random[:])
+	srcMAC := net.HardwareAddr{traceMACPrefix[0], traceMACPrefix[1], traceMACPrefix[2], random[0], random[1], random[2]}
+
+	frame := make([]byte, traceMinFrame)
+	copy(frame[0:], dstMAC)
+	copy(frame[6:], srcMAC)
+	binary.BigEndian.PutUint16(frame[12:], uint16(traceEtherType))
+	payload := frame[EthernetOverhead:]
+	copy(payload, traceMagic[:])
+	copy(payload[traceOriginOffset:], router.Ourself.NameByte)
+	binary.BigEndian.PutUint64(payload[traceIDOffset:], id)
+
+	result := &TraceResult{ID: fmt.Sprintf("%016x", id), SrcMAC: srcMAC.String(), DstMAC: dstMAC.String()}
+	if dstIP != nil {
+		result.DstIP = dstIP.String()
+	}
+	if router.segments != nil {
+		if segment == 0 && dstIP != nil {
+			segment = router.segmentOf(dstIP)
+		}
+		result.Segment = segment
+		if segment != 0 {
+			// as the bridge would have tagged it
+			frame = pushSegmentTag(frame, segment)
+		}
+	}
+	tracer := router.tracer
+	tracer.Lock()
+	tracer.traces[id] = result
+	tracer.Unlock()
+
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(frame)
+	if fop := router.handleLocalPacket(dec.PacketKey(), true); fop != nil {
+		fop.Process(frame, dec, false)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-stop:
+	}
+
+	tracer.Lock()
+	delete(tracer.traces, id)
+	hops := result.Hops
+	tracer.Unlock()
+	sort.Slice(hops, func(i, j int) bool {
+		return hops[i].Hop < hops[j].Hop || (hops[i].Hop == hops[j].Hop && hops[i].Peer < hops[j].Peer)
+	})
+	return result, nil
+}
+
+// traceFlowOp reports what this peer did with a probe, before
+// passing it on with the hop count incremented.
+type traceFlowOp struct {
+	inspectingFlowOp
+	router *NetworkRouter
+	hop    TraceHop
+}
+
+func (op traceFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	payload := dec.linkPayload()
+	if dec.etherType() != traceEtherType || len(payload) < tracePayloadSize {
+		return
+	}
+	if !bytes.Equal(payload[:len(traceMagic)], traceMagic[:]) {
+		return
+	}
+	hop := op.hop
+	hop.Hop = int(payload[traceHopOffset])
+	payload[traceHopOffset]++
+	origin := mesh.PeerNameFromBin(payload[traceOriginOffset:traceIDOffset])
+	id := binary.BigEndian.Uint64(payload[traceIDOffset:])
+	// don't hold up the packet handling goroutine
+	go op.router.tracer.report(origin, traceReport{ID: id, Hop: hop})
+}
+
+// Wrap the FlowOp for a probe in a traceFlowOp describing how it was
+// handled, if the packet is a probe.  local says whether it was
+// captured from the local bridge, in which case the destination peer
+// is found here, as forwardCapturedPacket does.
+func (router *NetworkRouter) tracePacket(key ForwardPacketKey, local bool, fop FlowOp) FlowOp {
+	hop := TraceHop{Peer: router.Ourself.Name.String(), NickName: router.Ourself.NickName}
+	switch {
+	case local:
+		key.DstPeer = router.Macs.Lookup(net.HardwareAddr(key.DstMAC[:]), key.Segment)
+		switch key.DstPeer {
+		case nil:
+			hop.Action = TraceBroadcast
+		case router.Ourself.Peer:
+			hop.Action = TraceDiscarded
+			hop.Detail = "destination MAC is local"
+		default:
+			hop.Action = TraceForwarded
+			router.traceNextHop(&hop, key.DstPeer)
+		}
+	case key.DstPeer != router.Ourself.Peer:
+		hop.Action = TraceRelayed
+		router.traceNextHop(&hop, key.DstPeer)
+	default:
+		hop.Action = TraceInjected
+		if dstPeer := router.Macs.Lookup(net.HardwareAddr(key.DstMAC[:]), key.Segment); dstPeer != router.Ourself.Peer {
+			hop.Detail = "destination MAC is not local; relaying as a broadcast"
+		}
+	}
+	if key.DstPeer != nil && key.DstPeer != router.Ourself.Peer {
+		hop.To = key.DstPeer.String()
+	}
+	if fop == nil || fop.Discards() {
+		hop.Action = TraceDiscarded
+	}
+
+	mfop := NewMultiFlowOp(false, traceFlowOp{router: router, hop: hop})
+	if fop != nil {
+		mfop.Add(fop)
+	}
+	return mfop
+}
+
+func (router *NetworkRouter) traceNextHop(hop *TraceHop, dstPeer *mesh.Peer) {
+	fwd, via, err := router.nextHop(dstPeer)
+	if err != nil {
+		hop.Detail = err.Error()
+		return
+	}
+	hop.Via = via.String()
+	if peer := router.Peers.Fetch(via); peer != nil {
+		hop.Via = peer.String()
+	}
+	hop.Overlay, _ = fwd.Attrs()["name"].(string)
+}
+
+// The MAC of an IPv4 address, from the bindings ARP suppression has
+// learnt
+func (router *NetworkRouter) traceMACFor(ip net.IP) (MAC, bool) {
+	var mac MAC
+	ipv4 := ip.To4()
+	if router.arp == nil || ipv4 == nil {
+		return mac, false
+	}
+	var key [4]byte
+	copy(key[:], ipv4)
+	router.arp.Lock()
+	defer router.arp.Unlock()
+	mac, found := router.arp.bindings[key]
+	return mac, found
+}
+
+func (tracer *packetTracer) report(origin mesh.PeerName, report traceReport) {
+	if origin == tracer.router.Ourself.Name {
+		tracer.record(report)
+		return
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(report); err != nil {
+		log.Warningln("Packet trace: unable to encode report:", err)
+		return
+	}
+	if err := tracer.gossip.GossipUnicast(origin, buf.Bytes()); err != nil {
+		log.Warningln("Packet trace: unable to report to", origin, err)
+	}
+}
+
+func (tracer *packetTracer) record(report traceReport) {
+	tracer.Lock()
+	defer tracer.Unlock()
+	if result := tracer.traces[report.ID]; result != nil {
+		result.Hops = append(result.Hops, report.Hop)
+	}
+}
+
+// Gossip methods - only unicast is used
+
+func (tracer *packetTracer) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	var report traceReport
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&report); err != nil {
+		return err
+	}
+	tracer.record(report)
+	return nil
+}
+
+func (tracer *packetTracer) OnGossipBroadcast(sender mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	return nil, nil
+}
+
+func (tracer *packetTracer) Gossip() mesh.GossipData {
+	return nil
+}
+
+func (tracer *packetTracer) OnGossip(msg []byte) (mesh.GossipData, error) {
+	return nil, nil
+}
+
+// ParseTraceRequest reads the destination, segment and timeout of a
+// trace from the parameters mac, ip, segment and timeout.  At least
+// one of mac and ip must be given.
+func ParseTraceRequest(r *http.Request) (dstMAC net.HardwareAddr, dstIP net.IP, segment Segment, timeout time.Duration, err error) {
+	if err = r.ParseForm(); err != nil {
+		return
+	}
+	if s := r.FormValue("mac"); s != "" {
+		if dstMAC, err = net.ParseMAC(s); err != nil {
+			return
+		}
+	}
+	if s := r.FormValue("ip"); s != "" {
+		if dstIP = net.ParseIP(s); dstIP == nil {
+			err = fmt.Errorf("invalid IP address %q", s)
+			return
+		}
+	}
+	if dstMAC == nil && dstIP == nil {
+		err = fmt.Errorf("no destination mac or ip given")
+		return
+	}
+	if s := r.FormValue("segment"); s != "" {
+		id, perr := strconv.ParseUint(s, 10, 16)
+		if perr != nil || id == 1 || id > MaxSegment {
+			err = fmt.Errorf("invalid segment %q", s)
+			return
+		}
+		segment = Segment(id)
+	}
+	timeout = DefaultTraceTimeout
+	if s := r.FormValue("timeout"); s != "" {
+		if timeout, err = time.ParseDuration(s); err != nil {
+			return
+		}
+		if timeout <= 0 || timeout > MaxTraceTimeout {
+			err = fmt.Errorf("trace timeout must be positive and at most %v", MaxTraceTimeout)
+		}
+	}
+	return
+}
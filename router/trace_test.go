@@ -0,0 +1,22 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Containers cannot send probes: frames from the bridge with a probe
+// source MAC are dropped before anything else looks at them.
+func TestCapturedProbesDropped(t *testing.T) {
+	router := &NetworkRouter{}
+	for _, mac := range []MAC{
+		{0x0a, 0x77, 0x74, 0x00, 0x00, 0x00},
+		{0x0a, 0x77, 0x74, 0x12, 0x34, 0x56},
+	} {
+		require.True(t, isTraceMAC(mac))
+		fop := router.handleCapturedPacket(PacketKey{SrcMAC: mac, DstMAC: MAC{0x02, 0, 0, 0, 0, 1}})
+		require.Equal(t, FlowOp(DiscardingFlowOp{}), fop, mac.String())
+	}
+	require.False(t, isTraceMAC(MAC{0x0a, 0x77, 0x75, 0x12, 0x34, 0x56}))
+}
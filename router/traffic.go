@@ -0,0 +1,69 @@
+package router
+
+import (
+	"sync/atomic"
+)
+
+// TrafficStats counts the frames carried across a connection.  Tx is
+// towards the remote peer, Rx from it; frames which are only relayed
+// through either end are included.
+type TrafficStats struct {
+	TxBytes   uint64
+	TxPackets uint64
+	RxBytes   uint64
+	RxPackets uint64
+}
+
+func (stats *TrafficStats) Add(other TrafficStats) {
+	stats.TxBytes += other.TxBytes
+	stats.TxPackets += other.TxPackets
+	stats.RxBytes += other.RxBytes
+	stats.RxPackets += other.RxPackets
+}
+
+func (stats *TrafficStats) count(tx bool, packets, bytes uint64) {
+	if tx {
+		stats.TxPackets += packets
+		stats.TxBytes += bytes
+	} else {
+		stats.RxPackets += packets
+		stats.RxBytes += bytes
+	}
+}
+
+// Forwarders which count their traffic implement trafficReporter.
+// The result is keyed by overlay name, so that an
+// overlaySwitchForwarder can report on each of its subsidiary
+// forwarders.
+type trafficReporter interface {
+	Traffic() map[string]TrafficStats
+}
+
+// trafficCounters may be updated concurrently from the capture and
+// receive paths.  They must be allocated separately, so that the
+// counters are 64-bit aligned for the atomic operations.
+type trafficCounters struct {
+	txBytes   uint64
+	txPackets uint64
+	rxBytes   uint64
+	rxPackets uint64
+}
+
+func (c *trafficCounters) countTx(frame []byte) {
+	atomic.AddUint64(&c.txBytes, uint64(len(frame)))
+	atomic.AddUint64(&c.txPackets, 1)
+}
+
+func (c *trafficCounters) countRx(frame []byte) {
+	atomic.AddUint64(&c.rxBytes, uint64(len(frame)))
+	atomic.AddUint64(&c.rxPackets, 1)
+}
+
+func (c *trafficCounters) stats() TrafficStats {
+	return TrafficStats{
+		TxBytes:   atomic.LoadUint64(&c.txBytes),
+		TxPackets: atomic.LoadUint64(&c.txPackets),
+		RxBytes:   atomic.LoadUint64(&c.rxBytes),
+		RxPackets: atomic.LoadUint64(&c.rxPackets),
+	}
+}
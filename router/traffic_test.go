@@ -0,0 +1,106 @@
+package router
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testTrafficForwarder counts the frames it forwards, and those it is
+// given to receive, as the real forwarders do
+type testTrafficForwarder struct {
+	NullNetworkOverlay
+	overlay string
+	traffic *trafficCounters
+}
+
+func newTestTrafficForwarder(overlay string) testTrafficForwarder {
+	return testTrafficForwarder{overlay: overlay, traffic: &trafficCounters{}}
+}
+
+func (testTrafficForwarder) HealthChannel() <-chan bool {
+	return nil
+}
+
+func (fwd testTrafficForwarder) Forward(ForwardPacketKey) FlowOp {
+	return testTrafficFlowOp{fwd: fwd}
+}
+
+func (fwd testTrafficForwarder) receive(frame []byte) {
+	fwd.traffic.countRx(frame)
+}
+
+func (fwd testTrafficForwarder) Traffic() map[string]TrafficStats {
+	return map[string]TrafficStats{fwd.overlay: fwd.traffic.stats()}
+}
+
+type testTrafficFlowOp struct {
+	NonDiscardingFlowOp
+	fwd testTrafficForwarder
+}
+
+func (op testTrafficFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	op.fwd.traffic.countTx(frame)
+}
+
+func TestTrafficCounters(t *testing.T) {
+	fwd := newTestTrafficForwarder("sleeve")
+	require.Equal(t, map[string]TrafficStats{"sleeve": {}}, fwd.Traffic())
+
+	// Frames counted concurrently from the capture and receive
+	// paths all add up
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				fwd.Forward(ForwardPacketKey{}).Process(make([]byte, 60), nil, false)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				fwd.receive(make([]byte, 1500))
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, map[string]TrafficStats{"sleeve": {
+		TxBytes: 1000 * 60, TxPackets: 1000,
+		RxBytes: 1000 * 1500, RxPackets: 1000,
+	}}, fwd.Traffic())
+
+	total := TrafficStats{TxBytes: 1, TxPackets: 2, RxBytes: 3, RxPackets: 4}
+	total.Add(TrafficStats{TxBytes: 10, TxPackets: 20, RxBytes: 30, RxPackets: 40})
+	require.Equal(t, TrafficStats{TxBytes: 11, TxPackets: 22, RxBytes: 33, RxPackets: 44}, total)
+}
+
+// The overlay switch reports the traffic of each of its subsidiary
+// forwarders, by overlay
+func TestOverlaySwitchTraffic(t *testing.T) {
+	fastdp := newTestTrafficForwarder("fastdp")
+	sleeve := newTestTrafficForwarder("sleeve")
+	fwd := &overlaySwitchForwarder{forwarders: []subForwarder{
+		{fwd: fastdp, overlayName: "fastdp"},
+		{fwd: sleeve, overlayName: "sleeve"},
+		{fwd: testCompatConnection{}, overlayName: "compat"}, // doesn't count its traffic
+	}}
+	require.Equal(t, map[string]TrafficStats{"fastdp": {}, "sleeve": {}}, fwd.Traffic())
+
+	fastdp.Forward(ForwardPacketKey{}).Process(make([]byte, 100), nil, false)
+	fastdp.receive(make([]byte, 200))
+	fastdp.receive(make([]byte, 300))
+	sleeve.Forward(ForwardPacketKey{}).Process(make([]byte, 400), nil, false)
+	require.Equal(t, map[string]TrafficStats{
+		"fastdp": {TxBytes: 100, TxPackets: 1, RxBytes: 500, RxPackets: 2},
+		"sleeve": {TxBytes: 400, TxPackets: 1},
+	}, fwd.Traffic())
+
+	// Forwarders of the same overlay add up
+	other := newTestTrafficForwarder("sleeve")
+	other.receive(make([]byte, 50))
+	fwd.forwarders = append(fwd.forwarders, subForwarder{fwd: other, overlayName: "sleeve"})
+	require.Equal(t, TrafficStats{TxBytes: 400, TxPackets: 1, RxBytes: 50, RxPackets: 1}, fwd.Traffic()["sleeve"])
+}
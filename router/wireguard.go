@@ -0,0 +1,562 @@
+// This contains the Overlay implementation which carries frames over
+// a kernel WireGuard device.
+//
+// Each peer has an IPv6 link-local address on the device, derived
+// from its peer name, and frames are sent in UDP between those
+// addresses.  WireGuard's cryptokey routing guarantees that a packet
+// from a given address really came from the peer with that name.
+// Public keys are exchanged in the connection features, and the
+// preshared keys are derived from the mesh session key, so the
+// overlay is only used on encrypted connections.
+
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/wireguard"
+)
+
+const (
+	WireGuardIfName = "weave-wg"
+	WireGuardMTU    = 1420
+
+	wireGuardPublicKeyFeature = "WireGuardPublicKey"
+	wireGuardPortFeature      = "WireGuardPort"
+)
+
+// The WireGuard device, as the overlay uses it
+type wireGuardDevice interface {
+	Name() string
+	AddAddr(ip net.IP) error
+	SetPeer(peer wireguard.Peer) error
+	RemovePeer(publicKey wireguard.Key) error
+	Destroy() error
+}
+
+type WireGuardOverlay struct {
+	device     wireGuardDevice
+	privateKey wireguard.Key
+	publicKey  wireguard.Key
+	listenPort int // the UDP port of the WireGuard device
+	port       int // the UDP port for frames within the tunnel
+
+	// These fields are set in StartConsumingPackets, and not
+	// subsequently modified
+	localPeer *mesh.Peer
+	consumer  OverlayConsumer
+	peers     *mesh.Peers
+	conn      *net.UDPConn
+
+	// The device has a single peer for each public key, so it
+	// has the configuration of the confirmed forwarder to each
+	// remote peer.  Both are guarded by lock.
+	lock       sync.Mutex
+	forwarders map[mesh.PeerName]*wireGuardForwarder
+}
+
+// NewWireGuardOverlay sets up the WireGuard device, listening on
+// listenPort.  Frames within the tunnel use port.
+func NewWireGuardOverlay(listenPort, port int) (*WireGuardOverlay, error) {
+	device, err := wireguard.New(WireGuardIfName, WireGuardMTU)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := wireguard.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := device.Configure(privateKey, listenPort); err != nil {
+		return nil, err
+	}
+
+	return &WireGuardOverlay{
+		device:     device,
+		privateKey: privateKey,
+		publicKey:  privateKey.PublicKey(),
+		listenPort: listenPort,
+		port:       port,
+		forwarders: make(map[mesh.PeerName]*wireGuardForwarder),
+	}, nil
+}
+
+// The link-local address of a peer on the WireGuard device
+func wireGuardAddr(name []byte) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	ip[0], ip[1] = 0xfe, 0x80
+	copy(ip[net.IPv6len-NameSize:], name)
+	return ip
+}
+
+func (wg *WireGuardOverlay) udpAddr(name []byte) *net.UDPAddr {
+	return &net.UDPAddr{IP: wireGuardAddr(name), Port: wg.port, Zone: wg.device.Name()}
+}
+
+func (wg *WireGuardOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *mesh.Peers, consumer OverlayConsumer) error {
+	if err := wg.device.AddAddr(wireGuardAddr(localPeer.NameByte)); err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp6", wg.udpAddr(localPeer.NameByte))
+	if err != nil {
+		return err
+	}
+
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+
+	if wg.localPeer != nil {
+		conn.Close()
+		return fmt.Errorf("StartConsumingPackets already called")
+	}
+
+	wg.localPeer = localPeer
+	wg.consumer = consumer
+	wg.peers = peers
+	wg.conn = conn
+	go wg.readUDP()
+	return nil
+}
+
+func (*WireGuardOverlay) InvalidateRoutes() {
+	// no cached information, so nothing to do
+}
+
+func (*WireGuardOverlay) InvalidateShortIDs() {
+	// no cached information, so nothing to do
+}
+
+func (wg *WireGuardOverlay) AddFeaturesTo(features map[string]string) {
+	features[wireGuardPublicKeyFeature] = wg.publicKey.String()
+	features[wireGuardPortFeature] = strconv.Itoa(wg.listenPort)
+}
+
+func (wg *WireGuardOverlay) Diagnostics() interface{} {
+	return map[string]interface{}{
+		"Interface": wg.device.Name(),
+		"PublicKey": wg.publicKey.String(),
+		"Port":      wg.listenPort,
+	}
+}
+
+func (wg *WireGuardOverlay) Stop() {
+	if err := wg.device.Destroy(); err != nil {
+		log.Errorf("wireguard: unable to delete %s: %s", wg.device.Name(), err)
+	}
+}
+
+func (wg *WireGuardOverlay) lookupForwarder(peer mesh.PeerName) *wireGuardForwarder {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+	return wg.forwarders[peer]
+}
+
+// Make fwd the forwarder to its remote peer, replacing the device
+// peer of any earlier connection to it, along with its preshared key.
+func (wg *WireGuardOverlay) addForwarder(fwd *wireGuardForwarder) error {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+	if err := wg.device.SetPeer(fwd.devicePeer); err != nil {
+		return err
+	}
+	wg.forwarders[fwd.remotePeer.Name] = fwd
+	return nil
+}
+
+// Remove fwd, and the device peer, unless a newer connection to the
+// same remote peer has replaced them.
+func (wg *WireGuardOverlay) removeForwarder(fwd *wireGuardForwarder) error {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+	if wg.forwarders[fwd.remotePeer.Name] != fwd {
+		return nil
+	}
+	delete(wg.forwarders, fwd.remotePeer.Name)
+	return wg.device.RemovePeer(fwd.remoteKey)
+}
+
+// Each UDP packet within the tunnel carries a single frame, preceded
+// by the names of its source and destination peers.
+const wireGuardHeaderSize = NameSize + NameSize
+
+func (wg *WireGuardOverlay) readUDP() {
+	defer wg.conn.Close()
+	dec := NewEthernetDecoder()
+	buf := make([]byte, MaxUDPPacketSize)
+
+	for {
+		n, sender, err := wg.conn.ReadFromUDP(buf)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			log.Print("wireguard: ignoring UDP read error ", err)
+			continue
+		} else if n < wireGuardHeaderSize {
+			log.Print("wireguard: ignoring too short UDP packet from ", sender)
+			continue
+		}
+
+		senderIP := sender.IP.To16()
+		fwd := wg.lookupForwarder(mesh.PeerNameFromBin(senderIP[net.IPv6len-NameSize:]))
+		if fwd == nil {
+			continue
+		}
+
+		// The frame may be queued by the consumer, and buf is
+		// reused, so take a copy
+		frame := make([]byte, n-wireGuardHeaderSize)
+		copy(frame, buf[wireGuardHeaderSize:n])
+		dec.DecodeLayers(frame)
+		decodedLen := len(dec.decoded)
+		if decodedLen == 0 {
+			continue
+		}
+
+		srcPeer := wg.peers.Fetch(mesh.PeerNameFromBin(buf[:NameSize]))
+		dstPeer := wg.peers.Fetch(mesh.PeerNameFromBin(buf[NameSize:wireGuardHeaderSize]))
+		if srcPeer == nil || dstPeer == nil {
+			continue
+		}
+
+		if decodedLen == 1 && dec.IsSpecial() {
+			if srcPeer == fwd.remotePeer && dstPeer == wg.localPeer {
+				fwd.handleSpecialFrame(frame)
+			}
+			continue
+		}
+
+		fwd.traffic.countRx(frame)
+		if fop := wg.consumer(ForwardPacketKey{
+			SrcPeer:   srcPeer,
+			DstPeer:   dstPeer,
+			PacketKey: dec.PacketKey(),
+		}); fop != nil {
+			fop.Process(frame, dec, false)
+		}
+	}
+}
+
+func (wg *WireGuardOverlay) send(srcPeer, dstPeer *mesh.Peer, frame []byte, raddr *net.UDPAddr) error {
+	wg.lock.Lock()
+	conn := wg.conn
+	wg.lock.Unlock()
+
+	if conn == nil {
+		// Consume wasn't called yet
+		return nil
+	}
+
+	msg := make([]byte, wireGuardHeaderSize+len(frame))
+	copy(msg, srcPeer.NameByte)
+	copy(msg[NameSize:], dstPeer.NameByte)
+	copy(msg[wireGuardHeaderSize:], frame)
+	_, err := conn.WriteToUDP(msg, raddr)
+	return err
+}
+
+type wireGuardForwarder struct {
+	wg             *WireGuardOverlay
+	remotePeer     *mesh.Peer
+	remoteAddr     *net.UDPAddr // within the tunnel
+	remoteKey      wireguard.Key
+	devicePeer     wireguard.Peer // set on the device on Confirm
+	sendControlMsg func(byte, []byte) error
+	connUID        uint64
+	traffic        *trafficCounters
+
+	lock              sync.Mutex
+	confirmed         bool
+	heartbeatInterval time.Duration
+	heartbeatTimer    *time.Timer // for sending
+	heartbeatTimeout  *time.Timer // for receiving
+	ackedHeartbeat    bool
+	stopChan          chan struct{}
+	stopped           bool
+	healthy           bool
+	established       bool
+	establishedChan   chan struct{}
+	errorChan         chan error
+	healthChan        chan bool
+}
+
+func (wg *WireGuardOverlay) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	if params.SessionKey == nil {
+		return nil, fmt.Errorf("encryption is not enabled")
+	}
+
+	keyFeature, present := params.Features[wireGuardPublicKeyFeature]
+	if !present {
+		return nil, fmt.Errorf("peer did not supply a WireGuard public key")
+	}
+	remoteKey, err := wireguard.ParseKey(keyFeature)
+	if err != nil {
+		return nil, fmt.Errorf("bad WireGuard public key from peer: %s", err)
+	}
+
+	presharedKey, err := wireguard.DerivePresharedKey(params.SessionKey, params.ConnUID)
+	if err != nil {
+		return nil, err
+	}
+
+	peer := wireguard.Peer{
+		PublicKey:    remoteKey,
+		PresharedKey: presharedKey,
+		AllowedIP:    wireGuardAddr(params.RemotePeer.NameByte),
+	}
+	// The connectee learns the endpoint when the connector first
+	// sends a handshake.
+	if params.Outbound {
+		port, err := strconv.Atoi(params.Features[wireGuardPortFeature])
+		if err != nil {
+			return nil, fmt.Errorf("bad WireGuard port from peer: %s", err)
+		}
+		peer.Endpoint = &net.UDPAddr{IP: params.RemoteAddr.IP, Port: port}
+	}
+	fwd := &wireGuardForwarder{
+		wg:             wg,
+		remotePeer:     params.RemotePeer,
+		remoteAddr:     wg.udpAddr(params.RemotePeer.NameByte),
+		remoteKey:      remoteKey,
+		devicePeer:     peer,
+		sendControlMsg: params.SendControlMessage,
+		connUID:        params.ConnUID,
+		traffic:        &trafficCounters{},
+		healthy:        true,
+
+		heartbeatInterval: FastHeartbeat,
+		stopChan:          make(chan struct{}),
+
+		establishedChan: make(chan struct{}),
+		errorChan:       make(chan error, 1),
+		healthChan:      make(chan bool),
+	}
+
+	return fwd, nil
+}
+
+func (fwd *wireGuardForwarder) logPrefix() string {
+	return fmt.Sprintf("wireguard ->[%s]: ", fwd.remotePeer)
+}
+
+func (fwd *wireGuardForwarder) Confirm() {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	if fwd.confirmed {
+		log.Fatal(fwd.logPrefix(), "already confirmed")
+	}
+
+	log.Debug(fwd.logPrefix(), "confirmed")
+	fwd.confirmed = true
+	if err := fwd.wg.addForwarder(fwd); err != nil {
+		fwd.handleError(err)
+		return
+	}
+
+	// have the goroutine send a heartbeat straight away
+	fwd.heartbeatTimer = time.NewTimer(0)
+	fwd.heartbeatTimeout = time.NewTimer(HeartbeatTimeout)
+
+	go fwd.doHeartbeats()
+}
+
+func (fwd *wireGuardForwarder) EstablishedChannel() <-chan struct{} {
+	return fwd.establishedChan
+}
+
+func (fwd *wireGuardForwarder) ErrorChannel() <-chan error {
+	return fwd.errorChan
+}
+
+func (fwd *wireGuardForwarder) HealthChannel() <-chan bool {
+	return fwd.healthChan
+}
+
+func (fwd *wireGuardForwarder) doHeartbeats() {
+	for {
+		select {
+		case <-fwd.heartbeatTimer.C:
+			log.Debug(fwd.logPrefix(), "sending Heartbeat to peer")
+			if err := fwd.sendHeartbeat(); err != nil {
+				log.Debug(fwd.logPrefix(), "sending Heartbeat failed: ", err)
+			}
+			fwd.lock.Lock()
+			fwd.heartbeatTimer.Reset(fwd.heartbeatInterval)
+			fwd.lock.Unlock()
+
+		case <-fwd.heartbeatTimeout.C:
+			log.Debug(fwd.logPrefix(), "missed Heartbeat from peer, marking wireguard forwarder as un-healthy")
+
+			// treat missed heartbeat as transient error. Indicate to overlay forwarder
+			// that Forwarder is un-healthy so it can pick next best forwarder
+			select {
+			case fwd.healthChan <- false:
+			case <-fwd.stopChan:
+				return
+			}
+
+			fwd.lock.Lock()
+			fwd.healthy = false
+			// avoid aggressive heartbeats when the peer is not answering
+			fwd.setHeartbeatInterval(SlowHeartbeat)
+			fwd.lock.Unlock()
+
+		case <-fwd.stopChan:
+			return
+		}
+	}
+}
+
+func (fwd *wireGuardForwarder) setHeartbeatInterval(interval time.Duration) {
+	if fwd.heartbeatInterval != interval {
+		fwd.heartbeatInterval = interval
+		if fwd.heartbeatTimer != nil {
+			fwd.heartbeatTimer.Reset(fwd.heartbeatInterval)
+		}
+	}
+}
+
+// Handle an error which leads to notifying the listener and
+// termination of the forwarder
+func (fwd *wireGuardForwarder) handleError(err error) {
+	if err == nil {
+		return
+	}
+
+	select {
+	case fwd.errorChan <- err:
+	default:
+	}
+
+	// stop the heartbeat goroutine
+	if !fwd.stopped {
+		fwd.stopped = true
+		close(fwd.stopChan)
+	}
+}
+
+func (fwd *wireGuardForwarder) sendHeartbeat() error {
+	// the heartbeat payload consists of the 64-bit connection uid
+	buf := make([]byte, EthernetOverhead+8)
+	binary.BigEndian.PutUint64(buf[EthernetOverhead:], fwd.connUID)
+	return fwd.wg.send(fwd.wg.localPeer, fwd.remotePeer, buf, fwd.remoteAddr)
+}
+
+const (
+	WireGuardHeartbeatAck = iota
+)
+
+func (fwd *wireGuardForwarder) handleSpecialFrame(frame []byte) {
+	// the only special frame is a heartbeat
+	if len(frame) != EthernetOverhead+8 ||
+		binary.BigEndian.Uint64(frame[EthernetOverhead:]) != fwd.connUID {
+		return
+	}
+
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	if fwd.stopped {
+		return
+	}
+
+	if !fwd.ackedHeartbeat {
+		fwd.ackedHeartbeat = true
+		log.Debug(fwd.logPrefix(), "Ack Heartbeat from peer")
+		fwd.handleError(fwd.sendControlMsg(WireGuardHeartbeatAck, nil))
+	}
+
+	// we can receive a heartbeat before Confirm() has set up
+	// heartbeatTimeout
+	if fwd.heartbeatTimeout != nil {
+		fwd.heartbeatTimeout.Reset(HeartbeatTimeout)
+		if !fwd.healthy {
+			log.Debug(fwd.logPrefix(), "got Heartbeat from peer, marking wireguard forwarder as healthy")
+			fwd.healthy = true
+			go func() {
+				select {
+				case fwd.healthChan <- true:
+				case <-fwd.stopChan:
+				}
+			}()
+		}
+	}
+}
+
+func (fwd *wireGuardForwarder) ControlMessage(tag byte, msg []byte) {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	switch tag {
+	case WireGuardHeartbeatAck:
+		fwd.handleHeartbeatAck()
+	default:
+		log.Info(fwd.logPrefix(), "Ignoring unknown control message: ", tag)
+	}
+}
+
+func (fwd *wireGuardForwarder) handleHeartbeatAck() {
+	log.Debug(fwd.logPrefix(), "handleHeartbeatAck")
+
+	if !fwd.established {
+		close(fwd.establishedChan)
+		fwd.established = true
+	}
+
+	fwd.setHeartbeatInterval(SlowHeartbeat)
+}
+
+func (fwd *wireGuardForwarder) Attrs() map[string]interface{} {
+	return map[string]interface{}{"name": "wireguard", "mtu": WireGuardMTU}
+}
+
+func (fwd *wireGuardForwarder) Traffic() map[string]TrafficStats {
+	return map[string]TrafficStats{"wireguard": fwd.traffic.stats()}
+}
+
+func (fwd *wireGuardForwarder) Forward(key ForwardPacketKey) FlowOp {
+	return wireGuardFlowOp{fwd: fwd, key: key}
+}
+
+type wireGuardFlowOp struct {
+	NonDiscardingFlowOp
+	fwd *wireGuardForwarder
+	key ForwardPacketKey
+}
+
+func (op wireGuardFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	// Frames larger than the device MTU are fragmented by the
+	// kernel within the tunnel, so there is no need for PMTU
+	// handling here.
+	if err := op.fwd.wg.send(op.key.SrcPeer, op.key.DstPeer, frame, op.fwd.remoteAddr); err != nil {
+		log.Debug(op.fwd.logPrefix(), err)
+		return
+	}
+	op.fwd.traffic.countTx(frame)
+}
+
+func (fwd *wireGuardForwarder) Stop() {
+	if err := fwd.wg.removeForwarder(fwd); err != nil {
+		log.Warning(fwd.logPrefix(), err)
+	}
+
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+	fwd.sendControlMsg = func(byte, []byte) error { return nil }
+
+	// stop the heartbeat goroutine
+	if !fwd.stopped {
+		fwd.stopped = true
+		close(fwd.stopChan)
+	}
+}
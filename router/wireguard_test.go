@@ -0,0 +1,117 @@
+package router
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/wireguard"
+)
+
+// fakeWireGuardDevice keeps the peers set on it
+type fakeWireGuardDevice struct {
+	sync.Mutex
+	peers map[wireguard.Key]wireguard.Peer
+}
+
+func (*fakeWireGuardDevice) Name() string         { return WireGuardIfName }
+func (*fakeWireGuardDevice) AddAddr(net.IP) error { return nil }
+func (*fakeWireGuardDevice) Destroy() error       { return nil }
+
+func (dev *fakeWireGuardDevice) SetPeer(peer wireguard.Peer) error {
+	dev.Lock()
+	defer dev.Unlock()
+	dev.peers[peer.PublicKey] = peer
+	return nil
+}
+
+func (dev *fakeWireGuardDevice) RemovePeer(publicKey wireguard.Key) error {
+	dev.Lock()
+	defer dev.Unlock()
+	delete(dev.peers, publicKey)
+	return nil
+}
+
+func (dev *fakeWireGuardDevice) peer(publicKey wireguard.Key) (wireguard.Peer, bool) {
+	dev.Lock()
+	defer dev.Unlock()
+	peer, found := dev.peers[publicKey]
+	return peer, found
+}
+
+func TestWireGuardConnections(t *testing.T) {
+	dev := &fakeWireGuardDevice{peers: make(map[wireguard.Key]wireguard.Peer)}
+	wg := &WireGuardOverlay{device: dev, listenPort: 6785, port: 6784, forwarders: make(map[mesh.PeerName]*wireGuardForwarder)}
+
+	privateKey, err := wireguard.GeneratePrivateKey()
+	require.NoError(t, err)
+	remoteKey := privateKey.PublicKey()
+	remotePeer := testPeer(mesh.PeerName(0x000000000002), "host2")
+	remotePeer.NameByte = []byte{0, 0, 0, 0, 0, 2}
+	features := map[string]string{wireGuardPublicKeyFeature: remoteKey.String(), wireGuardPortFeature: "6785"}
+	sessionKey := [32]byte{1, 2, 3}
+
+	prepare := func(connUID uint64) *wireGuardForwarder {
+		conn, err := wg.PrepareConnection(mesh.OverlayConnectionParams{
+			RemotePeer:         remotePeer,
+			RemoteAddr:         &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 6783},
+			Outbound:           true,
+			ConnUID:            connUID,
+			SessionKey:         &sessionKey,
+			Features:           features,
+			SendControlMessage: func(byte, []byte) error { return nil },
+		})
+		require.NoError(t, err)
+		return conn.(*wireGuardForwarder)
+	}
+	presharedKey := func(connUID uint64) wireguard.Key {
+		key, err := wireguard.DerivePresharedKey(&sessionKey, connUID)
+		require.NoError(t, err)
+		return key
+	}
+
+	// The device peer is only set on Confirm
+	fwd1 := prepare(1)
+	_, found := dev.peer(remoteKey)
+	require.False(t, found)
+	fwd1.Confirm()
+	peer, found := dev.peer(remoteKey)
+	require.True(t, found)
+	require.Equal(t, presharedKey(1), peer.PresharedKey)
+	require.Equal(t, &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 6785}, peer.Endpoint)
+	require.Equal(t, wireGuardAddr(remotePeer.NameByte), peer.AllowedIP)
+
+	// A duplicate connection which is never confirmed leaves the
+	// device peer alone, even when it is stopped
+	fwd2 := prepare(2)
+	fwd2.Stop()
+	peer, _ = dev.peer(remoteKey)
+	require.Equal(t, presharedKey(1), peer.PresharedKey)
+	require.Equal(t, fwd1, wg.lookupForwarder(remotePeer.Name))
+
+	// One which is confirmed takes the device peer over, so
+	// stopping the earlier one doesn't remove it
+	fwd3 := prepare(3)
+	fwd3.Confirm()
+	peer, _ = dev.peer(remoteKey)
+	require.Equal(t, presharedKey(3), peer.PresharedKey)
+	fwd1.Stop()
+	peer, found = dev.peer(remoteKey)
+	require.True(t, found)
+	require.Equal(t, presharedKey(3), peer.PresharedKey)
+	require.Equal(t, fwd3, wg.lookupForwarder(remotePeer.Name))
+
+	fwd3.Stop()
+	_, found = dev.peer(remoteKey)
+	require.False(t, found)
+	require.Nil(t, wg.lookupForwarder(remotePeer.Name))
+
+	// The overlay needs encryption and the remote peer's key
+	_, err = wg.PrepareConnection(mesh.OverlayConnectionParams{RemotePeer: remotePeer, Features: features})
+	require.Error(t, err)
+	_, err = wg.PrepareConnection(mesh.OverlayConnectionParams{RemotePeer: remotePeer, SessionKey: &sessionKey, Features: map[string]string{}})
+	require.Error(t, err)
+}
@@ -0,0 +1,3 @@
+module github.com/weaveworks/go-odp
+
+go 1.12
@@ -0,0 +1,151 @@
+package odp
+
+import (
+	"syscall"
+	"testing"
+)
+
+func flowKeyNlAttrs(t *testing.T, fks FlowKeys) (keys Attrs, masks Attrs) {
+	msg := NewNlMsgBuilder(0, 0)
+	if err := fks.toNlAttrs(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := msg.Finish()
+	attrs, err := ParseNestedAttrs(data[syscall.NLMSG_HDRLEN:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err = attrs.GetNestedAttrs(OVS_FLOW_ATTR_KEY, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	masks, err = attrs.GetNestedAttrs(OVS_FLOW_ATTR_MASK, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys, masks
+}
+
+func TestEthertypeFlowKey(t *testing.T) {
+	fk := NewEthertypeFlowKey(0x0800)
+	if fk.Ethertype() != 0x0800 {
+		t.Fatal("wrong ethertype", fk)
+	}
+
+	flow := FlowKeys{
+		OVS_KEY_ATTR_ETHERNET:  NewEthernetFlowKey(),
+		OVS_KEY_ATTR_ETHERTYPE: fk,
+	}
+	keys, masks := flowKeyNlAttrs(t, flow)
+	if k := keys[OVS_KEY_ATTR_ETHERTYPE]; len(k) != 2 || k[0] != 0x08 || k[1] != 0x00 {
+		t.Fatal("wrong ethertype key", k)
+	}
+
+	if m := masks[OVS_KEY_ATTR_ETHERTYPE]; !AllBytes(m, 0xff) {
+		t.Fatal("ethertype not exact", m)
+	}
+
+	// The IPv4 key must be present, wildcarded
+	if k := keys[OVS_KEY_ATTR_IPV4]; len(k) != 12 {
+		t.Fatal("missing IPv4 key", k)
+	}
+
+	if m := masks[OVS_KEY_ATTR_IPV4]; len(m) != 12 || !AllBytes(m, 0) {
+		t.Fatal("IPv4 key not wildcarded", m)
+	}
+
+	// It parses back to the same flow keys, the protocol key
+	// being ignored
+	fks, err := ParseFlowKeys(keys, masks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !fks.Equals(flow) {
+		t.Fatal("flow keys differ", fks)
+	}
+
+	if _, ok := fks[OVS_KEY_ATTR_ETHERTYPE].(EthertypeFlowKey); !ok {
+		t.Fatal("ethertype key parsed as", fks[OVS_KEY_ATTR_ETHERTYPE])
+	}
+}
+
+func TestEthertypeFlowKeyWithoutProtocol(t *testing.T) {
+	// No protocol key is needed for other ethertypes
+	keys, _ := flowKeyNlAttrs(t, FlowKeys{OVS_KEY_ATTR_ETHERTYPE: NewEthertypeFlowKey(0x88cc)})
+	for typ := range keys {
+		if typ != OVS_KEY_ATTR_ETHERTYPE && typ != OVS_KEY_ATTR_ETHERNET {
+			t.Fatal("unexpected key", typ)
+		}
+	}
+
+	// Nor when the ethertype is not matched exactly
+	fk := NewEthertypeFlowKey(0x0800)
+	fk.mask()[1] = 0
+	keys, _ = flowKeyNlAttrs(t, FlowKeys{OVS_KEY_ATTR_ETHERTYPE: fk})
+	if _, ok := keys[OVS_KEY_ATTR_IPV4]; ok {
+		t.Fatal("unexpected IPv4 key")
+	}
+}
+
+func TestVlanFlowKey(t *testing.T) {
+	for _, tc := range []struct {
+		tci    []byte
+		vid    uint16
+		tagged bool
+	}{
+		{tci: []byte{0x10, 0x05}, vid: 5, tagged: true},
+		{tci: []byte{0xbf, 0xfe}, vid: 4094, tagged: true}, // with a priority
+		{tci: []byte{0x00, 0x00}, vid: 0, tagged: false},
+	} {
+		// Miss upcalls have no masks
+		fks, err := ParseFlowKeys(Attrs{OVS_KEY_ATTR_VLAN: tc.tci}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fk, ok := fks[OVS_KEY_ATTR_VLAN].(VlanFlowKey)
+		if !ok {
+			t.Fatal("VLAN key parsed as", fks[OVS_KEY_ATTR_VLAN])
+		}
+
+		if vid, tagged := fk.VlanID(); vid != tc.vid || tagged != tc.tagged {
+			t.Fatal("wrong VLAN", tc.tci, vid, tagged)
+		}
+	}
+
+	if vid, tagged := NewVlanFlowKey(100).VlanID(); vid != 100 || !tagged {
+		t.Fatal("wrong VLAN", vid, tagged)
+	}
+
+	// A flow on a VLAN matches the 802.1Q ethertype exactly, and
+	// has an empty encapsulation key
+	keys, masks := flowKeyNlAttrs(t, FlowKeys{OVS_KEY_ATTR_VLAN: NewVlanFlowKey(100)})
+	if k := keys[OVS_KEY_ATTR_ETHERTYPE]; len(k) != 2 || k[0] != 0x81 || k[1] != 0x00 {
+		t.Fatal("wrong ethertype key", k)
+	}
+
+	if m := masks[OVS_KEY_ATTR_ETHERTYPE]; len(m) != 2 || !AllBytes(m, 0xff) {
+		t.Fatal("ethertype not exact", m)
+	}
+
+	for _, attrs := range []Attrs{keys, masks} {
+		if e, ok := attrs[OVS_KEY_ATTR_ENCAP]; !ok || len(e) != 0 {
+			t.Fatal("wrong encapsulation key", e, ok)
+		}
+	}
+
+	// A dumped flow already has them
+	fks, err := ParseFlowKeys(keys, masks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(defaultVlanFlowKeys(fks)) != 0 {
+		t.Fatal("keys added again to", fks)
+	}
+}
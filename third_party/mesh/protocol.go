@@ -0,0 +1,476 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// Protocol identifies a sort of major version of the protocol.
+	Protocol = "weave"
+
+	// ProtocolMinVersion establishes the lowest protocol version among peers
+	// that we're willing to try to communicate with.
+	ProtocolMinVersion = 1
+
+	// ProtocolMaxVersion establishes the highest protocol version among peers
+	// that we're willing to try to communicate with.
+	ProtocolMaxVersion = 2
+)
+
+var (
+	protocolBytes = []byte(Protocol)
+
+	// How long we wait for the handshake phase of protocol negotiation.
+	headerTimeout = 10 * time.Second
+
+	// See filterV1Features.
+	protocolV1Features = []string{
+		"ConnID",
+		"Name",
+		"NickName",
+		"PeerNameFlavour",
+		"UID",
+	}
+
+	errExpectedCrypto   = fmt.Errorf("password specified, but peer requested an unencrypted connection")
+	errExpectedNoCrypto = fmt.Errorf("no password specificed, but peer requested an encrypted connection")
+	errNoPasswordMatch  = fmt.Errorf("unable to decrypt TCP msg with any of our passwords")
+	errAuthNoCrypto     = fmt.Errorf("peer authentication requires encryption")
+	errAuthV1           = fmt.Errorf("peer authentication requires protocol version 2")
+)
+
+type protocolIntroConn interface {
+	io.ReadWriter
+
+	// net.Conn's deadline methods
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// The params necessary to negotiate a protocol intro with a remote peer.
+type protocolIntroParams struct {
+	MinVersion byte
+	MaxVersion byte
+	Outbound   bool
+	Features   map[string]string
+	Conn       protocolIntroConn
+	Password   []byte
+	// Also accepted on incoming connections, with protocol version 2
+	SecondaryPasswords [][]byte
+	Authenticator      PeerAuthenticator
+}
+
+// The results from a successful protocol intro.
+type protocolIntroResults struct {
+	Features   map[string]string
+	Receiver   tcpReceiver
+	Sender     tcpSender
+	SessionKey *[32]byte
+	Version    byte
+	// The name the remote peer's credentials are for, when using a
+	// PeerAuthenticator
+	AuthenticatedName PeerName
+}
+
+// DoIntro executes the protocol introduction.
+func (params protocolIntroParams) doIntro() (res protocolIntroResults, err error) {
+	if err = params.Conn.SetDeadline(time.Now().Add(headerTimeout)); err != nil {
+		return
+	}
+
+	if res.Version, err = params.exchangeProtocolHeader(); err != nil {
+		return
+	}
+
+	if params.Authenticator != nil && params.Password == nil {
+		err = errAuthNoCrypto
+		return
+	}
+
+	var pubKey, privKey *[32]byte
+	if params.Password != nil {
+		if pubKey, privKey, err = generateKeyPair(); err != nil {
+			return
+		}
+	}
+
+	if err = params.Conn.SetWriteDeadline(time.Time{}); err != nil {
+		return
+	}
+	if err = params.Conn.SetReadDeadline(time.Now().Add(tcpHeartbeat * 2)); err != nil {
+		return
+	}
+
+	switch res.Version {
+	case 1:
+		if params.Authenticator != nil {
+			err = errAuthV1
+			return
+		}
+		err = res.doIntroV1(params, pubKey, privKey)
+	case 2:
+		err = res.doIntroV2(params, pubKey, privKey)
+	default:
+		panic("unhandled protocol version")
+	}
+
+	return
+}
+
+func (params protocolIntroParams) exchangeProtocolHeader() (byte, error) {
+	// Write in a separate goroutine to avoid the possibility of
+	// deadlock.  The result channel is of size 1 so that the
+	// goroutine does not linger even if we encounter an error on
+	// the read side.
+	sendHeader := append(protocolBytes, params.MinVersion, params.MaxVersion)
+	writeDone := make(chan error, 1)
+	go func() {
+		_, err := params.Conn.Write(sendHeader)
+		writeDone <- err
+	}()
+
+	header := make([]byte, len(protocolBytes)+2)
+	if n, err := io.ReadFull(params.Conn, header); err != nil && n == 0 {
+		return 0, fmt.Errorf("failed to receive remote protocol header: %s", err)
+	} else if err != nil {
+		return 0, fmt.Errorf("received incomplete remote protocol header (%d octets instead of %d): %v; error: %s",
+			n, len(header), header[:n], err)
+	}
+
+	if !bytes.Equal(protocolBytes, header[:len(protocolBytes)]) {
+		return 0, fmt.Errorf("remote protocol header not recognised: %v", header[:len(protocolBytes)])
+	}
+
+	theirMinVersion := header[len(protocolBytes)]
+	minVersion := theirMinVersion
+	if params.MinVersion > minVersion {
+		minVersion = params.MinVersion
+	}
+
+	theirMaxVersion := header[len(protocolBytes)+1]
+	maxVersion := theirMaxVersion
+	if maxVersion > params.MaxVersion {
+		maxVersion = params.MaxVersion
+	}
+
+	if minVersion > maxVersion {
+		return 0, fmt.Errorf("remote version range [%d,%d] is incompatible with ours [%d,%d]",
+			theirMinVersion, theirMaxVersion,
+			params.MinVersion, params.MaxVersion)
+	}
+
+	if err := <-writeDone; err != nil {
+		return 0, err
+	}
+
+	return maxVersion, nil
+}
+
+// The V1 procotol consists of the protocol identification/version
+// header, followed by a stream of gobified values.  The first value
+// is the encoded features map (never encrypted).  The subsequent
+// values are the messages on the connection (encrypted for an
+// encrypted connection).  For an encrypted connection, the public key
+// is passed in the "PublicKey" feature as a string of hex digits.
+func (res *protocolIntroResults) doIntroV1(params protocolIntroParams, pubKey, privKey *[32]byte) error {
+	features := filterV1Features(params.Features)
+	if pubKey != nil {
+		features["PublicKey"] = hex.EncodeToString(pubKey[:])
+	}
+
+	enc := gob.NewEncoder(params.Conn)
+	dec := gob.NewDecoder(params.Conn)
+
+	// Encode in a separate goroutine to avoid the possibility of
+	// deadlock.  The result channel is of size 1 so that the
+	// goroutine does not linger even if we encounter an error on
+	// the read side.
+	encodeDone := make(chan error, 1)
+	go func() {
+		encodeDone <- enc.Encode(features)
+	}()
+
+	if err := dec.Decode(&res.Features); err != nil {
+		return err
+	}
+
+	if err := <-encodeDone; err != nil {
+		return err
+	}
+
+	res.Sender = newGobTCPSender(enc)
+	res.Receiver = newGobTCPReceiver(dec)
+
+	if pubKey == nil {
+		if _, present := res.Features["PublicKey"]; present {
+			return errExpectedNoCrypto
+		}
+	} else {
+		remotePubKeyStr, ok := res.Features["PublicKey"]
+		if !ok {
+			return errExpectedCrypto
+		}
+
+		remotePubKey, err := hex.DecodeString(remotePubKeyStr)
+		if err != nil {
+			return err
+		}
+
+		res.setupCrypto(params, remotePubKey, privKey)
+	}
+
+	res.Features = filterV1Features(res.Features)
+	return nil
+}
+
+// In the V1 protocol, the intro fields are sent unencrypted.  So we
+// restrict them to an established subset of fields that are assumed
+// to be safe.
+func filterV1Features(intro map[string]string) map[string]string {
+	safe := make(map[string]string)
+	for _, k := range protocolV1Features {
+		if val, ok := intro[k]; ok {
+			safe[k] = val
+		}
+	}
+
+	return safe
+}
+
+// The V2 procotol consists of the protocol identification/version
+// header, followed by:
+//
+// - A single "encryption flag" byte: 0 for no encryption, 1 for
+// encryption.
+//
+// - When the connection is encrypted, 32 bytes follow containing the
+// public key.
+//
+// - Then a stream of length-prefixed messages, which are encrypted
+// for an encrypted connection.
+//
+// The first message contains the encoded features map (so in contrast
+// to V1, it will be encrypted on an encrypted connection).
+func (res *protocolIntroResults) doIntroV2(params protocolIntroParams, pubKey, privKey *[32]byte) error {
+	// Public key exchange
+	var wbuf, remotePubKey []byte
+	if pubKey == nil {
+		wbuf = []byte{0}
+	} else {
+		wbuf = make([]byte, 1+len(*pubKey))
+		wbuf[0] = 1
+		copy(wbuf[1:], (*pubKey)[:])
+	}
+
+	// Write in a separate goroutine to avoid the possibility of
+	// deadlock.  The result channel is of size 1 so that the
+	// goroutine does not linger even if we encounter an error on
+	// the read side.
+	writeDone := make(chan error, 1)
+	go func() {
+		_, err := params.Conn.Write(wbuf)
+		writeDone <- err
+	}()
+
+	rbuf := make([]byte, 1)
+	if _, err := io.ReadFull(params.Conn, rbuf); err != nil {
+		return err
+	}
+
+	trialPasswords := pubKey != nil && !params.Outbound && len(params.SecondaryPasswords) > 0
+	switch rbuf[0] {
+	case 0:
+		if pubKey != nil {
+			return errExpectedCrypto
+		}
+
+		res.Sender = newLengthPrefixTCPSender(params.Conn)
+		res.Receiver = newLengthPrefixTCPReceiver(params.Conn)
+
+	case 1:
+		if pubKey == nil {
+			return errExpectedNoCrypto
+		}
+
+		rbuf = make([]byte, len(pubKey))
+		if _, err := io.ReadFull(params.Conn, rbuf); err != nil {
+			return err
+		}
+
+		remotePubKey = rbuf
+		res.Sender = newLengthPrefixTCPSender(params.Conn)
+		res.Receiver = newLengthPrefixTCPReceiver(params.Conn)
+		if !trialPasswords {
+			res.setupCrypto(params, remotePubKey, privKey)
+		}
+
+	default:
+		return fmt.Errorf("Bad encryption flag %d", rbuf[0])
+	}
+
+	if err := <-writeDone; err != nil {
+		return err
+	}
+
+	// The remote peer of an incoming connection may be using any of
+	// our passwords, and the crypto can only be set up once we know
+	// which, so we must receive its features before sending ours.
+	if trialPasswords {
+		var err error
+		if rbuf, err = res.setupCryptoByTrial(params, remotePubKey, privKey); err != nil {
+			return err
+		}
+	}
+
+	features := params.Features
+	if params.Authenticator != nil {
+		var err error
+		if features, err = params.withCredentials(pubKey[:], remotePubKey); err != nil {
+			return err
+		}
+	}
+
+	// Features exchange
+	go func() {
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(&features); err != nil {
+			writeDone <- err
+			return
+		}
+
+		writeDone <- res.Sender.Send(buf.Bytes())
+	}()
+
+	if !trialPasswords {
+		var err error
+		if rbuf, err = res.Receiver.Receive(); err != nil {
+			return err
+		}
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(rbuf)).Decode(&res.Features); err != nil {
+		return err
+	}
+
+	if err := <-writeDone; err != nil {
+		return err
+	}
+
+	if params.Authenticator != nil {
+		var err error
+		if res.AuthenticatedName, err = params.authenticate(res.Features, pubKey[:], remotePubKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The credentials of each peer are bound to the connection by proving
+// possession of them for a transcript of the public keys exchanged on
+// it, so they cannot be replayed on another connection.
+func authTranscript(signerOutbound bool, outboundPubKey, inboundPubKey []byte) []byte {
+	transcript := []byte("inbound")
+	if signerOutbound {
+		transcript = []byte("outbound")
+	}
+	transcript = append(transcript, outboundPubKey...)
+	return append(transcript, inboundPubKey...)
+}
+
+func (params protocolIntroParams) transcriptKeys(pubKey, remotePubKey []byte) ([]byte, []byte) {
+	if params.Outbound {
+		return pubKey, remotePubKey
+	}
+	return remotePubKey, pubKey
+}
+
+// Add our credentials to the features sent to the remote peer.
+func (params protocolIntroParams) withCredentials(pubKey, remotePubKey []byte) (map[string]string, error) {
+	outboundPubKey, inboundPubKey := params.transcriptKeys(pubKey, remotePubKey)
+	credentials, err := params.Authenticator.Credentials(authTranscript(params.Outbound, outboundPubKey, inboundPubKey))
+	if err != nil {
+		return nil, err
+	}
+	features := make(map[string]string, len(params.Features)+1)
+	for k, v := range params.Features {
+		features[k] = v
+	}
+	features["PeerCredentials"] = credentials
+	return features, nil
+}
+
+// Check the credentials of the remote peer, returning the name they are for.
+func (params protocolIntroParams) authenticate(features map[string]string, pubKey, remotePubKey []byte) (PeerName, error) {
+	credentials, ok := features["PeerCredentials"]
+	if !ok {
+		return UnknownPeerName, fmt.Errorf("peer did not present credentials")
+	}
+	outboundPubKey, inboundPubKey := params.transcriptKeys(pubKey, remotePubKey)
+	return params.Authenticator.Authenticate(credentials, authTranscript(!params.Outbound, outboundPubKey, inboundPubKey))
+}
+
+func (res *protocolIntroResults) setupCrypto(params protocolIntroParams, remotePubKey []byte, privKey *[32]byte) {
+	var remotePubKeyArr [32]byte
+	copy(remotePubKeyArr[:], remotePubKey)
+	res.SessionKey = formSessionKey(&remotePubKeyArr, privKey, params.Password)
+	res.Sender = newEncryptedTCPSender(res.Sender, res.SessionKey, params.Outbound)
+	res.Receiver = newEncryptedTCPReceiver(res.Receiver, res.SessionKey, params.Outbound)
+}
+
+// Set up the crypto with whichever of our passwords decrypts the first
+// message from the remote peer, returning the decrypted message.
+func (res *protocolIntroResults) setupCryptoByTrial(params protocolIntroParams, remotePubKey []byte, privKey *[32]byte) ([]byte, error) {
+	msg, err := res.Receiver.Receive()
+	if err != nil {
+		return nil, err
+	}
+	for _, password := range append([][]byte{params.Password}, params.SecondaryPasswords...) {
+		params.Password = password
+		trial := *res
+		trial.setupCrypto(params, remotePubKey, privKey)
+		if decodedMsg, err := trial.Receiver.(*encryptedTCPReceiver).decode(msg); err == nil {
+			*res = trial
+			return decodedMsg, nil
+		}
+	}
+	return nil, errNoPasswordMatch
+}
+
+// ProtocolTag identifies the type of msg encoded in a ProtocolMsg.
+type protocolTag byte
+
+const (
+	// ProtocolHeartbeat identifies a heartbeat msg.
+	ProtocolHeartbeat = iota
+	// ProtocolReserved1 is a legacy overly control message.
+	ProtocolReserved1
+	// ProtocolReserved2 is a legacy overly control message.
+	ProtocolReserved2
+	// ProtocolReserved3 is a legacy overly control message.
+	ProtocolReserved3
+	// ProtocolGossip identifies a pure gossip msg.
+	ProtocolGossip
+	// ProtocolGossipUnicast identifies a gossip (unicast) msg.
+	ProtocolGossipUnicast
+	// ProtocolGossipBroadcast identifies a gossip (broadcast) msg.
+	ProtocolGossipBroadcast
+	// ProtocolOverlayControlMsg identifies a control msg.
+	ProtocolOverlayControlMsg
+)
+
+// ProtocolMsg combines a tag and encoded msg.
+type protocolMsg struct {
+	tag protocolTag
+	msg []byte
+}
+
+type protocolSender interface {
+	SendProtocolMsg(m protocolMsg) error
+}
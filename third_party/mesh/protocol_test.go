@@ -0,0 +1,288 @@
+package mesh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testConn struct {
+	io.Writer
+	io.Reader
+}
+
+func (testConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (testConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (testConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func connPair() (protocolIntroConn, protocolIntroConn) {
+	a := testConn{}
+	b := testConn{}
+	a.Reader, b.Writer = io.Pipe()
+	b.Reader, a.Writer = io.Pipe()
+	return &a, &b
+}
+
+func doIntro(t *testing.T, params protocolIntroParams) <-chan protocolIntroResults {
+	ch := make(chan protocolIntroResults, 1)
+	go func() {
+		res, err := params.doIntro()
+		require.Nil(t, err)
+		ch <- res
+	}()
+	return ch
+}
+
+func doProtocolIntro(t *testing.T, aver, bver byte, password []byte) byte {
+	aconn, bconn := connPair()
+	aresch := doIntro(t, protocolIntroParams{
+		MinVersion: ProtocolMinVersion,
+		MaxVersion: aver,
+		Features:   map[string]string{"Name": "A"},
+		Conn:       aconn,
+		Outbound:   true,
+		Password:   password,
+	})
+	bresch := doIntro(t, protocolIntroParams{
+		MinVersion: ProtocolMinVersion,
+		MaxVersion: bver,
+		Features:   map[string]string{"Name": "B"},
+		Conn:       bconn,
+		Outbound:   false,
+		Password:   password,
+	})
+	ares := <-aresch
+	bres := <-bresch
+
+	// Check that features were conveyed
+	require.Equal(t, "B", ares.Features["Name"])
+	require.Equal(t, "A", bres.Features["Name"])
+
+	// Check that Senders and Receivers work
+	go func() {
+		require.Nil(t, ares.Sender.Send([]byte("Hello from A")))
+		require.Nil(t, bres.Sender.Send([]byte("Hello from B")))
+	}()
+
+	data, err := bres.Receiver.Receive()
+	require.Nil(t, err)
+	require.Equal(t, "Hello from A", string(data))
+
+	data, err = ares.Receiver.Receive()
+	require.Nil(t, err)
+	require.Equal(t, "Hello from B", string(data))
+
+	require.Equal(t, ares.Version, bres.Version)
+	return ares.Version
+}
+
+func TestProtocolIntro(t *testing.T) {
+	require.Equal(t, 2, int(doProtocolIntro(t, 2, 2, nil)))
+	require.Equal(t, 2, int(doProtocolIntro(t, 2, 2, []byte("sekr1t"))))
+	require.Equal(t, 1, int(doProtocolIntro(t, 1, 2, nil)))
+	require.Equal(t, 1, int(doProtocolIntro(t, 1, 2, []byte("pa55"))))
+	require.Equal(t, 1, int(doProtocolIntro(t, 2, 1, nil)))
+	require.Equal(t, 1, int(doProtocolIntro(t, 2, 1, []byte("w0rd"))))
+}
+
+// An incoming connection tries each of its passwords on the first
+// encrypted message from the remote peer.
+func doPasswordTrialIntro(t *testing.T, outboundPassword []byte, inboundPasswords ...[]byte) (protocolIntroResults, error, protocolIntroResults, error) {
+	aconn, bconn := connPair()
+	type result struct {
+		res protocolIntroResults
+		err error
+	}
+	intro := func(params protocolIntroParams, conn protocolIntroConn) <-chan result {
+		ch := make(chan result, 1)
+		go func() {
+			res, err := params.doIntro()
+			if err != nil {
+				// Unblock the other end
+				conn.(*testConn).Writer.(*io.PipeWriter).CloseWithError(err)
+			}
+			ch <- result{res, err}
+		}()
+		return ch
+	}
+	aresch := intro(protocolIntroParams{
+		MinVersion: ProtocolMinVersion,
+		MaxVersion: ProtocolMaxVersion,
+		Features:   map[string]string{"Name": "A"},
+		Conn:       aconn,
+		Outbound:   true,
+		Password:   outboundPassword,
+	}, aconn)
+	bresch := intro(protocolIntroParams{
+		MinVersion:         ProtocolMinVersion,
+		MaxVersion:         ProtocolMaxVersion,
+		Features:           map[string]string{"Name": "B"},
+		Conn:               bconn,
+		Outbound:           false,
+		Password:           inboundPasswords[0],
+		SecondaryPasswords: inboundPasswords[1:],
+	}, bconn)
+	a, b := <-aresch, <-bresch
+	return a.res, a.err, b.res, b.err
+}
+
+func TestProtocolIntroSecondaryPasswords(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		outbound string
+		inbound  []string
+		ok       bool
+	}{
+		{"primary", "primary", []string{"primary", "next"}, true},
+		{"secondary", "next", []string{"primary", "next"}, true},
+		{"second secondary", "other", []string{"primary", "next", "other"}, true},
+		{"no match", "wrong", []string{"primary", "next"}, false},
+	} {
+		var inbound [][]byte
+		for _, password := range test.inbound {
+			inbound = append(inbound, []byte(password))
+		}
+		ares, aerr, bres, berr := doPasswordTrialIntro(t, []byte(test.outbound), inbound...)
+		if !test.ok {
+			require.Equal(t, errNoPasswordMatch, berr, test.name)
+			require.Error(t, aerr, test.name)
+			continue
+		}
+		require.NoError(t, aerr, test.name)
+		require.NoError(t, berr, test.name)
+		require.Equal(t, "B", ares.Features["Name"], test.name)
+		require.Equal(t, "A", bres.Features["Name"], test.name)
+		require.Equal(t, *ares.SessionKey, *bres.SessionKey, test.name)
+
+		go func() {
+			require.NoError(t, ares.Sender.Send([]byte("Hello from A")))
+			require.NoError(t, bres.Sender.Send([]byte("Hello from B")))
+		}()
+		data, err := bres.Receiver.Receive()
+		require.NoError(t, err, test.name)
+		require.Equal(t, "Hello from A", string(data), test.name)
+		data, err = ares.Receiver.Receive()
+		require.NoError(t, err, test.name)
+		require.Equal(t, "Hello from B", string(data), test.name)
+	}
+}
+
+// testAuthenticator proves possession of a peer name with a hash of it
+// and the transcript, and accepts any name proven so.
+type testAuthenticator struct {
+	name     PeerName
+	replayed string // if set, sent instead of fresh credentials
+}
+
+func testCredentials(name PeerName, transcript []byte) string {
+	h := sha256.Sum256(append([]byte(name.String()), transcript...))
+	return name.String() + " " + hex.EncodeToString(h[:])
+}
+
+func (auth testAuthenticator) Credentials(transcript []byte) (string, error) {
+	if auth.replayed != "" {
+		return auth.replayed, nil
+	}
+	return testCredentials(auth.name, transcript), nil
+}
+
+func (testAuthenticator) Authenticate(credentials string, transcript []byte) (PeerName, error) {
+	fields := strings.Fields(credentials)
+	if len(fields) != 2 {
+		return UnknownPeerName, fmt.Errorf("malformed credentials")
+	}
+	name, err := PeerNameFromString(fields[0])
+	if err != nil {
+		return UnknownPeerName, err
+	}
+	if testCredentials(name, transcript) != credentials {
+		return UnknownPeerName, fmt.Errorf("bad proof")
+	}
+	return name, nil
+}
+
+func doAuthenticatedIntro(aauth, bauth PeerAuthenticator, password []byte) (protocolIntroResults, error, protocolIntroResults, error) {
+	aconn, bconn := connPair()
+	type result struct {
+		res protocolIntroResults
+		err error
+	}
+	intro := func(params protocolIntroParams) <-chan result {
+		ch := make(chan result, 1)
+		go func() {
+			res, err := params.doIntro()
+			if err != nil {
+				params.Conn.(*testConn).Writer.(*io.PipeWriter).CloseWithError(err)
+			}
+			ch <- result{res, err}
+		}()
+		return ch
+	}
+	aresch := intro(protocolIntroParams{
+		MinVersion: ProtocolMinVersion, MaxVersion: ProtocolMaxVersion,
+		Features: map[string]string{}, Conn: aconn, Outbound: true,
+		Password: password, Authenticator: aauth,
+	})
+	bresch := intro(protocolIntroParams{
+		MinVersion: ProtocolMinVersion, MaxVersion: ProtocolMaxVersion,
+		Features: map[string]string{}, Conn: bconn, Outbound: false,
+		Password: password, Authenticator: bauth,
+	})
+	a, b := <-aresch, <-bresch
+	return a.res, a.err, b.res, b.err
+}
+
+func TestProtocolIntroAuthenticated(t *testing.T) {
+	nameA, _ := PeerNameFromString("00:00:00:00:00:0a")
+	nameB, _ := PeerNameFromString("00:00:00:00:00:0b")
+	password := []byte("sekr1t")
+
+	ares, aerr, bres, berr := doAuthenticatedIntro(testAuthenticator{name: nameA}, testAuthenticator{name: nameB}, password)
+	require.NoError(t, aerr)
+	require.NoError(t, berr)
+	require.Equal(t, nameB, ares.AuthenticatedName)
+	require.Equal(t, nameA, bres.AuthenticatedName)
+
+	// Credentials for the transcript of another connection are refused
+	replayed := testCredentials(nameA, authTranscript(true, []byte("old outbound key"), []byte("old inbound key")))
+	_, _, _, berr = doAuthenticatedIntro(testAuthenticator{replayed: replayed}, testAuthenticator{name: nameB}, password)
+	require.Error(t, berr)
+
+	// Credentials proving the outbound side can't be reflected back
+	// by the inbound side
+	_, aerr, _, _ = doAuthenticatedIntro(testAuthenticator{name: nameA}, reflectingAuthenticator{}, password)
+	require.Error(t, aerr)
+
+	// Authentication requires encryption
+	_, aerr, _, berr = doAuthenticatedIntro(testAuthenticator{name: nameA}, testAuthenticator{name: nameB}, nil)
+	require.Equal(t, errAuthNoCrypto, aerr)
+	require.Equal(t, errAuthNoCrypto, berr)
+}
+
+// reflectingAuthenticator presents the outbound peer's own proof,
+// computed over the inbound-signed transcript
+type reflectingAuthenticator struct{}
+
+func (reflectingAuthenticator) Credentials(transcript []byte) (string, error) {
+	nameA, _ := PeerNameFromString("00:00:00:00:00:0a")
+	// Turn the "inbound" transcript into the "outbound" one
+	return testCredentials(nameA, append([]byte("outbound"), transcript[len("inbound"):]...)), nil
+}
+
+func (reflectingAuthenticator) Authenticate(credentials string, transcript []byte) (PeerName, error) {
+	return testAuthenticator{}.Authenticate(credentials, transcript)
+}